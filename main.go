@@ -15,12 +15,17 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"log"
 	"net/http"
+	"net/url"
 	"path/filepath"
+	"regexp"
 	"runtime"
+	"strings"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -35,8 +40,63 @@ const (
 
 var port = flag.Int("port", 8009, "TCP port to listen on")
 var upstreamURL = flag.String("upstream", "http://localhost:8008/", "URL of upstream server")
+var syncUpstreamURL = flag.String("sync-upstream", "", "URL of the server to send /sync requests to, such as a read replica, if not -upstream")
+var requestTimeout = flag.Duration("request-timeout", 30*time.Second, "Timeout for upstream requests other than /sync (0 to disable)")
+var requestClassTimeouts = flag.String("request-class-timeouts", "", "Comma-separated list of class=timeout pairs overriding -request-timeout for a class of request: sync, read or write")
+var syncRetries = flag.Int("sync-retries", 0, "Number of times to retry a /sync which fails with a 5xx response before closing the connection")
+var closeGracePeriod = flag.Duration("close-grace-period", 5*time.Second, "Time allowed for clients to respond to a close message before the socket is closed")
+var jsonRPC = flag.Bool("jsonrpc", false, "Use JSON-RPC 2.0 for requests and responses on the websocket")
+var receiptFlushInterval = flag.Duration("receipt-flush-interval", 0, "Interval at which receipts queued with 'queue_receipt' are sent (0 to only send them on request or disconnect)")
+var apiPrefix = flag.String("api-prefix", "", "Version prefix for client-server API requests (r0 or v3); detected from the upstream server if unset")
+var cursorStoreType = flag.String("cursor-store", "none", "Where to save each client's latest sync token, for resumption: none, memory or file")
+var cursorStoreFile = flag.String("cursor-store-file", "cursors.json", "Path of the file used by -cursor-store=file")
+var csAPIPrefixes = flag.String("cs-api-prefixes", "", "Comma-separated list of endpoint prefixes, relative to _matrix/client/, which clients may call with the 'cs_api' method (empty to disable it)")
+var markEmptySyncs = flag.Bool("mark-empty-syncs", false, "Add '_empty: true' to sync responses which contain no events")
+var reconnectHints = flag.String("reconnect-hints", "", "Comma-separated list of close-code=hint pairs overriding the reconnection hint (now, backoff or never) sent to clients before the connection is closed")
+var maxClientRequestTimeout = flag.Duration("max-client-request-timeout", time.Minute, "Longest timeout clients may set for a request with 'timeout_ms' (0 for no limit)")
+var maxContentBytes = flag.Int("max-content-bytes", 0, "Maximum size in bytes of the JSON content of events clients may send, checked before contacting the upstream server (0 for no limit)")
+var roomAllowlist = flag.String("room-allowlist", "", "Path to a JSON file mapping user IDs to the only room IDs their connections may send to; users not listed are not restricted")
+var strictRoomIDs = flag.Bool("strict-room-ids", false, "Reject room IDs which are not of the form !localpart:server, rather than passing them to the upstream server")
+var adminToken = flag.String("admin-token", "", "Shared token which admins must give as a bearer token to use the /admin/drain endpoint, which closes a user's connections (empty to disable it)")
+var allowGuest = flag.Bool("allow-guest", false, "Allow clients to connect without an access token, and register as a guest user with the 'register_guest' method")
+var maintenancePattern = flag.String("maintenance-pattern", proxy.DefaultMaintenancePattern, "Regular expression matching upstream error messages which mean the homeserver is down for maintenance, for which connections are closed with 1012 (service restart) and told to back off before reconnecting; empty to disable")
+var tenants = flag.String("tenants", "", "Comma-separated list of the tenant names clients may give with the 'tenant' parameter, to label their connections in metrics; others are counted as 'other'")
+var shareSyncs = flag.Bool("share-syncs", false, "Share a single upstream sync between connections with the same access token and sync parameters, after each has made its own initial sync; such connections cannot change their filter or presence, and do not use -cursor-store")
+var coalesceReads = flag.Bool("coalesce-reads", false, "Make identical concurrent read requests on a connection only once")
+var dialTimeout = flag.Duration("dial-timeout", 10*time.Second, "Timeout for establishing connections to the upstream server (0 for no limit)")
+var upstreamClientCert = flag.String("upstream-client-cert", "", "Path to a PEM client certificate to present to the upstream server")
+var upstreamClientKey = flag.String("upstream-client-key", "", "Path to the PEM private key for -upstream-client-cert")
+var appHeartbeatInterval = flag.Duration("app-heartbeat-interval", 0, "Interval at which to send heartbeat messages, for clients which can't see websocket pings (0 to disable)")
+var minSyncInterval = flag.Duration("min-sync-interval", 0, "Minimum time between sync responses sent to each client (0 for no limit)")
+var compress = flag.Bool("compress", false, "Compress messages to clients which support it")
+var sendParameters = flag.Bool("send-parameters", false, "Send clients a message describing the connection's sync timeout, ping period and other settings before the initial sync")
+var gzipInitialSync = flag.Bool("gzip-initial-sync", false, "Send the initial sync response gzipped, in a binary message, to clients which ask for it with the 'm.json.gzip-initial' subprotocol")
+var compressThreshold = flag.Int("compress-threshold", 256, "Size in bytes above which messages are compressed, if -compress is set")
+var maxUpstreamConcurrency = flag.Int("max-upstream-concurrency", 0, "Maximum number of concurrent requests to the upstream server, other than syncs (0 for no limit)")
+var syncErrorMode = flag.String("sync-error-mode", proxy.SyncErrorClose, "What to do when a sync fails: 'close' the connection, or 'notify' the client and keep retrying")
+var sequenceNumbers = flag.Bool("sequence-numbers", false, "Add an increasing 'seq' number to each message sent to clients, so that they can detect lost messages. Not used with -jsonrpc")
+var syncBreakerFailures = flag.Int("sync-breaker-failures", 0, "Close the connection after this many consecutive sync failures (0 to disable)")
+var syncBreakerWindow = flag.Duration("sync-breaker-window", time.Minute, "Only count sync failures within this window towards -sync-breaker-failures (0 for no window)")
+var logServerTiming = flag.Bool("log-server-timing", false, "Log the durations reported in Server-Timing headers from the upstream server")
+var initialSyncCacheTTL = flag.Duration("initial-sync-cache-ttl", 0, "How long to keep initial sync responses for resuming clients after they disconnect (0 to disable)")
+var mockSync = flag.String("mock-sync", "", "Path to a JSON file containing an array of sync responses to send to clients, instead of syncing with the upstream server")
+var mockSyncInterval = flag.Duration("mock-sync-interval", 5*time.Second, "Interval between sync responses in -mock-sync mode")
+var defaultInitialFilter = flag.String("default-initial-filter", "", "Filter ID or JSON filter to use for the initial sync of connections without a 'since', in place of the client's filter")
+var basePath = flag.String("base-path", "", "Path prefix under which all endpoints are served, for use behind a reverse proxy which does not strip it")
+var logLevel = flag.String("log-level", "debug", "Minimum level of message to log: debug, info, warn or error")
 var testHTML *string
 
+var initialSyncCache *proxy.InitialSyncCache
+var syncHub *proxy.SyncHub
+var cursorStore proxy.CursorStore
+var mockSyncFrames []json.RawMessage
+var allowedRooms proxy.RoomAllowlist
+var connReconnectHints map[int]string
+var connMaintenancePattern *regexp.Regexp
+var classTimeouts map[proxy.RequestClass]time.Duration
+var upstreamTransport http.RoundTripper
+var upstreamVersions *proxy.Versions
+
 func init() {
 	_, srcfile, _, _ := runtime.Caller(0)
 	def := filepath.Join(filepath.Dir(srcfile), "test")
@@ -46,61 +106,449 @@ func init() {
 func main() {
 	flag.Parse()
 
+	if level, err := proxy.ParseLogLevel(*logLevel); err != nil {
+		log.Fatal("Invalid -log-level: ", err)
+	} else {
+		proxy.SetLogLevel(level)
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if *upstreamClientCert != "" {
+		var err error
+		transport, err = proxy.NewClientCertTransport(*upstreamClientCert, *upstreamClientKey)
+		if err != nil {
+			log.Fatal("Error loading upstream client certificate: ", err)
+		}
+	}
+	proxy.SetDialTimeout(transport, *dialTimeout)
+	upstreamTransport = transport
+
+	if versions, err := newUpstreamClient("").GetVersions(context.Background()); err != nil {
+		proxy.Logf(proxy.LogWarn, "Unable to fetch supported versions from upstream: %v", err)
+	} else {
+		proxy.Logf(proxy.LogInfo, "Upstream supports versions %v", versions.Versions)
+		upstreamVersions = versions
+	}
+
+	if *apiPrefix == "" {
+		if upstreamVersions != nil {
+			*apiPrefix = upstreamVersions.APIPrefix()
+		} else {
+			*apiPrefix = "r0"
+		}
+		proxy.Logf(proxy.LogInfo, "Using API prefix %s", *apiPrefix)
+	}
+
+	proxy.SetMaxUpstreamConcurrency(*maxUpstreamConcurrency)
+	proxy.SetStrictRoomIDs(*strictRoomIDs)
+	proxy.SetAdminToken(*adminToken)
+
+	if *syncErrorMode != proxy.SyncErrorClose && *syncErrorMode != proxy.SyncErrorNotify {
+		log.Fatal("Invalid -sync-error-mode: ", *syncErrorMode)
+	}
+
+	if *sequenceNumbers && *jsonRPC {
+		log.Fatal("-sequence-numbers can't be used with -jsonrpc")
+	}
+
+	if strings.HasPrefix(*defaultInitialFilter, "{") && !json.Valid([]byte(*defaultInitialFilter)) {
+		log.Fatal("Invalid -default-initial-filter: not valid JSON")
+	}
+
+	if *maintenancePattern != "" {
+		var err error
+		connMaintenancePattern, err = regexp.Compile(*maintenancePattern)
+		if err != nil {
+			log.Fatal("Invalid -maintenance-pattern: ", err)
+		}
+	}
+
+	if *tenants != "" {
+		if err := proxy.SetTenants(strings.Split(*tenants, ",")); err != nil {
+			log.Fatal("Invalid -tenants: ", err)
+		}
+	}
+
+	if *shareSyncs {
+		syncHub = proxy.NewSyncHub()
+	}
+
+	if *initialSyncCacheTTL > 0 {
+		initialSyncCache = proxy.NewInitialSyncCache(*initialSyncCacheTTL)
+	}
+
+	switch *cursorStoreType {
+	case "none":
+	case "memory":
+		cursorStore = proxy.NewMemoryCursorStore()
+	case "file":
+		var err error
+		cursorStore, err = proxy.NewFileCursorStore(*cursorStoreFile)
+		if err != nil {
+			log.Fatal("Error loading cursor store: ", err)
+		}
+	default:
+		log.Fatal("Invalid -cursor-store: ", *cursorStoreType)
+	}
+
+	if *requestClassTimeouts != "" {
+		var err error
+		classTimeouts, err = proxy.ParseClassTimeouts(*requestClassTimeouts)
+		if err != nil {
+			log.Fatal("Invalid -request-class-timeouts: ", err)
+		}
+	}
+
+	if *reconnectHints != "" {
+		var err error
+		connReconnectHints, err = proxy.ParseReconnectHints(*reconnectHints)
+		if err != nil {
+			log.Fatal("Invalid -reconnect-hints: ", err)
+		}
+	}
+
+	if *mockSync != "" {
+		var err error
+		mockSyncFrames, err = proxy.LoadMockSyncFrames(*mockSync)
+		if err != nil {
+			log.Fatal("Error loading mock sync data: ", err)
+		}
+	}
+
+	if *roomAllowlist != "" {
+		var err error
+		allowedRooms, err = proxy.LoadRoomAllowlist(*roomAllowlist)
+		if err != nil {
+			log.Fatal("Error loading room allowlist: ", err)
+		}
+	}
+
 	fmt.Println("Starting websock server on port", *port)
-	http.Handle("/test/", http.StripPrefix("/test/", http.FileServer(http.Dir(*testHTML))))
-	http.HandleFunc("/stream", serveStream)
-	err := http.ListenAndServe(fmt.Sprintf(":%d", *port), nil)
+	err := http.ListenAndServe(fmt.Sprintf(":%d", *port), newServeMux(*basePath))
 	log.Fatal("ListenAndServe: ", err)
 }
 
+// newServeMux creates the handler for all of our endpoints, which are served
+// under the given base path.
+func newServeMux(base string) *http.ServeMux {
+	base = "/" + strings.Trim(base, "/")
+	if base == "/" {
+		base = ""
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(base+"/test/", http.StripPrefix(base+"/test/", http.FileServer(http.Dir(*testHTML))))
+	mux.HandleFunc(base+"/stream", serveStream)
+	mux.HandleFunc(base+"/methods", proxy.ServeMethods)
+	mux.HandleFunc(base+"/metrics", proxy.ServeMetrics)
+	mux.HandleFunc(base+"/status", proxy.ServeStatus)
+	mux.HandleFunc(base+"/admin/drain", proxy.ServeDrain)
+	return mux
+}
+
 // handle a request to /stream
 //
 func serveStream(w http.ResponseWriter, r *http.Request) {
-	log.Println("Got websocket request to", r.URL)
+	proxy.Logf(proxy.LogInfo, "Got websocket request to %s", redactAccessToken(r.URL))
 
 	if r.Method != "GET" {
-		log.Println("Invalid method", r.Method)
+		proxy.Logf(proxy.LogWarn, "Invalid method %s", r.Method)
 		httpError(w, http.StatusMethodNotAllowed)
 		return
 	}
 
-	r.URL.Query().Set("timeout", "0")
-	syncer := &proxy.Syncer{
-		UpstreamURL: *upstreamURL + "_matrix/client/v2_alpha/sync",
-		SyncParams:  r.URL.Query(),
+	// the access token is sent in the Authorization header rather than as
+	// a sync parameter
+	syncParams := r.URL.Query()
+	// with -allow-guest, a client without an access token can connect, and
+	// then register as a guest with 'register_guest'
+	guest := syncParams.Get("access_token") == "" && mockSyncFrames == nil
+	if guest && !*allowGuest {
+		matrixError(w, http.StatusUnauthorized, "M_MISSING_TOKEN", "Missing access token")
+		return
 	}
+	client := newUpstreamClient(syncParams.Get("access_token"))
+	client.APIPrefix = *apiPrefix
+	client.RequestTimeout = *requestTimeout
+	client.ClassTimeouts = classTimeouts
+	client.LogServerTiming = *logServerTiming
+	client.SetForwardedHeaders(r.Header)
+	client.SetTraceParent(r.Header.Get("traceparent"))
+	proxy.Logf(proxy.LogDebug, "Trace ID for websocket request: %s", client.TraceID())
+	syncParams.Del("access_token")
 
-	msg, err := syncer.MakeRequest()
-	if err != nil {
-		switch err.(type) {
-		case *proxy.SyncError:
-			errp := err.(*proxy.SyncError)
-			log.Println("sync failed:", string(errp.Body))
-			w.Header().Set("Content-Type", errp.ContentType)
-			w.WriteHeader(errp.StatusCode)
-			w.Write(errp.Body)
-		default:
-			log.Println("Error in sync", err)
-			httpError(w, http.StatusInternalServerError)
+	// 'set_presence' is validated here, and then applied by the client
+	if presence := syncParams.Get("set_presence"); presence != "" {
+		if !proxy.IsValidPresence(presence) {
+			matrixError(w, http.StatusBadRequest, "M_INVALID_PARAM",
+				"Invalid value for set_presence")
+			return
 		}
+		client.SetPresence = presence
+		syncParams.Del("set_presence")
+	}
+
+	// 'tenant' only labels the connection in our metrics
+	tenant := proxy.TenantLabel(syncParams.Get("tenant"))
+	syncParams.Del("tenant")
+
+	// 'resume' is handled by the initial sync cache rather than upstream
+	resume := syncParams.Get("resume")
+	syncParams.Del("resume")
+
+	// 'resume_cursor=true' asks to continue from the token in the cursor
+	// store when there is no 'since'
+	resumeCursor := syncParams.Get("resume_cursor") == "true"
+	syncParams.Del("resume_cursor")
+
+	var syncer proxy.SyncRequestor
+	var msg []byte
+	var err error
+	if guest {
+		// there is nothing to sync until the client has registered
+		syncParams.Set("timeout", fmt.Sprintf("%d", syncTimeout/time.Millisecond))
+		syncer = &proxy.Syncer{
+			Client:        client,
+			SyncParams:    syncParams,
+			InitialFilter: *defaultInitialFilter,
+		}
+	} else if sharedSyncKey(client, syncParams, resume) != "" && !resumeCursor {
+		syncer, msg, err = sharedInitialSync(client, syncParams)
+	} else {
+		syncer, msg, err = initialSync(client, syncParams, resume, resumeCursor)
+	}
+	if err != nil {
+		writeRequestError(w, "Error in sync", err)
 		return
 	}
-	syncer.SyncParams.Set("timeout", fmt.Sprintf("%d", syncTimeout/time.Millisecond))
+
+	// the user ID is only needed for the room allowlist, and so that admins
+	// can close the user's connections. A guest's is set when it registers.
+	var userID string
+	if !guest && (allowedRooms != nil || *adminToken != "") {
+		userID, _, err = client.WhoAmI(r.Context())
+		if err != nil {
+			writeRequestError(w, "Error in whoami", err)
+			return
+		}
+	}
 
 	upgrader := websocket.Upgrader{
-		Subprotocols: []string{"m.json"},
+		Subprotocols:      []string{"m.json"},
+		EnableCompression: *compress,
+	}
+	if *gzipInitialSync {
+		// preferred to m.json by clients which ask for both
+		upgrader.Subprotocols = []string{proxy.GzipInitialSyncProtocol, "m.json"}
 	}
-	ws, err := upgrader.Upgrade(w, r, nil)
+	connID := proxy.NextConnectionID()
+	ws, err := upgrader.Upgrade(w, r, proxy.UpgradeResponseHeaders(connID))
 	if err != nil {
-		log.Println(err)
+		proxy.Logf(proxy.LogWarn, "Error upgrading websocket request: %v", err)
+		if initialSyncCache != nil && !guest {
+			initialSyncCache.Touch(client)
+		}
+		if shared, ok := syncer.(*proxy.SharedSyncer); ok {
+			shared.Close()
+		}
 		return
 	}
 
-	c := proxy.New(syncer, ws)
-	c.SendMessage(msg)
+	c := proxy.NewWithID(connID, syncer, client, ws)
+	c.MaxSyncRetries = *syncRetries
+	c.CloseGracePeriod = *closeGracePeriod
+	c.JSONRPC = *jsonRPC
+	c.ReceiptFlushInterval = *receiptFlushInterval
+	c.MarkEmptySyncs = *markEmptySyncs
+	c.SequenceNumbers = *sequenceNumbers
+	c.ReconnectHints = connReconnectHints
+	c.MaintenancePattern = connMaintenancePattern
+	c.CoalesceReads = *coalesceReads
+	c.MaxRequestTimeout = *maxClientRequestTimeout
+	c.AppHeartbeatInterval = *appHeartbeatInterval
+	c.MinSyncInterval = *minSyncInterval
+	c.CompressThreshold = *compressThreshold
+	c.SyncErrorMode = *syncErrorMode
+	c.SyncBreakerFailures = *syncBreakerFailures
+	c.SyncBreakerWindow = *syncBreakerWindow
+	c.AllowGuest = *allowGuest
+	c.MaxContentBytes = *maxContentBytes
+	c.RoomAllowlist = allowedRooms
+	c.UserID = userID
+	c.Tenant = tenant
+	if *csAPIPrefixes != "" {
+		c.CSAPIPrefixes = strings.Split(*csAPIPrefixes, ",")
+	}
+	c.Compressed = *compress && requestsCompression(r)
+	switch s := syncer.(type) {
+	case *proxy.Syncer:
+		msg = proxy.MarkResumed(msg, s.Resumed())
+	case *proxy.SharedSyncer:
+		msg = proxy.MarkResumed(msg, false)
+	}
+	if *sendParameters {
+		c.SendParameters()
+	}
+	switch {
+	case guest:
+		// the first sync is sent once the client has registered
+	case ws.Subprotocol() == proxy.GzipInitialSyncProtocol:
+		c.SendGzippedSyncResponse(msg)
+	default:
+		c.SendSyncResponse(msg)
+	}
 	c.Start()
+
+	if initialSyncCache != nil && !guest {
+		go func() {
+			<-c.Done()
+			initialSyncCache.Touch(client)
+		}()
+	}
+	if shared, ok := syncer.(*proxy.SharedSyncer); ok {
+		go func() {
+			<-c.Done()
+			shared.Close()
+		}()
+	}
+}
+
+// requestsCompression returns true if the websocket upgrade request offers
+// per-message compression, which the upgrader accepts if -compress is set.
+func requestsCompression(r *http.Request) bool {
+	for _, ext := range r.Header["Sec-Websocket-Extensions"] {
+		if strings.Contains(ext, "permessage-deflate") {
+			return true
+		}
+	}
+	return false
+}
+
+// writeRequestError writes the response for an error from an upstream
+// request made while setting up a connection.
+func writeRequestError(w http.ResponseWriter, context string, err error) {
+	switch err.(type) {
+	case *proxy.MatrixError:
+		writeUpstreamError(w, &err.(*proxy.MatrixError).HTTPError)
+	case *proxy.HTTPError:
+		writeUpstreamError(w, err.(*proxy.HTTPError))
+	default:
+		proxy.Logf(proxy.LogError, "%s: %v", context, err)
+		if proxy.IsDialTimeout(err) {
+			matrixError(w, http.StatusGatewayTimeout, "M_UNKNOWN",
+				"Timed out connecting to the homeserver")
+			return
+		}
+		httpError(w, http.StatusInternalServerError)
+	}
+}
+
+// newUpstreamClient creates a MatrixClient for the upstream server with the
+// given access token.
+func newUpstreamClient(accessToken string) *proxy.MatrixClient {
+	client := proxy.NewMatrixClient(*upstreamURL, accessToken)
+	client.SyncURL = *syncUpstreamURL
+	if upstreamTransport != nil {
+		client.SetTransport(upstreamTransport)
+	}
+	client.Versions = upstreamVersions
+	return client
+}
+
+// sharedSyncKey returns the key with which the connection's syncs can be
+// shared through syncHub, or "" if they can't be.
+func sharedSyncKey(client *proxy.MatrixClient, syncParams url.Values, resume string) string {
+	if syncHub == nil || mockSyncFrames != nil || resume != "" {
+		return ""
+	}
+	return proxy.SharedSyncKey(client, syncParams)
+}
+
+// sharedInitialSync is like initialSync, but for connections which share
+// their syncs after the initial one through syncHub.
+func sharedInitialSync(client *proxy.MatrixClient, syncParams url.Values) (proxy.SyncRequestor, []byte, error) {
+	syncParams.Set("timeout", "0")
+	syncer := &proxy.Syncer{
+		Client:        client,
+		SyncParams:    syncParams,
+		InitialFilter: *defaultInitialFilter,
+	}
+	msg, err := syncer.MakeRequest(context.Background())
+	if err != nil {
+		return nil, nil, err
+	}
+	syncer.SyncParams.Set("timeout", fmt.Sprintf("%d", syncTimeout/time.Millisecond))
+	return syncHub.NewSharedSyncer(syncer), msg, nil
+}
+
+// initialSync creates the syncer for a new connection, and makes the initial
+// sync request, returning the syncer and the body of the initial response.
+// If resumeCursor is set, a sync without a 'since' continues from the token
+// in the cursor store.
+func initialSync(client *proxy.MatrixClient, syncParams url.Values, resume string, resumeCursor bool) (proxy.SyncRequestor, []byte, error) {
+	if mockSyncFrames != nil {
+		syncer := proxy.NewMockSyncer(mockSyncFrames, *mockSyncInterval)
+		msg, err := syncer.MakeRequest(context.Background())
+		return syncer, msg, err
+	}
+
+	syncParams.Set("timeout", "0")
+	syncer := &proxy.Syncer{
+		Client:        client,
+		SyncParams:    syncParams,
+		InitialFilter: *defaultInitialFilter,
+	}
+
+	if cursorStore != nil {
+		if err := syncer.UseCursorStore(cursorStore, resumeCursor); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	var msg []byte
+	var err error
+	if initialSyncCache != nil {
+		msg, err = initialSyncCache.InitialSync(syncer, resume)
+	} else {
+		msg, err = syncer.MakeRequest(context.Background())
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	syncer.SyncParams.Set("timeout", fmt.Sprintf("%d", syncTimeout/time.Millisecond))
+	return syncer, msg, nil
+}
+
+// redactAccessToken returns the given request URL for logging, without any
+// access token in the query string.
+func redactAccessToken(u *url.URL) string {
+	query := u.Query()
+	if _, ok := query["access_token"]; !ok {
+		return u.String()
+	}
+	query.Del("access_token")
+	redacted := *u
+	redacted.RawQuery = query.Encode()
+	return redacted.String()
+}
+
+// writeUpstreamError relays an error response from the upstream server to
+// the client.
+func writeUpstreamError(w http.ResponseWriter, errp *proxy.HTTPError) {
+	proxy.Logf(proxy.LogWarn, "sync failed: %s", errp.Body)
+	w.Header().Set("Content-Type", errp.ContentType)
+	w.WriteHeader(errp.StatusCode)
+	w.Write(errp.Body)
 }
 
 func httpError(w http.ResponseWriter, status int) {
 	http.Error(w, http.StatusText(status), status)
 }
+
+// matrixError writes an error response in the Matrix format.
+func matrixError(w http.ResponseWriter, status int, errcode string, message string) {
+	body, _ := json.Marshal(proxy.MatrixErrorDetails{ErrCode: errcode, Error: message})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(body)
+}
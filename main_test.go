@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestServeMuxBasePath(t *testing.T) {
+	tests := []struct {
+		base     string
+		method   string
+		path     string
+		expected int
+	}{
+		{"", "GET", "/methods", http.StatusOK},
+		{"/ws/", "GET", "/ws/methods", http.StatusOK},
+		{"/ws/", "GET", "/ws/metrics", http.StatusOK},
+		{"/ws/", "GET", "/ws/status", http.StatusOK},
+		{"/ws/", "GET", "/ws/test/", http.StatusOK},
+		{"/ws/", "POST", "/ws/stream", http.StatusMethodNotAllowed},
+		{"ws", "GET", "/ws/methods", http.StatusOK},
+		{"/ws/", "GET", "/methods", http.StatusNotFound},
+		{"/ws/", "POST", "/stream", http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		newServeMux(tt.base).ServeHTTP(w, httptest.NewRequest(tt.method, tt.path, nil))
+		if w.Code != tt.expected {
+			t.Errorf("Base %q, %v %v: expected %d, got %d", tt.base, tt.method, tt.path, tt.expected, w.Code)
+		}
+	}
+}
+
+func TestInitialSyncResumed(t *testing.T) {
+	done := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("timeout") != "0" {
+			// a long poll after the initial sync
+			<-done
+			return
+		}
+		w.Write([]byte(`{"next_batch": "s2"}`))
+	}))
+	defer upstream.Close()
+	defer close(done)
+
+	oldUpstream := *upstreamURL
+	*upstreamURL = upstream.URL + "/"
+	defer func() { *upstreamURL = oldUpstream }()
+
+	srv := httptest.NewServer(newServeMux(""))
+	defer srv.Close()
+
+	tests := []struct {
+		query    string
+		expected string
+	}{
+		{"access_token=token", `{"resumed":false,"next_batch": "s2"}`},
+		{"access_token=token&since=s1", `{"resumed":true,"next_batch": "s2"}`},
+	}
+	for _, tt := range tests {
+		ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/stream?"+tt.query, nil)
+		if err != nil {
+			t.Fatal("Error connecting:", err)
+		}
+		ws.SetReadDeadline(time.Now().Add(2 * time.Second))
+		_, msg, err := ws.ReadMessage()
+		if err != nil {
+			t.Fatal("Error reading:", err)
+		}
+		if string(msg) != tt.expected {
+			t.Errorf("%v: expected %s, got %s", tt.query, tt.expected, msg)
+		}
+		ws.Close()
+	}
+}
+
+func TestMissingToken(t *testing.T) {
+	var requests int
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+	}))
+	defer upstream.Close()
+
+	oldUpstream := *upstreamURL
+	*upstreamURL = upstream.URL + "/"
+	defer func() { *upstreamURL = oldUpstream }()
+
+	w := httptest.NewRecorder()
+	newServeMux("").ServeHTTP(w, httptest.NewRequest("GET", "/stream?since=s1", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401, got %d", w.Code)
+	}
+	expected := `{"errcode":"M_MISSING_TOKEN","error":"Missing access token"}`
+	if body := w.Body.String(); body != expected {
+		t.Errorf("Expected %s, got %s", expected, body)
+	}
+	if requests != 0 {
+		t.Errorf("Expected no upstream requests, got %d", requests)
+	}
+}
+
+func TestRedactAccessToken(t *testing.T) {
+	tests := []struct {
+		url      string
+		expected string
+	}{
+		{"/stream?since=s1", "/stream?since=s1"},
+		{"/stream?access_token=secret&since=s1", "/stream?since=s1"},
+		{"/stream?access_token=secret", "/stream"},
+	}
+	for _, tt := range tests {
+		u, err := url.Parse(tt.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if redacted := redactAccessToken(u); redacted != tt.expected {
+			t.Errorf("%s: expected %s, got %s", tt.url, tt.expected, redacted)
+		}
+	}
+}
+
+func TestGuestConnect(t *testing.T) {
+	done := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/_matrix/client/r0/register":
+			w.Write([]byte(`{"user_id": "@123:test", "access_token": "guest_token", "device_id": "GUEST"}`))
+		case r.Header.Get("Authorization") != "Bearer guest_token":
+			t.Error("Unexpected request without the guest token:", r.URL.Path)
+		case r.URL.Query().Get("since") == "":
+			w.Write([]byte(`{"next_batch": "s1"}`))
+		default:
+			<-done
+		}
+	}))
+	defer upstream.Close()
+	defer close(done)
+
+	oldUpstream := *upstreamURL
+	*upstreamURL = upstream.URL + "/"
+	defer func() { *upstreamURL = oldUpstream }()
+	*allowGuest = true
+	defer func() { *allowGuest = false }()
+
+	srv := httptest.NewServer(newServeMux(""))
+	defer srv.Close()
+
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/stream", nil)
+	if err != nil {
+		t.Fatal("Error connecting:", err)
+	}
+	defer ws.Close()
+
+	// the response and the first sync may come in either order
+	ws.WriteMessage(websocket.TextMessage, []byte(`{"id": "1", "method": "register_guest"}`))
+	expected := map[string]bool{
+		`{"id":"1","result":{"user_id":"@123:test","access_token":"guest_token","device_id":"GUEST"}}`: true,
+		`{"next_batch": "s1"}`: true,
+	}
+	for len(expected) > 0 {
+		ws.SetReadDeadline(time.Now().Add(2 * time.Second))
+		_, msg, err := ws.ReadMessage()
+		if err != nil {
+			t.Fatal("Error reading:", err)
+		}
+		if !expected[string(msg)] {
+			t.Fatalf("Unexpected message %s", msg)
+		}
+		delete(expected, string(msg))
+	}
+}
+
+func TestGzipInitialSync(t *testing.T) {
+	done := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("timeout") != "0" {
+			<-done
+			return
+		}
+		w.Write([]byte(`{"next_batch": "s2"}`))
+	}))
+	defer upstream.Close()
+	defer close(done)
+
+	oldUpstream := *upstreamURL
+	*upstreamURL = upstream.URL + "/"
+	defer func() { *upstreamURL = oldUpstream }()
+	*gzipInitialSync = true
+	defer func() { *gzipInitialSync = false }()
+
+	srv := httptest.NewServer(newServeMux(""))
+	defer srv.Close()
+
+	dialer := websocket.Dialer{Subprotocols: []string{"m.json.gzip-initial", "m.json"}}
+	ws, _, err := dialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/stream?access_token=token", nil)
+	if err != nil {
+		t.Fatal("Error connecting:", err)
+	}
+	defer ws.Close()
+	if ws.Subprotocol() != "m.json.gzip-initial" {
+		t.Errorf("Expected the gzip subprotocol, got %q", ws.Subprotocol())
+	}
+
+	ws.SetReadDeadline(time.Now().Add(2 * time.Second))
+	msgType, msg, err := ws.ReadMessage()
+	if err != nil {
+		t.Fatal("Error reading:", err)
+	}
+	if msgType != websocket.BinaryMessage {
+		t.Errorf("Expected a binary message, got type %d", msgType)
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(msg))
+	if err != nil {
+		t.Fatal("Initial sync is not gzipped:", err)
+	}
+	body, err := ioutil.ReadAll(zr)
+	if err != nil {
+		t.Fatal("Error decompressing:", err)
+	}
+	expected := `{"resumed":false,"next_batch": "s2"}`
+	if string(body) != expected {
+		t.Errorf("Expected %s, got %s", expected, body)
+	}
+}
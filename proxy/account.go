@@ -0,0 +1,220 @@
+package proxy
+
+import (
+	"sort"
+	"strings"
+)
+
+// handleGetPushers returns the pushers registered for the user.
+func handleGetPushers(c *Connection, req *jsonRequest) (interface{}, error) {
+	pushers, err := c.client.GetPushers(req.ctx)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{"pushers": pushers}, nil
+}
+
+// handleSetPusher forwards the pusher registration in the 'body' parameter to
+// the upstream server.
+func handleSetPusher(c *Connection, req *jsonRequest) (interface{}, error) {
+	p := newParamReader(req)
+	body := p.object("body")
+	if err := p.err(); err != nil {
+		return nil, err
+	}
+
+	if err := c.client.SetPusher(req.ctx, body); err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{}, nil
+}
+
+// handleGet3PIDs returns the third-party identifiers, such as email addresses,
+// associated with the user's account.
+func handleGet3PIDs(c *Connection, req *jsonRequest) (interface{}, error) {
+	threepids, err := c.client.Get3PIDs(req.ctx)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{"threepids": threepids}, nil
+}
+
+// the allowed values of 'medium' for third-party identifiers
+var threePIDMedia = []string{"email", "msisdn"}
+
+// handleDelete3PID removes a third-party identifier from the user's account.
+func handleDelete3PID(c *Connection, req *jsonRequest) (interface{}, error) {
+	p := newParamReader(req)
+	medium := p.enum("medium", threePIDMedia)
+	address := p.string("address")
+	if err := p.err(); err != nil {
+		return nil, err
+	}
+
+	return c.client.Delete3PID(req.ctx, medium, address)
+}
+
+// handleRequestOpenIDToken gets an OpenID token, which the client can give to
+// a third party to prove its identity.
+func handleRequestOpenIDToken(c *Connection, req *jsonRequest) (interface{}, error) {
+	return c.client.RequestOpenIDToken(req.ctx)
+}
+
+// handleGetAccountData returns the content of the user's account data of a
+// given type, either global or, if 'room_id' is given, for a room. If there is
+// none, the result is empty.
+func handleGetAccountData(c *Connection, req *jsonRequest) (interface{}, error) {
+	p := newParamReader(req)
+	dataType := p.string("type")
+	roomID := p.optionalRoomID("room_id")
+	if err := p.err(); err != nil {
+		return nil, err
+	}
+
+	content, err := c.client.GetAccountData(req.ctx, roomID, dataType)
+	if mErr, ok := err.(*MatrixError); ok && mErr.Details.ErrCode == "M_NOT_FOUND" {
+		return map[string]interface{}{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return content, nil
+}
+
+// handleAuthMetadata returns the homeserver's OAuth 2.0 authorization server
+// metadata, for clients which use OIDC-based authentication (MSC2965).
+func handleAuthMetadata(c *Connection, req *jsonRequest) (interface{}, error) {
+	metadata, err := c.client.GetAuthMetadata(req.ctx)
+	if err != nil {
+		if mErr, ok := err.(*MatrixError); ok && mErr.StatusCode == 404 {
+			return nil, &requestError{errCode: "M_UNRECOGNIZED",
+				message: "The homeserver does not support OIDC authentication"}
+		}
+		return nil, err
+	}
+	return metadata, nil
+}
+
+// handleSetAccessToken switches the connection to a new access token, such
+// as one obtained with a refresh token. The new token must be valid, and for
+// the same user and device as the current one.
+func handleSetAccessToken(c *Connection, req *jsonRequest) (interface{}, error) {
+	p := newParamReader(req)
+	token := p.string("access_token")
+	if err := p.err(); err != nil {
+		return nil, err
+	}
+
+	c.tokenMutex.Lock()
+	defer c.tokenMutex.Unlock()
+
+	userID, deviceID, err := c.client.WhoAmI(req.ctx)
+	if err != nil {
+		return nil, err
+	}
+	newUserID, newDeviceID, err := c.client.WhoAmIForToken(req.ctx, token)
+	if err != nil {
+		return nil, err
+	}
+	if newUserID != userID || newDeviceID != deviceID {
+		return nil, &requestError{errCode: "M_FORBIDDEN",
+			message: "The access token is for a different user or device"}
+	}
+
+	c.client.SetAccessToken(token)
+	logInfo("Switched to a new access token for", userID)
+	return map[string]interface{}{}, nil
+}
+
+// a syncResetter is a SyncRequestor which can start again with a full sync.
+type syncResetter interface {
+	ResetSync()
+}
+
+// handleRegisterGuest registers a guest user, and switches the connection to
+// its access token. Subsequent syncs start from scratch, for the new user.
+//
+// This is only allowed on a connection opened without an access token, so
+// that there is no state belonging to another user, such as a shared sync, to
+// be replaced. The room allowlist is checked against the guest user from then
+// on.
+func handleRegisterGuest(c *Connection, req *jsonRequest) (interface{}, error) {
+	if !c.AllowGuest {
+		return nil, &requestError{errCode: "M_FORBIDDEN", message: "Guest registration is not enabled"}
+	}
+	p := newParamReader(req)
+	displayName := p.optionalString("initial_device_display_name")
+	if err := p.err(); err != nil {
+		return nil, err
+	}
+
+	c.tokenMutex.Lock()
+	defer c.tokenMutex.Unlock()
+
+	rs, ok := c.syncer.(syncResetter)
+	if c.client.accessToken() != "" || !ok {
+		return nil, &requestError{errCode: "M_FORBIDDEN",
+			message: "Guest registration is only allowed on connections opened without an access token"}
+	}
+
+	reg, err := c.client.RegisterGuest(req.ctx, displayName)
+	if err != nil {
+		return nil, err
+	}
+	c.client.SetAccessToken(reg.AccessToken)
+	c.setUserID(reg.UserID)
+	rs.ResetSync()
+
+	// the sync pump is waiting for a token
+	c.refreshSync()
+	logInfo("Switched to guest user", reg.UserID)
+	return reg, nil
+}
+
+// the fields of the user's profile which can be set with 'set_profile'
+var profileFields = []string{"displayname", "avatar_url"}
+
+// handleSetProfile sets the user's display name and avatar, or either of
+// them. Each field is a separate upstream request, so setting both takes no
+// longer than setting one, and one being rejected, such as for a bad avatar,
+// doesn't stop the other being set. The fields which were set are listed in
+// 'updated', and any which weren't are in 'errors'.
+func handleSetProfile(c *Connection, req *jsonRequest) (interface{}, error) {
+	p := newParamReader(req)
+	values := make(map[string]string)
+	for _, field := range profileFields {
+		if p.has(field) {
+			values[field] = p.optionalString(field)
+		}
+	}
+	if avatar := values["avatar_url"]; avatar != "" && !strings.HasPrefix(avatar, "mxc://") {
+		p.addInvalid("avatar_url", "must be an mxc:// URI")
+	}
+	if err := p.err(); err != nil {
+		return nil, err
+	}
+	if len(values) == 0 {
+		return nil, &requestError{errCode: "M_MISSING_PARAM",
+			message: "One of displayname or avatar_url is required", fields: profileFields}
+	}
+
+	calls := make(map[string]func() (interface{}, error))
+	for field, value := range values {
+		field, value := field, value
+		calls[field] = func() (interface{}, error) {
+			return nil, c.client.SetProfileField(req.ctx, field, value)
+		}
+	}
+	set, errs := callConcurrently("set_profile", calls)
+
+	updated := []string{}
+	for field := range set {
+		updated = append(updated, field)
+	}
+	sort.Strings(updated)
+	result := map[string]interface{}{"updated": updated}
+	if len(errs) > 0 {
+		result["errors"] = errs
+	}
+	return result, nil
+}
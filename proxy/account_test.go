@@ -0,0 +1,449 @@
+package proxy
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestGetPushers(t *testing.T) {
+	pushers := `[{"pushkey":"abc","kind":"http","app_id":"face.mcapp.appy.prod"}]`
+
+	c, srv := newTestConnection(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" || r.URL.Path != "/_matrix/client/r0/pushers" {
+			t.Error("Unexpected request:", r.Method, r.URL.Path)
+		}
+		w.Write([]byte(`{"pushers":` + pushers + `}`))
+	})
+	defer srv.Close()
+
+	resp := c.handleRequest([]byte(`{"id": "1", "method": "get_pushers"}`))
+	expected := `{"id":"1","result":{"pushers":` + pushers + `}}`
+	if string(resp) != expected {
+		t.Errorf("Expected %s, got %s", expected, resp)
+	}
+}
+
+func TestSetPusher(t *testing.T) {
+	c, srv := newTestConnection(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" || r.URL.Path != "/_matrix/client/r0/pushers/set" {
+			t.Error("Unexpected request:", r.Method, r.URL.Path)
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		expected := `{"app_id":"face.mcapp.appy.prod","kind":"http","pushkey":"abc"}`
+		if string(body) != expected {
+			t.Errorf("Expected body %s, got %s", expected, body)
+		}
+		w.Write([]byte(`{}`))
+	})
+	defer srv.Close()
+
+	resp := c.handleRequest([]byte(`{"id": "1", "method": "set_pusher", "params": {"body": {"pushkey": "abc", "kind": "http", "app_id": "face.mcapp.appy.prod"}}}`))
+	if string(resp) != `{"id":"1","result":{}}` {
+		t.Errorf("Unexpected response: %s", resp)
+	}
+
+	resp = c.handleRequest([]byte(`{"id": "2", "method": "set_pusher"}`))
+	expected := `{"id":"2","error":{"errcode":"M_MISSING_PARAM","error":"Missing parameter body","fields":["body"]}}`
+	if string(resp) != expected {
+		t.Errorf("Expected %s, got %s", expected, resp)
+	}
+}
+
+func TestGet3PIDs(t *testing.T) {
+	threepids := `[{"medium":"email","address":"alice@example.com","validated_at":1535176800000,"added_at":1535336848756}]`
+
+	c, srv := newTestConnection(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" || r.URL.Path != "/_matrix/client/r0/account/3pid" {
+			t.Error("Unexpected request:", r.Method, r.URL.Path)
+		}
+		w.Write([]byte(`{"threepids":` + threepids + `}`))
+	})
+	defer srv.Close()
+
+	resp := c.handleRequest([]byte(`{"id": "1", "method": "get_3pids"}`))
+	expected := `{"id":"1","result":{"threepids":` + threepids + `}}`
+	if string(resp) != expected {
+		t.Errorf("Expected %s, got %s", expected, resp)
+	}
+}
+
+func TestDelete3PID(t *testing.T) {
+	c, srv := newTestConnection(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" || r.URL.Path != "/_matrix/client/r0/account/3pid/delete" {
+			t.Error("Unexpected request:", r.Method, r.URL.Path)
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		expected := `{"address":"alice@example.com","medium":"email"}`
+		if string(body) != expected {
+			t.Errorf("Expected body %s, got %s", expected, body)
+		}
+		w.Write([]byte(`{"id_server_unbind_result": "success"}`))
+	})
+	defer srv.Close()
+
+	resp := c.handleRequest([]byte(`{"id": "1", "method": "delete_3pid", "params": {"medium": "email", "address": "alice@example.com"}}`))
+	expected := `{"id":"1","result":{"id_server_unbind_result":"success"}}`
+	if string(resp) != expected {
+		t.Errorf("Expected %s, got %s", expected, resp)
+	}
+
+	resp = c.handleRequest([]byte(`{"id": "2", "method": "delete_3pid", "params": {"medium": "pigeon"}}`))
+	expected = `{"id":"2","error":{"errcode":"M_MISSING_PARAM","error":"medium must be one of: email, msisdn; Missing parameter address","fields":["medium","address"]}}`
+	if string(resp) != expected {
+		t.Errorf("Expected %s, got %s", expected, resp)
+	}
+}
+
+func TestRequestOpenIDToken(t *testing.T) {
+	token := `{"access_token":"SomeT0kenHere","token_type":"Bearer","matrix_server_name":"example.org","expires_in":3600}`
+
+	userID := "@alice/x:example.org"
+	c, srv := newTestConnection(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/_matrix/client/r0/account/whoami" {
+			w.Write([]byte(`{"user_id": "` + userID + `"}`))
+			return
+		}
+		path := "/_matrix/client/r0/user/@alice%2Fx:example.org/openid/request_token"
+		if r.Method != "POST" || r.URL.EscapedPath() != path {
+			t.Error("Unexpected request:", r.Method, r.URL.EscapedPath())
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		if string(body) != `{}` {
+			t.Errorf("Unexpected body %s", body)
+		}
+		w.Write([]byte(token))
+	})
+	defer srv.Close()
+
+	resp := c.handleRequest([]byte(`{"id": "1", "method": "request_openid_token"}`))
+	expected := `{"id":"1","result":` + token + `}`
+	if string(resp) != expected {
+		t.Errorf("Expected %s, got %s", expected, resp)
+	}
+}
+
+func TestRequestOpenIDTokenBadUserID(t *testing.T) {
+	c, srv := newTestConnection(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/_matrix/client/r0/account/whoami" {
+			t.Error("Unexpected request:", r.Method, r.URL.Path)
+		}
+		w.Write([]byte(`{"user_id": "alice"}`))
+	})
+	defer srv.Close()
+
+	resp := c.handleRequest([]byte(`{"id": "1", "method": "request_openid_token"}`))
+	expected := `{"id":"1","error":{"errcode":"M_UNKNOWN","error":"invalid user ID from /whoami: \"alice\""}}`
+	if string(resp) != expected {
+		t.Errorf("Expected %s, got %s", expected, resp)
+	}
+}
+
+func TestGetAccountData(t *testing.T) {
+	tests := []struct {
+		params       string
+		expectedPath string
+		expected     string
+	}{
+		{
+			`{"type": "m.direct"}`,
+			"/_matrix/client/r0/user/@alice:example.org/account_data/m.direct",
+			`{"id":"1","result":{"@bob:test":["!dm:test"]}}`,
+		},
+		{
+			`{"type": "org.example/custom", "room_id": "!room:test"}`,
+			"/_matrix/client/r0/user/@alice:example.org/rooms/%21room:test/account_data/org.example%2Fcustom",
+			`{"id":"1","result":{"@bob:test":["!dm:test"]}}`,
+		},
+		{
+			`{"type": "m.missing"}`,
+			"/_matrix/client/r0/user/@alice:example.org/account_data/m.missing",
+			`{"id":"1","result":{}}`,
+		},
+	}
+
+	for _, tt := range tests {
+		c, cleanup := newWhoAmITestConnection(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != "GET" || r.URL.EscapedPath() != tt.expectedPath {
+				t.Error("Unexpected request:", r.Method, r.URL.EscapedPath())
+			}
+			if strings.HasSuffix(r.URL.Path, "m.missing") {
+				w.WriteHeader(404)
+				w.Write([]byte(`{"errcode": "M_NOT_FOUND", "error": "Account data not found"}`))
+				return
+			}
+			w.Write([]byte(`{"@bob:test": ["!dm:test"]}`))
+		})
+
+		resp := c.handleRequest([]byte(`{"id": "1", "method": "get_account_data", "params": ` + tt.params + `}`))
+		if string(resp) != tt.expected {
+			t.Errorf("Params %s: expected %s, got %s", tt.params, tt.expected, resp)
+		}
+		cleanup()
+	}
+}
+
+func TestGetAccountDataInvalid(t *testing.T) {
+	c, srv := newTestConnection(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("Unexpected request:", r.Method, r.URL.Path)
+	})
+	defer srv.Close()
+	SetStrictRoomIDs(true)
+	defer SetStrictRoomIDs(false)
+
+	resp := c.handleRequest([]byte(`{"id": "1", "method": "get_account_data", "params": {"room_id": "#room:test"}}`))
+	expected := `{"id":"1","error":{"errcode":"M_MISSING_PARAM","error":"Missing parameter type; room_id must be of the form !localpart:server","fields":["type","room_id"]}}`
+	if string(resp) != expected {
+		t.Errorf("Expected %s, got %s", expected, resp)
+	}
+}
+
+func TestAuthMetadata(t *testing.T) {
+	metadata := `{"issuer":"https://auth.example.com/","authorization_endpoint":"https://auth.example.com/oauth2/auth","response_types_supported":["code"]}`
+
+	tests := []struct {
+		versions      *Versions
+		supportedPath string
+		expected      string
+	}{
+		{nil, "/_matrix/client/v1/auth_metadata", `{"id":"1","result":` + metadata + `}`},
+		{nil, "/_matrix/client/unstable/org.matrix.msc2965/auth_metadata", `{"id":"1","result":` + metadata + `}`},
+		{nil, "", `{"id":"1","error":{"errcode":"M_UNRECOGNIZED","error":"The homeserver does not support OIDC authentication"}}`},
+		{
+			&Versions{Versions: []string{"v1.1"}, UnstableFeatures: map[string]bool{"org.matrix.msc2965": true}},
+			"/_matrix/client/unstable/org.matrix.msc2965/auth_metadata",
+			`{"id":"1","result":` + metadata + `}`,
+		},
+		{
+			&Versions{Versions: []string{"v1.1"}},
+			"",
+			`{"id":"1","error":{"errcode":"M_UNRECOGNIZED","error":"The homeserver does not support auth_metadata"}}`,
+		},
+	}
+
+	for _, tt := range tests {
+		c, srv := newTestConnection(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != "GET" || r.URL.Path != tt.supportedPath {
+				w.WriteHeader(404)
+				w.Write([]byte(`{"errcode": "M_UNRECOGNIZED", "error": "Unrecognized request"}`))
+				return
+			}
+			w.Write([]byte(metadata))
+		})
+		c.client.Versions = tt.versions
+
+		resp := c.handleRequest([]byte(`{"id": "1", "method": "auth_metadata"}`))
+		if string(resp) != tt.expected {
+			t.Errorf("Path %q: expected %s, got %s", tt.supportedPath, tt.expected, resp)
+		}
+		srv.Close()
+	}
+}
+
+func TestSetAccessToken(t *testing.T) {
+	tokens := map[string]string{
+		"token":     `{"user_id": "@alice:test", "device_id": "DEV"}`,
+		"refreshed": `{"user_id": "@alice:test", "device_id": "DEV"}`,
+		"other":     `{"user_id": "@alice:test", "device_id": "OTHER"}`,
+	}
+	var pushersToken string
+	c, srv := newTestConnection(func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		switch r.URL.Path {
+		case "/_matrix/client/r0/account/whoami":
+			if resp, ok := tokens[token]; ok {
+				w.Write([]byte(resp))
+				return
+			}
+			w.WriteHeader(401)
+			w.Write([]byte(`{"errcode": "M_UNKNOWN_TOKEN", "error": "Invalid access token"}`))
+		case "/_matrix/client/r0/pushers":
+			pushersToken = token
+			w.Write([]byte(`{"pushers": []}`))
+		default:
+			t.Error("Unexpected path:", r.URL.Path)
+		}
+	})
+	defer srv.Close()
+
+	tests := []struct {
+		token    string
+		expected string
+	}{
+		{"bad", `{"id":"1","error":{"errcode":"M_UNKNOWN_TOKEN","error":"Invalid access token","status_code":401}}`},
+		{"other", `{"id":"1","error":{"errcode":"M_FORBIDDEN","error":"The access token is for a different user or device"}}`},
+		{"refreshed", `{"id":"1","result":{}}`},
+	}
+	for _, tt := range tests {
+		resp := c.handleRequest([]byte(`{"id": "1", "method": "set_access_token", "params": {"access_token": "` + tt.token + `"}}`))
+		if string(resp) != tt.expected {
+			t.Errorf("Token %v: expected %s, got %s", tt.token, tt.expected, resp)
+		}
+
+		c.handleRequest([]byte(`{"id": "2", "method": "get_pushers"}`))
+		expectedToken := "token"
+		if tt.token == "refreshed" {
+			expectedToken = "refreshed"
+		}
+		if pushersToken != expectedToken {
+			t.Errorf("After token %v: expected request with %v, got %v", tt.token, expectedToken, pushersToken)
+		}
+	}
+}
+
+func TestRegisterGuest(t *testing.T) {
+	var syncs []string
+	var pushersToken string
+	c, srv := newTestConnection(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/_matrix/client/r0/register":
+			if r.Method != "POST" || r.URL.Query().Get("kind") != "guest" {
+				t.Errorf("Unexpected registration request %v %v", r.Method, r.URL)
+			}
+			if auth, ok := r.Header["Authorization"]; ok {
+				t.Errorf("Unexpected Authorization header %v", auth)
+			}
+			body, _ := ioutil.ReadAll(r.Body)
+			if string(body) != `{"initial_device_display_name":"Kiosk"}` {
+				t.Errorf("Unexpected body %s", body)
+			}
+			w.Write([]byte(`{"user_id": "@123:test", "access_token": "guest_token", "device_id": "GUEST"}`))
+		case "/_matrix/client/r0/pushers":
+			pushersToken = r.Header.Get("Authorization")
+			w.Write([]byte(`{"pushers": []}`))
+		case "/_matrix/client/r0/sync":
+			syncs = append(syncs, r.Header.Get("Authorization")+" since="+r.URL.Query().Get("since"))
+			w.Write([]byte(`{"next_batch": "s2"}`))
+		default:
+			t.Error("Unexpected path:", r.URL.Path)
+		}
+	})
+	defer srv.Close()
+	syncer := &Syncer{Client: c.client, SyncParams: url.Values{"since": {"s1"}}}
+	c.syncer = syncer
+
+	request := []byte(`{"id": "1", "method": "register_guest", "params": {"initial_device_display_name": "Kiosk"}}`)
+	resp := c.handleRequest(request)
+	expected := `{"id":"1","error":{"errcode":"M_FORBIDDEN","error":"Guest registration is not enabled"}}`
+	if string(resp) != expected {
+		t.Errorf("Expected %s, got %s", expected, resp)
+	}
+
+	// a connection which already has a user can't switch to a guest
+	c.AllowGuest = true
+	resp = c.handleRequest(request)
+	expected = `{"id":"1","error":{"errcode":"M_FORBIDDEN","error":"Guest registration is only allowed on connections opened without an access token"}}`
+	if string(resp) != expected {
+		t.Errorf("Expected %s, got %s", expected, resp)
+	}
+
+	// until it registers, a connection without a token doesn't sync
+	c.client.SetAccessToken("")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := syncer.MakeRequest(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Expected the sync to wait, got %v", err)
+	}
+
+	resp = c.handleRequest(request)
+	expected = `{"id":"1","result":{"user_id":"@123:test","access_token":"guest_token","device_id":"GUEST"}}`
+	if string(resp) != expected {
+		t.Errorf("Expected %s, got %s", expected, resp)
+	}
+
+	c.handleRequest([]byte(`{"id": "2", "method": "get_pushers"}`))
+	if pushersToken != "Bearer guest_token" {
+		t.Errorf("Expected the guest token to be used, got %q", pushersToken)
+	}
+
+	if _, err := syncer.MakeRequest(context.Background()); err != nil {
+		t.Fatal("Unexpected sync error:", err)
+	}
+	if len(syncs) != 1 || syncs[0] != "Bearer guest_token since=" {
+		t.Errorf("Expected a full sync as the guest, got %v", syncs)
+	}
+	if c.userID() != "@123:test" {
+		t.Errorf("Expected the connection to be for the guest, got %q", c.userID())
+	}
+
+	// and it can only register once
+	resp = c.handleRequest(request)
+	if !strings.Contains(string(resp), "M_FORBIDDEN") {
+		t.Errorf("Expected a second registration to be refused, got %s", resp)
+	}
+}
+
+func TestSetProfile(t *testing.T) {
+	var mutex sync.Mutex
+	bodies := make(map[string]string)
+	c, srv := newTestConnection(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.EscapedPath() {
+		case "/_matrix/client/r0/account/whoami":
+			w.Write([]byte(`{"user_id": "@alice:test", "device_id": "DEV"}`))
+		case "/_matrix/client/r0/profile/@alice:test/displayname":
+			body, _ := ioutil.ReadAll(r.Body)
+			mutex.Lock()
+			bodies["displayname"] = r.Method + " " + string(body)
+			mutex.Unlock()
+			w.Write([]byte(`{}`))
+		case "/_matrix/client/r0/profile/@alice:test/avatar_url":
+			body, _ := ioutil.ReadAll(r.Body)
+			mutex.Lock()
+			bodies["avatar_url"] = r.Method + " " + string(body)
+			mutex.Unlock()
+			w.WriteHeader(403)
+			w.Write([]byte(`{"errcode": "M_FORBIDDEN", "error": "Avatar changes are disabled"}`))
+		default:
+			t.Error("Unexpected path:", r.URL.EscapedPath())
+		}
+	})
+	defer srv.Close()
+
+	resp := c.handleRequest([]byte(`{"id": "1", "method": "set_profile", "params": {"displayname": "Alice", "avatar_url": "mxc://test/abc"}}`))
+	expected := `{"id":"1","result":{"errors":{"avatar_url":{"errcode":"M_FORBIDDEN","error":"Avatar changes are disabled","status_code":403}},"updated":["displayname"]}}`
+	if string(resp) != expected {
+		t.Errorf("Expected %s, got %s", expected, resp)
+	}
+	if bodies["displayname"] != `PUT {"displayname":"Alice"}` {
+		t.Errorf("Unexpected displayname request %s", bodies["displayname"])
+	}
+	if bodies["avatar_url"] != `PUT {"avatar_url":"mxc://test/abc"}` {
+		t.Errorf("Unexpected avatar_url request %s", bodies["avatar_url"])
+	}
+}
+
+func TestSetProfileInvalid(t *testing.T) {
+	c, srv := newTestConnection(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("Unexpected request:", r.Method, r.URL.Path)
+	})
+	defer srv.Close()
+
+	tests := []struct {
+		params   string
+		expected string
+	}{
+		{
+			`{}`,
+			`{"id":"1","error":{"errcode":"M_MISSING_PARAM","error":"One of displayname or avatar_url is required","fields":["displayname","avatar_url"]}}`,
+		},
+		{
+			`{"avatar_url": "https://example.com/me.png"}`,
+			`{"id":"1","error":{"errcode":"M_INVALID_PARAM","error":"avatar_url must be an mxc:// URI","fields":["avatar_url"]}}`,
+		},
+		{
+			`{"displayname": 5}`,
+			`{"id":"1","error":{"errcode":"M_INVALID_PARAM","error":"displayname must be a string","fields":["displayname"]}}`,
+		},
+	}
+	for _, tt := range tests {
+		resp := c.handleRequest([]byte(`{"id": "1", "method": "set_profile", "params": ` + tt.params + `}`))
+		if string(resp) != tt.expected {
+			t.Errorf("Params %s: expected %s, got %s", tt.params, tt.expected, resp)
+		}
+	}
+}
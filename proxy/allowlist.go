@@ -0,0 +1,72 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+)
+
+// A RoomAllowlist maps from user ID to the rooms which connections for that
+// user may send to. Users which are not listed are not restricted.
+type RoomAllowlist map[string][]string
+
+// LoadRoomAllowlist reads a JSON file containing an object which maps from
+// user ID to a list of room IDs.
+func LoadRoomAllowlist(path string) (RoomAllowlist, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var allowlist RoomAllowlist
+	if err := json.Unmarshal(data, &allowlist); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return allowlist, nil
+}
+
+// allows returns true if connections for the given user may send to the
+// given room.
+func (a RoomAllowlist) allows(userID, roomID string) bool {
+	rooms, ok := a[userID]
+	if !ok {
+		return true
+	}
+	return indexOf(rooms, roomID) >= 0
+}
+
+// roomsRestricted returns true if the connection's user may only send to the
+// rooms listed for it in RoomAllowlist. The user is looked up on each request,
+// since it changes when the connection registers as a guest.
+func (c *Connection) roomsRestricted() bool {
+	_, ok := c.RoomAllowlist[c.userID()]
+	return ok
+}
+
+// checkRoomAllowed returns an M_FORBIDDEN error if the connection's user may
+// not send to the given room, so that the request is rejected without
+// contacting the upstream server.
+func (c *Connection) checkRoomAllowed(roomID string) error {
+	return c.checkRoomParamAllowed("room_id", roomID)
+}
+
+// checkRoomParamAllowed is like checkRoomAllowed, for a parameter which may
+// also be a room alias. Aliases are refused if the user is restricted, since
+// the room they point to is not known until the upstream server resolves them.
+func (c *Connection) checkRoomParamAllowed(field, room string) error {
+	if c.RoomAllowlist.allows(c.userID(), room) {
+		return nil
+	}
+	if room != "" && room[0] == '#' {
+		return &requestError{
+			errCode: "M_FORBIDDEN",
+			message: "This connection may only send to rooms given by ID",
+			fields:  []string{field},
+		}
+	}
+	return &requestError{
+		errCode: "M_FORBIDDEN",
+		message: "This connection may not send to " + room,
+		fields:  []string{field},
+	}
+}
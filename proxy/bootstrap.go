@@ -0,0 +1,69 @@
+package proxy
+
+import (
+	"sync"
+)
+
+// handleBootstrap fetches the things a client typically needs when it starts
+// up - the user's identity, the server's versions and capabilities, and the
+// joined rooms - with concurrent upstream requests, so that the client need
+// only make one round trip.
+//
+// If some of the requests fail, the others are still returned, and the
+// failures are reported in 'errors', keyed on the name of the section.
+func handleBootstrap(c *Connection, req *jsonRequest) (interface{}, error) {
+	sections := map[string]func() (interface{}, error){
+		"whoami": func() (interface{}, error) {
+			userID, deviceID, err := c.client.WhoAmI(req.ctx)
+			if err != nil {
+				return nil, err
+			}
+			return map[string]string{"user_id": userID, "device_id": deviceID}, nil
+		},
+		"versions": func() (interface{}, error) {
+			return c.client.GetVersions(req.ctx)
+		},
+		"capabilities": func() (interface{}, error) {
+			return c.client.GetCapabilities(req.ctx)
+		},
+		"joined_rooms": func() (interface{}, error) {
+			return c.client.GetJoinedRooms(req.ctx)
+		},
+	}
+
+	result, errs := callConcurrently("bootstrap", sections)
+	if len(errs) > 0 {
+		result["errors"] = errs
+	}
+	return result, nil
+}
+
+// callConcurrently makes each of the given calls in its own goroutine, and
+// waits for them all. It returns the results of those which succeeded and the
+// errors of those which failed, keyed on the names of the calls. method is
+// only used to log the failures.
+func callConcurrently(method string, calls map[string]func() (interface{}, error)) (map[string]interface{}, map[string]*MatrixErrorDetails) {
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	results := make(map[string]interface{})
+	errs := make(map[string]*MatrixErrorDetails)
+
+	for name, call := range calls {
+		wg.Add(1)
+		go func(name string, call func() (interface{}, error)) {
+			defer wg.Done()
+			res, err := call()
+
+			mutex.Lock()
+			defer mutex.Unlock()
+			if err != nil {
+				logInfo(method+":", name, "failed:", err)
+				errs[name] = errorToResponse(err)
+			} else {
+				results[name] = res
+			}
+		}(name, call)
+	}
+	wg.Wait()
+	return results, errs
+}
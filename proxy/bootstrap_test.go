@@ -0,0 +1,65 @@
+package proxy
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestBootstrap(t *testing.T) {
+	c, srv := newTestConnection(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/_matrix/client/r0/account/whoami":
+			w.Write([]byte(`{"user_id": "@alice:test", "device_id": "DEV"}`))
+		case "/_matrix/client/versions":
+			w.Write([]byte(`{"versions": ["v1.1"], "unstable_features": {"org.example": true}}`))
+		case "/_matrix/client/r0/capabilities":
+			w.Write([]byte(`{"capabilities": {"m.change_password": {"enabled": false}}}`))
+		case "/_matrix/client/r0/joined_rooms":
+			w.Write([]byte(`{"joined_rooms": ["!a:test", "!b:test"]}`))
+		default:
+			t.Error("Unexpected path:", r.URL.Path)
+		}
+	})
+	defer srv.Close()
+
+	resp := c.handleRequest([]byte(`{"id": "1", "method": "bootstrap"}`))
+	expected := `{"id":"1","result":{` +
+		`"capabilities":{"m.change_password":{"enabled":false}},` +
+		`"joined_rooms":["!a:test","!b:test"],` +
+		`"versions":{"versions":["v1.1"],"unstable_features":{"org.example":true}},` +
+		`"whoami":{"device_id":"DEV","user_id":"@alice:test"}}}`
+	if string(resp) != expected {
+		t.Errorf("Expected %s, got %s", expected, resp)
+	}
+}
+
+func TestBootstrapPartialFailure(t *testing.T) {
+	c, srv := newTestConnection(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/_matrix/client/r0/account/whoami":
+			w.Write([]byte(`{"user_id": "@alice:test", "device_id": "DEV"}`))
+		case "/_matrix/client/versions":
+			w.Write([]byte(`{"versions": ["r0.6.1"]}`))
+		case "/_matrix/client/r0/capabilities":
+			w.WriteHeader(404)
+			w.Write([]byte(`{"errcode": "M_UNRECOGNIZED", "error": "Unrecognized request"}`))
+		case "/_matrix/client/r0/joined_rooms":
+			w.WriteHeader(502)
+			w.Write([]byte(`Bad Gateway`))
+		default:
+			t.Error("Unexpected path:", r.URL.Path)
+		}
+	})
+	defer srv.Close()
+
+	resp := c.handleRequest([]byte(`{"id": "1", "method": "bootstrap"}`))
+	expected := `{"id":"1","result":{` +
+		`"errors":{` +
+		`"capabilities":{"errcode":"M_UNRECOGNIZED","error":"Unrecognized request","status_code":404},` +
+		`"joined_rooms":{"errcode":"M_UNKNOWN","error":"Unexpected HTTP 502 response from the homeserver","status_code":502,"body":"Bad Gateway"}},` +
+		`"versions":{"versions":["r0.6.1"],"unstable_features":null},` +
+		`"whoami":{"device_id":"DEV","user_id":"@alice:test"}}}`
+	if string(resp) != expected {
+		t.Errorf("Expected %s, got %s", expected, resp)
+	}
+}
@@ -0,0 +1,1310 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A MatrixClient makes requests to the upstream homeserver on behalf of a
+// single user.
+type MatrixClient struct {
+	// base URL of the upstream server, including a trailing slash
+	UpstreamURL string
+
+	// base URL of the server for /sync requests, such as a read replica,
+	// including a trailing slash. If empty, UpstreamURL is used.
+	SyncURL string
+
+	// the access token for requests. Once the client is in use, it should
+	// only be changed with SetAccessToken.
+	AccessToken string
+	tokenMutex  sync.RWMutex
+
+	// the version prefix for client-server API paths ("r0" or "v3"). If
+	// empty, "r0" is used.
+	APIPrefix string
+
+	// the versions and features supported by the upstream server, if known.
+	// Methods which the server does not support are rejected without
+	// contacting it.
+	Versions *Versions
+
+	// if set, the value of 'set_presence' for /sync requests which do not
+	// give one
+	SetPresence string
+
+	// timeout for requests other than /sync, which has its own long-poll
+	// timeout. Zero means no timeout.
+	RequestTimeout time.Duration
+
+	// timeouts for particular classes of request, overriding RequestTimeout
+	// (or, for /sync, the lack of a timeout). A sync timeout should allow
+	// for the long-poll timeout.
+	ClassTimeouts map[RequestClass]time.Duration
+
+	// the user and device for our access token, populated by WhoAmI
+	whoAmIMutex sync.Mutex
+	userID      string
+	deviceID    string
+
+	// if true, the durations in any Server-Timing header in upstream
+	// responses are logged
+	LogServerTiming bool
+
+	// headers from the client's request which are forwarded on every upstream
+	// request
+	forwardHeaders http.Header
+
+	// the trace context for upstream requests, set by SetTraceParent
+	traceID    string
+	traceFlags string
+
+	httpClient http.Client
+}
+
+// forwardableHeaders lists the headers which are copied from the client's
+// request to the upstream requests.
+var forwardableHeaders = []string{
+	"Accept-Language",
+}
+
+// NewMatrixClient creates a MatrixClient for the given upstream server and
+// access token.
+func NewMatrixClient(upstreamURL string, accessToken string) *MatrixClient {
+	return &MatrixClient{
+		UpstreamURL: upstreamURL,
+		AccessToken: accessToken,
+		httpClient:  http.Client{CheckRedirect: checkRedirect},
+	}
+}
+
+// clone returns a new MatrixClient for the same server and access token, and
+// with the same settings, but without the headers and trace context of the
+// client's request, for requests made on behalf of several connections.
+func (c *MatrixClient) clone() *MatrixClient {
+	clone := NewMatrixClient(c.UpstreamURL, c.accessToken())
+	clone.SyncURL = c.SyncURL
+	clone.APIPrefix = c.APIPrefix
+	clone.Versions = c.Versions
+	clone.SetPresence = c.SetPresence
+	clone.RequestTimeout = c.RequestTimeout
+	clone.ClassTimeouts = c.ClassTimeouts
+	clone.LogServerTiming = c.LogServerTiming
+	clone.httpClient = c.httpClient
+	return clone
+}
+
+// A RequestClass groups upstream requests with similar latencies, so that
+// they can be given different timeouts.
+type RequestClass string
+
+const (
+	// long-polling /sync requests
+	RequestClassSync RequestClass = "sync"
+
+	// other GET requests
+	RequestClassRead RequestClass = "read"
+
+	// requests which change something
+	RequestClassWrite RequestClass = "write"
+)
+
+// ParseClassTimeouts parses a comma-separated list of class=timeout pairs,
+// such as "sync=90s,write=10s".
+func ParseClassTimeouts(s string) (map[RequestClass]time.Duration, error) {
+	timeouts := make(map[RequestClass]time.Duration)
+	if s == "" {
+		return timeouts, nil
+	}
+
+	for _, pair := range strings.Split(s, ",") {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid request timeout %q", pair)
+		}
+		class := RequestClass(strings.TrimSpace(kv[0]))
+		switch class {
+		case RequestClassSync, RequestClassRead, RequestClassWrite:
+		default:
+			return nil, fmt.Errorf("invalid request class in %q", pair)
+		}
+		timeout, err := time.ParseDuration(strings.TrimSpace(kv[1]))
+		if err != nil || timeout < 0 {
+			return nil, fmt.Errorf("invalid timeout in %q", pair)
+		}
+		timeouts[class] = timeout
+	}
+	return timeouts, nil
+}
+
+// timeoutFor returns the timeout for requests of the given class.
+func (c *MatrixClient) timeoutFor(class RequestClass) time.Duration {
+	if timeout, ok := c.ClassTimeouts[class]; ok {
+		return timeout
+	}
+	if class == RequestClassSync {
+		return 0
+	}
+	return c.RequestTimeout
+}
+
+// requestClassOf returns the class of a request, other than /sync, with the
+// given method.
+func requestClassOf(method string) RequestClass {
+	if method == "GET" {
+		return RequestClassRead
+	}
+	return RequestClassWrite
+}
+
+// SetForwardedHeaders captures any forwardable headers from the given request
+// headers, so that they are sent on all subsequent upstream requests.
+func (c *MatrixClient) SetForwardedHeaders(h http.Header) {
+	c.forwardHeaders = make(http.Header)
+	for _, name := range forwardableHeaders {
+		if v, ok := h[http.CanonicalHeaderKey(name)]; ok {
+			c.forwardHeaders[http.CanonicalHeaderKey(name)] = v
+		}
+	}
+}
+
+// HTTPError is returned when the upstream server returns a non-200 response.
+type HTTPError struct {
+	StatusCode  int
+	ContentType string
+	Body        []byte
+
+	// how long the server asked us to wait before retrying, from its
+	// Retry-After header or the 'retry_after_ms' of a Matrix error. Zero if
+	// it didn't say.
+	RetryAfter time.Duration
+}
+
+func (e *HTTPError) Error() string {
+	return fmt.Sprintf("%d: %s", e.StatusCode, string(e.Body))
+}
+
+// MatrixErrorDetails is the body of an error response in the Matrix format.
+type MatrixErrorDetails struct {
+	ErrCode string `json:"errcode"`
+	Error   string `json:"error"`
+
+	// for errors in the parameters of a request, the names of all of the
+	// parameters which were missing or invalid.
+	Fields []string `json:"fields,omitempty"`
+
+	// for errors from the upstream server, the HTTP status code of its
+	// response. This is not part of the error body sent by the server.
+	StatusCode int `json:"status_code,omitempty"`
+
+	// for non-Matrix error responses from the upstream server, such as those
+	// from a gateway in front of it, the start of the response body.
+	Body string `json:"body,omitempty"`
+}
+
+// MatrixError is returned when the upstream server returns a non-200 response
+// whose body is a Matrix error.
+type MatrixError struct {
+	HTTPError
+	Details MatrixErrorDetails
+}
+
+func (e *MatrixError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Details.ErrCode, e.Details.Error)
+}
+
+// presenceValues are the allowed values of the 'set_presence' parameter to
+// /sync.
+var presenceValues = []string{"offline", "online", "unavailable"}
+
+// IsValidPresence returns true if the given string is an allowed value of
+// SetPresence.
+func IsValidPresence(presence string) bool {
+	for _, p := range presenceValues {
+		if presence == p {
+			return true
+		}
+	}
+	return false
+}
+
+// Sync makes a request to /sync with the given parameters, and returns the
+// body of the response. The request is aborted if ctx is cancelled.
+func (c *MatrixClient) Sync(ctx context.Context, params url.Values) ([]byte, error) {
+	if c.SetPresence != "" && params.Get("set_presence") == "" {
+		params = copyValues(params)
+		params.Set("set_presence", c.SetPresence)
+	}
+
+	base := c.UpstreamURL
+	if c.SyncURL != "" {
+		base = c.SyncURL
+	}
+	u := buildURL(base, c.clientPath("sync"), params)
+	req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	return c.doWithTimeout(req, c.timeoutFor(RequestClassSync))
+}
+
+// inviteFilter is the sync filter used by GetInvites. It excludes as much as
+// possible other than the invites.
+const inviteFilter = `{"presence":{"types":[]},"account_data":{"types":[]},` +
+	`"room":{"timeline":{"limit":0},"state":{"types":[]},"ephemeral":{"types":[]},` +
+	`"account_data":{"types":[]}}}`
+
+// GetInvites makes a one-off sync request, filtered to exclude everything
+// except the rooms the user is invited to, and returns the 'rooms.invite'
+// section of the response.
+func (c *MatrixClient) GetInvites(ctx context.Context) (json.RawMessage, error) {
+	body, err := c.oneOffSync(ctx, inviteFilter)
+	if err != nil {
+		return nil, err
+	}
+
+	var resp struct {
+		Rooms struct {
+			Invite json.RawMessage `json:"invite"`
+		} `json:"rooms"`
+	}
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return nil, err
+	}
+	if resp.Rooms.Invite == nil {
+		return json.RawMessage(`{}`), nil
+	}
+	return resp.Rooms.Invite, nil
+}
+
+// receiptFilter returns the sync filter used by GetReceipts for the given
+// room. It excludes everything except the room's receipts.
+func receiptFilter(roomID string) string {
+	rooms, _ := json.Marshal([]string{roomID})
+	return `{"presence":{"types":[]},"account_data":{"types":[]},` +
+		`"room":{"rooms":` + string(rooms) + `,"timeline":{"limit":0},"state":{"types":[]},` +
+		`"ephemeral":{"types":["m.receipt"]},"account_data":{"types":[]}}}`
+}
+
+// GetReceipts makes a one-off sync request, filtered to exclude everything
+// except the read receipts in the given room, and returns them in the format
+// of the content of an m.receipt event.
+func (c *MatrixClient) GetReceipts(ctx context.Context, roomID string) (map[string]json.RawMessage, error) {
+	body, err := c.oneOffSync(ctx, receiptFilter(roomID))
+	if err != nil {
+		return nil, err
+	}
+
+	var resp struct {
+		Rooms struct {
+			Join map[string]struct {
+				Ephemeral struct {
+					Events []struct {
+						Type    string                     `json:"type"`
+						Content map[string]json.RawMessage `json:"content"`
+					} `json:"events"`
+				} `json:"ephemeral"`
+			} `json:"join"`
+		} `json:"rooms"`
+	}
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return nil, err
+	}
+
+	// the receipts may be split between several events, keyed by event ID
+	receipts := make(map[string]json.RawMessage)
+	for _, event := range resp.Rooms.Join[roomID].Ephemeral.Events {
+		if event.Type != "m.receipt" {
+			continue
+		}
+		for eventID, r := range event.Content {
+			receipts[eventID] = r
+		}
+	}
+	return receipts, nil
+}
+
+// oneOffSync makes a sync request with the given filter, which returns
+// straight away rather than waiting for new events, and returns the body of
+// the response.
+func (c *MatrixClient) oneOffSync(ctx context.Context, filter string) ([]byte, error) {
+	// this is a quick sync, so is treated as a read rather than a long poll
+	if timeout := c.timeoutFor(RequestClassRead); timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	params := url.Values{}
+	params.Set("filter", filter)
+	params.Set("timeout", "0")
+	return c.Sync(ctx, params)
+}
+
+// WhoAmI returns the user ID and device ID for the access token. The result
+// is cached after the first successful call.
+func (c *MatrixClient) WhoAmI(ctx context.Context) (userID string, deviceID string, err error) {
+	c.whoAmIMutex.Lock()
+	defer c.whoAmIMutex.Unlock()
+
+	if c.userID != "" {
+		return c.userID, c.deviceID, nil
+	}
+
+	var resp struct {
+		UserID   string `json:"user_id"`
+		DeviceID string `json:"device_id"`
+	}
+	if err := c.getJSON(ctx, c.clientPath("account/whoami"), nil, &resp); err != nil {
+		return "", "", err
+	}
+	c.userID, c.deviceID = resp.UserID, resp.DeviceID
+	return c.userID, c.deviceID, nil
+}
+
+// WhoAmIForToken returns the user ID and device ID for the given access
+// token, which need not be the one the client is using.
+func (c *MatrixClient) WhoAmIForToken(ctx context.Context, token string) (userID string, deviceID string, err error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", c.url(c.clientPath("account/whoami"), nil), nil)
+	if err != nil {
+		return "", "", err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	body, err := c.do(req)
+	if err != nil {
+		return "", "", err
+	}
+	var resp struct {
+		UserID   string `json:"user_id"`
+		DeviceID string `json:"device_id"`
+	}
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return "", "", err
+	}
+	return resp.UserID, resp.DeviceID, nil
+}
+
+// SetAccessToken changes the access token used for requests, including any
+// sync request made after the call. It does not check the token, but forgets
+// the user and device found by WhoAmI, in case they have changed.
+func (c *MatrixClient) SetAccessToken(token string) {
+	c.tokenMutex.Lock()
+	c.AccessToken = token
+	c.tokenMutex.Unlock()
+
+	c.whoAmIMutex.Lock()
+	c.userID, c.deviceID = "", ""
+	c.whoAmIMutex.Unlock()
+}
+
+// accessToken returns the current access token.
+func (c *MatrixClient) accessToken() string {
+	c.tokenMutex.RLock()
+	defer c.tokenMutex.RUnlock()
+	return c.AccessToken
+}
+
+// GetUserID returns the user ID for the access token.
+func (c *MatrixClient) GetUserID(ctx context.Context) (string, error) {
+	userID, _, err := c.WhoAmI(ctx)
+	return userID, err
+}
+
+// GetCapabilities returns the 'capabilities' object from the
+// /capabilities endpoint.
+func (c *MatrixClient) GetCapabilities(ctx context.Context) (json.RawMessage, error) {
+	var resp struct {
+		Capabilities json.RawMessage `json:"capabilities"`
+	}
+	if err := c.getJSON(ctx, c.clientPath("capabilities"), nil, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Capabilities, nil
+}
+
+// GetJoinedRooms returns the IDs of the rooms the user has joined.
+func (c *MatrixClient) GetJoinedRooms(ctx context.Context) ([]string, error) {
+	var resp struct {
+		JoinedRooms []string `json:"joined_rooms"`
+	}
+	if err := c.getJSON(ctx, c.clientPath("joined_rooms"), nil, &resp); err != nil {
+		return nil, err
+	}
+	if resp.JoinedRooms == nil {
+		return []string{}, nil
+	}
+	return resp.JoinedRooms, nil
+}
+
+// SendState sends a state event to the given room, and returns the event ID.
+func (c *MatrixClient) SendState(ctx context.Context, roomID, eventType, stateKey string, content interface{}) (string, error) {
+	path := c.clientPath("rooms/" + url.PathEscape(roomID) + "/state/" +
+		url.PathEscape(eventType) + "/" + url.PathEscape(stateKey))
+
+	var resp struct {
+		EventID string `json:"event_id"`
+	}
+	if err := c.putJSON(ctx, path, content, &resp); err != nil {
+		return "", err
+	}
+	return resp.EventID, nil
+}
+
+// A StateEvent is the current value of a piece of room state.
+type StateEvent struct {
+	// empty if the server only returned the content
+	EventID string
+	Content json.RawMessage
+}
+
+// GetStateEvent gets the current state event of the given type and state key
+// in a room.
+func (c *MatrixClient) GetStateEvent(ctx context.Context, roomID, eventType, stateKey string) (*StateEvent, error) {
+	path := c.clientPath("rooms/" + url.PathEscape(roomID) + "/state/" +
+		url.PathEscape(eventType) + "/" + url.PathEscape(stateKey))
+
+	// ask for the whole event, so that we get the event ID. Servers which
+	// don't support 'format' return just the content.
+	var raw json.RawMessage
+	if err := c.getJSON(ctx, path, url.Values{"format": {"event"}}, &raw); err != nil {
+		return nil, err
+	}
+
+	var event struct {
+		EventID string          `json:"event_id"`
+		Content json.RawMessage `json:"content"`
+	}
+	if err := json.Unmarshal(raw, &event); err != nil {
+		return nil, err
+	}
+	if event.EventID == "" || event.Content == nil {
+		return &StateEvent{Content: raw}, nil
+	}
+	return &StateEvent{EventID: event.EventID, Content: event.Content}, nil
+}
+
+// SendEvent sends a message event to the given room, and returns the event
+// ID.
+func (c *MatrixClient) SendEvent(ctx context.Context, roomID, eventType, txnID string, content interface{}) (string, error) {
+	path := c.clientPath("rooms/" + url.PathEscape(roomID) + "/send/" +
+		url.PathEscape(eventType) + "/" + url.PathEscape(txnID))
+
+	var resp struct {
+		EventID string `json:"event_id"`
+	}
+	if err := c.putJSON(ctx, path, content, &resp); err != nil {
+		return "", err
+	}
+	return resp.EventID, nil
+}
+
+// Redact redacts the given event, and returns the event ID of the redaction.
+// The reason, if non-empty, is sent in the content of the redaction; servers
+// which don't support it ignore it.
+func (c *MatrixClient) Redact(ctx context.Context, roomID, eventID, txnID, reason string) (string, error) {
+	path := c.clientPath("rooms/" + url.PathEscape(roomID) + "/redact/" +
+		url.PathEscape(eventID) + "/" + url.PathEscape(txnID))
+
+	content := map[string]string{}
+	if reason != "" {
+		content["reason"] = reason
+	}
+
+	var resp struct {
+		EventID string `json:"event_id"`
+	}
+	if err := c.putJSON(ctx, path, content, &resp); err != nil {
+		return "", err
+	}
+	return resp.EventID, nil
+}
+
+// AddAlias creates a mapping from the given room alias to the room ID.
+func (c *MatrixClient) AddAlias(ctx context.Context, alias, roomID string) error {
+	path := c.clientPath("directory/room/" + url.PathEscape(alias))
+
+	var resp json.RawMessage
+	return c.putJSON(ctx, path, map[string]string{"room_id": roomID}, &resp)
+}
+
+// DeleteAlias removes the given room alias.
+func (c *MatrixClient) DeleteAlias(ctx context.Context, alias string) error {
+	path := c.clientPath("directory/room/" + url.PathEscape(alias))
+
+	var resp json.RawMessage
+	return c.deleteJSON(ctx, path, &resp)
+}
+
+// UpgradeRoom upgrades a room to the given room version, and returns the ID
+// of the replacement room.
+func (c *MatrixClient) UpgradeRoom(ctx context.Context, roomID, newVersion string) (string, error) {
+	path := c.clientPath("rooms/" + url.PathEscape(roomID) + "/upgrade")
+
+	var resp struct {
+		ReplacementRoom string `json:"replacement_room"`
+	}
+	body := map[string]string{"new_version": newVersion}
+	if err := c.postJSON(ctx, path, body, &resp); err != nil {
+		return "", err
+	}
+	return resp.ReplacementRoom, nil
+}
+
+// Knock asks to join the given room, which may be given by ID or alias, and
+// returns the room ID. serverNames are the servers to attempt to knock
+// through.
+func (c *MatrixClient) Knock(ctx context.Context, roomIDOrAlias, reason string, serverNames []string) (string, error) {
+	path := c.clientPath("knock/" + url.PathEscape(roomIDOrAlias))
+
+	query := url.Values{}
+	for _, name := range serverNames {
+		query.Add("server_name", name)
+	}
+	body := map[string]string{}
+	if reason != "" {
+		body["reason"] = reason
+	}
+
+	var resp struct {
+		RoomID string `json:"room_id"`
+	}
+	if err := c.sendJSON(ctx, "POST", path, query, body, &resp); err != nil {
+		return "", err
+	}
+	return resp.RoomID, nil
+}
+
+// GetRoomSummary gets the summary of a room, using the stable endpoint if the
+// server supports it and the MSC3266 one otherwise. Servers in 'via' are
+// asked about the room if the upstream server is not in it.
+func (c *MatrixClient) GetRoomSummary(ctx context.Context, roomIDOrAlias string, via []string) (json.RawMessage, error) {
+	path := "_matrix/client/unstable/im.nheko.summary/rooms/" +
+		url.PathEscape(roomIDOrAlias) + "/summary"
+	if c.Versions != nil && c.Versions.atLeast(1, 15) {
+		path = "_matrix/client/v1/room_summary/" + url.PathEscape(roomIDOrAlias)
+	}
+
+	query := url.Values{}
+	for _, server := range via {
+		query.Add("via", server)
+	}
+
+	var resp json.RawMessage
+	if err := c.getJSON(ctx, path, query, &resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// SendReceipt sends a read receipt for the given event.
+func (c *MatrixClient) SendReceipt(ctx context.Context, roomID, eventID string) error {
+	path := c.clientPath("rooms/" + url.PathEscape(roomID) +
+		"/receipt/m.read/" + url.PathEscape(eventID))
+
+	var resp json.RawMessage
+	return c.postJSON(ctx, path, struct{}{}, &resp)
+}
+
+// GetRelations returns the events which relate to the given event. If relType
+// is non-empty, only relations of that type are returned; if eventType is
+// also non-empty, only events of that type are returned.
+//
+// The response, including the 'chunk' and pagination tokens, is returned
+// as-is.
+func (c *MatrixClient) GetRelations(ctx context.Context, roomID, eventID, relType, eventType string) (json.RawMessage, error) {
+	path := "_matrix/client/v1/rooms/" + url.PathEscape(roomID) + "/relations/" +
+		url.PathEscape(eventID)
+	if relType != "" {
+		path += "/" + url.PathEscape(relType)
+		if eventType != "" {
+			path += "/" + url.PathEscape(eventType)
+		}
+	}
+
+	var resp json.RawMessage
+	if err := c.getJSON(ctx, path, nil, &resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// GetThreads returns the thread roots in the given room. include may be
+// "all", "participated", or "" for the server default.
+//
+// The response, including the 'chunk' and 'next_batch', is returned as-is.
+func (c *MatrixClient) GetThreads(ctx context.Context, roomID, include string) (json.RawMessage, error) {
+	path := "_matrix/client/v1/rooms/" + url.PathEscape(roomID) + "/threads"
+
+	query := url.Values{}
+	if include != "" {
+		query.Set("include", include)
+	}
+
+	var resp json.RawMessage
+	if err := c.getJSON(ctx, path, query, &resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// ReportEvent reports an event as inappropriate to the server admins. If
+// score is non-nil, it is sent as the offensiveness score; if reason is
+// non-empty, it is sent as the reason for the report.
+func (c *MatrixClient) ReportEvent(ctx context.Context, roomID, eventID string, score *int, reason string) error {
+	path := c.clientPath("rooms/" + url.PathEscape(roomID) + "/report/" +
+		url.PathEscape(eventID))
+
+	body := map[string]interface{}{}
+	if score != nil {
+		body["score"] = *score
+	}
+	if reason != "" {
+		body["reason"] = reason
+	}
+	var resp json.RawMessage
+	return c.postJSON(ctx, path, body, &resp)
+}
+
+// Search performs a server-side search, forwarding the given search body
+// as-is, and returns the 'search_categories' result. If nextBatch is
+// non-empty, it is used to fetch the next page of results.
+func (c *MatrixClient) Search(ctx context.Context, body interface{}, nextBatch string) (json.RawMessage, error) {
+	query := url.Values{}
+	if nextBatch != "" {
+		query.Set("next_batch", nextBatch)
+	}
+
+	var resp struct {
+		SearchCategories json.RawMessage `json:"search_categories"`
+	}
+	if err := c.sendJSON(ctx, "POST", c.clientPath("search"), query, body, &resp); err != nil {
+		return nil, err
+	}
+	return resp.SearchCategories, nil
+}
+
+// DownloadMedia downloads the media with the given server name and media ID,
+// and returns its content and content type. If width and height are
+// non-zero, a thumbnail of that size is returned instead, with the given
+// resizing method, if any.
+func (c *MatrixClient) DownloadMedia(ctx context.Context, serverName, mediaID string, width, height int, method string, maxBytes int64) ([]byte, string, error) {
+	endpoint := "download"
+	query := url.Values{}
+	if width > 0 && height > 0 {
+		endpoint = "thumbnail"
+		query.Set("width", strconv.Itoa(width))
+		query.Set("height", strconv.Itoa(height))
+		if method != "" {
+			query.Set("method", method)
+		}
+	}
+	path := c.mediaPath(endpoint + "/" + url.PathEscape(serverName) + "/" +
+		url.PathEscape(mediaID))
+
+	req, err := http.NewRequestWithContext(ctx, "GET", c.url(path, query), nil)
+	if err != nil {
+		return nil, "", err
+	}
+
+	body, header, err := c.doWithHeaders(req, c.timeoutFor(RequestClassRead), maxBytes)
+	if err != nil {
+		return nil, "", err
+	}
+	return body, header.Get("Content-Type"), nil
+}
+
+// GetMediaConfig returns the homeserver's media configuration, such as the
+// maximum upload size in 'm.upload.size'.
+func (c *MatrixClient) GetMediaConfig(ctx context.Context) (json.RawMessage, error) {
+	var resp json.RawMessage
+	if err := c.getJSON(ctx, c.mediaPath("config"), nil, &resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// GetPushers returns the list of pushers registered for the user.
+func (c *MatrixClient) GetPushers(ctx context.Context) (json.RawMessage, error) {
+	var resp struct {
+		Pushers json.RawMessage `json:"pushers"`
+	}
+	if err := c.getJSON(ctx, c.clientPath("pushers"), nil, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Pushers, nil
+}
+
+// SetPusher creates, updates or deletes a pusher for the user. The body is
+// forwarded as-is.
+func (c *MatrixClient) SetPusher(ctx context.Context, body interface{}) error {
+	var resp json.RawMessage
+	return c.postJSON(ctx, c.clientPath("pushers/set"), body, &resp)
+}
+
+// Get3PIDs returns the third-party identifiers associated with the user's
+// account.
+func (c *MatrixClient) Get3PIDs(ctx context.Context) (json.RawMessage, error) {
+	var resp struct {
+		ThreePIDs json.RawMessage `json:"threepids"`
+	}
+	if err := c.getJSON(ctx, c.clientPath("account/3pid"), nil, &resp); err != nil {
+		return nil, err
+	}
+	if resp.ThreePIDs == nil {
+		return json.RawMessage(`[]`), nil
+	}
+	return resp.ThreePIDs, nil
+}
+
+// Delete3PID removes a third-party identifier from the user's account, and
+// returns the server's response, which says whether it was also unbound from
+// the identity server.
+func (c *MatrixClient) Delete3PID(ctx context.Context, medium, address string) (json.RawMessage, error) {
+	body := map[string]string{"medium": medium, "address": address}
+
+	var resp json.RawMessage
+	if err := c.postJSON(ctx, c.clientPath("account/3pid/delete"), body, &resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// RequestOpenIDToken gets an OpenID token for the user, and returns the token
+// object.
+func (c *MatrixClient) RequestOpenIDToken(ctx context.Context) (json.RawMessage, error) {
+	userID, err := c.GetUserID(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(userID, "@") || !strings.Contains(userID, ":") {
+		return nil, fmt.Errorf("invalid user ID from /whoami: %q", userID)
+	}
+
+	path := c.clientPath("user/" + url.PathEscape(userID) + "/openid/request_token")
+	var resp json.RawMessage
+	if err := c.postJSON(ctx, path, map[string]interface{}{}, &resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// SetProfileField sets one field of the user's profile, such as
+// 'displayname' or 'avatar_url'.
+func (c *MatrixClient) SetProfileField(ctx context.Context, field, value string) error {
+	userID, err := c.GetUserID(ctx)
+	if err != nil {
+		return err
+	}
+	path := c.clientPath("profile/" + url.PathEscape(userID) + "/" + url.PathEscape(field))
+	var resp json.RawMessage
+	return c.putJSON(ctx, path, map[string]string{field: value}, &resp)
+}
+
+// A GuestRegistration is the result of registering a guest user.
+type GuestRegistration struct {
+	UserID      string `json:"user_id"`
+	AccessToken string `json:"access_token"`
+	DeviceID    string `json:"device_id"`
+}
+
+// RegisterGuest registers a new guest user. The request is made without the
+// client's access token.
+func (c *MatrixClient) RegisterGuest(ctx context.Context, deviceDisplayName string) (*GuestRegistration, error) {
+	body := map[string]interface{}{}
+	if deviceDisplayName != "" {
+		body["initial_device_display_name"] = deviceDisplayName
+	}
+	reqBody, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST",
+		c.url(c.clientPath("register"), url.Values{"kind": {"guest"}}), bytes.NewReader(reqBody))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header["Authorization"] = nil
+
+	respBody, err := c.do(req)
+	if err != nil {
+		return nil, err
+	}
+	var resp GuestRegistration
+	if err := json.Unmarshal(respBody, &resp); err != nil {
+		return nil, err
+	}
+	if resp.AccessToken == "" {
+		return nil, errors.New("no access token in registration response")
+	}
+	return &resp, nil
+}
+
+// KeysQueryResponse is the part of the response from /keys/query used by the
+// proxy: the keys for each user.
+type KeysQueryResponse struct {
+	DeviceKeys      map[string]json.RawMessage `json:"device_keys"`
+	MasterKeys      map[string]json.RawMessage `json:"master_keys"`
+	SelfSigningKeys map[string]json.RawMessage `json:"self_signing_keys"`
+}
+
+// QueryKeys gets the device and cross-signing keys of the given users. The
+// map is from user ID to the device IDs to query; an empty list means all of
+// the user's devices.
+func (c *MatrixClient) QueryKeys(ctx context.Context, deviceKeys map[string][]string) (*KeysQueryResponse, error) {
+	body := map[string]interface{}{"device_keys": deviceKeys}
+
+	var resp KeysQueryResponse
+	if err := c.postJSON(ctx, c.clientPath("keys/query"), body, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// GetAccountData returns the content of the user's account data of the given
+// type: for the given room, or global if roomID is empty.
+func (c *MatrixClient) GetAccountData(ctx context.Context, roomID, dataType string) (json.RawMessage, error) {
+	userID, err := c.GetUserID(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	path := "user/" + url.PathEscape(userID)
+	if roomID != "" {
+		path += "/rooms/" + url.PathEscape(roomID)
+	}
+	path += "/account_data/" + url.PathEscape(dataType)
+
+	var resp json.RawMessage
+	if err := c.getJSON(ctx, c.clientPath(path), nil, &resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// GetFilter returns the definition of one of the user's uploaded filters.
+func (c *MatrixClient) GetFilter(ctx context.Context, filterID string) (json.RawMessage, error) {
+	userID, err := c.GetUserID(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var resp json.RawMessage
+	path := "user/" + url.PathEscape(userID) + "/filter/" + url.PathEscape(filterID)
+	if err := c.getJSON(ctx, c.clientPath(path), nil, &resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// GetAuthMetadata returns the server's OAuth 2.0 authorization server
+// metadata. The stable endpoint is tried first, unless the server is known not
+// to support it, and then the MSC2965 one.
+func (c *MatrixClient) GetAuthMetadata(ctx context.Context) (json.RawMessage, error) {
+	paths := []string{
+		"_matrix/client/v1/auth_metadata",
+		"_matrix/client/unstable/org.matrix.msc2965/auth_metadata",
+	}
+	if c.Versions != nil && !c.Versions.atLeast(1, 15) {
+		paths = paths[1:]
+	}
+
+	var err error
+	for _, path := range paths {
+		var resp json.RawMessage
+		if err = c.getJSON(ctx, path, nil, &resp); err == nil {
+			return resp, nil
+		}
+		if mErr, ok := err.(*MatrixError); !ok || mErr.StatusCode != 404 {
+			return nil, err
+		}
+	}
+	return nil, err
+}
+
+// GetTags returns the tags the user has set on the given room, as a map from
+// tag name to tag content.
+func (c *MatrixClient) GetTags(ctx context.Context, roomID string) (json.RawMessage, error) {
+	path, err := c.tagsPath(ctx, roomID)
+	if err != nil {
+		return nil, err
+	}
+
+	var resp struct {
+		Tags json.RawMessage `json:"tags"`
+	}
+	if err := c.getJSON(ctx, path, nil, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Tags, nil
+}
+
+// SetTag adds a tag to the given room. If order is non-nil, it is the
+// position of the room within the tag.
+func (c *MatrixClient) SetTag(ctx context.Context, roomID, tag string, order *float64) error {
+	path, err := c.tagsPath(ctx, roomID)
+	if err != nil {
+		return err
+	}
+
+	body := map[string]interface{}{}
+	if order != nil {
+		body["order"] = *order
+	}
+	var resp json.RawMessage
+	return c.putJSON(ctx, path+"/"+url.PathEscape(tag), body, &resp)
+}
+
+// DeleteTag removes a tag from the given room.
+func (c *MatrixClient) DeleteTag(ctx context.Context, roomID, tag string) error {
+	path, err := c.tagsPath(ctx, roomID)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "DELETE", c.url(path+"/"+url.PathEscape(tag), nil), nil)
+	if err != nil {
+		return err
+	}
+	_, err = c.do(req)
+	return err
+}
+
+// tagsPath returns the path of the tags endpoint for the given room.
+func (c *MatrixClient) tagsPath(ctx context.Context, roomID string) (string, error) {
+	userID, err := c.GetUserID(ctx)
+	if err != nil {
+		return "", err
+	}
+	return c.clientPath("user/" + url.PathEscape(userID) + "/rooms/" +
+		url.PathEscape(roomID) + "/tags"), nil
+}
+
+// Forward makes an arbitrary request to the client-server API. endpoint is
+// relative to '_matrix/client/'. If body is non-nil, it is sent as JSON.
+//
+// Unlike the other methods, error responses from the upstream server are not
+// returned as errors: the status code and body are returned as-is.
+func (c *MatrixClient) Forward(ctx context.Context, method, endpoint string, query url.Values, body interface{}) (int, []byte, error) {
+	var reqBody io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return 0, nil, err
+		}
+		reqBody = bytes.NewReader(b)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.url("_matrix/client/"+endpoint, query), reqBody)
+	if err != nil {
+		return 0, nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	respBody, err := c.do(req)
+	switch err.(type) {
+	case nil:
+		return http.StatusOK, respBody, nil
+	case *MatrixError:
+		return err.(*MatrixError).StatusCode, err.(*MatrixError).Body, nil
+	case *HTTPError:
+		return err.(*HTTPError).StatusCode, err.(*HTTPError).Body, nil
+	}
+	return 0, nil, err
+}
+
+// getJSON makes a GET request to the given path on the upstream server, and
+// unmarshals the response into result.
+func (c *MatrixClient) getJSON(ctx context.Context, path string, query url.Values, result interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", c.url(path, query), nil)
+	if err != nil {
+		return err
+	}
+
+	body, err := c.do(req)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(body, result)
+}
+
+// postJSON makes a POST request with the JSON encoding of body to the given
+// path on the upstream server, and unmarshals the response into result.
+func (c *MatrixClient) postJSON(ctx context.Context, path string, body interface{}, result interface{}) error {
+	return c.sendJSON(ctx, "POST", path, nil, body, result)
+}
+
+// putJSON makes a PUT request with the JSON encoding of body to the given
+// path on the upstream server, and unmarshals the response into result.
+func (c *MatrixClient) putJSON(ctx context.Context, path string, body interface{}, result interface{}) error {
+	return c.sendJSON(ctx, "PUT", path, nil, body, result)
+}
+
+// deleteJSON makes a DELETE request to the given path on the upstream server,
+// and unmarshals the response into result.
+func (c *MatrixClient) deleteJSON(ctx context.Context, path string, result interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, "DELETE", c.url(path, nil), nil)
+	if err != nil {
+		return err
+	}
+
+	body, err := c.do(req)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(body, result)
+}
+
+// sendJSON makes a request with the given method, and the JSON encoding of
+// body, to the given path on the upstream server, and unmarshals the response
+// into result.
+func (c *MatrixClient) sendJSON(ctx context.Context, method, path string, query url.Values, body interface{}, result interface{}) error {
+	reqBody, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.url(path, query), bytes.NewReader(reqBody))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	respBody, err := c.do(req)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(respBody, result)
+}
+
+// copyValues returns a copy of the given url.Values, which can be modified
+// without affecting the original.
+func copyValues(v url.Values) url.Values {
+	res := make(url.Values, len(v))
+	for k, vals := range v {
+		res[k] = append([]string(nil), vals...)
+	}
+	return res
+}
+
+// clientPath returns the path of the given client-server API endpoint,
+// relative to the upstream URL.
+func (c *MatrixClient) clientPath(endpoint string) string {
+	prefix := c.APIPrefix
+	if prefix == "" {
+		prefix = "r0"
+	}
+	return "_matrix/client/" + prefix + "/" + endpoint
+}
+
+// mediaPath returns the path of the given media API endpoint, relative to
+// the upstream URL.
+func (c *MatrixClient) mediaPath(endpoint string) string {
+	prefix := c.APIPrefix
+	if prefix == "" {
+		prefix = "r0"
+	}
+	return "_matrix/media/" + prefix + "/" + endpoint
+}
+
+// url builds the URL for the given path and query parameters on the upstream
+// server.
+func (c *MatrixClient) url(path string, query url.Values) string {
+	return buildURL(c.UpstreamURL, path, query)
+}
+
+// buildURL builds the URL for the given path and query parameters relative to
+// the given base URL.
+func buildURL(base string, path string, query url.Values) string {
+	u := base + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	return u
+}
+
+// do sends the given request to the upstream server, adding the access token
+// and any forwarded headers, and returns the body of the response. The timeout
+// depends on whether the request is a read or a write.
+//
+// If the server returns a non-200 response, the error returned will be a
+// MatrixError if the body can be parsed as a Matrix error, or an HTTPError
+// otherwise.
+func (c *MatrixClient) do(req *http.Request) ([]byte, error) {
+	return c.doWithTimeout(req, c.timeoutFor(requestClassOf(req.Method)))
+}
+
+// doWithTimeout is like do, but gives up after the given timeout, if it is
+// non-zero.
+func (c *MatrixClient) doWithTimeout(req *http.Request, timeout time.Duration) ([]byte, error) {
+	body, _, err := c.doWithHeaders(req, timeout, 0)
+	return body, err
+}
+
+// errResponseTooLarge is returned by doWithHeaders when the body of the
+// response is larger than the limit.
+var errResponseTooLarge = errors.New("response from the upstream server is too large")
+
+// doWithHeaders is like doWithTimeout, but also returns the headers of the
+// response. If maxBytes is non-zero, it gives up with errResponseTooLarge
+// rather than read a body of more than that many bytes.
+func (c *MatrixClient) doWithHeaders(req *http.Request, timeout time.Duration, maxBytes int64) ([]byte, http.Header, error) {
+	if timeout > 0 {
+		ctx, cancel := context.WithTimeout(req.Context(), timeout)
+		defer cancel()
+		req = req.WithContext(ctx)
+	}
+
+	for name, v := range c.forwardHeaders {
+		req.Header[name] = v
+	}
+	// requests for a particular token set their own Authorization header,
+	// and unauthenticated ones set it to nil
+	if _, ok := req.Header["Authorization"]; !ok {
+		if token := c.accessToken(); token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+	}
+	if tp := c.traceParent(); tp != "" {
+		req.Header.Set("traceparent", tp)
+	}
+
+	if isUpstreamLimited(req.Context()) {
+		if err := acquireUpstreamSlot(req.Context()); err != nil {
+			return nil, nil, err
+		}
+		defer releaseUpstreamSlot()
+	}
+
+	if c.traceID != "" {
+		logDebug("Upstream request", req.Method, req.URL.Path, "trace", c.traceID)
+	} else {
+		logDebug("Upstream request", req.Method, req.URL.Path)
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	if c.LogServerTiming {
+		if h := resp.Header.Get("Server-Timing"); h != "" {
+			logInfo("Upstream Server-Timing for", req.Method, req.URL.Path+":",
+				parseServerTiming(h))
+		}
+	}
+
+	var reader io.Reader = resp.Body
+	if maxBytes > 0 {
+		if resp.ContentLength > maxBytes {
+			return nil, nil, errResponseTooLarge
+		}
+		// read one more byte than allowed, to tell if there are more
+		reader = io.LimitReader(resp.Body, maxBytes+1)
+	}
+	body, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error reading response: %w", err)
+	}
+	if maxBytes > 0 && int64(len(body)) > maxBytes {
+		return nil, nil, errResponseTooLarge
+	}
+
+	if resp.StatusCode != 200 {
+		return nil, nil, newHTTPError(resp, body)
+	}
+	return body, resp.Header, nil
+}
+
+// newHTTPError builds a MatrixError or HTTPError for a non-200 response.
+func newHTTPError(resp *http.Response, body []byte) error {
+	httpErr := HTTPError{
+		StatusCode:  resp.StatusCode,
+		ContentType: resp.Header.Get("Content-Type"),
+		Body:        body,
+		RetryAfter:  parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()),
+	}
+
+	var details MatrixErrorDetails
+	if err := json.Unmarshal(body, &details); err != nil || details.ErrCode == "" {
+		return &httpErr
+	}
+
+	// the header takes precedence, as 'retry_after_ms' is deprecated
+	if httpErr.RetryAfter == 0 {
+		var retry struct {
+			RetryAfterMS int64 `json:"retry_after_ms"`
+		}
+		json.Unmarshal(body, &retry)
+		if retry.RetryAfterMS > 0 {
+			httpErr.RetryAfter = cappedRetryAfter(retry.RetryAfterMS, time.Millisecond)
+		}
+	}
+	return &MatrixError{httpErr, details}
+}
+
+// maxRetryAfter is the longest delay asked for by the upstream server which
+// is honoured, so that a mistaken Retry-After doesn't stall a connection
+// indefinitely.
+const maxRetryAfter = 5 * time.Minute
+
+// parseRetryAfter returns the delay given by a Retry-After header, which is
+// either a number of seconds or an HTTP date, relative to now. It returns
+// zero if the header is empty, invalid or in the past, and at most
+// maxRetryAfter.
+func parseRetryAfter(header string, now time.Time) time.Duration {
+	if header == "" {
+		return 0
+	}
+	if secs, err := strconv.ParseInt(header, 10, 64); err == nil {
+		if secs <= 0 {
+			return 0
+		}
+		return cappedRetryAfter(secs, time.Second)
+	}
+	t, err := http.ParseTime(header)
+	if err != nil || !t.After(now) {
+		return 0
+	}
+	if d := t.Sub(now); d < maxRetryAfter {
+		return d
+	}
+	return maxRetryAfter
+}
+
+// cappedRetryAfter returns n of the given unit, or maxRetryAfter if that is
+// shorter; checking before multiplying means that huge values can't
+// overflow.
+func cappedRetryAfter(n int64, unit time.Duration) time.Duration {
+	if n >= int64(maxRetryAfter/unit) {
+		return maxRetryAfter
+	}
+	return time.Duration(n) * unit
+}
+
+// retryAfterOf returns how long the upstream server asked us to wait before
+// retrying after the given error, or zero if it didn't say.
+func retryAfterOf(err error) time.Duration {
+	switch e := err.(type) {
+	case *MatrixError:
+		return e.RetryAfter
+	case *HTTPError:
+		return e.RetryAfter
+	}
+	return 0
+}
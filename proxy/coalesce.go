@@ -0,0 +1,90 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+)
+
+// coalescableMethods lists the methods which only read from the upstream
+// server, and so can share a response with identical concurrent requests.
+var coalescableMethods = map[string]bool{
+	"capabilities":     true,
+	"bootstrap":        true,
+	"relations":        true,
+	"threads":          true,
+	"get_pushers":      true,
+	"get_3pids":        true,
+	"auth_metadata":    true,
+	"get_account_data": true,
+	"get_tags":         true,
+	"get_state_event":  true,
+	"get_state_events": true,
+	"get_invites":      true,
+	"room_summary":     true,
+	"media_config":     true,
+	"get_receipts":     true,
+
+	// this is a POST, but doesn't change anything
+	"get_user_devices": true,
+}
+
+// a requestGroup tracks the in-flight requests on a connection, so that
+// identical concurrent requests can be made only once.
+type requestGroup struct {
+	mutex sync.Mutex
+	calls map[string]*inflightCall
+}
+
+type inflightCall struct {
+	// closed when the call completes
+	done chan struct{}
+
+	result interface{}
+	err    error
+}
+
+// do calls fn and returns its result, unless there is already a call with the
+// same key in flight, in which case it waits for that call and returns its
+// result instead, or gives up once ctx is done.
+func (g *requestGroup) do(ctx context.Context, key string, fn func() (interface{}, error)) (interface{}, error) {
+	g.mutex.Lock()
+	if call, ok := g.calls[key]; ok {
+		g.mutex.Unlock()
+		select {
+		case <-call.done:
+			return call.result, call.err
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	if g.calls == nil {
+		g.calls = make(map[string]*inflightCall)
+	}
+	call := &inflightCall{done: make(chan struct{})}
+	g.calls[key] = call
+	g.mutex.Unlock()
+
+	call.result, call.err = fn()
+
+	g.mutex.Lock()
+	delete(g.calls, key)
+	g.mutex.Unlock()
+	close(call.done)
+
+	return call.result, call.err
+}
+
+// coalesceKey returns the key identifying requests which can share a
+// response, or "" if the request must be made on its own.
+func coalesceKey(req *jsonRequest) string {
+	if !coalescableMethods[req.Method] {
+		return ""
+	}
+	// map keys are sorted when marshalled, so equal params give equal keys
+	params, err := json.Marshal(req.Params)
+	if err != nil {
+		return ""
+	}
+	return req.Method + " " + string(params)
+}
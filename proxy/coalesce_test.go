@@ -0,0 +1,64 @@
+package proxy
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCoalesceReads(t *testing.T) {
+	var requests int32
+	release := make(chan struct{})
+	c, srv := newTestConnection(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		<-release
+		w.Write([]byte(`{"capabilities": {}}`))
+	})
+	defer srv.Close()
+	c.CoalesceReads = true
+
+	const n = 5
+	var wg sync.WaitGroup
+	responses := make([]string, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			id := strconv.Itoa(i)
+			responses[i] = string(c.handleRequest([]byte(`{"id": "` + id + `", "method": "capabilities"}`)))
+		}(i)
+	}
+
+	// give all of the requests a chance to start before the first completes
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if n := atomic.LoadInt32(&requests); n != 1 {
+		t.Errorf("Expected 1 upstream request, got %d", n)
+	}
+	for i, resp := range responses {
+		if resp != `{"id":"`+strconv.Itoa(i)+`","result":{}}` {
+			t.Errorf("Unexpected response %s", resp)
+		}
+	}
+}
+
+func TestCoalesceKey(t *testing.T) {
+	a := coalesceKey(&jsonRequest{Method: "threads", Params: map[string]interface{}{"room_id": "!a", "include": "all"}})
+	b := coalesceKey(&jsonRequest{Method: "threads", Params: map[string]interface{}{"include": "all", "room_id": "!a"}})
+	if a == "" || a != b {
+		t.Errorf("Expected equal keys, got %q and %q", a, b)
+	}
+
+	if k := coalesceKey(&jsonRequest{Method: "threads", Params: map[string]interface{}{"room_id": "!b"}}); k == a {
+		t.Errorf("Expected different params to give a different key")
+	}
+
+	if k := coalesceKey(&jsonRequest{Method: "send"}); k != "" {
+		t.Errorf("Expected no key for a mutating method, got %q", k)
+	}
+}
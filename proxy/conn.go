@@ -1,8 +1,18 @@
 package proxy
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
 	"log"
+	"net/http"
 	"net/url"
+	"regexp"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -18,15 +28,69 @@ const (
 	// Send pings to peer with this period. Must be less than pongWait.
 	pingPeriod = (pongWait * 9) / 10
 
-	// Maximum message size allowed from peer.
+	// Maximum message size allowed from peer, in addition to MaxContentBytes
+	// if that is set.
 	maxMessageBytes = 512
+
+	// Default time allowed for the peer to respond to a close message.
+	defaultCloseGracePeriod = 5 * time.Second
+
+	// Maximum time to wait between retries of a failed sync.
+	maxSyncRetryBackoff = 30 * time.Second
 )
 
+// The values of Connection.SyncErrorMode.
+const (
+	// close the connection when a sync fails
+	SyncErrorClose = "close"
+
+	// send the client a message describing the error, and keep retrying
+	// the sync, with a backoff, until it succeeds.
+	SyncErrorNotify = "notify"
+)
+
+// Time to wait before the first retry of a failed sync. It is doubled on each
+// subsequent retry.
+var syncRetryBackoff = time.Second
+
+// the ID of the most recently created Connection
+var lastConnectionID uint64
+
+// Version is the version of the proxy, reported to clients in the
+// X-Proxy-Version header.
+const Version = "0.1.0"
+
 type message struct {
 	messageType int
 	body        []byte
+	priority    messagePriority
+
+	// for sync responses, the 'next_batch' to commit once the message has
+	// been written
+	cursor string
 }
 
+// messagePriority says whether a message can be dropped when the client is
+// not keeping up.
+type messagePriority int
+
+const (
+	// high priority messages, such as responses to requests and syncs with
+	// something in them, are always sent.
+	priorityHigh messagePriority = iota
+
+	// low priority messages, such as empty syncs, are dropped when the send
+	// buffer is saturated.
+	priorityLow
+)
+
+// size of the buffer of messages waiting to be sent to the client
+const sendBufferSize = 256
+
+// once this many messages are waiting to be sent, low priority messages are
+// dropped, leaving the rest of the buffer for high priority ones.
+const lowPrioritySendLimit = sendBufferSize * 3 / 4
+
 // A Connection represents a single websocket.
 //
 // Each connection has three main goroutines:
@@ -49,6 +113,9 @@ type message struct {
 // shutdown process.
 //
 type Connection struct {
+	// a unique ID for this connection, for logging
+	id uint64
+
 	ws *websocket.Conn
 
 	send chan message
@@ -57,53 +124,360 @@ type Connection struct {
 	// writer also stop.
 	quit chan struct{}
 
-	syncer *Syncer
+	// This gets closed when the writer stops, which may be some time before
+	// the reader does, so that messages queued in the meantime are dropped
+	// rather than blocking once the send buffer is full.
+	writerStopped chan struct{}
+
+	// the context of the client's requests other than syncs, and its cancel
+	// function, which is called when the reader stops, so that in-flight
+	// requests made by handlers are abandoned.
+	requestCtx     context.Context
+	cancelRequests context.CancelFunc
+
+	syncer SyncRequestor
+
+	// client for making requests to the upstream server on behalf of the
+	// user
+	client *MatrixClient
+
+	// The number of times a sync which fails with a 5xx response is retried
+	// before giving up and closing the connection.
+	MaxSyncRetries int
+
+	// The time allowed for the peer to respond to a close message sent by
+	// us, after which the socket is closed regardless.
+	CloseGracePeriod time.Duration
+
+	// If true, requests and responses use the JSON-RPC 2.0 format.
+	JSONRPC bool
+
+	// cancels the in-flight sync request, if any; guarded by syncMutex
+	syncMutex  sync.Mutex
+	syncCancel context.CancelFunc
+
+	// set to 1 when the client asks for a refresh; the next sync request
+	// is then made with a zero timeout.
+	refreshRequested int32
+
+	// also signalled when the client asks for a refresh, so that the sync
+	// pump stops waiting to retry a failed sync.
+	refreshed chan struct{}
+
+	// set to 1 when the client mutes presence; the presence section is then
+	// stripped from sync responses.
+	presenceMuted int32
+
+	// when a sync response containing events was last sent to the client,
+	// in Unix nanoseconds; accessed atomically
+	lastEventTime int64
+
+	// the IDs of the requests currently being handled, so that a request
+	// reusing one can be rejected
+	requestIDMutex sync.Mutex
+	requestIDs     map[string]bool
+
+	// serialises 'set_access_token' requests
+	tokenMutex sync.Mutex
+
+	// the rooms the client has subscribed to with 'subscribe_rooms', and the
+	// filter they were added to, which is restored once there are none left.
+	// roomsBaseFilterDef is its definition, if it has been needed.
+	subscriptionMutex  sync.Mutex
+	subscribedRooms    map[string]bool
+	roomsBaseFilter    string
+	roomsBaseFilterDef []byte
+
+	// why the connection is closing, for the close counter; guarded by
+	// closeMutex.
+	closeMutex sync.Mutex
+	closeCode  int
+	closeCause string
+
+	// the sequence number of the last frame sent; only used by the writer
+	lastSeq uint64
+
+	// the number of transaction IDs generated for 'send' requests
+	lastTxnID uint64
+
+	// receipts queued by the client with 'queue_receipt'
+	receipts receiptQueue
+
+	// If non-zero, queued receipts are sent at this interval. They are also
+	// sent on request, and when the client closes the connection.
+	ReceiptFlushInterval time.Duration
+
+	// The endpoint prefixes (relative to '_matrix/client/') which may be
+	// accessed with the 'cs_api' method. If empty, the method is disabled.
+	CSAPIPrefixes []string
+
+	// The maximum size of the content of events sent with 'send' and
+	// 'state', in bytes of JSON. Zero means no limit. The largest message
+	// the client may send is raised to allow for it.
+	MaxContentBytes int
+
+	// The only rooms the client may send events, state or receipts to, or
+	// otherwise change, for each restricted user. It is checked against the
+	// connection's current user, so it still applies after 'register_guest'.
+	RoomAllowlist RoomAllowlist
+
+	// The user the connection is for, if known, so that an admin can close
+	// the user's connections with ServeDrain. Once the connection has
+	// started, it is guarded by userMutex, since 'register_guest' sets it.
+	UserID    string
+	userMutex sync.Mutex
+
+	// The label for the connection in metrics, from TenantLabel. If empty,
+	// DefaultTenant is used.
+	Tenant string
+
+	// If true, clients may register as a guest user with 'register_guest'.
+	AllowGuest bool
+
+	// If true, sync responses which contain no events are marked with
+	// '_empty: true'.
+	MarkEmptySyncs bool
+
+	// Maps from close code to the reconnection hint sent to the client
+	// before the connection is closed with that code. If nil,
+	// DefaultReconnectHints is used.
+	ReconnectHints map[int]string
+
+	// Matches the upstream error messages which mean that the homeserver is
+	// down for maintenance, so that when a sync fails with one, the client
+	// is told to reconnect later rather than that there was an error. If
+	// nil, maintenance is not detected.
+	MaintenancePattern *regexp.Regexp
+
+	// If true, identical concurrent read requests share a single upstream
+	// request.
+	CoalesceReads bool
+
+	// the in-flight read requests, used when CoalesceReads is set
+	inflight requestGroup
+
+	// the longest timeout a client may give with the 'timeout_ms' request
+	// parameter; longer ones are reduced to this. Zero means no limit.
+	MaxRequestTimeout time.Duration
+
+	// If non-zero, a heartbeat message is sent at this interval, for clients
+	// which can't see websocket pings.
+	AppHeartbeatInterval time.Duration
+
+	// If non-zero, the minimum time between sync responses sent to the
+	// client. Events which arrive in the meantime are picked up by the next
+	// sync.
+	MinSyncInterval time.Duration
+
+	// If compression was negotiated with the client, only messages larger
+	// than this many bytes are compressed.
+	CompressThreshold int
+
+	// Whether compression was negotiated with the client. This is only used
+	// to report it to the client with SendParameters.
+	Compressed bool
+
+	// What to do when a sync fails (after any retries): SyncErrorClose or
+	// SyncErrorNotify. The default is to close the connection.
+	SyncErrorMode string
+
+	// If true, each text frame sent to the client is given a 'seq' member,
+	// which counts up from 1, so that the client can detect lost frames. It
+	// is ignored in JSON-RPC mode, whose messages can't have extra members.
+	SequenceNumbers bool
+
+	// If SyncBreakerFailures is non-zero, the connection is closed, with
+	// CloseTryAgainLater, once that many consecutive syncs have failed within
+	// SyncBreakerWindow, regardless of any remaining retries.
+	SyncBreakerFailures int
+	SyncBreakerWindow   time.Duration
+}
+
+// NextConnectionID allocates the ID for a new Connection, for use with
+// NewWithID.
+func NextConnectionID() uint64 {
+	return atomic.AddUint64(&lastConnectionID, 1)
+}
+
+// UpgradeResponseHeaders returns the headers to add to the response to the
+// websocket upgrade request for the connection with the given ID.
+func UpgradeResponseHeaders(id uint64) http.Header {
+	h := http.Header{}
+	h.Set("X-Proxy-Version", Version)
+	h.Set("X-Connection-Id", strconv.FormatUint(id, 10))
+	return h
 }
 
 // New creates a new Connection for an incoming websocket upgrade request
-func New(syncer *Syncer, ws *websocket.Conn) *Connection {
+func New(syncer SyncRequestor, client *MatrixClient, ws *websocket.Conn) *Connection {
+	return NewWithID(NextConnectionID(), syncer, client, ws)
+}
+
+// NewWithID is like New, but uses an ID previously allocated with
+// NextConnectionID.
+func NewWithID(id uint64, syncer SyncRequestor, client *MatrixClient, ws *websocket.Conn) *Connection {
 	if syncer == nil {
 		log.Fatalln("nil value passed as syncer to proxy.New()")
 	}
+	if client == nil {
+		log.Fatalln("nil value passed as client to proxy.New()")
+	}
 	if ws == nil {
 		log.Fatalln("nil value passed as ws to proxy.New()")
 	}
 
-	return &Connection{
-		ws:     ws,
-		send:   make(chan message, 256),
-		quit:   make(chan struct{}),
-		syncer: syncer,
+	ctx, cancel := context.WithCancel(context.Background())
+
+	c := &Connection{
+		id:             id,
+		ws:             ws,
+		send:           make(chan message, sendBufferSize),
+		quit:           make(chan struct{}),
+		writerStopped:  make(chan struct{}),
+		refreshed:      make(chan struct{}, 1),
+		requestCtx:     ctx,
+		cancelRequests: cancel,
+		syncer:         syncer,
+		client:         client,
+
+		CloseGracePeriod: defaultCloseGracePeriod,
 	}
+	// the initial sync is sent as soon as the connection is created
+	c.markEventsDelivered(time.Now())
+	return c
 }
 
+// SendMessage queues a message to be sent to the client. It does nothing if
+// the connection has stopped.
 func (c *Connection) SendMessage(body []byte) {
-	c.send <- message{
-		websocket.TextMessage,
-		body,
+	c.queue(message{
+		messageType: websocket.TextMessage,
+		body:        body,
+	})
+}
+
+// SendSyncResponse queues the latest sync response to be sent to the client.
+// Once it has been written, its 'next_batch' is committed to the syncer, so
+// that a saved sync position never skips a response the client did not get.
+//
+// It must not be called concurrently with the syncer's MakeRequest.
+func (c *Connection) SendSyncResponse(body []byte) {
+	c.sendSync(body, priorityHigh)
+}
+
+// GzipInitialSyncProtocol is the websocket subprotocol with which clients
+// ask for the initial sync response to be compressed with
+// SendGzippedSyncResponse. Apart from that, it is the same as "m.json".
+const GzipInitialSyncProtocol = "m.json.gzip-initial"
+
+// SendGzippedSyncResponse is like SendSyncResponse, but sends the response
+// gzip-compressed, in a binary message. It is intended for sending the
+// initial sync, which is often large, to clients which can't negotiate
+// per-message compression.
+func (c *Connection) SendGzippedSyncResponse(body []byte) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	// writes to a bytes.Buffer can't fail
+	zw.Write(body)
+	zw.Close()
+	c.queueSync(websocket.BinaryMessage, buf.Bytes(), priorityHigh)
+}
+
+// sendSync is like SendSyncResponse, but with the given priority. Low
+// priority messages are dropped if the send buffer is saturated.
+func (c *Connection) sendSync(body []byte, priority messagePriority) {
+	c.queueSync(websocket.TextMessage, body, priority)
+}
+
+// queueSync queues a message containing a sync response, to be sent with
+// the given priority.
+func (c *Connection) queueSync(messageType int, body []byte, priority messagePriority) {
+	if priority == priorityLow && c.sendSaturated() {
+		logDebug("Send buffer saturated; dropping low priority message")
+		return
+	}
+	m := message{
+		messageType: messageType,
+		body:        body,
+		priority:    priority,
 	}
+	if cc, ok := c.syncer.(cursorCommitter); ok {
+		m.cursor = cc.FetchedCursor()
+	}
+	c.queue(m)
+}
+
+// a cursorCommitter is a SyncRequestor which distinguishes the sync position
+// it has fetched up to from the one the client has been sent.
+type cursorCommitter interface {
+	// FetchedCursor returns the 'next_batch' of the latest response.
+	FetchedCursor() string
+
+	// CommitCursor records that the response with the given 'next_batch'
+	// has been sent to the client.
+	CommitCursor(cursor string)
+}
+
+// sendSaturated returns true if so many messages are waiting to be sent that
+// low priority ones should be dropped.
+func (c *Connection) sendSaturated() bool {
+	return len(c.send) >= lowPrioritySendLimit
 }
 
 func (c *Connection) SendClose(closeCode int, text string) {
 	// XXX: we're allowed to send control frames from any thread, so it
 	// might be easier to write the message directly to the web socket.
-	c.send <- message{
-		websocket.CloseMessage,
-		websocket.FormatCloseMessage(closeCode, text),
+	c.queue(message{
+		messageType: websocket.CloseMessage,
+		body:        websocket.FormatCloseMessage(closeCode, text),
+	})
+}
+
+// queue adds a message to the send channel, unless the connection or its
+// writer has stopped, in which case nobody is going to send it.
+func (c *Connection) queue(m message) {
+	select {
+	case c.send <- m:
+	case <-c.quit:
+	case <-c.writerStopped:
 	}
 }
 
+// ID returns the unique ID of the connection.
+func (c *Connection) ID() uint64 {
+	return c.id
+}
+
+// Done returns a channel which is closed when the connection stops.
+func (c *Connection) Done() <-chan struct{} {
+	return c.quit
+}
+
+// Start starts the goroutines which run the connection. Messages queued
+// before it is called, such as the initial sync, are sent ahead of the
+// responses to any requests from the client, since those are only read once
+// the reader has started here.
 func (c *Connection) Start() {
+	registerConnection(c)
 	go c.writePump()
 	go c.syncPump()
 	go c.reader()
+	if c.ReceiptFlushInterval > 0 {
+		go c.receiptFlusher()
+	}
 }
 
 // syncPump repeatedly calls /sync and writes the results to the messageSend
 // channel.
 func (c *Connection) syncPump() {
-	log.Println("Starting sync pump")
-	defer log.Println("Sync pump stopped")
+	logDebug("Starting sync pump")
+	defer logDebug("Sync pump stopped")
+
+	retries := 0
+	backoff := syncRetryBackoff
+
+	// the times of the consecutive sync failures, for the circuit breaker
+	var failures []time.Time
 
 	for {
 		// check that it's not time to exit
@@ -113,10 +487,42 @@ func (c *Connection) syncPump() {
 		default:
 		}
 
-		body, err := c.syncer.MakeRequest()
+		body, err, cancelled := c.makeSyncRequest()
+		if cancelled {
+			// either the client asked for a refresh, in which case we go
+			// round again with an immediate sync, or we are stopping.
+			continue
+		}
 
 		if err != nil {
-			log.Println("Error performing sync", err)
+			logWarn("Error performing sync", err)
+
+			failures = c.recordSyncFailure(failures, time.Now())
+			if c.SyncBreakerFailures > 0 && len(failures) >= c.SyncBreakerFailures {
+				logWarnf("%d syncs failed within %v; closing connection\n",
+					len(failures), c.SyncBreakerWindow)
+				if c.isMaintenanceError(err) {
+					c.closeForSyncError(err)
+					return
+				}
+				c.recordClose(websocket.CloseTryAgainLater, syncErrorCause(err))
+				c.closeWithHint(websocket.CloseTryAgainLater, truncateCloseText(
+					fmt.Sprintf("%d consecutive sync failures: %v", len(failures), err)),
+					retryAfterOf(err))
+				return
+			}
+
+			if retries < c.MaxSyncRetries && isRetryableSyncError(err) {
+				retries++
+				wait := syncRetryWait(backoff, err)
+				logInfof("Retrying sync in %v (attempt %d of %d)\n",
+					wait, retries, c.MaxSyncRetries)
+				if !c.waitForSyncRetry(wait) {
+					return
+				}
+				backoff = nextSyncRetryBackoff(backoff)
+				continue
+			}
 
 			// unpack url.Error, whose stringification contains a lot of
 			// useless info
@@ -125,40 +531,273 @@ func (c *Connection) syncPump() {
 				err = err.(*url.Error).Err
 			}
 
-			// we are constrained to 125 characters in the close message, so
-			// trim the error string.
-			errmsg := err.Error()
-			if len(errmsg) > 100 {
-				errmsg = errmsg[:100] + "..."
+			if c.SyncErrorMode == SyncErrorNotify && !isPermanentSyncError(err) {
+				c.notifySyncError(err)
+				wait := syncRetryWait(backoff, err)
+				logInfof("Retrying sync in %v\n", wait)
+				if !c.waitForSyncRetry(wait) {
+					return
+				}
+				backoff = nextSyncRetryBackoff(backoff)
+				continue
 			}
 
-			c.SendClose(websocket.CloseInternalServerErr, errmsg)
+			c.closeForSyncError(err)
 			return
 		}
 
-		c.SendMessage(body)
+		retries = 0
+		backoff = syncRetryBackoff
+		failures = failures[:0]
+		if atomic.LoadInt32(&c.presenceMuted) != 0 {
+			body = stripPresence(body)
+		}
+		// empty syncs tell the client nothing, so can be dropped if it is
+		// falling behind.
+		if isEmptySync(body) {
+			if c.MarkEmptySyncs {
+				body = insertEmptyMarker(body)
+			}
+			c.sendSync(body, priorityLow)
+		} else {
+			c.markEventsDelivered(time.Now())
+			c.sendSync(body, priorityHigh)
+		}
+
+		if c.MinSyncInterval > 0 {
+			select {
+			case <-c.quit:
+				return
+			case <-time.After(c.MinSyncInterval):
+			}
+		}
+	}
+}
+
+// closeForSyncError closes the connection after a sync failed with the given
+// error, telling the client how to reconnect.
+func (c *Connection) closeForSyncError(err error) {
+	closeCode := c.syncErrorCloseCode(err)
+	c.recordClose(closeCode, syncErrorCause(err))
+	c.closeWithReconnectHint(closeCode, c.syncErrorReconnectHint(err),
+		c.syncErrorCloseText(err), c.syncErrorRetryAfter(err))
+}
+
+// recordSyncFailure adds a sync failure at the given time to the list of
+// consecutive failures, dropping any which are outside the circuit breaker's
+// window.
+func (c *Connection) recordSyncFailure(failures []time.Time, now time.Time) []time.Time {
+	failures = append(failures, now)
+	if c.SyncBreakerWindow <= 0 {
+		return failures
 	}
+	for len(failures) > 0 && now.Sub(failures[0]) > c.SyncBreakerWindow {
+		failures = failures[1:]
+	}
+	return failures
+}
+
+// truncateCloseText trims the text for a close message: we are constrained to
+// 125 bytes in the close frame, including the code.
+func truncateCloseText(text string) string {
+	if len(text) > 100 {
+		return text[:100] + "..."
+	}
+	return text
+}
+
+// waitForSyncRetry waits for the given time before a failed sync is retried,
+// or until the client asks for a refresh. It returns false if the connection
+// stops in the meantime.
+func (c *Connection) waitForSyncRetry(d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	for {
+		select {
+		case <-c.quit:
+			return false
+		case <-c.refreshed:
+			// the signal may be left over from a refresh which the failed
+			// request already dealt with, in which case keep waiting
+			if atomic.LoadInt32(&c.refreshRequested) != 0 {
+				return true
+			}
+		case <-timer.C:
+			return true
+		}
+	}
+}
+
+// nextSyncRetryBackoff returns the time to wait before the next retry of a
+// failed sync, given the time waited before the last one.
+func nextSyncRetryBackoff(backoff time.Duration) time.Duration {
+	backoff *= 2
+	if backoff > maxSyncRetryBackoff {
+		backoff = maxSyncRetryBackoff
+	}
+	return backoff
+}
+
+// syncRetryWait returns the time to wait before retrying a sync which failed
+// with the given error: the backoff, unless the upstream server asked us to
+// wait longer.
+func syncRetryWait(backoff time.Duration, err error) time.Duration {
+	if retryAfter := retryAfterOf(err); retryAfter > backoff {
+		return retryAfter
+	}
+	return backoff
+}
+
+// isPermanentSyncError returns true if retrying a sync which failed with the
+// given error will not help, so the connection should be closed even in
+// SyncErrorNotify mode: an invalid access token, or any other 4xx response
+// other than rate limiting.
+func isPermanentSyncError(err error) bool {
+	if isAuthError(err) {
+		return true
+	}
+	var status int
+	switch e := err.(type) {
+	case *MatrixError:
+		status = e.StatusCode
+	case *HTTPError:
+		status = e.StatusCode
+	}
+	return status >= 400 && status < 500 && status != http.StatusTooManyRequests
+}
+
+// notifySyncError sends the client a message describing an error from a sync,
+// in SyncErrorNotify mode. In JSON-RPC mode, this is a 'sync_error'
+// notification.
+func (c *Connection) notifySyncError(err error) {
+	var v interface{} = map[string]interface{}{"error": errorToResponse(err)}
+	if c.JSONRPC {
+		v = jsonRPCNotification{JSONRPC: "2.0", Method: "sync_error", Params: v}
+	}
+	msg, merr := json.Marshal(v)
+	if merr != nil {
+		logError("Error marshalling:", merr)
+		return
+	}
+	c.SendMessage(msg)
+}
+
+// makeSyncRequest makes the next sync request, in such a way that it can be
+// cancelled by refreshSync, or by the connection stopping. cancelled is true
+// if the request was cancelled.
+func (c *Connection) makeSyncRequest() (body []byte, err error, cancelled bool) {
+	baseCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go func() {
+		select {
+		case <-c.quit:
+			cancel()
+		case <-baseCtx.Done():
+		}
+	}()
+
+	c.syncMutex.Lock()
+	c.syncCancel = cancel
+	c.syncMutex.Unlock()
+
+	ctx := baseCtx
+	if atomic.SwapInt32(&c.refreshRequested, 0) != 0 {
+		ctx = withImmediateSync(ctx)
+	}
+
+	body, err = c.syncer.MakeRequest(ctx)
+
+	c.syncMutex.Lock()
+	c.syncCancel = nil
+	c.syncMutex.Unlock()
+
+	if err != nil && ctx.Err() == context.Canceled {
+		return nil, err, true
+	}
+	return body, err, false
+}
+
+// refreshSync cancels any in-flight sync request, so that the sync pump
+// immediately makes a new request which returns the current state without
+// waiting for new events.
+func (c *Connection) refreshSync() {
+	atomic.StoreInt32(&c.refreshRequested, 1)
+
+	// cut short any wait before retrying a failed sync
+	select {
+	case c.refreshed <- struct{}{}:
+	default:
+	}
+
+	c.syncMutex.Lock()
+	defer c.syncMutex.Unlock()
+	if c.syncCancel != nil {
+		c.syncCancel()
+	}
+}
+
+// isRetryableSyncError returns true if the given error from a sync is a
+// (presumably transient) 5xx or 429 response from the upstream server.
+func isRetryableSyncError(err error) bool {
+	switch err.(type) {
+	case *MatrixError:
+		return isRetryableStatus(err.(*MatrixError).StatusCode)
+	case *HTTPError:
+		return isRetryableStatus(err.(*HTTPError).StatusCode)
+	}
+	return false
+}
+
+// isRetryableStatus returns true if a sync which failed with the given HTTP
+// status is worth retrying: server errors, and rate limiting, after which we
+// wait as long as the server asks.
+func isRetryableStatus(status int) bool {
+	return status >= 500 || status == http.StatusTooManyRequests
 }
 
 // writePump pumps messages out to the websocket connection, and takes
 // responsibility for sending pings.
 func (c *Connection) writePump() {
-	defer func() { log.Println("Writer stopped") }()
+	defer func() { logDebug("Writer stopped") }()
+	defer close(c.writerStopped)
 
 	// start a ticker for sending pings
 	ticker := time.NewTicker(pingPeriod)
 	defer ticker.Stop()
 
+	// and one for sending heartbeats, if enabled
+	var heartbeats <-chan time.Time
+	if c.AppHeartbeatInterval > 0 {
+		heartbeatTicker := time.NewTicker(c.AppHeartbeatInterval)
+		defer heartbeatTicker.Stop()
+		heartbeats = heartbeatTicker.C
+	}
+
 	for {
 		select {
 		case <-c.quit:
 			return
 
 		case message := <-c.send:
+			if message.priority == priorityLow && c.sendSaturated() {
+				// this has been overtaken by more messages since it was
+				// queued.
+				logDebug("Send buffer saturated; dropping low priority message")
+				continue
+			}
 			if err := c.write(message.messageType, message.body); err != nil {
 				return
 			}
+			if message.cursor != "" {
+				c.syncer.(cursorCommitter).CommitCursor(message.cursor)
+			}
 			if message.messageType == websocket.CloseMessage {
+				// don't wait for the full pong timeout for the peer to
+				// respond: the reader will stop (and close the socket) if
+				// the response doesn't arrive within the grace period.
+				c.ws.SetReadDeadline(time.Now().Add(c.CloseGracePeriod))
+
 				// any further attempts to write messages will fail with an
 				// error, so we may as well give up now
 				return
@@ -168,22 +807,64 @@ func (c *Connection) writePump() {
 			if err := c.write(websocket.PingMessage, nil); err != nil {
 				return
 			}
+
+		case now := <-heartbeats:
+			// the queued messages will show that the connection is alive
+			if c.sendSaturated() {
+				continue
+			}
+			if err := c.write(websocket.TextMessage, heartbeatMessage(now)); err != nil {
+				return
+			}
 		}
 	}
 }
 
+// heartbeatMessage returns the body of an application-level heartbeat sent
+// at the given time.
+func heartbeatMessage(now time.Time) []byte {
+	return []byte(fmt.Sprintf(`{"type":"heartbeat","ts":%d}`,
+		now.UnixNano()/int64(time.Millisecond)))
+}
+
 // helper for writePump: writes a message with the given message type and payload.
 func (c *Connection) write(messageType int, payload []byte) error {
+	// numbering the frames here means that the numbers are in the order in
+	// which the client receives them
+	if c.SequenceNumbers && !c.JSONRPC && messageType == websocket.TextMessage {
+		c.lastSeq++
+		payload = prependJSONMember(payload, fmt.Sprintf(`"seq":%d`, c.lastSeq))
+	}
 	c.ws.SetWriteDeadline(time.Now().Add(writeWait))
+	// this is a no-op unless compression was negotiated
+	c.ws.EnableWriteCompression(len(payload) > c.CompressThreshold)
 	err := c.ws.WriteMessage(messageType, payload)
 	if err != nil {
-		log.Println("Error sending message:", err)
+		logError("Error sending message:", err)
+	} else if messageType == websocket.TextMessage || messageType == websocket.BinaryMessage {
+		// binary frames carry the gzipped initial sync
+		c.countMessage(false)
 	}
 	return err
 }
 
+// maxMessageBytes returns the largest message the client may send, which
+// leaves room for content of up to MaxContentBytes, so that content just
+// over that gets an M_TOO_LARGE error rather than closing the connection.
+func (c *Connection) maxMessageBytes() int {
+	if c.MaxContentBytes > 0 {
+		return maxMessageBytes + c.MaxContentBytes
+	}
+	return maxMessageBytes
+}
+
 func (c *Connection) reader() {
-	defer log.Println("Reader stopped")
+	defer logDebug("Reader stopped")
+
+	// count the reason for the connection closing
+	defer c.countConnectionClose()
+
+	defer unregisterConnection(c)
 
 	// close the socket when we exit
 	defer c.ws.Close()
@@ -191,21 +872,31 @@ func (c *Connection) reader() {
 	// tell the syncPump to close when we exit
 	defer close(c.quit)
 
-	c.ws.SetReadLimit(maxMessageBytes)
+	// abandon any requests being made by handlers
+	defer c.cancelRequests()
+
+	c.ws.SetReadLimit(int64(c.maxMessageBytes()))
 	c.ws.SetReadDeadline(time.Now().Add(pongWait))
 	c.ws.SetPongHandler(func(string) error { c.ws.SetReadDeadline(time.Now().Add(pongWait)); return nil })
 	for {
 		_, message, err := c.ws.ReadMessage()
 		if err != nil {
+			c.recordClose(readErrorCause(err))
 			switch err.(type) {
 			case *websocket.CloseError:
 				closeErr := err.(*websocket.CloseError)
-				log.Printf("Socket closed %v; stopping reader\n", *closeErr)
+				logInfof("Socket closed %v; stopping reader\n", *closeErr)
+
+				// the client has gone away cleanly, so send anything it
+				// had queued up. This must happen before the client's
+				// requests are cancelled.
+				c.flushReceipts()
 			default:
-				log.Println("Error in reader:", err)
+				logWarn("Error in reader:", err)
 			}
 			return
 		}
+		c.countMessage(true)
 		go c.handleMessage(message)
 	}
 }
@@ -213,9 +904,15 @@ func (c *Connection) reader() {
 // handleMessage processes a message received from the websocket: it determines
 // the correct response, and sends it.
 func (c *Connection) handleMessage(message []byte) {
-	log.Println("Got message:", string(message))
+	logDebug("Got message:", string(message))
 
-	if response := handleRequest(message); response != nil {
+	var response []byte
+	if c.JSONRPC {
+		response = c.handleJSONRPCRequest(message)
+	} else {
+		response = c.handleRequest(message)
+	}
+	if response != nil {
 		c.SendMessage(response)
 	}
 }
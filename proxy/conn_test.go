@@ -0,0 +1,1020 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// makeWsConn starts a websocket server which wraps each incoming connection
+// in a Connection talking to the given upstream server, and connects to it.
+//
+// setup, if non-nil, is called on the Connection before it is started.
+//
+// It returns the client end of the websocket, and a function to tidy up.
+func makeWsConn(t *testing.T, upstream *httptest.Server, setup func(c *Connection)) (*websocket.Conn, func()) {
+	return dialWsConn(t, upstream, websocket.DefaultDialer, setup)
+}
+
+// dialWsConn is like makeWsConn, but connects with the given Dialer.
+// Compression is enabled on the server side, so is used if the Dialer asks
+// for it.
+func dialWsConn(t *testing.T, upstream *httptest.Server, dialer *websocket.Dialer, setup func(c *Connection)) (*websocket.Conn, func()) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upgrader := websocket.Upgrader{EnableCompression: true}
+		id := NextConnectionID()
+		ws, err := upgrader.Upgrade(w, r, UpgradeResponseHeaders(id))
+		if err != nil {
+			t.Error("Error upgrading:", err)
+			return
+		}
+
+		client := NewMatrixClient(upstream.URL+"/", "token")
+		syncer := &Syncer{Client: client, SyncParams: url.Values{}}
+		c := NewWithID(id, syncer, client, ws)
+		if setup != nil {
+			setup(c)
+		}
+		c.Start()
+	}))
+
+	wsURL := "ws" + strings.TrimPrefix(srv.URL, "http")
+	ws, _, err := dialer.Dial(wsURL, nil)
+	if err != nil {
+		srv.Close()
+		t.Fatal("Error connecting to websocket:", err)
+	}
+
+	return ws, func() {
+		ws.Close()
+		srv.Close()
+	}
+}
+
+func TestSyncRetriesOn5xx(t *testing.T) {
+	defer func(b time.Duration) { syncRetryBackoff = b }(syncRetryBackoff)
+	syncRetryBackoff = time.Millisecond
+
+	var mutex sync.Mutex
+	syncs := 0
+	done := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		syncs++
+		n := syncs
+		mutex.Unlock()
+
+		if n <= 2 {
+			w.WriteHeader(503)
+			w.Write([]byte("Service Unavailable"))
+			return
+		}
+		if n > 3 {
+			// hold subsequent syncs until the test finishes
+			<-done
+			return
+		}
+		w.Write([]byte(`{"next_batch": "s3"}`))
+	}))
+	defer upstream.Close()
+	defer close(done)
+
+	ws, cleanup := makeWsConn(t, upstream, func(c *Connection) {
+		c.MaxSyncRetries = 2
+	})
+	defer cleanup()
+
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	msgType, msg, err := ws.ReadMessage()
+	if err != nil {
+		t.Fatal("Expected a sync frame, got error:", err)
+	}
+	if msgType != websocket.TextMessage || string(msg) != `{"next_batch": "s3"}` {
+		t.Errorf("Unexpected frame (type %d): %s", msgType, msg)
+	}
+}
+
+func TestSyncClosesAfterRetries(t *testing.T) {
+	defer func(b time.Duration) { syncRetryBackoff = b }(syncRetryBackoff)
+	syncRetryBackoff = time.Millisecond
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(502)
+		w.Write([]byte("Bad Gateway"))
+	}))
+	defer upstream.Close()
+
+	ws, cleanup := makeWsConn(t, upstream, func(c *Connection) {
+		c.MaxSyncRetries = 2
+	})
+	defer cleanup()
+
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, msg, err := ws.ReadMessage()
+	if err != nil {
+		t.Fatal("Error reading reconnect hint:", err)
+	}
+	if string(msg) != `{"reconnect":"backoff"}` {
+		t.Errorf("Unexpected message %s", msg)
+	}
+
+	_, _, err = ws.ReadMessage()
+	closeErr, ok := err.(*websocket.CloseError)
+	if !ok {
+		t.Fatalf("Expected a close error, got %v", err)
+	}
+	if closeErr.Code != websocket.CloseInternalServerErr {
+		t.Errorf("Expected close code %d, got %d", websocket.CloseInternalServerErr,
+			closeErr.Code)
+	}
+}
+
+func TestCloseGracePeriod(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(400)
+		w.Write([]byte(`{"errcode": "M_UNKNOWN", "error": "Bad request"}`))
+	}))
+	defer upstream.Close()
+
+	ws, cleanup := makeWsConn(t, upstream, func(c *Connection) {
+		c.CloseGracePeriod = 50 * time.Millisecond
+	})
+	defer cleanup()
+
+	// don't respond to the close message
+	ws.SetCloseHandler(func(int, string) error { return nil })
+
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, _, err := ws.ReadMessage(); err != nil {
+		t.Fatal("Expected reconnect hint:", err)
+	}
+	if _, _, err := ws.ReadMessage(); err == nil {
+		t.Fatal("Expected close message")
+	}
+
+	// now wait for the server to close the socket
+	start := time.Now()
+	ws.UnderlyingConn().SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := ws.UnderlyingConn().Read(make([]byte, 1)); err == nil {
+		t.Fatal("Expected the socket to be closed")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Socket was not closed within the grace period (took %v)", elapsed)
+	}
+}
+
+func TestRefresh(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("timeout") != "0" {
+			// a long-poll: wait until it is cancelled
+			<-r.Context().Done()
+			return
+		}
+		w.Write([]byte(`{"next_batch": "s2"}`))
+	}))
+	defer upstream.Close()
+
+	ws, cleanup := makeWsConn(t, upstream, func(c *Connection) {
+		c.syncer.(*Syncer).SyncParams.Set("timeout", "60000")
+	})
+	defer cleanup()
+
+	// give the sync pump a chance to start its long-poll
+	time.Sleep(50 * time.Millisecond)
+	ws.WriteMessage(websocket.TextMessage, []byte(`{"id": "1", "method": "refresh"}`))
+
+	expected := map[string]bool{
+		`{"id":"1","result":{}}`: true,
+		`{"next_batch": "s2"}`:   true,
+	}
+	ws.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for len(expected) > 0 {
+		_, msg, err := ws.ReadMessage()
+		if err != nil {
+			t.Fatalf("Error reading; still expecting %v: %v", expected, err)
+		}
+		if !expected[string(msg)] {
+			t.Errorf("Unexpected message %s", msg)
+		}
+		delete(expected, string(msg))
+	}
+}
+
+func TestRequestImmediatelyAfterUpgrade(t *testing.T) {
+	done := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-done
+	}))
+	defer upstream.Close()
+	defer close(done)
+
+	ws, cleanup := makeWsConn(t, upstream, nil)
+	defer cleanup()
+
+	ws.WriteMessage(websocket.TextMessage, []byte(`{"id": "1", "method": "ping"}`))
+
+	ws.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, msg, err := ws.ReadMessage()
+	if err != nil {
+		t.Fatal("Error reading response:", err)
+	}
+	if string(msg) != `{"id":"1","result":{}}` {
+		t.Errorf("Unexpected response %s", msg)
+	}
+}
+
+func TestDisconnectCancelsHandlerRequests(t *testing.T) {
+	cancelled := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.Path, "/send/") {
+			// the server only notices the client going away once the
+			// body has been read
+			ioutil.ReadAll(r.Body)
+			<-r.Context().Done()
+			close(cancelled)
+			return
+		}
+		// a long-poll sync: wait until it is cancelled
+		<-r.Context().Done()
+	}))
+	defer upstream.Close()
+
+	ws, cleanup := makeWsConn(t, upstream, nil)
+	defer cleanup()
+
+	ws.WriteMessage(websocket.TextMessage, []byte(`{"id": "1", "method": "send", "params": {"room_id": "!room:test", "event_type": "m.room.message", "content": {}}}`))
+
+	// give the handler a chance to start its request, then drop the socket
+	time.Sleep(50 * time.Millisecond)
+	ws.Close()
+
+	select {
+	case <-cancelled:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Upstream request was not cancelled")
+	}
+}
+
+func TestAppHeartbeats(t *testing.T) {
+	done := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-done
+	}))
+	defer upstream.Close()
+	defer close(done)
+
+	ws, cleanup := makeWsConn(t, upstream, func(c *Connection) {
+		c.AppHeartbeatInterval = 50 * time.Millisecond
+	})
+	defer cleanup()
+
+	heartbeat := regexp.MustCompile(`^{"type":"heartbeat","ts":\d+}$`)
+	start := time.Now()
+	ws.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for i := 0; i < 3; i++ {
+		_, msg, err := ws.ReadMessage()
+		if err != nil {
+			t.Fatal("Error reading heartbeat:", err)
+		}
+		if !heartbeat.Match(msg) {
+			t.Errorf("Unexpected message %s", msg)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond || elapsed > time.Second {
+		t.Errorf("Expected 3 heartbeats in about 150ms, took %v", elapsed)
+	}
+}
+
+func TestMinSyncInterval(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"next_batch": "s1"}`))
+	}))
+	defer upstream.Close()
+
+	const interval = 50 * time.Millisecond
+	ws, cleanup := makeWsConn(t, upstream, func(c *Connection) {
+		c.MinSyncInterval = interval
+	})
+	defer cleanup()
+
+	ws.SetReadDeadline(time.Now().Add(2 * time.Second))
+	var last time.Time
+	for i := 0; i < 4; i++ {
+		if _, _, err := ws.ReadMessage(); err != nil {
+			t.Fatal("Error reading sync:", err)
+		}
+		now := time.Now()
+		if i > 0 && now.Sub(last) < interval*9/10 {
+			t.Errorf("Sync responses only %v apart", now.Sub(last))
+		}
+		last = now
+	}
+}
+
+// a recordingConn records everything read from the underlying connection.
+type recordingConn struct {
+	net.Conn
+	mutex sync.Mutex
+	read  []byte
+}
+
+func (c *recordingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.mutex.Lock()
+	c.read = append(c.read, b[:n]...)
+	c.mutex.Unlock()
+	return n, err
+}
+
+// compressedFrames parses the websocket frames from the server in the data
+// read by a recordingConn, and returns whether each one was compressed.
+func (c *recordingConn) compressedFrames() []bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	// skip the HTTP response
+	data := c.read[bytes.Index(c.read, []byte("\r\n\r\n"))+4:]
+
+	var frames []bool
+	for len(data) >= 2 {
+		// frames from the server are not masked
+		compressed := data[0]&0x40 != 0
+		length := int(data[1] & 0x7f)
+		header := 2
+		switch length {
+		case 126:
+			length = int(binary.BigEndian.Uint16(data[2:4]))
+			header = 4
+		case 127:
+			length = int(binary.BigEndian.Uint64(data[2:10]))
+			header = 10
+		}
+		frames = append(frames, compressed)
+		data = data[header+length:]
+	}
+	return frames
+}
+
+func TestCompressThreshold(t *testing.T) {
+	bigSync := `{"next_batch": "s1", "rooms": {"join": {"!room:test": {"timeline": {"events": [` +
+		strings.Repeat(`{"type": "m.room.message", "content": {"body": "hello"}},`, 20) +
+		`{}]}}}}}`
+	done := make(chan struct{})
+	var syncs int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&syncs, 1) > 1 {
+			<-done
+			return
+		}
+		w.Write([]byte(bigSync))
+	}))
+	defer upstream.Close()
+	defer close(done)
+
+	var conn *recordingConn
+	dialer := &websocket.Dialer{
+		EnableCompression: true,
+		NetDial: func(network, addr string) (net.Conn, error) {
+			c, err := net.Dial(network, addr)
+			conn = &recordingConn{Conn: c}
+			return conn, err
+		},
+	}
+	ws, cleanup := dialWsConn(t, upstream, dialer, func(c *Connection) {
+		c.CompressThreshold = 100
+	})
+	defer cleanup()
+
+	ws.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, msg, err := ws.ReadMessage(); err != nil || string(msg) != bigSync {
+		t.Fatalf("Unexpected sync response %s (error %v)", msg, err)
+	}
+	ws.WriteMessage(websocket.TextMessage, []byte(`{"id": "1", "method": "ping"}`))
+	if _, msg, err := ws.ReadMessage(); err != nil || string(msg) != `{"id":"1","result":{}}` {
+		t.Fatalf("Unexpected ping response %s (error %v)", msg, err)
+	}
+
+	frames := conn.compressedFrames()
+	if len(frames) != 2 || !frames[0] || frames[1] {
+		t.Errorf("Expected the sync to be compressed and the ping response not, got %v", frames)
+	}
+}
+
+func TestUpgradeResponseHeaders(t *testing.T) {
+	done := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-done
+	}))
+	defer upstream.Close()
+	defer close(done)
+
+	var conn *recordingConn
+	dialer := &websocket.Dialer{
+		NetDial: func(network, addr string) (net.Conn, error) {
+			c, err := net.Dial(network, addr)
+			conn = &recordingConn{Conn: c}
+			return conn, err
+		},
+	}
+	ids := make(chan uint64, 1)
+	_, cleanup := dialWsConn(t, upstream, dialer, func(c *Connection) {
+		ids <- c.ID()
+	})
+	defer cleanup()
+
+	conn.mutex.Lock()
+	resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(conn.read)), nil)
+	conn.mutex.Unlock()
+	if err != nil {
+		t.Fatal("Error parsing upgrade response:", err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Errorf("Unexpected status %d", resp.StatusCode)
+	}
+	if v := resp.Header.Get("X-Proxy-Version"); v != Version {
+		t.Errorf("Expected X-Proxy-Version %s, got %s", Version, v)
+	}
+	expectedID := fmt.Sprint(<-ids)
+	if id := resp.Header.Get("X-Connection-Id"); id != expectedID {
+		t.Errorf("Expected X-Connection-Id %s, got %s", expectedID, id)
+	}
+}
+
+// a failingSyncer fails the first 'failures' requests, and then returns a
+// fixed response. Subsequent requests wait until they are cancelled.
+type failingSyncer struct {
+	mutex     sync.Mutex
+	failures  int
+	succeeded bool
+
+	// the error to fail with, if not a 500
+	err error
+}
+
+func (s *failingSyncer) MakeRequest(ctx context.Context) ([]byte, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.failures > 0 {
+		s.failures--
+		if s.err != nil {
+			return nil, s.err
+		}
+		return nil, &MatrixError{
+			HTTPError{StatusCode: 500, ContentType: "application/json"},
+			MatrixErrorDetails{ErrCode: "M_UNKNOWN", Error: "Internal error"},
+		}
+	}
+	if !s.succeeded {
+		s.succeeded = true
+		return []byte(`{"next_batch": "s1"}`), nil
+	}
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestSyncErrorModes(t *testing.T) {
+	defer func(b time.Duration) { syncRetryBackoff = b }(syncRetryBackoff)
+	syncRetryBackoff = time.Millisecond
+
+	done := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-done
+	}))
+	defer upstream.Close()
+	defer close(done)
+
+	// in close mode, the reconnect hint and close message are sent
+	ws, cleanup := makeWsConn(t, upstream, func(c *Connection) {
+		c.syncer = &failingSyncer{failures: 1}
+		c.SyncErrorMode = SyncErrorClose
+	})
+	defer cleanup()
+
+	ws.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, msg, err := ws.ReadMessage(); err != nil || string(msg) != `{"reconnect":"backoff"}` {
+		t.Errorf("Unexpected message %s (error %v)", msg, err)
+	}
+	if _, _, err := ws.ReadMessage(); err == nil {
+		t.Error("Expected close message")
+	}
+
+	// in notify mode, errors are sent as messages until the sync succeeds
+	ws, cleanup = makeWsConn(t, upstream, func(c *Connection) {
+		c.syncer = &failingSyncer{failures: 2}
+		c.SyncErrorMode = SyncErrorNotify
+	})
+	defer cleanup()
+
+	expected := []string{
+		`{"error":{"errcode":"M_UNKNOWN","error":"Internal error","status_code":500}}`,
+		`{"error":{"errcode":"M_UNKNOWN","error":"Internal error","status_code":500}}`,
+		`{"next_batch": "s1"}`,
+	}
+	ws.SetReadDeadline(time.Now().Add(3 * time.Second))
+	for _, e := range expected {
+		_, msg, err := ws.ReadMessage()
+		if err != nil {
+			t.Fatal("Error reading:", err)
+		}
+		if string(msg) != e {
+			t.Errorf("Expected %s, got %s", e, msg)
+		}
+	}
+}
+
+func TestSyncErrorNotifyMode(t *testing.T) {
+	defer func(b time.Duration) { syncRetryBackoff = b }(syncRetryBackoff)
+	syncRetryBackoff = time.Millisecond
+
+	done := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-done
+	}))
+	defer upstream.Close()
+	defer close(done)
+
+	// in JSON-RPC mode, errors are sent as notifications
+	ws, cleanup := makeWsConn(t, upstream, func(c *Connection) {
+		c.syncer = &failingSyncer{failures: 1}
+		c.SyncErrorMode = SyncErrorNotify
+		c.JSONRPC = true
+	})
+	defer cleanup()
+
+	ws.SetReadDeadline(time.Now().Add(2 * time.Second))
+	expected := `{"jsonrpc":"2.0","method":"sync_error","params":{"error":{"errcode":"M_UNKNOWN","error":"Internal error","status_code":500}}}`
+	if _, msg, err := ws.ReadMessage(); err != nil || string(msg) != expected {
+		t.Errorf("Expected %s, got %s (error %v)", expected, msg, err)
+	}
+	// wait for the retry to succeed, so that the sync pump is idle
+	if _, _, err := ws.ReadMessage(); err != nil {
+		t.Fatal("Error reading:", err)
+	}
+
+	// errors which retrying won't fix still close the connection
+	ws, cleanup = makeWsConn(t, upstream, func(c *Connection) {
+		c.syncer = &failingSyncer{failures: 100, err: &MatrixError{
+			HTTPError{StatusCode: 401, ContentType: "application/json"},
+			MatrixErrorDetails{ErrCode: "M_UNKNOWN_TOKEN", Error: "Invalid access token"},
+		}}
+		c.SyncErrorMode = SyncErrorNotify
+	})
+	defer cleanup()
+
+	ws.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, msg, err := ws.ReadMessage(); err != nil || string(msg) != `{"reconnect":"never"}` {
+		t.Errorf("Unexpected message %s (error %v)", msg, err)
+	}
+	_, _, err := ws.ReadMessage()
+	if closeErr, ok := err.(*websocket.CloseError); !ok || closeErr.Code != websocket.ClosePolicyViolation {
+		t.Errorf("Expected a policy violation close, got %v", err)
+	}
+}
+
+func TestWaitForSyncRetry(t *testing.T) {
+	c := &Connection{quit: make(chan struct{}), refreshed: make(chan struct{}, 1)}
+
+	// a signal left over from a refresh which has already been dealt with
+	// doesn't cut the wait short
+	c.refreshed <- struct{}{}
+	start := time.Now()
+	if !c.waitForSyncRetry(50 * time.Millisecond) {
+		t.Error("Expected waitForSyncRetry to return true")
+	}
+	if d := time.Since(start); d < 50*time.Millisecond {
+		t.Errorf("Expected to wait for the full time, waited %v", d)
+	}
+
+	// a new refresh does
+	c.refreshSync()
+	start = time.Now()
+	if !c.waitForSyncRetry(time.Minute) {
+		t.Error("Expected waitForSyncRetry to return true")
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("Expected the refresh to cut the wait short, waited %v", d)
+	}
+}
+
+func TestSyncCircuitBreaker(t *testing.T) {
+	defer func(b time.Duration) { syncRetryBackoff = b }(syncRetryBackoff)
+	syncRetryBackoff = time.Millisecond
+
+	done := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-done
+	}))
+	defer upstream.Close()
+	defer close(done)
+
+	syncer := &failingSyncer{failures: 100}
+	ws, cleanup := makeWsConn(t, upstream, func(c *Connection) {
+		c.syncer = syncer
+		c.SyncErrorMode = SyncErrorNotify
+		c.SyncBreakerFailures = 3
+		c.SyncBreakerWindow = time.Minute
+	})
+	defer cleanup()
+
+	expected := []string{
+		`{"error":{"errcode":"M_UNKNOWN","error":"Internal error","status_code":500}}`,
+		`{"error":{"errcode":"M_UNKNOWN","error":"Internal error","status_code":500}}`,
+		`{"reconnect":"backoff"}`,
+	}
+	ws.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for _, e := range expected {
+		_, msg, err := ws.ReadMessage()
+		if err != nil {
+			t.Fatal("Error reading:", err)
+		}
+		if string(msg) != e {
+			t.Errorf("Expected %s, got %s", e, msg)
+		}
+	}
+
+	_, _, err := ws.ReadMessage()
+	closeErr, ok := err.(*websocket.CloseError)
+	if !ok {
+		t.Fatalf("Expected a close error, got %v", err)
+	}
+	if closeErr.Code != websocket.CloseTryAgainLater {
+		t.Errorf("Expected close code %d, got %d", websocket.CloseTryAgainLater, closeErr.Code)
+	}
+	if closeErr.Text != "3 consecutive sync failures: M_UNKNOWN: Internal error" {
+		t.Errorf("Unexpected close text %q", closeErr.Text)
+	}
+
+	syncer.mutex.Lock()
+	defer syncer.mutex.Unlock()
+	if syncer.failures != 97 {
+		t.Errorf("Expected 3 sync attempts, got %d", 100-syncer.failures)
+	}
+}
+
+func TestRecordSyncFailure(t *testing.T) {
+	c := &Connection{SyncBreakerWindow: 10 * time.Second}
+	start := time.Now()
+
+	var failures []time.Time
+	failures = c.recordSyncFailure(failures, start)
+	failures = c.recordSyncFailure(failures, start.Add(5*time.Second))
+	failures = c.recordSyncFailure(failures, start.Add(12*time.Second))
+	if len(failures) != 2 {
+		t.Errorf("Expected the first failure to drop out of the window, got %v", failures)
+	}
+}
+
+func TestLowPriorityMessagesDropped(t *testing.T) {
+	c := &Connection{
+		send: make(chan message, sendBufferSize),
+		quit: make(chan struct{}),
+	}
+
+	// flood with low priority messages, interleaved with high priority ones
+	highSent := 0
+	for i := 0; i < 1000; i++ {
+		c.sendSync([]byte(`{"next_batch":"s1"}`), priorityLow)
+		if i%20 == 0 {
+			c.SendMessage([]byte(fmt.Sprintf(`{"id":"%d","result":{}}`, highSent)))
+			highSent++
+		}
+	}
+
+	if len(c.send) > sendBufferSize-1 {
+		t.Fatalf("Send buffer overfilled: %d", len(c.send))
+	}
+
+	low, high := 0, 0
+	for len(c.send) > 0 {
+		m := <-c.send
+		if m.priority == priorityLow {
+			low++
+			continue
+		}
+		expected := fmt.Sprintf(`{"id":"%d","result":{}}`, high)
+		if string(m.body) != expected {
+			t.Errorf("Expected %s, got %s", expected, m.body)
+		}
+		high++
+	}
+
+	if high != highSent {
+		t.Errorf("Expected %d high priority messages, got %d", highSent, high)
+	}
+	if low == 0 || low > lowPrioritySendLimit {
+		t.Errorf("Expected up to %d low priority messages, got %d",
+			lowPrioritySendLimit, low)
+	}
+}
+
+func TestEmptySyncsAreLowPriority(t *testing.T) {
+	syncer := NewMockSyncer([]json.RawMessage{
+		json.RawMessage(`{"next_batch":"s1","rooms":{"join":{"!room:test":{}}}}`),
+		json.RawMessage(`{"next_batch":"s2","rooms":{"join":{"!room:test":{"timeline":{"events":[{}]}}}}}`),
+	}, 0)
+	client := NewMatrixClient("http://localhost/", "token")
+
+	// no writer is started, so the sync pump fills the send buffer with
+	// further empty syncs, and then should start dropping them.
+	c := NewWithID(NextConnectionID(), syncer, client, &websocket.Conn{})
+	c.MarkEmptySyncs = true
+	go c.syncPump()
+	defer close(c.quit)
+
+	m := <-c.send
+	if m.priority != priorityLow || string(m.body) != `{"_empty":true,"next_batch":"s1","rooms":{"join":{"!room:test":{}}}}` {
+		t.Errorf("Unexpected first message %v %s", m.priority, m.body)
+	}
+	m = <-c.send
+	if m.priority != priorityHigh {
+		t.Errorf("Unexpected priority %v for non-empty sync %s", m.priority, m.body)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for len(c.send) < lowPrioritySendLimit {
+		if time.Now().After(deadline) {
+			t.Fatalf("Send buffer did not fill: %d", len(c.send))
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// the sync pump should not block, and responses should still get
+	// through
+	c.SendMessage([]byte(`{"id":"1","result":{}}`))
+	time.Sleep(10 * time.Millisecond)
+	if n := len(c.send); n != lowPrioritySendLimit+1 {
+		t.Errorf("Expected %d queued messages, got %d", lowPrioritySendLimit+1, n)
+	}
+}
+
+func TestSequenceNumbers(t *testing.T) {
+	done := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("since") == "" {
+			w.Write([]byte(`{"next_batch": "s1"}`))
+			return
+		}
+		<-done
+	}))
+	defer upstream.Close()
+	defer close(done)
+
+	// each connection has its own sequence
+	for i := 0; i < 2; i++ {
+		ws, cleanup := makeWsConn(t, upstream, func(c *Connection) {
+			c.SequenceNumbers = true
+		})
+
+		ws.SetReadDeadline(time.Now().Add(2 * time.Second))
+		_, msg, err := ws.ReadMessage()
+		if err != nil {
+			t.Fatal("Error reading:", err)
+		}
+		if string(msg) != `{"seq":1,"next_batch": "s1"}` {
+			t.Errorf("Unexpected sync frame %s", msg)
+		}
+
+		for seq := 2; seq <= 4; seq++ {
+			ws.WriteMessage(websocket.TextMessage, []byte(fmt.Sprintf(`{"id": "%d", "method": "ping"}`, seq)))
+			_, msg, err := ws.ReadMessage()
+			if err != nil {
+				t.Fatal("Error reading:", err)
+			}
+			expected := fmt.Sprintf(`{"seq":%d,"id":"%d","result":{}}`, seq, seq)
+			if string(msg) != expected {
+				t.Errorf("Expected %s, got %s", expected, msg)
+			}
+		}
+		cleanup()
+	}
+
+	// JSON-RPC responses are left alone
+	ws, cleanup := makeWsConn(t, upstream, func(c *Connection) {
+		c.SequenceNumbers = true
+		c.JSONRPC = true
+	})
+	defer cleanup()
+	ws.SetReadDeadline(time.Now().Add(2 * time.Second))
+	ws.ReadMessage()
+	ws.WriteMessage(websocket.TextMessage, []byte(`{"jsonrpc": "2.0", "id": 1, "method": "ping"}`))
+	_, msg, err := ws.ReadMessage()
+	if err != nil {
+		t.Fatal("Error reading:", err)
+	}
+	if expected := `{"jsonrpc":"2.0","id":1,"result":{}}`; string(msg) != expected {
+		t.Errorf("Expected %s, got %s", expected, msg)
+	}
+}
+
+func TestCursorCommittedAfterWrite(t *testing.T) {
+	serverConns := make(chan *websocket.Conn, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			t.Error("Error upgrading:", err)
+			return
+		}
+		serverConns <- ws
+	}))
+	defer srv.Close()
+
+	clientWs, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatal("Error connecting to websocket:", err)
+	}
+	defer clientWs.Close()
+	ws := <-serverConns
+
+	store := NewMemoryCursorStore()
+	syncer := &Syncer{SyncParams: url.Values{}, cursorStore: store, cursorKey: "key"}
+	c := NewWithID(NextConnectionID(), syncer, NewMatrixClient("http://localhost/", "token"), ws)
+	writerDone := make(chan struct{})
+	go func() {
+		c.writePump()
+		close(writerDone)
+	}()
+	defer close(c.quit)
+
+	syncer.SyncParams.Set("since", "s1")
+	c.SendSyncResponse([]byte(`{"next_batch":"s1"}`))
+	clientWs.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, msg, err := clientWs.ReadMessage(); err != nil || string(msg) != `{"next_batch":"s1"}` {
+		t.Fatalf("Unexpected first sync %s (error %v)", msg, err)
+	}
+
+	// the next response is fetched, but can't be written
+	ws.UnderlyingConn().Close()
+	syncer.SyncParams.Set("since", "s2")
+	c.SendSyncResponse([]byte(`{"next_batch":"s2"}`))
+
+	select {
+	case <-writerDone:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Writer did not stop after write error")
+	}
+
+	if cursor := syncer.CommittedCursor(); cursor != "s1" {
+		t.Errorf("Expected committed cursor s1, got %q", cursor)
+	}
+	if saved, _ := store.Load("key"); saved != "s1" {
+		t.Errorf("Expected saved cursor s1, got %q", saved)
+	}
+	if fetched := syncer.FetchedCursor(); fetched != "s2" {
+		t.Errorf("Expected fetched cursor s2, got %q", fetched)
+	}
+}
+
+func TestSendAfterStop(t *testing.T) {
+	// sends more messages than fit in the send buffer from separate
+	// goroutines, and checks that none of them block
+	sendMany := func(c *Connection) {
+		var wg sync.WaitGroup
+		for i := 0; i < sendBufferSize+50; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				c.SendMessage([]byte(`{"id":"1","result":{}}`))
+			}()
+		}
+		done := make(chan struct{})
+		go func() {
+			wg.Wait()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Error("SendMessage blocked after the connection stopped")
+		}
+	}
+
+	// once the connection has closed
+	upstream := httptest.NewServer(http.NotFoundHandler())
+	defer upstream.Close()
+	conns := make(chan *Connection, 1)
+	ws, cleanup := makeWsConn(t, upstream, func(c *Connection) {
+		conns <- c
+	})
+	defer cleanup()
+	conn := <-conns
+	ws.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+	select {
+	case <-conn.Done():
+	case <-time.After(time.Second):
+		t.Fatal("Connection did not stop")
+	}
+	sendMany(conn)
+
+	// and once the writer has stopped, but not yet the reader
+	c := &Connection{
+		send:          make(chan message, sendBufferSize),
+		quit:          make(chan struct{}),
+		writerStopped: make(chan struct{}),
+	}
+	close(c.writerStopped)
+	sendMany(c)
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2024, 1, 2, 15, 4, 5, 0, time.UTC)
+	tests := []struct {
+		header   string
+		expected time.Duration
+	}{
+		{"", 0},
+		{"2", 2 * time.Second},
+		{"0", 0},
+		{"-5", 0},
+		{"soon", 0},
+		{now.Add(10 * time.Second).Format(http.TimeFormat), 10 * time.Second},
+		{now.Add(-10 * time.Second).Format(http.TimeFormat), 0},
+		{"3600", maxRetryAfter},
+		{"9223372036854775807", maxRetryAfter},
+		{now.Add(24 * time.Hour).Format(http.TimeFormat), maxRetryAfter},
+	}
+	for _, tt := range tests {
+		if d := parseRetryAfter(tt.header, now); d != tt.expected {
+			t.Errorf("%q: expected %v, got %v", tt.header, tt.expected, d)
+		}
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	tests := []struct {
+		header   string
+		body     string
+		expected time.Duration
+	}{
+		{"2", `{"errcode": "M_LIMIT_EXCEEDED", "error": "Too many requests"}`, 2 * time.Second},
+		{"2", `Too many requests`, 2 * time.Second},
+		{"", `{"errcode": "M_LIMIT_EXCEEDED", "error": "Too many requests", "retry_after_ms": 1500}`, 1500 * time.Millisecond},
+		{"3", `{"errcode": "M_LIMIT_EXCEEDED", "error": "Too many requests", "retry_after_ms": 1500}`, 3 * time.Second},
+		{"", `{"errcode": "M_LIMIT_EXCEEDED", "error": "Too many requests", "retry_after_ms": 9223372036854775807}`, maxRetryAfter},
+	}
+	for _, tt := range tests {
+		upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if tt.header != "" {
+				w.Header().Set("Retry-After", tt.header)
+			}
+			w.WriteHeader(429)
+			w.Write([]byte(tt.body))
+		}))
+		client := NewMatrixClient(upstream.URL+"/", "token")
+		_, err := client.Sync(context.Background(), url.Values{})
+		if d := retryAfterOf(err); d != tt.expected {
+			t.Errorf("%q, %s: expected %v, got %v", tt.header, tt.body, tt.expected, d)
+		}
+		upstream.Close()
+	}
+
+	// the delay is passed on to the client when the connection is closed
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "2")
+		w.WriteHeader(429)
+		w.Write([]byte(`{"errcode": "M_LIMIT_EXCEEDED", "error": "Too many requests"}`))
+	}))
+	defer upstream.Close()
+	ws, cleanup := makeWsConn(t, upstream, nil)
+	defer cleanup()
+
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, msg, err := ws.ReadMessage()
+	if err != nil {
+		t.Fatal("Error reading reconnect hint:", err)
+	}
+	if string(msg) != `{"reconnect":"backoff","retry_after_ms":2000}` {
+		t.Errorf("Unexpected message %s", msg)
+	}
+}
+
+func TestSyncRetryWait(t *testing.T) {
+	rateLimited := &MatrixError{HTTPError{StatusCode: 429, RetryAfter: 5 * time.Second}, MatrixErrorDetails{ErrCode: "M_LIMIT_EXCEEDED"}}
+	if !isRetryableSyncError(rateLimited) {
+		t.Error("Expected a 429 to be retryable")
+	}
+	if d := syncRetryWait(time.Second, rateLimited); d != 5*time.Second {
+		t.Errorf("Expected to wait for the Retry-After delay, got %v", d)
+	}
+	if d := syncRetryWait(10*time.Second, rateLimited); d != 10*time.Second {
+		t.Errorf("Expected to wait for the longer backoff, got %v", d)
+	}
+	if d := syncRetryWait(time.Second, &HTTPError{StatusCode: 502}); d != time.Second {
+		t.Errorf("Expected to wait for the backoff, got %v", d)
+	}
+}
@@ -0,0 +1,122 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// the HTTP methods allowed in 'cs_api' requests
+var csAPIMethods = []string{"GET", "PUT", "POST", "DELETE"}
+
+// handleCSAPI forwards an arbitrary client-server API request to the upstream
+// server, and returns the status code and body of the response. Only
+// endpoints matching one of the connection's CSAPIPrefixes are allowed.
+func handleCSAPI(c *Connection, req *jsonRequest) (interface{}, error) {
+	if len(c.CSAPIPrefixes) == 0 {
+		return nil, &requestError{errCode: "M_FORBIDDEN", message: "cs_api is not enabled"}
+	}
+
+	p := newParamReader(req)
+	method := p.enum("method", csAPIMethods)
+	endpoint := p.string("endpoint")
+
+	query := url.Values{}
+	if p.has("query") {
+		for k, v := range p.object("query") {
+			str, ok := v.(string)
+			if !ok {
+				p.addInvalid("query", "values must be strings")
+				break
+			}
+			query.Set(k, str)
+		}
+	}
+
+	var body map[string]interface{}
+	if p.has("body") {
+		body = p.object("body")
+	}
+
+	if err := p.err(); err != nil {
+		return nil, err
+	}
+
+	if !c.csAPIAllowed(endpoint) {
+		return nil, &requestError{
+			errCode: "M_FORBIDDEN",
+			message: "Endpoint not allowed",
+			fields:  []string{"endpoint"},
+		}
+	}
+	if room := csAPIRoom(endpoint); room != "" {
+		if err := c.checkRoomParamAllowed("endpoint", room); err != nil {
+			return nil, err
+		}
+	}
+
+	// a nil map would be sent as 'null'
+	var reqBody interface{}
+	if body != nil {
+		reqBody = body
+	}
+
+	status, respBody, err := c.client.Forward(req.ctx, method, endpoint, query, reqBody)
+	if err != nil {
+		return nil, err
+	}
+
+	result := map[string]interface{}{"status": status}
+	if json.Valid(respBody) {
+		result["body"] = json.RawMessage(respBody)
+	} else {
+		result["body"] = string(respBody)
+	}
+	return result, nil
+}
+
+// csAPIAllowed returns true if the given endpoint may be accessed with the
+// 'cs_api' method.
+func (c *Connection) csAPIAllowed(endpoint string) bool {
+	// don't allow the prefix check to be sidestepped
+	if strings.ContainsAny(endpoint, "?#") {
+		return false
+	}
+
+	// the upstream server decodes the path before routing it, so check the
+	// decoded path, and refuse anything which could be decoded again or
+	// normalised into a different endpoint, such as encoded dot segments
+	decoded, err := url.PathUnescape(endpoint)
+	if err != nil || strings.ContainsAny(decoded, "%\\") || strings.Contains(decoded, "..") {
+		return false
+	}
+	if path.Clean(decoded) != decoded {
+		return false
+	}
+
+	for _, prefix := range c.CSAPIPrefixes {
+		if strings.HasPrefix(decoded, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// csAPIRoom returns the room ID or alias in an endpoint allowed by
+// csAPIAllowed, such as the room in 'v3/rooms/{roomId}/send/...', so that it
+// can be checked against the room allowlist. It returns "" if there is none.
+func csAPIRoom(endpoint string) string {
+	decoded, err := url.PathUnescape(endpoint)
+	if err != nil {
+		return ""
+	}
+	segments := strings.Split(decoded, "/")
+	for i := 0; i+1 < len(segments); i++ {
+		switch segments[i] {
+		case "rooms", "join", "knock":
+			return segments[i+1]
+		}
+	}
+	return ""
+}
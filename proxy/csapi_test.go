@@ -0,0 +1,79 @@
+package proxy
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestCSAPIAllowed(t *testing.T) {
+	c, srv := newTestConnection(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" || r.URL.Path != "/_matrix/client/v3/profile/@alice:example.org" {
+			t.Error("Unexpected request:", r.Method, r.URL.Path)
+		}
+		if r.URL.Query().Get("foo") != "bar" {
+			t.Error("Unexpected query:", r.URL.RawQuery)
+		}
+		if r.Header.Get("Authorization") != "Bearer token" {
+			t.Error("Missing access token")
+		}
+		w.Write([]byte(`{"displayname":"Alice"}`))
+	})
+	defer srv.Close()
+	c.CSAPIPrefixes = []string{"v3/profile/"}
+
+	// encoded characters are fine, as long as they don't change the path
+	for _, endpoint := range []string{"v3/profile/@alice:example.org", "v3/profile/%40alice%3Aexample.org"} {
+		resp := c.handleRequest([]byte(`{"id": "1", "method": "cs_api", "params": {"method": "GET", "endpoint": "` + endpoint + `", "query": {"foo": "bar"}}}`))
+		expected := `{"id":"1","result":{"body":{"displayname":"Alice"},"status":200}}`
+		if string(resp) != expected {
+			t.Errorf("%s: expected %s, got %s", endpoint, expected, resp)
+		}
+	}
+}
+
+func TestCSAPIErrorStatus(t *testing.T) {
+	c, srv := newTestConnection(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(404)
+		w.Write([]byte(`{"errcode":"M_NOT_FOUND","error":"Profile not found"}`))
+	})
+	defer srv.Close()
+	c.CSAPIPrefixes = []string{"v3/profile/"}
+
+	resp := c.handleRequest([]byte(`{"id": "1", "method": "cs_api", "params": {"method": "GET", "endpoint": "v3/profile/@bob:example.org"}}`))
+	expected := `{"id":"1","result":{"body":{"errcode":"M_NOT_FOUND","error":"Profile not found"},"status":404}}`
+	if string(resp) != expected {
+		t.Errorf("Expected %s, got %s", expected, resp)
+	}
+}
+
+func TestCSAPIBlocked(t *testing.T) {
+	c, srv := newTestConnection(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("Unexpected request:", r.Method, r.URL.Path)
+	})
+	defer srv.Close()
+
+	resp := c.handleRequest([]byte(`{"id": "1", "method": "cs_api", "params": {"method": "GET", "endpoint": "v3/profile/@alice:example.org"}}`))
+	expected := `{"id":"1","error":{"errcode":"M_FORBIDDEN","error":"cs_api is not enabled"}}`
+	if string(resp) != expected {
+		t.Errorf("Expected %s, got %s", expected, resp)
+	}
+
+	c.CSAPIPrefixes = []string{"v3/profile/"}
+	for _, endpoint := range []string{
+		"v3/account/deactivate",
+		"v3/profile/../account/deactivate",
+		"v3/profile/%2e%2e/%2e%2e/v3/account/deactivate",
+		"v3/profile/%2E%2E/account/deactivate",
+		"v3/profile/%252e%252e/account/deactivate",
+		"v3/profile/..%5Caccount/deactivate",
+		"v3/profile/./@alice:example.org",
+		"v3/profile//@alice:example.org",
+		"v3/profile/%ZZ",
+	} {
+		resp = c.handleRequest([]byte(`{"id": "2", "method": "cs_api", "params": {"method": "POST", "endpoint": "` + endpoint + `", "body": {}}}`))
+		expected = `{"id":"2","error":{"errcode":"M_FORBIDDEN","error":"Endpoint not allowed","fields":["endpoint"]}}`
+		if string(resp) != expected {
+			t.Errorf("%s: expected %s, got %s", endpoint, expected, resp)
+		}
+	}
+}
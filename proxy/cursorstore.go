@@ -0,0 +1,209 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// A CursorStore persists the latest sync token ('next_batch') for each
+// user and device, so that a client which reconnects (for example, after the
+// proxy restarts) can resume near where it left off.
+type CursorStore interface {
+	// Load returns the token stored for the given key, or "" if there is
+	// none.
+	Load(key string) (string, error)
+
+	// Save stores the token for the given key.
+	Save(key string, token string) error
+}
+
+// CursorKey returns the CursorStore key for the given user and device.
+func CursorKey(userID, deviceID string) string {
+	return userID + "|" + deviceID
+}
+
+// MemoryCursorStore is a CursorStore which keeps the tokens in memory. It
+// does not survive restarts, but allows resumption after reconnects.
+type MemoryCursorStore struct {
+	mutex   sync.Mutex
+	cursors map[string]string
+}
+
+// NewMemoryCursorStore creates an empty MemoryCursorStore.
+func NewMemoryCursorStore() *MemoryCursorStore {
+	return &MemoryCursorStore{cursors: make(map[string]string)}
+}
+
+func (s *MemoryCursorStore) Load(key string) (string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.cursors[key], nil
+}
+
+func (s *MemoryCursorStore) Save(key string, token string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.cursors[key] = token
+	return nil
+}
+
+// FileCursorStore is a CursorStore which keeps the tokens in memory, and
+// appends each update to a file, as a JSON array of the key and token on its
+// own line, so that a save doesn't rewrite the tokens of every other user.
+// The file is compacted when it is loaded, and whenever it has grown to
+// several times the number of keys.
+type FileCursorStore struct {
+	path string
+
+	mutex   sync.Mutex
+	cursors map[string]string
+	file    *os.File
+
+	// the number of entries in the file
+	entries int
+}
+
+// a FileCursorStore is compacted once it has this many times as many entries
+// as keys, and at least minCursorCompactEntries entries
+const (
+	cursorCompactRatio      = 4
+	minCursorCompactEntries = 1000
+)
+
+// NewFileCursorStore creates a FileCursorStore backed by the given file,
+// loading any tokens already in it.
+func NewFileCursorStore(path string) (*FileCursorStore, error) {
+	s := &FileCursorStore{
+		path:    path,
+		cursors: make(map[string]string),
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err := s.parse(data); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	// rewrite the file, which also drops any entry left half-written by a
+	// crash, so that later entries aren't appended to it
+	if err := s.compact(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// parse loads the tokens from the contents of the file. Files written before
+// entries were appended hold a single JSON object, which is still accepted.
+func (s *FileCursorStore) parse(data []byte) error {
+	if len(bytes.TrimSpace(data)) == 0 {
+		return nil
+	}
+	if bytes.TrimSpace(data)[0] == '{' {
+		return json.Unmarshal(data, &s.cursors)
+	}
+
+	lines := bytes.Split(data, []byte("\n"))
+	for i, line := range lines {
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		var entry [2]string
+		if err := json.Unmarshal(line, &entry); err != nil {
+			if i == len(lines)-1 {
+				logWarn("Ignoring incomplete sync token entry in", s.path)
+				break
+			}
+			return fmt.Errorf("line %d: %v", i+1, err)
+		}
+		s.cursors[entry[0]] = entry[1]
+	}
+	return nil
+}
+
+func (s *FileCursorStore) Load(key string) (string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.cursors[key], nil
+}
+
+func (s *FileCursorStore) Save(key string, token string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.cursors[key] == token {
+		return nil
+	}
+	s.cursors[key] = token
+
+	line, err := json.Marshal([2]string{key, token})
+	if err != nil {
+		return err
+	}
+	if _, err := s.file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	s.entries++
+
+	if s.entries >= minCursorCompactEntries && s.entries > cursorCompactRatio*len(s.cursors) {
+		return s.compact()
+	}
+	return nil
+}
+
+// Close closes the file. The store should not be used afterwards.
+func (s *FileCursorStore) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.file.Close()
+}
+
+// compact rewrites the file with a single entry per key, and reopens it for
+// appending. mutex must be held, unless the store is still being created.
+func (s *FileCursorStore) compact() error {
+	var buf bytes.Buffer
+	for key, token := range s.cursors {
+		line, err := json.Marshal([2]string{key, token})
+		if err != nil {
+			return err
+		}
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+
+	// write to a temporary file and rename it into place, so that we don't
+	// leave a half-written file if we crash.
+	tmp, err := ioutil.TempFile(filepath.Dir(s.path), filepath.Base(s.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(buf.Bytes()); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), s.path); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		return err
+	}
+	if s.file != nil {
+		s.file.Close()
+	}
+	s.file = file
+	s.entries = len(s.cursors)
+	return nil
+}
@@ -0,0 +1,187 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func testCursorStore(t *testing.T, name string, store CursorStore) {
+	if token, err := store.Load("@user:test|DEV"); err != nil || token != "" {
+		t.Errorf("%s: expected empty token, got '%v' (%v)", name, token, err)
+	}
+	if err := store.Save("@user:test|DEV", "s1"); err != nil {
+		t.Errorf("%s: error saving: %v", name, err)
+	}
+	if err := store.Save("@user:test|DEV", "s2"); err != nil {
+		t.Errorf("%s: error saving: %v", name, err)
+	}
+	if err := store.Save("@other:test|DEV", "s3"); err != nil {
+		t.Errorf("%s: error saving: %v", name, err)
+	}
+	if token, err := store.Load("@user:test|DEV"); err != nil || token != "s2" {
+		t.Errorf("%s: expected 's2', got '%v' (%v)", name, token, err)
+	}
+}
+
+func TestMemoryCursorStore(t *testing.T) {
+	testCursorStore(t, "memory", NewMemoryCursorStore())
+}
+
+func TestFileCursorStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cursors")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "cursors.json")
+
+	store, err := NewFileCursorStore(path)
+	if err != nil {
+		t.Fatalf("Error creating store: %v", err)
+	}
+	testCursorStore(t, "file", store)
+
+	// a new store on the same file should see the saved tokens
+	store, err = NewFileCursorStore(path)
+	if err != nil {
+		t.Fatalf("Error reloading store: %v", err)
+	}
+	if token, err := store.Load("@other:test|DEV"); err != nil || token != "s3" {
+		t.Errorf("Expected 's3' after reload, got '%v' (%v)", token, err)
+	}
+
+	// saves are appended to the file
+	if err := store.Save("@user:test|DEV", "s4"); err != nil {
+		t.Errorf("Error saving: %v", err)
+	}
+	store.Close()
+	data, _ := ioutil.ReadFile(path)
+	if !strings.HasSuffix(string(data), `["@user:test|DEV","s4"]`+"\n") || strings.Count(string(data), "\n") != 3 {
+		t.Errorf("Unexpected file contents %s", data)
+	}
+}
+
+func TestFileCursorStoreRecovery(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cursors")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "cursors.json")
+
+	for _, contents := range []string{
+		// the format used before entries were appended
+		`{"@user:test|DEV": "s1", "@other:test|DEV": "s3"}`,
+		// a crash part way through appending an entry
+		`["@user:test|DEV","s0"]` + "\n" + `["@user:test|DEV","s1"]` + "\n" + `["@other:test|DEV","s3"]` + "\n" + `["@user:te`,
+	} {
+		ioutil.WriteFile(path, []byte(contents), 0600)
+		store, err := NewFileCursorStore(path)
+		if err != nil {
+			t.Fatalf("Error loading %s: %v", contents, err)
+		}
+		if err := store.Save("@user:test|DEV", "s2"); err != nil {
+			t.Errorf("Error saving: %v", err)
+		}
+		store.Close()
+
+		store, err = NewFileCursorStore(path)
+		if err != nil {
+			t.Fatalf("Error reloading %s: %v", contents, err)
+		}
+		for key, expected := range map[string]string{"@user:test|DEV": "s2", "@other:test|DEV": "s3"} {
+			if token, _ := store.Load(key); token != expected {
+				t.Errorf("%s: expected %s for %s, got '%v'", contents, expected, key, token)
+			}
+		}
+		store.Close()
+	}
+}
+
+func TestFileCursorStoreCompaction(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cursors")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "cursors.json")
+
+	store, err := NewFileCursorStore(path)
+	if err != nil {
+		t.Fatalf("Error creating store: %v", err)
+	}
+	defer store.Close()
+	for i := 0; i < minCursorCompactEntries; i++ {
+		if err := store.Save("@user:test|DEV", fmt.Sprintf("s%d", i)); err != nil {
+			t.Fatalf("Error saving: %v", err)
+		}
+	}
+	data, _ := ioutil.ReadFile(path)
+	if lines := strings.Count(string(data), "\n"); lines != 1 {
+		t.Errorf("Expected the file to be compacted to one entry, got %d", lines)
+	}
+}
+
+func TestSyncerUsesCursorStore(t *testing.T) {
+	var since string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/_matrix/client/r0/account/whoami":
+			w.Write([]byte(`{"user_id": "@user:test", "device_id": "DEV"}`))
+		case "/_matrix/client/r0/sync":
+			since = r.URL.Query().Get("since")
+			w.Write([]byte(`{"next_batch": "s6"}`))
+		}
+	}))
+	defer srv.Close()
+
+	store := NewMemoryCursorStore()
+	store.Save(CursorKey("@user:test", "DEV"), "s5")
+
+	syncer := &Syncer{
+		Client:     NewMatrixClient(srv.URL+"/", "token"),
+		SyncParams: url.Values{},
+	}
+	if err := syncer.UseCursorStore(store, true); err != nil {
+		t.Fatalf("Expected no error, got '%v'", err)
+	}
+	if _, err := syncer.MakeRequest(context.Background()); err != nil {
+		t.Fatalf("Expected no error, got '%v'", err)
+	}
+
+	if since != "s5" {
+		t.Errorf("Expected sync since stored token 's5', got '%v'", since)
+	}
+
+	// the token is only saved once the response has been sent
+	if token, _ := store.Load(CursorKey("@user:test", "DEV")); token != "s5" {
+		t.Errorf("Expected stored token to stay at 's5' until committed, got '%v'", token)
+	}
+	syncer.CommitCursor(syncer.FetchedCursor())
+	if token, _ := store.Load(CursorKey("@user:test", "DEV")); token != "s6" {
+		t.Errorf("Expected stored token to be updated to 's6', got '%v'", token)
+	}
+
+	// clients which don't ask to resume start afresh, but still save tokens
+	syncer = &Syncer{
+		Client:     NewMatrixClient(srv.URL+"/", "token"),
+		SyncParams: url.Values{},
+	}
+	if err := syncer.UseCursorStore(store, false); err != nil {
+		t.Fatalf("Expected no error, got '%v'", err)
+	}
+	if _, err := syncer.MakeRequest(context.Background()); err != nil {
+		t.Fatalf("Expected no error, got '%v'", err)
+	}
+	if since != "" {
+		t.Errorf("Expected a sync without 'since', got '%v'", since)
+	}
+}
@@ -0,0 +1,138 @@
+package proxy
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync/atomic"
+
+	"github.com/gorilla/websocket"
+)
+
+// adminToken holds the token required by the admin endpoints, as a string.
+// They are disabled if it is empty.
+var adminToken atomic.Value
+
+func init() {
+	adminToken.Store("")
+}
+
+// SetAdminToken sets the shared token which must be given as a bearer token
+// to use the admin endpoints. An empty token disables them. It should be
+// called before the endpoints are served.
+func SetAdminToken(token string) {
+	adminToken.Store(token)
+}
+
+// checkAdminToken returns the HTTP status with which to reject the request,
+// or 0 if it gave the admin token.
+func checkAdminToken(r *http.Request) int {
+	token := adminToken.Load().(string)
+	if token == "" {
+		return http.StatusNotFound
+	}
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return http.StatusUnauthorized
+	}
+	given := strings.TrimPrefix(auth, "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+		return http.StatusForbidden
+	}
+	return 0
+}
+
+// the body of a request to the drain endpoint
+type drainRequest struct {
+	UserID    string `json:"user_id"`
+	CloseCode int    `json:"close_code"`
+	Reason    string `json:"reason"`
+}
+
+// isValidDrainCode returns true if the given code may be used to close
+// connections from the drain endpoint: those a server may send for an
+// application-level reason, and the codes reserved for applications.
+func isValidDrainCode(code int) bool {
+	switch code {
+	case websocket.CloseNormalClosure, websocket.CloseGoingAway,
+		websocket.ClosePolicyViolation, websocket.CloseInternalServerErr,
+		websocket.CloseServiceRestart, websocket.CloseTryAgainLater:
+		return true
+	}
+	return code >= 3000 && code <= 4999
+}
+
+// ServeDrain handles admin requests to close all of the live connections for
+// a user, for instance to force them to log in again after a password change.
+// It takes a JSON body giving the 'user_id', and optionally the 'close_code'
+// (1008, policy violation, by default) and 'reason' to close them with, and
+// returns the number of connections closed.
+//
+// Only connections whose UserID is set can be closed this way. The request
+// must give the token set with SetAdminToken.
+func ServeDrain(w http.ResponseWriter, r *http.Request) {
+	if status := checkAdminToken(r); status != 0 {
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req drainRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+		return
+	}
+	if req.UserID == "" {
+		http.Error(w, "'user_id' is required", http.StatusBadRequest)
+		return
+	}
+	if req.CloseCode == 0 {
+		req.CloseCode = websocket.ClosePolicyViolation
+	} else if !isValidDrainCode(req.CloseCode) {
+		http.Error(w, "Invalid 'close_code'", http.StatusBadRequest)
+		return
+	}
+
+	closed := drainUser(req.UserID, req.CloseCode, req.Reason)
+	logInfof("Closed %d connections for %s with %d\n", closed, req.UserID, req.CloseCode)
+
+	w.Header().Set("Content-Type", "application/json")
+	resp := map[string]interface{}{"closed": closed}
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		logError("Error writing drain response:", err)
+	}
+}
+
+// drainUser closes the live connections for the given user with the given
+// code and reason, and returns how many there were.
+func drainUser(userID string, closeCode int, reason string) int {
+	var closed int
+	for _, c := range listConnections() {
+		if c.userID() != userID {
+			continue
+		}
+		c.recordClose(closeCode, CloseCauseAdmin)
+		c.closeWithHint(closeCode, truncateCloseText(reason), 0)
+		closed++
+	}
+	return closed
+}
+
+// userID returns the user the connection is for, if known.
+func (c *Connection) userID() string {
+	c.userMutex.Lock()
+	defer c.userMutex.Unlock()
+	return c.UserID
+}
+
+// setUserID changes the user the connection is for, when it registers as a
+// guest.
+func (c *Connection) setUserID(userID string) {
+	c.userMutex.Lock()
+	defer c.userMutex.Unlock()
+	c.UserID = userID
+}
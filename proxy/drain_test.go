@@ -0,0 +1,124 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestDrainAuth(t *testing.T) {
+	defer SetAdminToken("")
+
+	tests := []struct {
+		adminToken string
+		auth       string
+		expected   int
+	}{
+		{"", "Bearer secret", http.StatusNotFound},
+		{"secret", "", http.StatusUnauthorized},
+		{"secret", "Bearer wrong", http.StatusForbidden},
+		{"secret", "Bearer secret", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		SetAdminToken(tt.adminToken)
+		req := httptest.NewRequest("POST", "/admin/drain", strings.NewReader(`{}`))
+		if tt.auth != "" {
+			req.Header.Set("Authorization", tt.auth)
+		}
+		w := httptest.NewRecorder()
+		ServeDrain(w, req)
+		if w.Code != tt.expected {
+			t.Errorf("%q, %q: expected %d, got %d", tt.adminToken, tt.auth, tt.expected, w.Code)
+		}
+	}
+}
+
+func TestDrainInvalid(t *testing.T) {
+	SetAdminToken("secret")
+	defer SetAdminToken("")
+
+	for _, body := range []string{
+		`not json`,
+		`{"close_code": 4000}`,
+		`{"user_id": "@alice:example.org", "close_code": 1006}`,
+		`{"user_id": "@alice:example.org", "close_code": 5000}`,
+	} {
+		req := httptest.NewRequest("POST", "/admin/drain", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer secret")
+		w := httptest.NewRecorder()
+		ServeDrain(w, req)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %d", body, w.Code)
+		}
+	}
+}
+
+func TestDrain(t *testing.T) {
+	SetAdminToken("secret")
+	defer SetAdminToken("")
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// hold the sync open until the test is done
+		<-r.Context().Done()
+	}))
+	// closed after the connections, so that their syncs have been cancelled
+	t.Cleanup(upstream.Close)
+
+	connect := func(userID string) *websocket.Conn {
+		ws, cleanup := makeWsConn(t, upstream, func(c *Connection) { c.UserID = userID })
+		t.Cleanup(cleanup)
+		return ws
+	}
+	alice1 := connect("@alice:example.org")
+	alice2 := connect("@alice:example.org")
+	bob := connect("@bob:example.org")
+
+	// wait for the connections to be registered
+	registered := func() int {
+		var n int
+		for _, c := range listConnections() {
+			if c.UserID != "" {
+				n++
+			}
+		}
+		return n
+	}
+	for start := time.Now(); registered() < 3; time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > 2*time.Second {
+			t.Fatal("Timed out waiting for the connections to start")
+		}
+	}
+
+	req := httptest.NewRequest("POST", "/admin/drain", strings.NewReader(
+		`{"user_id": "@alice:example.org", "close_code": 4001, "reason": "Password changed"}`))
+	req.Header.Set("Authorization", "Bearer secret")
+	w := httptest.NewRecorder()
+	ServeDrain(w, req)
+	if w.Code != 200 || strings.TrimSpace(w.Body.String()) != `{"closed":2}` {
+		t.Fatalf("Unexpected response %d %s", w.Code, w.Body.String())
+	}
+
+	for _, ws := range []*websocket.Conn{alice1, alice2} {
+		ws.SetReadDeadline(time.Now().Add(2 * time.Second))
+		_, msg, err := ws.ReadMessage()
+		if err != nil || string(msg) != `{"reconnect":"backoff"}` {
+			t.Errorf("Expected the reconnect hint, got %s, %v", msg, err)
+		}
+		_, _, err = ws.ReadMessage()
+		closeErr, ok := err.(*websocket.CloseError)
+		if !ok || closeErr.Code != 4001 || closeErr.Text != "Password changed" {
+			t.Errorf("Expected a 4001 close, got %v", err)
+		}
+	}
+
+	bob.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if _, msg, err := bob.ReadMessage(); err == nil {
+		t.Errorf("Expected nothing for another user, got %s", msg)
+	} else if _, ok := err.(*websocket.CloseError); ok {
+		t.Errorf("Expected another user's connection to stay open, got %v", err)
+	}
+}
@@ -0,0 +1,481 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// prefix for the transaction IDs generated for 'send' requests, so that they
+// are unique across restarts
+var txnIDPrefix = fmt.Sprintf("ws%d", time.Now().UnixNano())
+
+// nextTxnID generates a transaction ID for a request which the client did not
+// give one for.
+func (c *Connection) nextTxnID() string {
+	return fmt.Sprintf("%s.%d.%d", txnIDPrefix, c.id,
+		atomic.AddUint64(&c.lastTxnID, 1))
+}
+
+// handleSend sends a message event to a room. If the client does not give a
+// 'txn_id', one is generated.
+func handleSend(c *Connection, req *jsonRequest) (interface{}, error) {
+	p := newParamReader(req)
+	roomID := p.roomID("room_id")
+	eventType := p.string("event_type")
+	content := p.object("content")
+	txnID := p.optionalString("txn_id")
+	if err := p.err(); err != nil {
+		return nil, err
+	}
+	if err := c.checkRoomAllowed(roomID); err != nil {
+		return nil, err
+	}
+	if err := c.checkContentSize(content); err != nil {
+		return nil, err
+	}
+
+	if txnID == "" {
+		txnID = c.nextTxnID()
+	}
+
+	eventID, err := c.client.SendEvent(req.ctx, roomID, eventType, txnID, content)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]string{"event_id": eventID}, nil
+}
+
+// handleEdit replaces the content of a message event, given by 'room_id' and
+// 'event_id', with either a new text 'body' or new message 'content'. The
+// event is sent with a fallback body for clients which don't support edits.
+func handleEdit(c *Connection, req *jsonRequest) (interface{}, error) {
+	p := newParamReader(req)
+	roomID := p.roomID("room_id")
+	eventID := p.string("event_id")
+	body := p.optionalString("body")
+	newContent := p.optionalObject("content")
+	txnID := p.optionalString("txn_id")
+	if body != "" && newContent != nil {
+		p.addInvalid("body", "cannot be combined with content")
+	}
+	if newContent != nil {
+		if _, ok := newContent["body"].(string); !ok {
+			p.addInvalid("content", "must have a string 'body'")
+		}
+		if _, ok := newContent["m.relates_to"]; ok {
+			p.addInvalid("content", "must not have 'm.relates_to'")
+		}
+	}
+	if err := p.err(); err != nil {
+		return nil, err
+	}
+	if body == "" && newContent == nil {
+		return nil, &requestError{errCode: "M_MISSING_PARAM",
+			message: "One of body or content is required", fields: []string{"body", "content"}}
+	}
+	if err := c.checkRoomAllowed(roomID); err != nil {
+		return nil, err
+	}
+
+	if newContent == nil {
+		newContent = map[string]interface{}{"msgtype": "m.text", "body": body}
+	}
+	content := editContent(eventID, newContent)
+	if err := c.checkContentSize(content); err != nil {
+		return nil, err
+	}
+
+	if txnID == "" {
+		txnID = c.nextTxnID()
+	}
+
+	newEventID, err := c.client.SendEvent(req.ctx, roomID, "m.room.message", txnID, content)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]string{"event_id": newEventID}, nil
+}
+
+// editContent builds the content of an event which replaces the event with
+// the given ID with newContent.
+func editContent(eventID string, newContent map[string]interface{}) map[string]interface{} {
+	content := map[string]interface{}{
+		"body":          "* " + newContent["body"].(string),
+		"m.new_content": newContent,
+		"m.relates_to": map[string]interface{}{
+			"rel_type": "m.replace",
+			"event_id": eventID,
+		},
+	}
+	if msgtype, ok := newContent["msgtype"]; ok {
+		content["msgtype"] = msgtype
+	}
+	return content
+}
+
+// checkContentSize returns an M_TOO_LARGE error if the JSON encoding of the
+// given event content is longer than MaxContentBytes, so that the request is
+// rejected without contacting the upstream server.
+func (c *Connection) checkContentSize(content map[string]interface{}) error {
+	if c.MaxContentBytes <= 0 {
+		return nil
+	}
+	b, err := json.Marshal(content)
+	if err != nil {
+		return err
+	}
+	if len(b) > c.MaxContentBytes {
+		return &requestError{
+			errCode: "M_TOO_LARGE",
+			message: fmt.Sprintf("content must be at most %d bytes", c.MaxContentBytes),
+			fields:  []string{"content"},
+		}
+	}
+	return nil
+}
+
+// handleRedact redacts an event, with an optional 'reason'.
+func handleRedact(c *Connection, req *jsonRequest) (interface{}, error) {
+	p := newParamReader(req)
+	roomID := p.roomID("room_id")
+	eventID := p.string("event_id")
+	reason := p.optionalString("reason")
+	txnID := p.optionalString("txn_id")
+	if err := p.err(); err != nil {
+		return nil, err
+	}
+	if err := c.checkRoomAllowed(roomID); err != nil {
+		return nil, err
+	}
+
+	if txnID == "" {
+		txnID = c.nextTxnID()
+	}
+
+	redactionID, err := c.client.Redact(req.ctx, roomID, eventID, txnID, reason)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]string{"event_id": redactionID}, nil
+}
+
+// handleState sends a state event to a room. 'state_key' defaults to "".
+func handleState(c *Connection, req *jsonRequest) (interface{}, error) {
+	p := newParamReader(req)
+	roomID := p.roomID("room_id")
+	eventType := p.string("event_type")
+	stateKey := p.optionalString("state_key")
+	content := p.object("content")
+	ifUnchanged := p.optionalBool("if_unchanged")
+	prevEventID := p.optionalString("prev_event_id")
+	prevContent := p.optionalObject("prev_content")
+	if ifUnchanged && prevEventID == "" && prevContent == nil {
+		p.addInvalid("if_unchanged", "requires prev_event_id or prev_content")
+	}
+	if err := p.err(); err != nil {
+		return nil, err
+	}
+	if err := c.checkRoomAllowed(roomID); err != nil {
+		return nil, err
+	}
+	if err := c.checkContentSize(content); err != nil {
+		return nil, err
+	}
+
+	if ifUnchanged {
+		err := checkStateUnchanged(req.ctx, c, roomID, eventType, stateKey, prevEventID, prevContent)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	eventID, err := c.client.SendState(req.ctx, roomID, eventType, stateKey, content)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]string{"event_id": eventID}, nil
+}
+
+// handleGetStateEvent returns the content of the current state event of the
+// given type and state key in a room.
+func handleGetStateEvent(c *Connection, req *jsonRequest) (interface{}, error) {
+	p := newParamReader(req)
+	roomID := p.roomID("room_id")
+	eventType := p.string("event_type")
+	stateKey := p.optionalString("state_key")
+	if err := p.err(); err != nil {
+		return nil, err
+	}
+
+	return getStateContent(req.ctx, c, roomID, eventType, stateKey)
+}
+
+// getStateContent returns the content of the current state event of the given
+// type and state key in a room, or an M_NOT_FOUND error if there is none.
+func getStateContent(ctx context.Context, c *Connection, roomID, eventType, stateKey string) (json.RawMessage, error) {
+	event, err := c.client.GetStateEvent(ctx, roomID, eventType, stateKey)
+	if err != nil {
+		if mErr, ok := err.(*MatrixError); ok && mErr.StatusCode == 404 {
+			return nil, &requestError{errCode: "M_NOT_FOUND", message: "The state event does not exist"}
+		}
+		return nil, err
+	}
+	return event.Content, nil
+}
+
+// the most state events which can be fetched with one 'get_state_events'
+// request, and the number fetched at once
+const (
+	maxStateEventsPerRequest = 50
+	stateEventConcurrency    = 5
+)
+
+type stateEventKey struct {
+	EventType string `json:"event_type"`
+	StateKey  string `json:"state_key"`
+}
+
+type stateEventResult struct {
+	stateEventKey
+	Content json.RawMessage     `json:"content,omitempty"`
+	Error   *MatrixErrorDetails `json:"error,omitempty"`
+}
+
+// handleGetStateEvents returns the content of several state events in a room,
+// given by a list of 'events' with an 'event_type' and optional 'state_key'.
+// The results are in the same order, each with either the 'content' or an
+// 'error', which is M_NOT_FOUND if there is no such event.
+func handleGetStateEvents(c *Connection, req *jsonRequest) (interface{}, error) {
+	p := newParamReader(req)
+	roomID := p.roomID("room_id")
+	keys := readStateEventKeys(p, "events")
+	if err := p.err(); err != nil {
+		return nil, err
+	}
+
+	results := make([]stateEventResult, len(keys))
+	slots := make(chan struct{}, stateEventConcurrency)
+	var wg sync.WaitGroup
+	for i, key := range keys {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func(i int, key stateEventKey) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			content, err := getStateContent(req.ctx, c, roomID, key.EventType, key.StateKey)
+			results[i] = stateEventResult{stateEventKey: key, Content: content}
+			if err != nil {
+				results[i].Error = errorToResponse(err)
+			}
+		}(i, key)
+	}
+	wg.Wait()
+
+	return map[string]interface{}{"events": results}, nil
+}
+
+// readStateEventKeys reads a required parameter which is a list of objects
+// with an 'event_type' and optional 'state_key'.
+func readStateEventKeys(p *paramReader, name string) []stateEventKey {
+	if !p.has(name) {
+		p.addMissing(name)
+		return nil
+	}
+	list, ok := p.req.Params[name].([]interface{})
+	if !ok || len(list) == 0 {
+		p.addInvalid(name, "must be a non-empty list of objects")
+		return nil
+	}
+	if len(list) > maxStateEventsPerRequest {
+		p.addInvalid(name, fmt.Sprintf("must have at most %d items", maxStateEventsPerRequest))
+		return nil
+	}
+
+	keys := make([]stateEventKey, len(list))
+	for i, item := range list {
+		obj, ok := item.(map[string]interface{})
+		eventType, _ := obj["event_type"].(string)
+		stateKey, isString := obj["state_key"].(string)
+		if !ok || eventType == "" || (obj["state_key"] != nil && !isString) {
+			p.addInvalid(name, "items must have a string event_type and state_key")
+			return nil
+		}
+		keys[i] = stateEventKey{eventType, stateKey}
+	}
+	return keys
+}
+
+// checkStateUnchanged fetches the current value of a piece of room state, and
+// returns an M_BAD_STATE error if it does not have the expected event ID
+// and/or content.
+//
+// There is nothing to stop the state changing between the check and the
+// write, but this catches the common case of a client working from stale
+// state.
+func checkStateUnchanged(ctx context.Context, c *Connection, roomID, eventType, stateKey, prevEventID string, prevContent map[string]interface{}) error {
+	current, err := c.client.GetStateEvent(ctx, roomID, eventType, stateKey)
+	if err != nil {
+		if mErr, ok := err.(*MatrixError); ok && mErr.Details.ErrCode == "M_NOT_FOUND" {
+			return &requestError{errCode: "M_BAD_STATE", message: "The state does not exist"}
+		}
+		return err
+	}
+
+	if prevEventID != "" {
+		if current.EventID == "" {
+			return &requestError{errCode: "M_UNRECOGNIZED",
+				message: "The homeserver does not return state event IDs"}
+		}
+		if current.EventID != prevEventID {
+			return &requestError{errCode: "M_BAD_STATE",
+				message: "The state has changed to " + current.EventID}
+		}
+	}
+
+	if prevContent != nil {
+		dec := json.NewDecoder(bytes.NewReader(current.Content))
+		dec.UseNumber()
+		var content map[string]interface{}
+		if err := dec.Decode(&content); err != nil {
+			return err
+		}
+		if !jsonValuesEqual(content, prevContent) {
+			return &requestError{errCode: "M_BAD_STATE", message: "The state has changed"}
+		}
+	}
+	return nil
+}
+
+// jsonValuesEqual returns true if two values decoded from JSON, with numbers
+// as json.Number, are the same. Numbers are compared by value, so that 1 and
+// 1.0 are equal.
+func jsonValuesEqual(a, b interface{}) bool {
+	switch a := a.(type) {
+	case map[string]interface{}:
+		b, ok := b.(map[string]interface{})
+		if !ok || len(a) != len(b) {
+			return false
+		}
+		for k, v := range a {
+			if w, ok := b[k]; !ok || !jsonValuesEqual(v, w) {
+				return false
+			}
+		}
+		return true
+	case []interface{}:
+		b, ok := b.([]interface{})
+		if !ok || len(a) != len(b) {
+			return false
+		}
+		for i := range a {
+			if !jsonValuesEqual(a[i], b[i]) {
+				return false
+			}
+		}
+		return true
+	case json.Number:
+		b, ok := b.(json.Number)
+		if !ok {
+			return false
+		}
+		x, okA := new(big.Float).SetString(string(a))
+		y, okB := new(big.Float).SetString(string(b))
+		return okA && okB && x.Cmp(y) == 0
+	default:
+		return a == b
+	}
+}
+
+// handleRelations returns the events which relate to a given event, such as
+// thread replies or reactions.
+func handleRelations(c *Connection, req *jsonRequest) (interface{}, error) {
+	p := newParamReader(req)
+	roomID := p.roomID("room_id")
+	eventID := p.string("event_id")
+	relType := p.optionalString("rel_type")
+	eventType := p.optionalString("event_type")
+	if eventType != "" && relType == "" {
+		p.addInvalid("event_type", "requires rel_type")
+	}
+	if err := p.err(); err != nil {
+		return nil, err
+	}
+
+	return c.client.GetRelations(req.ctx, roomID, eventID, relType, eventType)
+}
+
+// the allowed values of 'include' for the threads method
+var threadIncludeValues = []string{"all", "participated"}
+
+// handleThreads returns the threads in a room.
+func handleThreads(c *Connection, req *jsonRequest) (interface{}, error) {
+	p := newParamReader(req)
+	roomID := p.roomID("room_id")
+	include := p.optionalEnum("include", threadIncludeValues)
+	if err := p.err(); err != nil {
+		return nil, err
+	}
+
+	return c.client.GetThreads(req.ctx, roomID, include)
+}
+
+// handleSearch searches for events, using the search criteria in the 'body'
+// parameter.
+func handleSearch(c *Connection, req *jsonRequest) (interface{}, error) {
+	p := newParamReader(req)
+	body := p.object("body")
+	nextBatch := p.optionalString("next_batch")
+	if err := p.err(); err != nil {
+		return nil, err
+	}
+
+	categories, err := c.client.Search(req.ctx, body, nextBatch)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{"search_categories": categories}, nil
+}
+
+// the range of scores allowed when reporting an event; -100 is the most
+// offensive.
+const (
+	minReportScore = -100
+	maxReportScore = 0
+)
+
+// handleReport reports an event to the server admins. Any 'score' is clamped
+// to the range allowed by the spec.
+func handleReport(c *Connection, req *jsonRequest) (interface{}, error) {
+	p := newParamReader(req)
+	roomID := p.roomID("room_id")
+	eventID := p.string("event_id")
+	scoreParam := p.optionalNumber("score")
+	reason := p.optionalString("reason")
+	if err := p.err(); err != nil {
+		return nil, err
+	}
+
+	var score *int
+	if scoreParam != nil {
+		// clamp before converting, since huge values don't fit in an int
+		f := *scoreParam
+		if f < minReportScore {
+			f = minReportScore
+		} else if f > maxReportScore {
+			f = maxReportScore
+		}
+		s := int(f)
+		score = &s
+	}
+
+	if err := c.client.ReportEvent(req.ctx, roomID, eventID, score, reason); err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{}, nil
+}
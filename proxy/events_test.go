@@ -0,0 +1,745 @@
+package proxy
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestRelations(t *testing.T) {
+	tests := []struct {
+		params       string
+		expectedPath string
+	}{
+		{
+			`{"room_id": "!room:test", "event_id": "$event"}`,
+			"/_matrix/client/v1/rooms/%21room:test/relations/$event",
+		},
+		{
+			`{"room_id": "!room:test", "event_id": "$event", "rel_type": "m.thread"}`,
+			"/_matrix/client/v1/rooms/%21room:test/relations/$event/m.thread",
+		},
+		{
+			`{"room_id": "!room:test", "event_id": "$event", "rel_type": "m.annotation", "event_type": "m.reaction"}`,
+			"/_matrix/client/v1/rooms/%21room:test/relations/$event/m.annotation/m.reaction",
+		},
+	}
+
+	chunk := `{"chunk":[{"event_id":"$reply","type":"m.room.message"}],"next_batch":"n1"}`
+	for _, tt := range tests {
+		c, srv := newTestConnection(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.EscapedPath() != tt.expectedPath {
+				t.Errorf("Expected path %v, got %v", tt.expectedPath, r.URL.EscapedPath())
+			}
+			w.Write([]byte(chunk))
+		})
+
+		resp := c.handleRequest([]byte(`{"id": "1", "method": "relations", "params": ` + tt.params + `}`))
+		if string(resp) != `{"id":"1","result":`+chunk+`}` {
+			t.Errorf("%s: unexpected response %s", tt.params, resp)
+		}
+		srv.Close()
+	}
+}
+
+func TestRelationsInvalid(t *testing.T) {
+	tests := []struct {
+		params        string
+		expectedError string
+	}{
+		{`{"event_id": "$event"}`, `{"errcode":"M_MISSING_PARAM","error":"Missing parameter room_id","fields":["room_id"]}`},
+		{`{"room_id": "!room:test"}`, `{"errcode":"M_MISSING_PARAM","error":"Missing parameter event_id","fields":["event_id"]}`},
+		{`{"room_id": "!room:test", "event_id": "$event", "event_type": "m.reaction"}`,
+			`{"errcode":"M_INVALID_PARAM","error":"event_type requires rel_type","fields":["event_type"]}`},
+	}
+
+	c, srv := newTestConnection(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("Unexpected upstream request:", r.URL)
+	})
+	defer srv.Close()
+
+	for _, tt := range tests {
+		resp := c.handleRequest([]byte(`{"id": "1", "method": "relations", "params": ` + tt.params + `}`))
+		if string(resp) != `{"id":"1","error":`+tt.expectedError+`}` {
+			t.Errorf("%s: unexpected response %s", tt.params, resp)
+		}
+	}
+}
+
+func TestThreads(t *testing.T) {
+	tests := []struct {
+		params          string
+		expectedInclude string
+	}{
+		{`{"room_id": "!room:test"}`, ""},
+		{`{"room_id": "!room:test", "include": "participated"}`, "participated"},
+	}
+
+	chunk := `{"chunk":[{"event_id":"$root"}],"next_batch":"n1"}`
+	for _, tt := range tests {
+		c, srv := newTestConnection(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.EscapedPath() != "/_matrix/client/v1/rooms/%21room:test/threads" {
+				t.Error("Unexpected path:", r.URL.EscapedPath())
+			}
+			if include := r.URL.Query().Get("include"); include != tt.expectedInclude {
+				t.Errorf("Expected include '%v', got '%v'", tt.expectedInclude, include)
+			}
+			w.Write([]byte(chunk))
+		})
+
+		resp := c.handleRequest([]byte(`{"id": "1", "method": "threads", "params": ` + tt.params + `}`))
+		if string(resp) != `{"id":"1","result":`+chunk+`}` {
+			t.Errorf("%s: unexpected response %s", tt.params, resp)
+		}
+		srv.Close()
+	}
+}
+
+func TestThreadsInvalid(t *testing.T) {
+	c, srv := newTestConnection(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("Unexpected upstream request:", r.URL)
+	})
+	defer srv.Close()
+
+	resp := c.handleRequest([]byte(`{"id": "1", "method": "threads", "params": {"room_id": "!room:test", "include": "some"}}`))
+	expected := `{"id":"1","error":{"errcode":"M_INVALID_PARAM","error":"include must be one of: all, participated","fields":["include"]}}`
+	if string(resp) != expected {
+		t.Errorf("Expected %s, got %s", expected, resp)
+	}
+
+	resp = c.handleRequest([]byte(`{"id": "2", "method": "threads"}`))
+	expected = `{"id":"2","error":{"errcode":"M_MISSING_PARAM","error":"Missing parameter room_id","fields":["room_id"]}}`
+	if string(resp) != expected {
+		t.Errorf("Expected %s, got %s", expected, resp)
+	}
+}
+
+func TestSend(t *testing.T) {
+	c, srv := newTestConnection(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "PUT" || r.URL.EscapedPath() != "/_matrix/client/r0/rooms/%21room:test/send/m.room.message/txn1" {
+			t.Error("Unexpected request:", r.Method, r.URL.EscapedPath())
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		if string(body) != `{"body":"héllo","msgtype":"m.text"}` {
+			t.Errorf("Unexpected body %s", body)
+		}
+		w.Write([]byte(`{"event_id": "$event"}`))
+	})
+	defer srv.Close()
+
+	resp := c.handleRequest([]byte(`{"id": "1", "method": "send", "params": {"room_id": "!room:test", "event_type": "m.room.message", "txn_id": "txn1", "content": {"msgtype": "m.text", "body": "héllo"}}}`))
+	expected := `{"id":"1","result":{"event_id":"$event"}}`
+	if string(resp) != expected {
+		t.Errorf("Expected %s, got %s", expected, resp)
+	}
+}
+
+func TestState(t *testing.T) {
+	c, srv := newTestConnection(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "PUT" || r.URL.EscapedPath() != "/_matrix/client/r0/rooms/%21room:test/state/m.room.name/" {
+			t.Error("Unexpected request:", r.Method, r.URL.EscapedPath())
+		}
+		w.Write([]byte(`{"event_id": "$event"}`))
+	})
+	defer srv.Close()
+
+	resp := c.handleRequest([]byte(`{"id": "1", "method": "state", "params": {"room_id": "!room:test", "event_type": "m.room.name", "state_key": "", "content": {"name": "Room"}}}`))
+	expected := `{"id":"1","result":{"event_id":"$event"}}`
+	if string(resp) != expected {
+		t.Errorf("Expected %s, got %s", expected, resp)
+	}
+}
+
+func TestEdit(t *testing.T) {
+	var sent map[string]interface{}
+	c, srv := newTestConnection(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, "/_matrix/client/r0/rooms/!room:test/send/m.room.message/") {
+			t.Error("Unexpected path:", r.URL.Path)
+		}
+		sent = nil
+		json.NewDecoder(r.Body).Decode(&sent)
+		w.Write([]byte(`{"event_id": "$edit"}`))
+	})
+	defer srv.Close()
+
+	tests := []struct {
+		params   string
+		expected string
+	}{
+		{
+			`{"room_id": "!room:test", "event_id": "$orig", "body": "fixed"}`,
+			`{"body":"* fixed","m.new_content":{"body":"fixed","msgtype":"m.text"},"m.relates_to":{"event_id":"$orig","rel_type":"m.replace"},"msgtype":"m.text"}`,
+		},
+		{
+			`{"room_id": "!room:test", "event_id": "$orig", "content": {"msgtype": "m.notice", "body": "fixed"}}`,
+			`{"body":"* fixed","m.new_content":{"body":"fixed","msgtype":"m.notice"},"m.relates_to":{"event_id":"$orig","rel_type":"m.replace"},"msgtype":"m.notice"}`,
+		},
+	}
+	for _, tt := range tests {
+		resp := c.handleRequest([]byte(`{"id": "1", "method": "edit", "params": ` + tt.params + `}`))
+		if string(resp) != `{"id":"1","result":{"event_id":"$edit"}}` {
+			t.Errorf("Unexpected response %s", resp)
+		}
+		if content, _ := json.Marshal(sent); string(content) != tt.expected {
+			t.Errorf("Expected content %s, got %s", tt.expected, content)
+		}
+	}
+}
+
+func TestEditInvalid(t *testing.T) {
+	c, srv := newTestConnection(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("Unexpected request to", r.URL.Path)
+	})
+	defer srv.Close()
+
+	tests := []struct {
+		params   string
+		expected string
+	}{
+		{
+			`{"room_id": "!room:test", "event_id": "$orig"}`,
+			`{"errcode":"M_MISSING_PARAM","error":"One of body or content is required","fields":["body","content"]}`,
+		},
+		{
+			`{"room_id": "!room:test", "event_id": "$orig", "body": "a", "content": {"body": "b"}}`,
+			`{"errcode":"M_INVALID_PARAM","error":"body cannot be combined with content","fields":["body"]}`,
+		},
+		{
+			`{"room_id": "!room:test", "event_id": "$orig", "content": {"msgtype": "m.text"}}`,
+			`{"errcode":"M_INVALID_PARAM","error":"content must have a string 'body'","fields":["content"]}`,
+		},
+	}
+	for _, tt := range tests {
+		resp := c.handleRequest([]byte(`{"id": "1", "method": "edit", "params": ` + tt.params + `}`))
+		expected := `{"id":"1","error":` + tt.expected + `}`
+		if string(resp) != expected {
+			t.Errorf("Expected %s, got %s", expected, resp)
+		}
+	}
+}
+
+func TestMaxContentBytes(t *testing.T) {
+	var requests int
+	c, srv := newTestConnection(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Write([]byte(`{"event_id": "$event"}`))
+	})
+	defer srv.Close()
+	c.MaxContentBytes = 40
+
+	big := `{"msgtype": "m.text", "body": "` + strings.Repeat("x", 100) + `"}`
+	tests := []struct {
+		request  string
+		expected string
+	}{
+		{
+			`{"id": "1", "method": "send", "params": {"room_id": "!room:test", "event_type": "m.room.message", "content": ` + big + `}}`,
+			`{"id":"1","error":{"errcode":"M_TOO_LARGE","error":"content must be at most 40 bytes","fields":["content"]}}`,
+		},
+		{
+			`{"id": "1", "method": "state", "params": {"room_id": "!room:test", "event_type": "m.room.topic", "content": {"topic": "` + strings.Repeat("x", 100) + `"}}}`,
+			`{"id":"1","error":{"errcode":"M_TOO_LARGE","error":"content must be at most 40 bytes","fields":["content"]}}`,
+		},
+	}
+	for _, tt := range tests {
+		resp := c.handleRequest([]byte(tt.request))
+		if string(resp) != tt.expected {
+			t.Errorf("Expected %s, got %s", tt.expected, resp)
+		}
+	}
+	if requests != 0 {
+		t.Errorf("Expected no upstream requests, got %d", requests)
+	}
+
+	// content within the limit is sent as normal
+	resp := c.handleRequest([]byte(`{"id": "1", "method": "send", "params": {"room_id": "!room:test", "event_type": "m.room.message", "content": {"body": "hi"}}}`))
+	if string(resp) != `{"id":"1","result":{"event_id":"$event"}}` || requests != 1 {
+		t.Errorf("Unexpected response %s after %d requests", resp, requests)
+	}
+}
+
+// content over MaxContentBytes, but too large for the default read limit, is
+// refused with an error rather than by closing the connection
+func TestMaxContentBytesOverWebsocket(t *testing.T) {
+	done := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-done
+	}))
+	defer upstream.Close()
+	defer close(done)
+
+	ws, cleanup := makeWsConn(t, upstream, func(c *Connection) {
+		c.MaxContentBytes = 1000
+	})
+	defer cleanup()
+
+	big := `{"body": "` + strings.Repeat("x", 1100) + `"}`
+	ws.WriteMessage(websocket.TextMessage, []byte(`{"id": "1", "method": "send", "params": {"room_id": "!room:test", "event_type": "m.room.message", "content": `+big+`}}`))
+	ws.WriteMessage(websocket.TextMessage, []byte(`{"id": "2", "method": "ping"}`))
+
+	// the requests are handled concurrently, so may be answered in any order
+	expected := map[string]bool{
+		`{"id":"1","error":{"errcode":"M_TOO_LARGE","error":"content must be at most 1000 bytes","fields":["content"]}}`: true,
+		`{"id":"2","result":{}}`: true,
+	}
+	ws.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for len(expected) > 0 {
+		_, msg, err := ws.ReadMessage()
+		if err != nil {
+			t.Fatalf("Error reading; still expecting %v: %v", expected, err)
+		}
+		if !expected[string(msg)] {
+			t.Errorf("Unexpected message %s", msg)
+		}
+		delete(expected, string(msg))
+	}
+}
+
+func TestGetStateEvents(t *testing.T) {
+	var mutex sync.Mutex
+	inflight, maxInflight := 0, 0
+	c, srv := newTestConnection(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		inflight++
+		if inflight > maxInflight {
+			maxInflight = inflight
+		}
+		mutex.Unlock()
+		time.Sleep(20 * time.Millisecond)
+		mutex.Lock()
+		inflight--
+		mutex.Unlock()
+
+		switch r.URL.EscapedPath() {
+		case "/_matrix/client/r0/rooms/%21room:test/state/m.room.name/":
+			w.Write([]byte(`{"name": "Room"}`))
+		case "/_matrix/client/r0/rooms/%21room:test/state/m.room.member/@alice:test":
+			w.Write([]byte(`{"membership": "join"}`))
+		default:
+			w.WriteHeader(404)
+			w.Write([]byte(`{"errcode": "M_NOT_FOUND", "error": "Event not found"}`))
+		}
+	})
+	defer srv.Close()
+
+	events := []string{
+		`{"event_type": "m.room.name"}`,
+		`{"event_type": "m.room.topic", "state_key": ""}`,
+		`{"event_type": "m.room.member", "state_key": "@alice:test"}`,
+	}
+	for i := 0; i < 7; i++ {
+		events = append(events, `{"event_type": "m.room.name"}`)
+	}
+	resp := c.handleRequest([]byte(`{"id": "1", "method": "get_state_events", "params": {"room_id": "!room:test", "events": [` + strings.Join(events, ",") + `]}}`))
+
+	var result struct {
+		Result struct {
+			Events []stateEventResult `json:"events"`
+		} `json:"result"`
+	}
+	if err := json.Unmarshal(resp, &result); err != nil || len(result.Result.Events) != len(events) {
+		t.Fatalf("Unexpected response %s", resp)
+	}
+	got := result.Result.Events
+	if got[0].EventType != "m.room.name" || string(got[0].Content) != `{"name":"Room"}` || got[0].Error != nil {
+		t.Errorf("Unexpected first result %+v", got[0])
+	}
+	if got[1].EventType != "m.room.topic" || got[1].Content != nil || got[1].Error == nil || got[1].Error.ErrCode != "M_NOT_FOUND" {
+		t.Errorf("Expected the second result to be not found, got %+v", got[1])
+	}
+	if got[2].StateKey != "@alice:test" || string(got[2].Content) != `{"membership":"join"}` {
+		t.Errorf("Unexpected third result %+v", got[2])
+	}
+	if maxInflight < 2 || maxInflight > stateEventConcurrency {
+		t.Errorf("Expected between 2 and %d concurrent requests, got %d", stateEventConcurrency, maxInflight)
+	}
+}
+
+func TestGetStateEventsInvalid(t *testing.T) {
+	tests := []struct {
+		params   string
+		expected string
+	}{
+		{
+			`{"room_id": "!room:test"}`,
+			`{"errcode":"M_MISSING_PARAM","error":"Missing parameter events","fields":["events"]}`,
+		},
+		{
+			`{"room_id": "!room:test", "events": []}`,
+			`{"errcode":"M_INVALID_PARAM","error":"events must be a non-empty list of objects","fields":["events"]}`,
+		},
+		{
+			`{"room_id": "!room:test", "events": [{"state_key": ""}]}`,
+			`{"errcode":"M_INVALID_PARAM","error":"events items must have a string event_type and state_key","fields":["events"]}`,
+		},
+		{
+			`{"room_id": "!room:test", "events": [{"event_type": "m.room.name", "state_key": 1}]}`,
+			`{"errcode":"M_INVALID_PARAM","error":"events items must have a string event_type and state_key","fields":["events"]}`,
+		},
+	}
+	c := &Connection{}
+	for _, tt := range tests {
+		resp := c.handleRequest([]byte(`{"id": "1", "method": "get_state_events", "params": ` + tt.params + `}`))
+		expected := `{"id":"1","error":` + tt.expected + `}`
+		if string(resp) != expected {
+			t.Errorf("Expected %s, got %s", expected, resp)
+		}
+	}
+}
+
+func TestAllowedRooms(t *testing.T) {
+	var requests int
+	c, srv := newTestConnection(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Write([]byte(`{"event_id": "$event"}`))
+	})
+	defer srv.Close()
+	c.RoomAllowlist = RoomAllowlist{"@bot:test": {"!allowed:test"}}
+	c.UserID = "@bot:test"
+	c.CSAPIPrefixes = []string{"v3/"}
+
+	resp := c.handleRequest([]byte(`{"id": "1", "method": "send", "params": {"room_id": "!allowed:test", "event_type": "m.room.message", "content": {"body": "hi"}}}`))
+	if string(resp) != `{"id":"1","result":{"event_id":"$event"}}` || requests != 1 {
+		t.Errorf("Unexpected response %s after %d requests", resp, requests)
+	}
+
+	for _, tt := range []struct {
+		params   string
+		expected string
+	}{
+		{`"method": "send", "params": {"room_id": "!other:test", "event_type": "m.room.message", "content": {"body": "hi"}}`,
+			`{"errcode":"M_FORBIDDEN","error":"This connection may not send to !other:test","fields":["room_id"]}`},
+		{`"method": "upgrade_room", "params": {"room_id": "!other:test", "new_version": "10"}`,
+			`{"errcode":"M_FORBIDDEN","error":"This connection may not send to !other:test","fields":["room_id"]}`},
+		{`"method": "add_alias", "params": {"alias": "#other:test", "room_id": "!other:test"}`,
+			`{"errcode":"M_FORBIDDEN","error":"This connection may not send to !other:test","fields":["room_id"]}`},
+		{`"method": "knock", "params": {"room_id_or_alias": "#other:test"}`,
+			`{"errcode":"M_FORBIDDEN","error":"This connection may only send to rooms given by ID","fields":["room_id_or_alias"]}`},
+		{`"method": "cs_api", "params": {"method": "PUT", "endpoint": "v3/rooms/%21other:test/send/m.room.message/1", "body": {}}`,
+			`{"errcode":"M_FORBIDDEN","error":"This connection may not send to !other:test","fields":["endpoint"]}`},
+		{`"method": "cs_api", "params": {"method": "POST", "endpoint": "v3/join/%23other:test", "body": {}}`,
+			`{"errcode":"M_FORBIDDEN","error":"This connection may only send to rooms given by ID","fields":["endpoint"]}`},
+	} {
+		resp = c.handleRequest([]byte(`{"id": "2", ` + tt.params + `}`))
+		expected := `{"id":"2","error":` + tt.expected + `}`
+		if string(resp) != expected {
+			t.Errorf("Expected %s, got %s", expected, resp)
+		}
+	}
+	if requests != 1 {
+		t.Errorf("Expected no upstream requests for disallowed rooms, got %d", requests-1)
+	}
+
+	// the allowlist applies to the connection's current user
+	c.setUserID("@other:test")
+	resp = c.handleRequest([]byte(`{"id": "3", "method": "send", "params": {"room_id": "!other:test", "event_type": "m.room.message", "content": {"body": "hi"}}}`))
+	if string(resp) != `{"id":"3","result":{"event_id":"$event"}}` {
+		t.Errorf("Expected unlisted user to be unrestricted, got %s", resp)
+	}
+}
+
+func TestGetStateEvent(t *testing.T) {
+	c, srv := newTestConnection(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			t.Error("Unexpected method:", r.Method)
+		}
+		switch r.URL.EscapedPath() {
+		case "/_matrix/client/r0/rooms/%21room:test/state/m.room.name/":
+			w.Write([]byte(`{"type": "m.room.name", "event_id": "$name", "content": {"name": "Room"}}`))
+		case "/_matrix/client/r0/rooms/%21room:test/state/m.room.member/@alice:test":
+			// a server which ignores 'format'
+			w.Write([]byte(`{"membership": "join"}`))
+		default:
+			w.WriteHeader(404)
+			w.Write([]byte(`{"errcode": "M_NOT_FOUND", "error": "Event not found."}`))
+		}
+	})
+	defer srv.Close()
+
+	tests := []struct {
+		params   string
+		expected string
+	}{
+		{
+			`{"room_id": "!room:test", "event_type": "m.room.name"}`,
+			`{"id":"1","result":{"name":"Room"}}`,
+		},
+		{
+			`{"room_id": "!room:test", "event_type": "m.room.member", "state_key": "@alice:test"}`,
+			`{"id":"1","result":{"membership":"join"}}`,
+		},
+		{
+			`{"room_id": "!room:test", "event_type": "m.room.topic"}`,
+			`{"id":"1","error":{"errcode":"M_NOT_FOUND","error":"The state event does not exist"}}`,
+		},
+		{
+			`{"room_id": "!room:test"}`,
+			`{"id":"1","error":{"errcode":"M_MISSING_PARAM","error":"Missing parameter event_type","fields":["event_type"]}}`,
+		},
+	}
+	for _, tt := range tests {
+		resp := c.handleRequest([]byte(`{"id": "1", "method": "get_state_event", "params": ` + tt.params + `}`))
+		if string(resp) != tt.expected {
+			t.Errorf("Params %s: expected %s, got %s", tt.params, tt.expected, resp)
+		}
+	}
+}
+
+func TestStateIfUnchanged(t *testing.T) {
+	tests := []struct {
+		params   string
+		expected string
+	}{
+		{
+			`"prev_event_id": "$old"`,
+			`{"id":"1","error":{"errcode":"M_BAD_STATE","error":"The state has changed to $current"}}`,
+		},
+		{
+			`"prev_content": {"name": "Old", "count": 1}`,
+			`{"id":"1","error":{"errcode":"M_BAD_STATE","error":"The state has changed"}}`,
+		},
+		{
+			`"prev_event_id": "$current", "prev_content": {"name": "Current", "count": 1}`,
+			`{"id":"1","result":{"event_id":"$event"}}`,
+		},
+		{
+			`"prev_content": {"name": "Current", "count": 1}`,
+			`{"id":"1","result":{"event_id":"$event"}}`,
+		},
+		// numbers are compared by value
+		{
+			`"prev_content": {"name": "Current", "count": 1.0}`,
+			`{"id":"1","result":{"event_id":"$event"}}`,
+		},
+		{
+			`"prev_content": {"name": "Current", "count": 1e0}`,
+			`{"id":"1","result":{"event_id":"$event"}}`,
+		},
+		{
+			`"prev_content": {"name": "Current", "count": 1.5}`,
+			`{"id":"1","error":{"errcode":"M_BAD_STATE","error":"The state has changed"}}`,
+		},
+	}
+
+	for _, tt := range tests {
+		sent := false
+		c, srv := newTestConnection(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.EscapedPath() != "/_matrix/client/r0/rooms/%21room:test/state/m.room.name/" {
+				t.Error("Unexpected path:", r.URL.EscapedPath())
+			}
+			if r.Method == "GET" {
+				if f := r.URL.Query().Get("format"); f != "event" {
+					t.Errorf("Expected format=event, got %q", f)
+				}
+				w.Write([]byte(`{"type": "m.room.name", "event_id": "$current", "content": {"name": "Current", "count": 1}}`))
+				return
+			}
+			sent = true
+			w.Write([]byte(`{"event_id": "$event"}`))
+		})
+
+		resp := c.handleRequest([]byte(`{"id": "1", "method": "state", "params": {"room_id": "!room:test", "event_type": "m.room.name", "content": {"name": "Room"}, "if_unchanged": true, ` + tt.params + `}}`))
+		if string(resp) != tt.expected {
+			t.Errorf("Params %s: expected %s, got %s", tt.params, tt.expected, resp)
+		}
+		if expectSent := strings.Contains(tt.expected, "result"); sent != expectSent {
+			t.Errorf("Params %s: expected sent=%v, got %v", tt.params, expectSent, sent)
+		}
+		srv.Close()
+	}
+}
+
+func TestStateIfUnchangedErrors(t *testing.T) {
+	c, srv := newTestConnection(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			t.Error("Unexpected request:", r.Method, r.URL.Path)
+		}
+		if strings.Contains(r.URL.Path, "m.room.topic") {
+			// a server which ignores 'format'
+			w.Write([]byte(`{"topic": "Topic"}`))
+			return
+		}
+		w.WriteHeader(404)
+		w.Write([]byte(`{"errcode": "M_NOT_FOUND", "error": "Event not found"}`))
+	})
+	defer srv.Close()
+
+	tests := []struct {
+		request  string
+		expected string
+	}{
+		{
+			`{"id": "1", "method": "state", "params": {"room_id": "!room:test", "event_type": "m.room.name", "content": {}, "if_unchanged": true}}`,
+			`{"id":"1","error":{"errcode":"M_INVALID_PARAM","error":"if_unchanged requires prev_event_id or prev_content","fields":["if_unchanged"]}}`,
+		},
+		{
+			`{"id": "1", "method": "state", "params": {"room_id": "!room:test", "event_type": "m.room.name", "content": {}, "if_unchanged": "yes", "prev_event_id": "$old"}}`,
+			`{"id":"1","error":{"errcode":"M_INVALID_PARAM","error":"if_unchanged must be a boolean","fields":["if_unchanged"]}}`,
+		},
+		{
+			`{"id": "1", "method": "state", "params": {"room_id": "!room:test", "event_type": "m.room.name", "content": {}, "if_unchanged": true, "prev_event_id": "$old"}}`,
+			`{"id":"1","error":{"errcode":"M_BAD_STATE","error":"The state does not exist"}}`,
+		},
+		{
+			`{"id": "1", "method": "state", "params": {"room_id": "!room:test", "event_type": "m.room.topic", "content": {}, "if_unchanged": true, "prev_event_id": "$old"}}`,
+			`{"id":"1","error":{"errcode":"M_UNRECOGNIZED","error":"The homeserver does not return state event IDs"}}`,
+		},
+		{
+			`{"id": "1", "method": "state", "params": {"room_id": "!room:test", "event_type": "m.room.topic", "content": {}, "if_unchanged": true, "prev_content": {"topic": "Other"}}}`,
+			`{"id":"1","error":{"errcode":"M_BAD_STATE","error":"The state has changed"}}`,
+		},
+	}
+
+	for _, tt := range tests {
+		resp := c.handleRequest([]byte(tt.request))
+		if string(resp) != tt.expected {
+			t.Errorf("Request %s: expected %s, got %s", tt.request, tt.expected, resp)
+		}
+	}
+}
+
+func TestSendRejectsInvalidUTF8(t *testing.T) {
+	c, srv := newTestConnection(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("Unexpected request:", r.Method, r.URL.Path)
+	})
+	defer srv.Close()
+
+	req := []byte(`{"id": "1", "method": "send", "params": {"room_id": "!room:test", "event_type": "m.room.message", "content": {"body": "` + "\xff\xfe" + `"}}}`)
+	resp := c.handleRequest(req)
+	expected := `{"id":null,"error":{"errcode":"M_NOT_JSON","error":"Request is not valid UTF-8"}}`
+	if string(resp) != expected {
+		t.Errorf("Expected %s, got %s", expected, resp)
+	}
+
+	c.JSONRPC = true
+	resp = c.handleJSONRPCRequest(req)
+	expected = `{"jsonrpc":"2.0","id":null,"error":{"code":-32700,"message":"Parse error","data":{"errcode":"M_NOT_JSON","error":"Request is not valid UTF-8"}}}`
+	if string(resp) != expected {
+		t.Errorf("Expected %s, got %s", expected, resp)
+	}
+}
+
+func TestSearch(t *testing.T) {
+	categories := `{"room_events":{"count":1,"results":[],"next_batch":"b2"}}`
+
+	c, srv := newTestConnection(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" || r.URL.Path != "/_matrix/client/r0/search" {
+			t.Error("Unexpected request:", r.Method, r.URL.Path)
+		}
+		if r.URL.Query().Get("next_batch") != "b1" {
+			t.Error("Unexpected query:", r.URL.RawQuery)
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		expected := `{"search_categories":{"room_events":{"search_term":"lunch"}}}`
+		if string(body) != expected {
+			t.Errorf("Expected body %s, got %s", expected, body)
+		}
+		w.Write([]byte(`{"search_categories":` + categories + `}`))
+	})
+	defer srv.Close()
+
+	resp := c.handleRequest([]byte(`{"id": "1", "method": "search", "params": {"next_batch": "b1", "body": {"search_categories": {"room_events": {"search_term": "lunch"}}}}}`))
+	expected := `{"id":"1","result":{"search_categories":` + categories + `}}`
+	if string(resp) != expected {
+		t.Errorf("Expected %s, got %s", expected, resp)
+	}
+
+	resp = c.handleRequest([]byte(`{"id": "2", "method": "search"}`))
+	expected = `{"id":"2","error":{"errcode":"M_MISSING_PARAM","error":"Missing parameter body","fields":["body"]}}`
+	if string(resp) != expected {
+		t.Errorf("Expected %s, got %s", expected, resp)
+	}
+}
+
+func TestReport(t *testing.T) {
+	tests := []struct {
+		params       string
+		expectedBody string
+	}{
+		{
+			`{"room_id": "!room:test", "event_id": "$event", "score": -50, "reason": "spam"}`,
+			`{"reason":"spam","score":-50}`,
+		},
+		{
+			`{"room_id": "!room:test", "event_id": "$event", "score": -500}`,
+			`{"score":-100}`,
+		},
+		{
+			`{"room_id": "!room:test", "event_id": "$event", "score": 20}`,
+			`{"score":0}`,
+		},
+		{
+			`{"room_id": "!room:test", "event_id": "$event", "score": -1e300}`,
+			`{"score":-100}`,
+		},
+		{
+			`{"room_id": "!room:test", "event_id": "$event", "score": 1e300}`,
+			`{"score":0}`,
+		},
+		{
+			`{"room_id": "!room:test", "event_id": "$event"}`,
+			`{}`,
+		},
+	}
+
+	for _, tt := range tests {
+		c, srv := newTestConnection(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != "POST" || r.URL.EscapedPath() != "/_matrix/client/r0/rooms/%21room:test/report/$event" {
+				t.Error("Unexpected request:", r.Method, r.URL.EscapedPath())
+			}
+			body, _ := ioutil.ReadAll(r.Body)
+			if string(body) != tt.expectedBody {
+				t.Errorf("Expected body %s, got %s", tt.expectedBody, body)
+			}
+			w.Write([]byte(`{}`))
+		})
+
+		resp := c.handleRequest([]byte(`{"id": "1", "method": "report", "params": ` + tt.params + `}`))
+		if string(resp) != `{"id":"1","result":{}}` {
+			t.Errorf("Unexpected response: %s", resp)
+		}
+		srv.Close()
+	}
+}
+
+func TestRedact(t *testing.T) {
+	tests := []struct {
+		params       string
+		expectedBody string
+	}{
+		{
+			`{"room_id": "!room:test", "event_id": "$event", "txn_id": "t1", "reason": "spam"}`,
+			`{"reason":"spam"}`,
+		},
+		{
+			`{"room_id": "!room:test", "event_id": "$event", "txn_id": "t1", "reason": ""}`,
+			`{}`,
+		},
+	}
+
+	for _, tt := range tests {
+		c, srv := newTestConnection(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != "PUT" || r.URL.EscapedPath() != "/_matrix/client/r0/rooms/%21room:test/redact/$event/t1" {
+				t.Error("Unexpected request:", r.Method, r.URL.EscapedPath())
+			}
+			body, _ := ioutil.ReadAll(r.Body)
+			if string(body) != tt.expectedBody {
+				t.Errorf("Expected body %s, got %s", tt.expectedBody, body)
+			}
+			w.Write([]byte(`{"event_id": "$redaction"}`))
+		})
+
+		resp := c.handleRequest([]byte(`{"id": "1", "method": "redact", "params": ` + tt.params + `}`))
+		if string(resp) != `{"id":"1","result":{"event_id":"$redaction"}}` {
+			t.Errorf("Unexpected response: %s", resp)
+		}
+		srv.Close()
+	}
+}
@@ -0,0 +1,122 @@
+package proxy
+
+import (
+	"encoding/json"
+	"unicode/utf8"
+)
+
+// JSON-RPC 2.0 error codes
+const (
+	jsonRPCParseError     = -32700
+	jsonRPCInvalidRequest = -32600
+	jsonRPCMethodNotFound = -32601
+	jsonRPCInvalidParams  = -32602
+	jsonRPCServerError    = -32000
+)
+
+type jsonRPCRequest struct {
+	JSONRPC string `json:"jsonrpc"`
+
+	// JSON-RPC allows numbers as well as strings as IDs, so we keep it in its
+	// raw form to echo back.
+	ID     json.RawMessage        `json:"id"`
+	Method string                 `json:"method"`
+	Params map[string]interface{} `json:"params"`
+}
+
+type jsonRPCError struct {
+	Code    int                 `json:"code"`
+	Message string              `json:"message"`
+	Data    *MatrixErrorDetails `json:"data,omitempty"`
+}
+
+type jsonRPCResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Result  interface{}     `json:"result,omitempty"`
+	Error   *jsonRPCError   `json:"error,omitempty"`
+}
+
+// jsonRPCNotification is a message sent to the client which is not a
+// response to any request.
+type jsonRPCNotification struct {
+	JSONRPC string      `json:"jsonrpc"`
+	Method  string      `json:"method"`
+	Params  interface{} `json:"params"`
+}
+
+// handleJSONRPCRequest is the equivalent of handleRequest for connections in
+// JSON-RPC 2.0 mode. It returns nil if no response should be sent.
+func (c *Connection) handleJSONRPCRequest(request []byte) []byte {
+	var resp *jsonRPCResponse
+	var jr jsonRPCRequest
+
+	if !utf8.Valid(request) {
+		logInfo("Invalid request: not valid UTF-8")
+		resp = newJSONRPCErrorResponse(nil, jsonRPCParseError, "Parse error",
+			&MatrixErrorDetails{ErrCode: "M_NOT_JSON", Error: "Request is not valid UTF-8"})
+	} else if err := unmarshalRequest(request, &jr); err != nil {
+		logInfo("Invalid request:", err)
+		resp = newJSONRPCErrorResponse(nil, jsonRPCParseError, "Parse error",
+			&MatrixErrorDetails{ErrCode: "M_NOT_JSON", Error: err.Error()})
+	} else if jr.JSONRPC != "2.0" {
+		resp = newJSONRPCErrorResponse(jr.ID, jsonRPCInvalidRequest,
+			"Invalid Request", nil)
+	} else if len(jr.ID) == 0 {
+		// a notification: the spec forbids us from replying, so there is
+		// not much point in doing anything at all.
+		logDebug("Ignoring JSON-RPC notification for", jr.Method)
+		return nil
+	} else if _, ok := handlerMap[jr.Method]; !ok {
+		logInfo("Unknown method:", jr.Method)
+		resp = newJSONRPCErrorResponse(jr.ID, jsonRPCMethodNotFound,
+			"Method not found", nil)
+	} else if !c.claimRequestID(string(jr.ID)) {
+		logInfo("Duplicate request id:", string(jr.ID))
+		resp = newJSONRPCErrorResponse(jr.ID, jsonRPCInvalidRequest,
+			"Invalid Request", errDuplicateRequestID)
+	} else {
+		defer c.releaseRequestID(string(jr.ID))
+		r := c.handleRequestObject(&jsonRequest{
+			Method: jr.Method,
+			Params: jr.Params,
+		})
+		if r.Error != nil {
+			resp = newJSONRPCErrorResponse(jr.ID, jsonRPCErrorCode(r.Error),
+				r.Error.Error, r.Error)
+		} else {
+			resp = &jsonRPCResponse{JSONRPC: "2.0", ID: jr.ID, Result: r.Result}
+		}
+	}
+
+	v, err := json.Marshal(resp)
+	if err != nil {
+		logError("Error marshalling:", err)
+		return nil
+	}
+	return v
+}
+
+func newJSONRPCErrorResponse(id json.RawMessage, code int, message string, data *MatrixErrorDetails) *jsonRPCResponse {
+	if len(id) == 0 {
+		id = json.RawMessage("null")
+	}
+	return &jsonRPCResponse{
+		JSONRPC: "2.0",
+		ID:      id,
+		Error: &jsonRPCError{
+			Code:    code,
+			Message: message,
+			Data:    data,
+		},
+	}
+}
+
+// jsonRPCErrorCode maps a Matrix error to a JSON-RPC error code
+func jsonRPCErrorCode(e *MatrixErrorDetails) int {
+	switch e.ErrCode {
+	case "M_MISSING_PARAM", "M_INVALID_PARAM":
+		return jsonRPCInvalidParams
+	}
+	return jsonRPCServerError
+}
@@ -0,0 +1,59 @@
+package proxy
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestJSONRPC(t *testing.T) {
+	c, srv := newTestConnection(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(403)
+		w.Write([]byte(`{"errcode": "M_FORBIDDEN", "error": "Nope"}`))
+	})
+	defer srv.Close()
+
+	tests := []struct {
+		request          string
+		expectedResponse string
+	}{
+		{
+			`{"jsonrpc": "2.0", "id": 1, "method": "ping"}`,
+			`{"jsonrpc":"2.0","id":1,"result":{}}`,
+		},
+		{
+			`{"jsonrpc": "2.0", "id": "abc", "method": "capabilities"}`,
+			`{"jsonrpc":"2.0","id":"abc","error":{"code":-32000,"message":"Nope","data":{"errcode":"M_FORBIDDEN","error":"Nope","status_code":403}}}`,
+		},
+		{
+			`{"jsonrpc": "2.0", "id": 2, "method": "set_join_rules", "params": {"room_id": "!room:test"}}`,
+			`{"jsonrpc":"2.0","id":2,"error":{"code":-32602,"message":"Missing parameter join_rule","data":{"errcode":"M_MISSING_PARAM","error":"Missing parameter join_rule","fields":["join_rule"]}}}`,
+		},
+		{
+			`{"jsonrpc": "2.0", "id": 3, "method": "frobnicate"}`,
+			`{"jsonrpc":"2.0","id":3,"error":{"code":-32601,"message":"Method not found"}}`,
+		},
+		{
+			`{"id": 4, "method": "ping"}`,
+			`{"jsonrpc":"2.0","id":4,"error":{"code":-32600,"message":"Invalid Request"}}`,
+		},
+		{
+			`{"jsonrpc": "2.0", "id": 5`,
+			`{"jsonrpc":"2.0","id":null,"error":{"code":-32700,"message":"Parse error","data":{"errcode":"M_NOT_JSON","error":"unexpected end of JSON input"}}}`,
+		},
+	}
+
+	for _, tt := range tests {
+		resp := c.handleJSONRPCRequest([]byte(tt.request))
+		if string(resp) != tt.expectedResponse {
+			t.Errorf("Request %s: expected %s, got %s", tt.request,
+				tt.expectedResponse, resp)
+		}
+	}
+}
+
+func TestJSONRPCNotification(t *testing.T) {
+	c := &Connection{}
+	if resp := c.handleJSONRPCRequest([]byte(`{"jsonrpc": "2.0", "method": "ping"}`)); resp != nil {
+		t.Errorf("Expected no response to a notification, got %s", resp)
+	}
+}
@@ -0,0 +1,36 @@
+package proxy
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// handleGetUserDevices returns the devices of a user, with their keys, and
+// the user's cross-signing keys, for verification.
+func handleGetUserDevices(c *Connection, req *jsonRequest) (interface{}, error) {
+	p := newParamReader(req)
+	userID := p.string("user_id")
+	if userID != "" && (userID[0] != '@' || strings.Index(userID, ":") < 2) {
+		p.addInvalid("user_id", "must be of the form @localpart:server")
+	}
+	if err := p.err(); err != nil {
+		return nil, err
+	}
+
+	keys, err := c.client.QueryKeys(req.ctx, map[string][]string{userID: {}})
+	if err != nil {
+		return nil, err
+	}
+
+	result := map[string]json.RawMessage{"devices": json.RawMessage(`{}`)}
+	if devices, ok := keys.DeviceKeys[userID]; ok {
+		result["devices"] = devices
+	}
+	if key, ok := keys.MasterKeys[userID]; ok {
+		result["master_key"] = key
+	}
+	if key, ok := keys.SelfSigningKeys[userID]; ok {
+		result["self_signing_key"] = key
+	}
+	return result, nil
+}
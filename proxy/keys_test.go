@@ -0,0 +1,48 @@
+package proxy
+
+import (
+	"io/ioutil"
+	"net/http"
+	"testing"
+)
+
+func TestGetUserDevices(t *testing.T) {
+	devices := `{"DEVICE":{"user_id":"@bob:test","device_id":"DEVICE","keys":{"ed25519:DEVICE":"key"}}}`
+	masterKey := `{"user_id":"@bob:test","usage":["master"],"keys":{"ed25519:master":"master"}}`
+
+	c, srv := newTestConnection(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" || r.URL.Path != "/_matrix/client/r0/keys/query" {
+			t.Error("Unexpected request:", r.Method, r.URL.Path)
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		if string(body) != `{"device_keys":{"@bob:test":[]}}` {
+			t.Errorf("Unexpected body %s", body)
+		}
+		w.Write([]byte(`{"failures": {}, "device_keys": {"@bob:test": ` + devices + `}, "master_keys": {"@bob:test": ` + masterKey + `}}`))
+	})
+	defer srv.Close()
+
+	resp := c.handleRequest([]byte(`{"id": "1", "method": "get_user_devices", "params": {"user_id": "@bob:test"}}`))
+	expected := `{"id":"1","result":{"devices":` + devices + `,"master_key":` + masterKey + `}}`
+	if string(resp) != expected {
+		t.Errorf("Expected %s, got %s", expected, resp)
+	}
+}
+
+func TestGetUserDevicesUnknownUser(t *testing.T) {
+	c, srv := newTestConnection(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"failures": {}, "device_keys": {}}`))
+	})
+	defer srv.Close()
+
+	resp := c.handleRequest([]byte(`{"id": "1", "method": "get_user_devices", "params": {"user_id": "@nobody:test"}}`))
+	if string(resp) != `{"id":"1","result":{"devices":{}}}` {
+		t.Errorf("Unexpected response %s", resp)
+	}
+
+	resp = c.handleRequest([]byte(`{"id": "2", "method": "get_user_devices", "params": {"user_id": "bob"}}`))
+	expected := `{"id":"2","error":{"errcode":"M_INVALID_PARAM","error":"user_id must be of the form @localpart:server","fields":["user_id"]}}`
+	if string(resp) != expected {
+		t.Errorf("Expected %s, got %s", expected, resp)
+	}
+}
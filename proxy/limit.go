@@ -0,0 +1,77 @@
+package proxy
+
+import (
+	"context"
+	"time"
+)
+
+// upstreamSlots limits the number of concurrent requests to the upstream
+// server, across all connections: a request must put a token into it before
+// being made. If nil, there is no limit.
+//
+// The long-polling syncs made by a Syncer are exempt, since they would hold
+// their slots for the whole of their timeouts, and each connection only makes
+// one at a time anyway. One-off syncs made for a client's request, such as
+// 'get_invites', are not.
+var upstreamSlots chan struct{}
+
+// How long a request waits for a slot before giving up.
+var upstreamSlotWait = time.Second
+
+// errUpstreamBusy is returned for requests which could not be made because
+// there were already too many requests in flight.
+var errUpstreamBusy = &requestError{
+	errCode: "M_LIMIT_EXCEEDED",
+	message: "Too many requests to the homeserver; try again later",
+}
+
+// SetMaxUpstreamConcurrency sets the maximum number of concurrent requests to
+// the upstream server, other than long-polling syncs. Zero means no limit. It
+// should be called before any requests are made.
+func SetMaxUpstreamConcurrency(n int) {
+	if n > 0 {
+		upstreamSlots = make(chan struct{}, n)
+	} else {
+		upstreamSlots = nil
+	}
+}
+
+type upstreamLimitKey struct{}
+
+// withoutUpstreamLimit returns a context for a request which does not need an
+// upstream slot.
+func withoutUpstreamLimit(ctx context.Context) context.Context {
+	return context.WithValue(ctx, upstreamLimitKey{}, true)
+}
+
+// isUpstreamLimited returns false if the context was returned by
+// withoutUpstreamLimit.
+func isUpstreamLimited(ctx context.Context) bool {
+	return ctx.Value(upstreamLimitKey{}) == nil
+}
+
+// acquireUpstreamSlot waits for a free slot for an upstream request. It
+// returns errUpstreamBusy if none became free in time. If it returns nil, the
+// caller must call releaseUpstreamSlot when the request is complete.
+func acquireUpstreamSlot(ctx context.Context) error {
+	if upstreamSlots == nil {
+		return nil
+	}
+
+	timer := time.NewTimer(upstreamSlotWait)
+	defer timer.Stop()
+	select {
+	case upstreamSlots <- struct{}{}:
+		return nil
+	case <-timer.C:
+		return errUpstreamBusy
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func releaseUpstreamSlot() {
+	if upstreamSlots != nil {
+		<-upstreamSlots
+	}
+}
@@ -0,0 +1,64 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestMaxUpstreamConcurrency(t *testing.T) {
+	defer SetMaxUpstreamConcurrency(0)
+	defer func(w time.Duration) { upstreamSlotWait = w }(upstreamSlotWait)
+	SetMaxUpstreamConcurrency(1)
+	upstreamSlotWait = 20 * time.Millisecond
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	c, srv := newTestConnection(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/_matrix/client/r0/pushers" {
+			close(started)
+			<-release
+		}
+		w.Write([]byte(`{"pushers": [], "capabilities": {}, "next_batch": "s1"}`))
+	})
+	defer srv.Close()
+
+	// the first request takes the only slot...
+	first := make(chan []byte)
+	go func() {
+		first <- c.handleRequest([]byte(`{"id": "1", "method": "get_pushers"}`))
+	}()
+	<-started
+
+	// ... so the second is turned away
+	resp := c.handleRequest([]byte(`{"id": "2", "method": "capabilities"}`))
+	expected := `{"id":"2","error":{"errcode":"M_LIMIT_EXCEEDED","error":"Too many requests to the homeserver; try again later"}}`
+	if string(resp) != expected {
+		t.Errorf("Expected %s, got %s", expected, resp)
+	}
+
+	// nor are one-off syncs made for a client's request
+	resp = c.handleRequest([]byte(`{"id": "2", "method": "get_invites"}`))
+	if string(resp) != expected {
+		t.Errorf("Expected %s, got %s", expected, resp)
+	}
+
+	// the connection's long-polling syncs don't need a slot
+	syncer := &Syncer{Client: c.client, SyncParams: url.Values{}}
+	if _, err := syncer.MakeRequest(context.Background()); err != nil {
+		t.Errorf("Expected the sync to be made, got %v", err)
+	}
+
+	close(release)
+	if resp := <-first; string(resp) != `{"id":"1","result":{"pushers":[]}}` {
+		t.Errorf("Unexpected response to first request: %s", resp)
+	}
+
+	// now the slot is free again
+	resp = c.handleRequest([]byte(`{"id": "3", "method": "capabilities"}`))
+	if string(resp) != `{"id":"3","result":{}}` {
+		t.Errorf("Unexpected response after slot freed: %s", resp)
+	}
+}
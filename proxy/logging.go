@@ -0,0 +1,68 @@
+package proxy
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync/atomic"
+)
+
+// A LogLevel is the severity of a log message.
+type LogLevel int32
+
+const (
+	LogDebug LogLevel = iota
+	LogInfo
+	LogWarn
+	LogError
+)
+
+var logLevelNames = map[string]LogLevel{
+	"debug": LogDebug,
+	"info":  LogInfo,
+	"warn":  LogWarn,
+	"error": LogError,
+}
+
+// the minimum level of message which is logged; accessed atomically.
+var logLevel = int32(LogDebug)
+
+// ParseLogLevel parses the name of a log level: one of debug, info, warn or
+// error.
+func ParseLogLevel(name string) (LogLevel, error) {
+	level, ok := logLevelNames[strings.ToLower(name)]
+	if !ok {
+		return 0, fmt.Errorf("unknown log level %q", name)
+	}
+	return level, nil
+}
+
+// SetLogLevel sets the minimum level of message which is logged. The default
+// is LogDebug, which logs everything.
+func SetLogLevel(level LogLevel) {
+	atomic.StoreInt32(&logLevel, int32(level))
+}
+
+func logAt(level LogLevel, msg string) {
+	if int32(level) < atomic.LoadInt32(&logLevel) {
+		return
+	}
+	// skip logAt and its caller, so that if the log flags ask for the file
+	// and line, they are those of the code logging the message
+	log.Output(3, msg)
+}
+
+func logDebug(v ...interface{}) { logAt(LogDebug, fmt.Sprintln(v...)) }
+func logInfo(v ...interface{})  { logAt(LogInfo, fmt.Sprintln(v...)) }
+func logWarn(v ...interface{})  { logAt(LogWarn, fmt.Sprintln(v...)) }
+func logError(v ...interface{}) { logAt(LogError, fmt.Sprintln(v...)) }
+
+func logInfof(format string, v ...interface{})  { logAt(LogInfo, fmt.Sprintf(format, v...)) }
+func logWarnf(format string, v ...interface{})  { logAt(LogWarn, fmt.Sprintf(format, v...)) }
+func logErrorf(format string, v ...interface{}) { logAt(LogError, fmt.Sprintf(format, v...)) }
+
+// Logf logs a message at the given level, unless it is below the level set by
+// SetLogLevel, for messages from outside the package.
+func Logf(level LogLevel, format string, v ...interface{}) {
+	logAt(level, fmt.Sprintf(format, v...))
+}
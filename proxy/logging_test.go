@@ -0,0 +1,49 @@
+package proxy
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestLogLevel(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+	defer SetLogLevel(LogDebug)
+
+	SetLogLevel(LogInfo)
+	logDebug("Got message:", "hello")
+	logInfof("Retrying sync in %v\n", "1s")
+	logError("Error sending message:", "boom")
+
+	out := buf.String()
+	if strings.Contains(out, "Got message") {
+		t.Errorf("Debug message was logged at info level: %q", out)
+	}
+	if !strings.Contains(out, "Retrying sync in 1s\n") {
+		t.Errorf("Info message was not logged: %q", out)
+	}
+	if !strings.Contains(out, "Error sending message: boom\n") {
+		t.Errorf("Error message was not logged: %q", out)
+	}
+
+	buf.Reset()
+	SetLogLevel(LogError)
+	logWarn("Error in reader:", "eof")
+	logError("Error marshalling:", "bad")
+	if out := buf.String(); strings.Contains(out, "Error in reader") || !strings.Contains(out, "Error marshalling: bad") {
+		t.Errorf("Unexpected output at error level: %q", out)
+	}
+}
+
+func TestParseLogLevel(t *testing.T) {
+	if level, err := ParseLogLevel("WARN"); err != nil || level != LogWarn {
+		t.Errorf("Expected LogWarn, got %v, %v", level, err)
+	}
+	if _, err := ParseLogLevel("verbose"); err == nil || err.Error() != `unknown log level "verbose"` {
+		t.Errorf("Unexpected error %v", err)
+	}
+}
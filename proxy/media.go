@@ -0,0 +1,77 @@
+package proxy
+
+import (
+	"encoding/base64"
+	"strings"
+)
+
+// Maximum size of media which can be fetched with 'download'. The content is
+// sent to the client base64-encoded in a single message, so this is kept
+// fairly small. Larger media is not read from the upstream server at all.
+var maxDownloadBytes int64 = 10 * 1024 * 1024
+
+// the allowed values of 'method' for thumbnails
+var thumbnailMethods = []string{"crop", "scale"}
+
+// parseMXC splits an mxc:// URI into its server name and media ID, returning
+// ok=false if it is not a valid mxc URI.
+func parseMXC(uri string) (serverName string, mediaID string, ok bool) {
+	if !strings.HasPrefix(uri, "mxc://") {
+		return "", "", false
+	}
+	parts := strings.Split(strings.TrimPrefix(uri, "mxc://"), "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", false
+	}
+	return parts[0], parts[1], true
+}
+
+// handleDownload fetches a piece of media, or a thumbnail of it if 'width'
+// and 'height' are given, and returns it base64-encoded.
+func handleDownload(c *Connection, req *jsonRequest) (interface{}, error) {
+	p := newParamReader(req)
+	mxc := p.string("mxc")
+	width := p.optionalNumber("width")
+	height := p.optionalNumber("height")
+	method := p.optionalEnum("method", thumbnailMethods)
+
+	serverName, mediaID, ok := parseMXC(mxc)
+	if mxc != "" && !ok {
+		p.addInvalid("mxc", "must be of the form mxc://server/id")
+	}
+	if (width == nil) != (height == nil) {
+		p.addInvalid("width", "and height must be given together")
+	} else if width != nil && (*width < 1 || *height < 1) {
+		p.addInvalid("width", "and height must be positive")
+	}
+	if method != "" && width == nil {
+		p.addInvalid("method", "requires width and height")
+	}
+	if err := p.err(); err != nil {
+		return nil, err
+	}
+
+	var w, h int
+	if width != nil {
+		w, h = int(*width), int(*height)
+	}
+
+	content, contentType, err := c.client.DownloadMedia(req.ctx, serverName, mediaID, w, h, method, maxDownloadBytes)
+	if err == errResponseTooLarge {
+		return nil, &requestError{errCode: "M_TOO_LARGE", message: "Media is too large to download"}
+	} else if err != nil {
+		return nil, err
+	}
+
+	return map[string]interface{}{
+		"content":      base64.StdEncoding.EncodeToString(content),
+		"content_type": contentType,
+		"size":         len(content),
+	}, nil
+}
+
+// handleMediaConfig returns the homeserver's media configuration, so that
+// clients can check the upload size limit.
+func handleMediaConfig(c *Connection, req *jsonRequest) (interface{}, error) {
+	return c.client.GetMediaConfig(req.ctx)
+}
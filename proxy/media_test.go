@@ -0,0 +1,124 @@
+package proxy
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestDownload(t *testing.T) {
+	c, srv := newTestConnection(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/_matrix/media/r0/download/example.org/abcd" {
+			t.Error("Unexpected path:", r.URL.Path)
+		}
+		if r.URL.RawQuery != "" {
+			t.Error("Unexpected query:", r.URL.RawQuery)
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte("hello"))
+	})
+	defer srv.Close()
+
+	resp := c.handleRequest([]byte(`{"id": "1", "method": "download", "params": {"mxc": "mxc://example.org/abcd"}}`))
+	expected := `{"id":"1","result":{"content":"aGVsbG8=","content_type":"text/plain","size":5}}`
+	if string(resp) != expected {
+		t.Errorf("Expected %s, got %s", expected, resp)
+	}
+}
+
+func TestDownloadTooLarge(t *testing.T) {
+	defer func(n int64) { maxDownloadBytes = n }(maxDownloadBytes)
+	maxDownloadBytes = 4
+
+	tests := []struct {
+		content  string
+		chunked  bool
+		expected string
+	}{
+		{"hell", false, `{"id":"1","result":{"content":"aGVsbA==","content_type":"text/plain","size":4}}`},
+		{"hell", true, `{"id":"1","result":{"content":"aGVsbA==","content_type":"text/plain","size":4}}`},
+		// refused because of the Content-Length
+		{"hello", false, `{"id":"1","error":{"errcode":"M_TOO_LARGE","error":"Media is too large to download"}}`},
+		// refused once more than the limit has been read
+		{"hello", true, `{"id":"1","error":{"errcode":"M_TOO_LARGE","error":"Media is too large to download"}}`},
+	}
+	for _, tt := range tests {
+		c, srv := newTestConnection(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/plain")
+			if tt.chunked {
+				// flushing before writing stops the Content-Length being set
+				w.(http.Flusher).Flush()
+			}
+			w.Write([]byte(tt.content))
+		})
+
+		resp := c.handleRequest([]byte(`{"id": "1", "method": "download", "params": {"mxc": "mxc://example.org/abcd"}}`))
+		if string(resp) != tt.expected {
+			t.Errorf("%s (chunked %v): expected %s, got %s", tt.content, tt.chunked, tt.expected, resp)
+		}
+		srv.Close()
+	}
+}
+
+func TestDownloadThumbnail(t *testing.T) {
+	c, srv := newTestConnection(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/_matrix/media/r0/thumbnail/example.org/abcd" {
+			t.Error("Unexpected path:", r.URL.Path)
+		}
+		if r.URL.RawQuery != "height=48&method=crop&width=64" {
+			t.Error("Unexpected query:", r.URL.RawQuery)
+		}
+		w.Header().Set("Content-Type", "image/png")
+		w.Write([]byte{0x89, 'P', 'N', 'G'})
+	})
+	defer srv.Close()
+
+	resp := c.handleRequest([]byte(`{"id": "1", "method": "download", "params": {"mxc": "mxc://example.org/abcd", "width": 64, "height": 48, "method": "crop"}}`))
+	expected := `{"id":"1","result":{"content":"iVBORw==","content_type":"image/png","size":4}}`
+	if string(resp) != expected {
+		t.Errorf("Expected %s, got %s", expected, resp)
+	}
+}
+
+func TestDownloadValidation(t *testing.T) {
+	tests := []struct {
+		params   string
+		expected string
+	}{
+		{
+			`{"mxc": "http://example.org/abcd"}`,
+			`{"id":"1","error":{"errcode":"M_INVALID_PARAM","error":"mxc must be of the form mxc://server/id","fields":["mxc"]}}`,
+		},
+		{
+			`{"mxc": "mxc://example.org/ab/cd", "width": 64}`,
+			`{"id":"1","error":{"errcode":"M_INVALID_PARAM","error":"mxc must be of the form mxc://server/id; width and height must be given together","fields":["mxc","width"]}}`,
+		},
+		{
+			`{"mxc": "mxc://example.org/abcd", "method": "scale"}`,
+			`{"id":"1","error":{"errcode":"M_INVALID_PARAM","error":"method requires width and height","fields":["method"]}}`,
+		},
+	}
+
+	c := &Connection{}
+	for _, tt := range tests {
+		resp := c.handleRequest([]byte(`{"id": "1", "method": "download", "params": ` + tt.params + `}`))
+		if string(resp) != tt.expected {
+			t.Errorf("%s: expected %s, got %s", tt.params, tt.expected, resp)
+		}
+	}
+}
+
+func TestMediaConfig(t *testing.T) {
+	c, srv := newTestConnection(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" || r.URL.Path != "/_matrix/media/r0/config" {
+			t.Error("Unexpected request:", r.Method, r.URL.Path)
+		}
+		w.Write([]byte(`{"m.upload.size": 52428800}`))
+	})
+	defer srv.Close()
+
+	resp := c.handleRequest([]byte(`{"id": "1", "method": "media_config"}`))
+	expected := `{"id":"1","result":{"m.upload.size":52428800}}`
+	if string(resp) != expected {
+		t.Errorf("Expected %s, got %s", expected, resp)
+	}
+}
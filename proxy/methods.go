@@ -0,0 +1,89 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+)
+
+// methodDescriptions gives a brief description of each method in handlerMap,
+// for ServeMethods.
+var methodDescriptions = map[string]string{
+	"ping":                   "Check that the connection is alive",
+	"send":                   "Send a message event to a room",
+	"edit":                   "Replace the content of a message with a new body or content",
+	"state":                  "Send a state event to a room",
+	"get_state_event":        "Get the content of a room's current state event of a given type and state key",
+	"get_state_events":       "Get the content of several of a room's current state events",
+	"redact":                 "Redact an event",
+	"capabilities":           "Get the homeserver's capabilities",
+	"bootstrap":              "Get the user's identity, the homeserver's versions and capabilities, and the joined rooms in one request",
+	"set_join_rules":         "Set the join rules of a room",
+	"set_guest_access":       "Set whether guests can join a room",
+	"set_history_visibility": "Set the history visibility of a room",
+	"upgrade_room":           "Upgrade a room to a new room version",
+	"knock":                  "Knock on a room",
+	"room_summary":           "Get a summary of a room, such as its name and size",
+	"pin_events":             "Add events to the pinned events of a room",
+	"unpin_events":           "Remove events from the pinned events of a room",
+	"get_invites":            "Get the rooms the user is invited to",
+	"add_alias":              "Add an alias for a room",
+	"delete_alias":           "Remove a room alias",
+	"refresh":                "Get a sync response straight away",
+	"set_filter":             "Change the filter used for syncs",
+	"ephemeral_only":         "Restrict syncs to typing notifications, receipts and presence",
+	"subscribe_rooms":        "Only sync the given rooms, and any others subscribed to",
+	"unsubscribe_rooms":      "Stop syncing rooms subscribed to with subscribe_rooms",
+	"mute_presence":          "Go offline, and stop receiving presence",
+	"threads":                "List the threads in a room",
+	"relations":              "Get the events which relate to an event",
+	"search":                 "Search for events",
+	"media_config":           "Get the homeserver's media configuration, such as the upload size limit",
+	"download":               "Download a piece of media",
+	"report":                 "Report an event to the homeserver administrators",
+	"queue_receipt":          "Queue a read receipt to be sent later",
+	"flush_receipts":         "Send any queued read receipts",
+	"get_receipts":           "Get the read receipts in a room",
+	"get_pushers":            "List the user's pushers",
+	"set_pusher":             "Create, update or delete a pusher",
+	"get_account_data":       "Get the user's global or per-room account data of a given type",
+	"auth_metadata":          "Get the homeserver's OIDC authorization server metadata",
+	"get_3pids":              "List the email addresses and phone numbers on the user's account",
+	"delete_3pid":            "Remove an email address or phone number from the user's account",
+	"get_user_devices":       "Get a user's devices and keys, for verification",
+	"request_openid_token":   "Get an OpenID token to prove the user's identity to a third party",
+	"set_access_token":       "Switch the connection to a new access token for the same device, such as after a token refresh",
+	"register_guest":         "Register a guest user, and switch the connection to it",
+	"set_profile":            "Set the user's display name and/or avatar",
+	"get_tags":               "Get the user's tags for a room",
+	"set_tag":                "Add a tag to a room",
+	"delete_tag":             "Remove a tag from a room",
+	"cs_api":                 "Make an arbitrary client-server API request",
+}
+
+type methodInfo struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}
+
+// ServeMethods handles HTTP requests for the list of methods supported by the
+// proxy, so that client developers can discover them without connecting.
+func ServeMethods(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	methods := make([]methodInfo, 0, len(handlerMap))
+	for name := range handlerMap {
+		methods = append(methods, methodInfo{name, methodDescriptions[name]})
+	}
+	sort.Slice(methods, func(i, j int) bool {
+		return methods[i].Name < methods[j].Name
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(methods); err != nil {
+		logError("Error writing method list:", err)
+	}
+}
@@ -0,0 +1,50 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestServeMethods(t *testing.T) {
+	w := httptest.NewRecorder()
+	ServeMethods(w, httptest.NewRequest("GET", "/methods", nil))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", w.Code)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Expected JSON content type, got %q", ct)
+	}
+
+	var methods []methodInfo
+	if err := json.Unmarshal(w.Body.Bytes(), &methods); err != nil {
+		t.Fatal("Error decoding response:", err)
+	}
+	if len(methods) != len(handlerMap) {
+		t.Errorf("Expected %d methods, got %d", len(handlerMap), len(methods))
+	}
+	for i, m := range methods {
+		if _, ok := handlerMap[m.Name]; !ok {
+			t.Errorf("Unknown method %q", m.Name)
+		}
+		if m.Description == "" {
+			t.Errorf("Method %q has no description", m.Name)
+		}
+		if i > 0 && methods[i-1].Name >= m.Name {
+			t.Errorf("Methods not sorted: %q before %q", methods[i-1].Name, m.Name)
+		}
+	}
+	if len(methods) == 0 || methods[0] != (methodInfo{"add_alias", "Add an alias for a room"}) {
+		t.Errorf("Unexpected first method %v", methods)
+	}
+}
+
+func TestServeMethodsRejectsPost(t *testing.T) {
+	w := httptest.NewRecorder()
+	ServeMethods(w, httptest.NewRequest("POST", "/methods", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected status 405, got %d", w.Code)
+	}
+}
@@ -0,0 +1,146 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// The causes of a connection closing, used to label the close counter.
+const (
+	CloseCauseClient    = "client"
+	CloseCauseNetwork   = "network"
+	CloseCauseIdle      = "idle"
+	CloseCauseAuth      = "auth"
+	CloseCauseRateLimit = "rate_limit"
+	CloseCauseUpstream  = "upstream"
+	CloseCauseAdmin     = "admin"
+)
+
+type closeLabels struct {
+	code  int
+	cause string
+}
+
+// closeCounts counts the connections which have closed, by close code and
+// cause.
+var closeCounts = struct {
+	sync.Mutex
+	counts map[closeLabels]uint64
+}{counts: make(map[closeLabels]uint64)}
+
+func countClose(code int, cause string) {
+	closeCounts.Lock()
+	defer closeCounts.Unlock()
+	closeCounts.counts[closeLabels{code, cause}]++
+}
+
+// closeCount returns the number of connections which have closed with the
+// given code and cause.
+func closeCount(code int, cause string) uint64 {
+	closeCounts.Lock()
+	defer closeCounts.Unlock()
+	return closeCounts.counts[closeLabels{code, cause}]
+}
+
+// recordClose notes why the connection is closing. Only the first reason is
+// kept, so that when we close the connection, the client's response is not
+// counted as the client closing it.
+func (c *Connection) recordClose(code int, cause string) {
+	c.closeMutex.Lock()
+	defer c.closeMutex.Unlock()
+	if c.closeCause == "" {
+		c.closeCode = code
+		c.closeCause = cause
+	}
+}
+
+// countConnectionClose adds the recorded close reason to the close counter.
+func (c *Connection) countConnectionClose() {
+	c.closeMutex.Lock()
+	code, cause := c.closeCode, c.closeCause
+	c.closeMutex.Unlock()
+
+	if cause == "" {
+		code, cause = websocket.CloseAbnormalClosure, CloseCauseNetwork
+	}
+	countClose(code, cause)
+}
+
+// readErrorCause returns the cause of the reader failing with the given error.
+func readErrorCause(err error) (int, string) {
+	var closeErr *websocket.CloseError
+	if errors.As(err, &closeErr) {
+		// the websocket library reports the connection dropping as an
+		// abnormal closure
+		if closeErr.Code == websocket.CloseAbnormalClosure {
+			return closeErr.Code, CloseCauseNetwork
+		}
+		return closeErr.Code, CloseCauseClient
+	}
+
+	// the read deadline is extended whenever the client answers a ping, so
+	// a timeout means it has stopped responding.
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return websocket.CloseAbnormalClosure, CloseCauseIdle
+	}
+	return websocket.CloseAbnormalClosure, CloseCauseNetwork
+}
+
+// syncErrorCause returns the cause to record when the connection is closed
+// because a sync failed with the given error.
+func syncErrorCause(err error) string {
+	if isAuthError(err) {
+		return CloseCauseAuth
+	}
+	switch e := err.(type) {
+	case *MatrixError:
+		if e.StatusCode == http.StatusTooManyRequests || e.Details.ErrCode == "M_LIMIT_EXCEEDED" {
+			return CloseCauseRateLimit
+		}
+	case *HTTPError:
+		if e.StatusCode == http.StatusTooManyRequests {
+			return CloseCauseRateLimit
+		}
+	}
+	return CloseCauseUpstream
+}
+
+// ServeMetrics handles HTTP requests for the proxy's metrics, in the
+// Prometheus text format.
+func ServeMetrics(w http.ResponseWriter, r *http.Request) {
+	closeCounts.Lock()
+	labels := make([]closeLabels, 0, len(closeCounts.counts))
+	for l := range closeCounts.counts {
+		labels = append(labels, l)
+	}
+	counts := make(map[closeLabels]uint64, len(labels))
+	for _, l := range labels {
+		counts[l] = closeCounts.counts[l]
+	}
+	closeCounts.Unlock()
+
+	sort.Slice(labels, func(i, j int) bool {
+		if labels[i].code != labels[j].code {
+			return labels[i].code < labels[j].code
+		}
+		return labels[i].cause < labels[j].cause
+	})
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	fmt.Fprintln(w, "# HELP websockets_proxy_connections_closed_total Connections which have closed, by close code and cause.")
+	fmt.Fprintln(w, "# TYPE websockets_proxy_connections_closed_total counter")
+	for _, l := range labels {
+		fmt.Fprintf(w, "websockets_proxy_connections_closed_total{code=\"%d\",cause=\"%s\"} %d\n",
+			l.code, l.cause, counts[l])
+	}
+	writeStalenessMetric(w, time.Now())
+	writeTenantMetrics(w)
+}
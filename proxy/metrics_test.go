@@ -0,0 +1,227 @@
+package proxy
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// waitForCloseCount waits for the count of closes with the given labels to
+// reach the expected value.
+func waitForCloseCount(t *testing.T, code int, cause string, expected uint64) {
+	deadline := time.Now().Add(2 * time.Second)
+	for closeCount(code, cause) != expected {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected %d closes with code %d and cause %s, got %d",
+				expected, code, cause, closeCount(code, cause))
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestCloseCounts(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		body   string
+		close  func(ws *websocket.Conn)
+		code   int
+		cause  string
+	}{
+		{
+			name: "client close",
+			close: func(ws *websocket.Conn) {
+				ws.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, ""))
+			},
+			code:  websocket.CloseGoingAway,
+			cause: CloseCauseClient,
+		},
+		{
+			name:  "network",
+			close: func(ws *websocket.Conn) { ws.UnderlyingConn().Close() },
+			code:  websocket.CloseAbnormalClosure,
+			cause: CloseCauseNetwork,
+		},
+		{
+			name:   "auth",
+			status: 401,
+			body:   `{"errcode": "M_UNKNOWN_TOKEN", "error": "Invalid token"}`,
+			code:   websocket.ClosePolicyViolation,
+			cause:  CloseCauseAuth,
+		},
+		{
+			name:   "rate limit",
+			status: 429,
+			body:   `{"errcode": "M_LIMIT_EXCEEDED", "error": "Too many requests"}`,
+			code:   websocket.CloseInternalServerErr,
+			cause:  CloseCauseRateLimit,
+		},
+		{
+			name:   "upstream",
+			status: 400,
+			body:   `{"errcode": "M_UNKNOWN", "error": "Bad filter"}`,
+			code:   websocket.CloseInternalServerErr,
+			cause:  CloseCauseUpstream,
+		},
+	}
+
+	for _, tt := range tests {
+		done := make(chan struct{})
+		upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if tt.status == 0 {
+				<-done
+				return
+			}
+			w.WriteHeader(tt.status)
+			w.Write([]byte(tt.body))
+		}))
+
+		before := closeCount(tt.code, tt.cause)
+		ws, cleanup := makeWsConn(t, upstream, nil)
+
+		if tt.close != nil {
+			tt.close(ws)
+		} else {
+			// read until the server closes the connection, and reply to the
+			// close, which should not be counted as the client closing
+			ws.SetReadDeadline(time.Now().Add(2 * time.Second))
+			for {
+				if _, _, err := ws.ReadMessage(); err != nil {
+					break
+				}
+			}
+		}
+
+		waitForCloseCount(t, tt.code, tt.cause, before+1)
+		cleanup()
+		close(done)
+		upstream.Close()
+	}
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestReadErrorCause(t *testing.T) {
+	tests := []struct {
+		err   error
+		code  int
+		cause string
+	}{
+		{&websocket.CloseError{Code: websocket.CloseNormalClosure}, websocket.CloseNormalClosure, CloseCauseClient},
+		{timeoutError{}, websocket.CloseAbnormalClosure, CloseCauseIdle},
+		{&websocket.CloseError{Code: websocket.CloseAbnormalClosure}, websocket.CloseAbnormalClosure, CloseCauseNetwork},
+		{errors.New("connection reset by peer"), websocket.CloseAbnormalClosure, CloseCauseNetwork},
+	}
+
+	for _, tt := range tests {
+		if code, cause := readErrorCause(tt.err); code != tt.code || cause != tt.cause {
+			t.Errorf("%v: expected %d %s, got %d %s", tt.err, tt.code, tt.cause, code, cause)
+		}
+	}
+}
+
+func TestServeMetrics(t *testing.T) {
+	countClose(4999, "test")
+
+	w := httptest.NewRecorder()
+	ServeMetrics(w, httptest.NewRequest("GET", "/metrics", nil))
+
+	body := w.Body.String()
+	if !strings.Contains(body, "# TYPE websockets_proxy_connections_closed_total counter\n") {
+		t.Errorf("Missing TYPE line in %s", body)
+	}
+	if !strings.Contains(body, `websockets_proxy_connections_closed_total{code="4999",cause="test"} 1`+"\n") {
+		t.Errorf("Missing count in %s", body)
+	}
+}
+
+func TestTenantMetrics(t *testing.T) {
+	if err := SetTenants([]string{"acme", "globex"}); err != nil {
+		t.Fatal(err)
+	}
+	defer SetTenants(nil)
+
+	if err := SetTenants([]string{`bad"}`}); err == nil {
+		t.Error("Expected an error for an invalid tenant name")
+	}
+
+	tests := []struct {
+		name     string
+		expected string
+	}{
+		{"acme", "acme"},
+		{"initech", DefaultTenant},
+		{"", DefaultTenant},
+	}
+	for _, tt := range tests {
+		if label := TenantLabel(tt.name); label != tt.expected {
+			t.Errorf("%q: expected %q, got %q", tt.name, tt.expected, label)
+		}
+	}
+
+	c := &Connection{Tenant: TenantLabel("globex")}
+	registerConnection(c)
+	defer unregisterConnection(c)
+	c.countMessage(true)
+	c.countMessage(false)
+	c.countMessage(false)
+
+	w := httptest.NewRecorder()
+	ServeMetrics(w, httptest.NewRequest("GET", "/metrics", nil))
+	for _, line := range []string{
+		`websockets_proxy_connections{tenant="globex"} 1`,
+		`websockets_proxy_messages_sent_total{tenant="globex"} 2`,
+		`websockets_proxy_messages_received_total{tenant="globex"} 1`,
+	} {
+		if !strings.Contains(w.Body.String(), line+"\n") {
+			t.Errorf("Expected %s in metrics, got:\n%s", line, w.Body.String())
+		}
+	}
+}
+
+func TestBinaryMessagesCounted(t *testing.T) {
+	if err := SetTenants([]string{"gzip"}); err != nil {
+		t.Fatal(err)
+	}
+	defer SetTenants(nil)
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer upstream.Close()
+	ws, cleanup := makeWsConn(t, upstream, func(c *Connection) {
+		c.Tenant = TenantLabel("gzip")
+		c.SendGzippedSyncResponse([]byte(`{"next_batch":"1"}`))
+	})
+	defer cleanup()
+
+	messageType, _, err := ws.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if messageType != websocket.BinaryMessage {
+		t.Fatal("Expected a binary message, got type", messageType)
+	}
+
+	sent := func() uint64 {
+		messageCounts.Lock()
+		defer messageCounts.Unlock()
+		return messageCounts.sent["gzip"]
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for sent() != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the binary message to be counted, got", sent())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
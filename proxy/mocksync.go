@@ -0,0 +1,66 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"time"
+)
+
+// A MockSyncer is a SyncRequestor which returns canned sync responses rather
+// than making requests to the upstream server. It is intended to help client
+// developers test against the proxy without a homeserver.
+//
+// The first response is returned immediately; subsequent ones are returned
+// after the configured interval. Once all of the responses have been
+// returned, empty responses are returned at the same interval.
+type MockSyncer struct {
+	frames   []json.RawMessage
+	interval time.Duration
+
+	// the number of calls to MakeRequest so far
+	count int
+}
+
+// LoadMockSyncFrames reads a JSON file containing an array of sync responses.
+func LoadMockSyncFrames(path string) ([]json.RawMessage, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var frames []json.RawMessage
+	if err := json.Unmarshal(data, &frames); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return frames, nil
+}
+
+// NewMockSyncer creates a MockSyncer which returns the given responses at the
+// given interval.
+func NewMockSyncer(frames []json.RawMessage, interval time.Duration) *MockSyncer {
+	return &MockSyncer{
+		frames:   frames,
+		interval: interval,
+	}
+}
+
+// MakeRequest returns the next canned response.
+func (s *MockSyncer) MakeRequest(ctx context.Context) ([]byte, error) {
+	if s.count > 0 && !isImmediateSync(ctx) {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(s.interval):
+		}
+	}
+
+	n := s.count
+	s.count++
+
+	if n < len(s.frames) {
+		return s.frames[n], nil
+	}
+	return []byte(fmt.Sprintf(`{"next_batch":"mock_%d"}`, n)), nil
+}
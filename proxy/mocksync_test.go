@@ -0,0 +1,69 @@
+package proxy
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMockSyncer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mocksync")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "sync.json")
+	data := `[{"next_batch": "s1", "rooms": {}}, {"next_batch": "s2"}]`
+	if err := ioutil.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	frames, err := LoadMockSyncFrames(path)
+	if err != nil {
+		t.Fatalf("Expected no error, got '%v'", err)
+	}
+
+	interval := 20 * time.Millisecond
+	var syncer SyncRequestor = NewMockSyncer(frames, interval)
+
+	expected := []string{
+		`{"next_batch": "s1", "rooms": {}}`,
+		`{"next_batch": "s2"}`,
+		`{"next_batch":"mock_2"}`,
+	}
+	for i, exp := range expected {
+		start := time.Now()
+		body, err := syncer.MakeRequest(context.Background())
+		if err != nil {
+			t.Fatalf("Frame %d: expected no error, got '%v'", i, err)
+		}
+		if string(body) != exp {
+			t.Errorf("Frame %d: expected %s, got %s", i, exp, body)
+		}
+		if elapsed := time.Since(start); i > 0 && elapsed < interval {
+			t.Errorf("Frame %d: returned after %v, expected at least %v", i,
+				elapsed, interval)
+		}
+	}
+}
+
+func TestLoadMockSyncFramesInvalid(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mocksync")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "sync.json")
+	if err := ioutil.WriteFile(path, []byte(`{"next_batch": "s1"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := LoadMockSyncFrames(path); err == nil {
+		t.Error("Expected an error for a non-array file")
+	}
+}
@@ -0,0 +1,53 @@
+package proxy
+
+import (
+	"encoding/json"
+	"strconv"
+	"time"
+)
+
+// connectionParameters describes the effective settings of a connection, so
+// that clients can adapt their own timers to them.
+type connectionParameters struct {
+	Type string `json:"type"`
+
+	// the long-polling timeout of the upstream syncs
+	SyncTimeoutMS int64 `json:"sync_timeout_ms"`
+
+	// the interval at which we send websocket pings, and the interval at
+	// which we send heartbeat messages, if they are enabled
+	PingPeriodMS        int64 `json:"ping_period_ms"`
+	HeartbeatIntervalMS int64 `json:"heartbeat_interval_ms,omitempty"`
+
+	// the largest message the client may send
+	MaxMessageBytes int `json:"max_message_bytes"`
+
+	// whether messages to the client may be compressed
+	Compression bool `json:"compression"`
+}
+
+// SendParameters queues a message describing the effective settings of the
+// connection, such as its sync timeout and ping period. It is intended to be
+// called before the initial sync response is sent.
+func (c *Connection) SendParameters() {
+	c.SendMessage(c.parametersMessage())
+}
+
+// parametersMessage returns the body of the message sent by SendParameters.
+func (c *Connection) parametersMessage() []byte {
+	params := connectionParameters{
+		Type:                "parameters",
+		PingPeriodMS:        int64(pingPeriod / time.Millisecond),
+		HeartbeatIntervalMS: int64(c.AppHeartbeatInterval / time.Millisecond),
+		MaxMessageBytes:     c.maxMessageBytes(),
+		Compression:         c.Compressed,
+	}
+	if s, ok := c.syncer.(*Syncer); ok {
+		// the homeserver's default is zero, which is what an invalid value
+		// would get the client anyway
+		params.SyncTimeoutMS, _ = strconv.ParseInt(s.SyncParams.Get("timeout"), 10, 64)
+	}
+
+	body, _ := json.Marshal(params)
+	return body
+}
@@ -0,0 +1,37 @@
+package proxy
+
+import (
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestParametersMessage(t *testing.T) {
+	client := NewMatrixClient("http://localhost/", "token")
+	syncer := &Syncer{Client: client, SyncParams: url.Values{"timeout": {"30000"}}}
+	c := &Connection{
+		syncer:               syncer,
+		client:               client,
+		AppHeartbeatInterval: 20 * time.Second,
+		Compressed:           true,
+	}
+
+	expected := `{"type":"parameters","sync_timeout_ms":30000,"ping_period_ms":54000,"heartbeat_interval_ms":20000,"max_message_bytes":512,"compression":true}`
+	if msg := string(c.parametersMessage()); msg != expected {
+		t.Errorf("Expected %s, got %s", expected, msg)
+	}
+
+	// unset values are reported as their defaults
+	c = &Connection{syncer: NewMockSyncer(nil, time.Second), client: client}
+	expected = `{"type":"parameters","sync_timeout_ms":0,"ping_period_ms":54000,"max_message_bytes":512,"compression":false}`
+	if msg := string(c.parametersMessage()); msg != expected {
+		t.Errorf("Expected %s, got %s", expected, msg)
+	}
+
+	// the message limit leaves room for the largest content allowed
+	c.MaxContentBytes = 1000
+	expected = `{"type":"parameters","sync_timeout_ms":0,"ping_period_ms":54000,"max_message_bytes":1512,"compression":false}`
+	if msg := string(c.parametersMessage()); msg != expected {
+		t.Errorf("Expected %s, got %s", expected, msg)
+	}
+}
@@ -0,0 +1,263 @@
+package proxy
+
+import (
+	"encoding/json"
+	"strings"
+	"sync/atomic"
+)
+
+// strictRoomIDs is set to 1 by SetStrictRoomIDs; accessed atomically
+var strictRoomIDs int32
+
+// SetStrictRoomIDs sets whether room IDs given by clients are checked for the
+// form !localpart:server before they are sent upstream, so that obviously
+// malformed IDs get a clear error rather than a 404 from the homeserver. It
+// is off by default, for homeservers with unusual room IDs.
+func SetStrictRoomIDs(strict bool) {
+	var v int32
+	if strict {
+		v = 1
+	}
+	atomic.StoreInt32(&strictRoomIDs, v)
+}
+
+// A paramReader reads the parameters of a request. Rather than stopping at
+// the first missing or invalid parameter, it records all of the problems, so
+// that they can be reported to the client together.
+//
+// Handlers should read all of their parameters, and then check err().
+type paramReader struct {
+	req *jsonRequest
+
+	// descriptions of each problem found, and the parameters concerned
+	problems []string
+	fields   []string
+	missing  bool
+}
+
+func newParamReader(req *jsonRequest) *paramReader {
+	return &paramReader{req: req}
+}
+
+func (p *paramReader) addMissing(name string) {
+	p.problems = append(p.problems, "Missing parameter "+name)
+	p.fields = append(p.fields, name)
+	p.missing = true
+}
+
+func (p *paramReader) addInvalid(name string, problem string) {
+	p.problems = append(p.problems, name+" "+problem)
+	p.fields = append(p.fields, name)
+}
+
+// has returns true if the given parameter was given.
+func (p *paramReader) has(name string) bool {
+	_, ok := p.req.Params[name]
+	return ok
+}
+
+// string returns the value of a required string parameter.
+func (p *paramReader) string(name string) string {
+	v, ok := p.req.Params[name]
+	if !ok || v == "" {
+		p.addMissing(name)
+		return ""
+	}
+	str, ok := v.(string)
+	if !ok {
+		p.addInvalid(name, "must be a string")
+		return ""
+	}
+	return str
+}
+
+// roomID returns the value of a required room ID parameter. If strict room
+// ID checking is enabled, any surrounding whitespace is removed, and IDs
+// which are not of the form !localpart:server are recorded as invalid.
+func (p *paramReader) roomID(name string) string {
+	id := p.string(name)
+	if id == "" || atomic.LoadInt32(&strictRoomIDs) == 0 {
+		return id
+	}
+	id = strings.TrimSpace(id)
+	if !isValidRoomID(id) {
+		p.addInvalid(name, "must be of the form !localpart:server")
+	}
+	return id
+}
+
+// optionalRoomID is like roomID, for an optional parameter. It returns "" if
+// the parameter is not given or empty.
+func (p *paramReader) optionalRoomID(name string) string {
+	if v, ok := p.req.Params[name]; !ok || v == "" {
+		return ""
+	}
+	return p.roomID(name)
+}
+
+// roomIDList returns the value of a required parameter which is a list of
+// room IDs, checked and trimmed as for roomID.
+func (p *paramReader) roomIDList(name string) []string {
+	ids := p.stringList(name)
+	if atomic.LoadInt32(&strictRoomIDs) == 0 {
+		return ids
+	}
+	for i, id := range ids {
+		ids[i] = strings.TrimSpace(id)
+		if !isValidRoomID(ids[i]) {
+			p.addInvalid(name, "must be a list of room IDs of the form !localpart:server")
+			break
+		}
+	}
+	return ids
+}
+
+// isValidRoomID returns true if id is of the form !localpart:server.
+func isValidRoomID(id string) bool {
+	colon := strings.Index(id, ":")
+	return strings.HasPrefix(id, "!") && colon > 1 && colon < len(id)-1 &&
+		!strings.ContainsAny(id, " \t\r\n")
+}
+
+// optionalString returns the value of an optional string parameter, or "" if
+// it is not given or empty.
+func (p *paramReader) optionalString(name string) string {
+	if v, ok := p.req.Params[name]; !ok || v == "" {
+		return ""
+	}
+	return p.string(name)
+}
+
+// enum returns the value of a required string parameter, checking that it is
+// one of the allowed values.
+func (p *paramReader) enum(name string, allowed []string) string {
+	str := p.string(name)
+	if str == "" {
+		return ""
+	}
+	for _, a := range allowed {
+		if str == a {
+			return str
+		}
+	}
+	p.addInvalid(name, "must be one of: "+strings.Join(allowed, ", "))
+	return ""
+}
+
+// optionalEnum is like enum, but returns "" if the parameter is not given.
+func (p *paramReader) optionalEnum(name string, allowed []string) string {
+	if !p.has(name) {
+		return ""
+	}
+	return p.enum(name, allowed)
+}
+
+// stringList returns the value of a required parameter which is a list of
+// strings.
+func (p *paramReader) stringList(name string) []string {
+	if !p.has(name) {
+		p.addMissing(name)
+		return nil
+	}
+	return p.optionalStringList(name)
+}
+
+// optionalStringList returns the value of an optional parameter which is a
+// list of strings, or nil if it is not given.
+func (p *paramReader) optionalStringList(name string) []string {
+	v, ok := p.req.Params[name]
+	if !ok {
+		return nil
+	}
+	list, ok := v.([]interface{})
+	if !ok {
+		p.addInvalid(name, "must be a list of strings")
+		return nil
+	}
+	res := make([]string, len(list))
+	for i, item := range list {
+		str, ok := item.(string)
+		if !ok {
+			p.addInvalid(name, "must be a list of strings")
+			return nil
+		}
+		res[i] = str
+	}
+	return res
+}
+
+// optionalNumber returns the value of an optional numeric parameter, or nil
+// if it is not given.
+func (p *paramReader) optionalNumber(name string) *float64 {
+	v, ok := p.req.Params[name]
+	if !ok {
+		return nil
+	}
+	num, ok := v.(json.Number)
+	if !ok {
+		p.addInvalid(name, "must be a number")
+		return nil
+	}
+	f, err := num.Float64()
+	if err != nil {
+		p.addInvalid(name, "must be a number")
+		return nil
+	}
+	return &f
+}
+
+// object returns the value of a required JSON object parameter.
+func (p *paramReader) object(name string) map[string]interface{} {
+	v, ok := p.req.Params[name]
+	if !ok {
+		p.addMissing(name)
+		return nil
+	}
+	obj, ok := v.(map[string]interface{})
+	if !ok {
+		p.addInvalid(name, "must be an object")
+		return nil
+	}
+	return obj
+}
+
+// optionalObject returns the value of an optional JSON object parameter, or
+// nil if it is not given.
+func (p *paramReader) optionalObject(name string) map[string]interface{} {
+	if !p.has(name) {
+		return nil
+	}
+	return p.object(name)
+}
+
+// optionalBool returns the value of an optional boolean parameter, or false if
+// it is not given.
+func (p *paramReader) optionalBool(name string) bool {
+	v, ok := p.req.Params[name]
+	if !ok {
+		return false
+	}
+	b, ok := v.(bool)
+	if !ok {
+		p.addInvalid(name, "must be a boolean")
+	}
+	return b
+}
+
+// err returns a requestError describing all of the problems found, or nil if
+// there were none.
+func (p *paramReader) err() error {
+	if len(p.problems) == 0 {
+		return nil
+	}
+
+	errCode := "M_INVALID_PARAM"
+	if p.missing {
+		errCode = "M_MISSING_PARAM"
+	}
+	return &requestError{
+		errCode: errCode,
+		message: strings.Join(p.problems, "; "),
+		fields:  p.fields,
+	}
+}
@@ -0,0 +1,130 @@
+package proxy
+
+import (
+	"sync"
+	"time"
+)
+
+// A receiptQueue holds the read receipts which have been queued by a client,
+// but not yet sent to the upstream server. Only the latest receipt for each
+// room is kept.
+type receiptQueue struct {
+	mutex sync.Mutex
+
+	// map from room ID to event ID
+	receipts map[string]string
+}
+
+// add queues a receipt, replacing any earlier receipt for the room.
+func (q *receiptQueue) add(roomID, eventID string) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if q.receipts == nil {
+		q.receipts = make(map[string]string)
+	}
+	q.receipts[roomID] = eventID
+}
+
+// restore puts back a receipt which could not be sent, unless a newer
+// receipt for the room has been queued in the meantime.
+func (q *receiptQueue) restore(roomID, eventID string) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if _, ok := q.receipts[roomID]; ok {
+		return
+	}
+	if q.receipts == nil {
+		q.receipts = make(map[string]string)
+	}
+	q.receipts[roomID] = eventID
+}
+
+// take removes all of the queued receipts, and returns them.
+func (q *receiptQueue) take() map[string]string {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	r := q.receipts
+	q.receipts = nil
+	return r
+}
+
+// flushReceipts sends any queued receipts to the upstream server. It returns
+// the number of receipts sent, and the first error encountered, if any.
+// Receipts which could not be sent are queued again for the next flush.
+func (c *Connection) flushReceipts() (int, error) {
+	var firstErr error
+	sent := 0
+
+	for roomID, eventID := range c.receipts.take() {
+		if err := c.client.SendReceipt(c.requestContext(), roomID, eventID); err != nil {
+			logWarn("Error sending receipt for", roomID, err)
+			c.receipts.restore(roomID, eventID)
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		sent++
+	}
+	return sent, firstErr
+}
+
+// receiptFlusher calls flushReceipts every ReceiptFlushInterval, until the
+// connection stops.
+func (c *Connection) receiptFlusher() {
+	ticker := time.NewTicker(c.ReceiptFlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.quit:
+			return
+		case <-ticker.C:
+			c.flushReceipts()
+		}
+	}
+}
+
+// handleQueueReceipt queues a read receipt, to be sent later.
+func handleQueueReceipt(c *Connection, req *jsonRequest) (interface{}, error) {
+	p := newParamReader(req)
+	roomID := p.roomID("room_id")
+	eventID := p.string("event_id")
+	if err := p.err(); err != nil {
+		return nil, err
+	}
+	if err := c.checkRoomAllowed(roomID); err != nil {
+		return nil, err
+	}
+
+	c.receipts.add(roomID, eventID)
+	return map[string]interface{}{}, nil
+}
+
+// handleFlushReceipts sends any queued receipts.
+func handleFlushReceipts(c *Connection, req *jsonRequest) (interface{}, error) {
+	sent, err := c.flushReceipts()
+	if err != nil {
+		return nil, err
+	}
+	return map[string]int{"sent": sent}, nil
+}
+
+// handleGetReceipts returns the read receipts in a room, so that the client
+// can show which events have been read without a full sync.
+func handleGetReceipts(c *Connection, req *jsonRequest) (interface{}, error) {
+	p := newParamReader(req)
+	roomID := p.roomID("room_id")
+	if err := p.err(); err != nil {
+		return nil, err
+	}
+
+	receipts, err := c.client.GetReceipts(req.ctx, roomID)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{"receipts": receipts}, nil
+}
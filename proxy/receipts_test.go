@@ -0,0 +1,179 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestFlushReceipts(t *testing.T) {
+	var mutex sync.Mutex
+	var paths []string
+	c, srv := newTestConnection(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		paths = append(paths, r.URL.EscapedPath())
+		mutex.Unlock()
+		w.Write([]byte(`{}`))
+	})
+	defer srv.Close()
+
+	requests := []string{
+		`{"id": "1", "method": "queue_receipt", "params": {"room_id": "!a:test", "event_id": "$1"}}`,
+		`{"id": "2", "method": "queue_receipt", "params": {"room_id": "!b:test", "event_id": "$2"}}`,
+		`{"id": "3", "method": "queue_receipt", "params": {"room_id": "!a:test", "event_id": "$3"}}`,
+	}
+	for _, req := range requests {
+		if resp := c.handleRequest([]byte(req)); !strings.Contains(string(resp), `"result":{}`) {
+			t.Errorf("Unexpected response to %s: %s", req, resp)
+		}
+	}
+	if len(paths) != 0 {
+		t.Errorf("Receipts sent before flush: %v", paths)
+	}
+
+	resp := c.handleRequest([]byte(`{"id": "4", "method": "flush_receipts"}`))
+	if string(resp) != `{"id":"4","result":{"sent":2}}` {
+		t.Errorf("Unexpected response to flush: %s", resp)
+	}
+
+	sort.Strings(paths)
+	expected := []string{
+		"/_matrix/client/r0/rooms/%21a:test/receipt/m.read/$3",
+		"/_matrix/client/r0/rooms/%21b:test/receipt/m.read/$2",
+	}
+	if strings.Join(paths, ",") != strings.Join(expected, ",") {
+		t.Errorf("Expected receipts %v, got %v", expected, paths)
+	}
+
+	// a second flush should have nothing to send
+	resp = c.handleRequest([]byte(`{"id": "5", "method": "flush_receipts"}`))
+	if string(resp) != `{"id":"5","result":{"sent":0}}` {
+		t.Errorf("Unexpected response to second flush: %s", resp)
+	}
+}
+
+func TestFlushReceiptsRetried(t *testing.T) {
+	var mutex sync.Mutex
+	var paths []string
+	var c *Connection
+	failures := 1
+	c, srv := newTestConnection(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		paths = append(paths, r.URL.EscapedPath())
+		if strings.Contains(r.URL.Path, "!b:test") {
+			// a newer receipt, queued while the older one was being sent
+			c.receipts.add("!b:test", "$3")
+		}
+		if failures > 0 {
+			failures--
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.Write([]byte(`{}`))
+	})
+	defer srv.Close()
+
+	c.receipts.add("!a:test", "$1")
+	if sent, err := c.flushReceipts(); sent != 0 || err == nil {
+		t.Errorf("Expected the flush to fail, got %d sent, %v", sent, err)
+	}
+	if sent, err := c.flushReceipts(); sent != 1 || err != nil {
+		t.Errorf("Expected the receipt to be sent on the next flush, got %d sent, %v", sent, err)
+	}
+
+	// the failed receipt doesn't replace a newer one
+	failures = 1
+	c.receipts.add("!b:test", "$2")
+	c.flushReceipts()
+	if queued := c.receipts.take(); queued["!b:test"] != "$3" {
+		t.Errorf("Expected the newer receipt to be kept, got %v", queued)
+	}
+
+	expected := []string{
+		"/_matrix/client/r0/rooms/%21a:test/receipt/m.read/$1",
+		"/_matrix/client/r0/rooms/%21a:test/receipt/m.read/$1",
+		"/_matrix/client/r0/rooms/%21b:test/receipt/m.read/$2",
+	}
+	if strings.Join(paths, ",") != strings.Join(expected, ",") {
+		t.Errorf("Expected receipts %v, got %v", expected, paths)
+	}
+}
+
+func TestReceiptsFlushedOnClose(t *testing.T) {
+	done := make(chan struct{})
+	receipts := make(chan string, 1)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.Path, "/sync") {
+			<-done
+			return
+		}
+		receipts <- r.URL.EscapedPath()
+		w.Write([]byte(`{}`))
+	}))
+	defer upstream.Close()
+	defer close(done)
+
+	ws, cleanup := makeWsConn(t, upstream, nil)
+	defer cleanup()
+
+	ws.WriteMessage(websocket.TextMessage, []byte(`{"id": "1", "method": "queue_receipt", "params": {"room_id": "!a:test", "event_id": "$1"}}`))
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, msg, err := ws.ReadMessage(); err != nil || string(msg) != `{"id":"1","result":{}}` {
+		t.Fatalf("Unexpected response to queue_receipt: %s (%v)", msg, err)
+	}
+
+	ws.WriteMessage(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+
+	select {
+	case path := <-receipts:
+		if path != "/_matrix/client/r0/rooms/%21a:test/receipt/m.read/$1" {
+			t.Errorf("Unexpected receipt path %v", path)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("Receipt was not sent on close")
+	}
+}
+
+func TestGetReceipts(t *testing.T) {
+	c, srv := newTestConnection(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/_matrix/client/r0/sync" {
+			t.Error("Unexpected path:", r.URL.Path)
+		}
+		if r.URL.Query().Get("timeout") != "0" || r.URL.Query().Get("since") != "" {
+			t.Error("Unexpected query:", r.URL.RawQuery)
+		}
+		if filter := r.URL.Query().Get("filter"); filter != receiptFilter("!room:test") ||
+			!strings.Contains(filter, `"rooms":["!room:test"]`) ||
+			!strings.Contains(filter, `"ephemeral":{"types":["m.receipt"]}`) {
+			t.Error("Unexpected filter:", filter)
+		}
+		w.Write([]byte(`{"next_batch": "s1", "rooms": {"join": {"!room:test": {"ephemeral": {"events": [
+			{"type": "m.receipt", "content": {"$a": {"m.read": {"@alice:test": {"ts": 1}}}}},
+			{"type": "m.typing", "content": {"user_ids": []}},
+			{"type": "m.receipt", "content": {"$b": {"m.read": {"@bob:test": {"ts": 2}}}}}
+		]}}}}}`))
+	})
+	defer srv.Close()
+
+	resp := c.handleRequest([]byte(`{"id": "1", "method": "get_receipts", "params": {"room_id": "!room:test"}}`))
+	expected := `{"id":"1","result":{"receipts":{"$a":{"m.read":{"@alice:test":{"ts":1}}},"$b":{"m.read":{"@bob:test":{"ts":2}}}}}}`
+	if string(resp) != expected {
+		t.Errorf("Expected %s, got %s", expected, resp)
+	}
+
+	SetStrictRoomIDs(true)
+	defer SetStrictRoomIDs(false)
+	resp = c.handleRequest([]byte(`{"id": "2", "method": "get_receipts", "params": {"room_id": "#alias:test"}}`))
+	expected = `{"id":"2","error":{"errcode":"M_INVALID_PARAM","error":"room_id must be of the form !localpart:server","fields":["room_id"]}}`
+	if string(resp) != expected {
+		t.Errorf("Expected %s, got %s", expected, resp)
+	}
+}
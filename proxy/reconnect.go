@@ -0,0 +1,192 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Hints sent to the client, before we close the connection, to tell it how to
+// reconnect.
+const (
+	// reconnect straight away, such as when the proxy is restarting
+	ReconnectNow = "now"
+
+	// reconnect with an increasing delay, such as after a network error
+	ReconnectBackoff = "backoff"
+
+	// don't reconnect without user intervention, such as after the access
+	// token has been invalidated
+	ReconnectNever = "never"
+)
+
+// DefaultReconnectHints maps from close code to the hint sent before closing
+// the connection with that code.
+var DefaultReconnectHints = map[int]string{
+	websocket.ClosePolicyViolation:   ReconnectNever,
+	websocket.CloseInternalServerErr: ReconnectBackoff,
+	websocket.CloseServiceRestart:    ReconnectNow,
+	websocket.CloseTryAgainLater:     ReconnectBackoff,
+}
+
+// ParseReconnectHints parses a comma-separated list of code=hint pairs, such
+// as "1011=backoff,1012=now", and returns them merged into a copy of
+// DefaultReconnectHints.
+func ParseReconnectHints(s string) (map[int]string, error) {
+	hints := make(map[int]string, len(DefaultReconnectHints))
+	for code, hint := range DefaultReconnectHints {
+		hints[code] = hint
+	}
+	if s == "" {
+		return hints, nil
+	}
+
+	for _, pair := range strings.Split(s, ",") {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid reconnect hint %q", pair)
+		}
+		code, err := strconv.Atoi(strings.TrimSpace(kv[0]))
+		if err != nil {
+			return nil, fmt.Errorf("invalid close code in %q", pair)
+		}
+		hint := strings.TrimSpace(kv[1])
+		switch hint {
+		case ReconnectNow, ReconnectBackoff, ReconnectNever:
+		default:
+			return nil, fmt.Errorf("invalid reconnect hint in %q", pair)
+		}
+		hints[code] = hint
+	}
+	return hints, nil
+}
+
+// DefaultMaintenancePattern matches the error messages with which a
+// homeserver says it is down for maintenance.
+const DefaultMaintenancePattern = `(?i)maintenance`
+
+// maintenanceCloseText is the text of the close message sent when the
+// homeserver is down for maintenance.
+const maintenanceCloseText = "The homeserver is down for maintenance"
+
+// maintenanceRetryAfter is how long clients are told to wait before
+// reconnecting when the homeserver is down for maintenance, unless it says.
+const maintenanceRetryAfter = time.Minute
+
+// isMaintenanceError returns true if the given error is an M_UNKNOWN error or
+// a 503 response whose message matches the connection's MaintenancePattern.
+func (c *Connection) isMaintenanceError(err error) bool {
+	re := c.MaintenancePattern
+	if re == nil {
+		return false
+	}
+	switch e := err.(type) {
+	case *MatrixError:
+		if e.Details.ErrCode == "M_UNKNOWN" || e.StatusCode == 503 {
+			return re.MatchString(e.Details.Error)
+		}
+	case *HTTPError:
+		if e.StatusCode == 503 {
+			return re.Match(e.Body)
+		}
+	}
+	return false
+}
+
+// syncErrorCloseText returns the text of the close message to send when a sync
+// fails with the given error.
+func (c *Connection) syncErrorCloseText(err error) string {
+	if c.isMaintenanceError(err) {
+		return maintenanceCloseText
+	}
+	return truncateCloseText(err.Error())
+}
+
+// syncErrorRetryAfter returns how long the client should wait before
+// reconnecting when a sync fails with the given error, or zero if there is
+// nothing to tell it.
+func (c *Connection) syncErrorRetryAfter(err error) time.Duration {
+	retryAfter := retryAfterOf(err)
+	if retryAfter == 0 && c.isMaintenanceError(err) {
+		retryAfter = maintenanceRetryAfter
+	}
+	return retryAfter
+}
+
+// syncErrorCloseCode returns the close code to use when a sync fails with the
+// given error.
+func (c *Connection) syncErrorCloseCode(err error) int {
+	if c.isMaintenanceError(err) {
+		return websocket.CloseServiceRestart
+	}
+	if err == errSharedSyncBehind {
+		return websocket.CloseTryAgainLater
+	}
+	if isAuthError(err) {
+		return websocket.ClosePolicyViolation
+	}
+	return websocket.CloseInternalServerErr
+}
+
+// isAuthError returns true if the given error means that the access token is
+// missing or invalid.
+func isAuthError(err error) bool {
+	var details *MatrixErrorDetails
+	var status int
+	switch err.(type) {
+	case *MatrixError:
+		details = &err.(*MatrixError).Details
+		status = err.(*MatrixError).StatusCode
+	case *HTTPError:
+		status = err.(*HTTPError).StatusCode
+	}
+
+	return status == 401 || (details != nil &&
+		(details.ErrCode == "M_UNKNOWN_TOKEN" || details.ErrCode == "M_MISSING_TOKEN"))
+}
+
+// reconnectHint returns the hint to send before closing the connection with
+// the given code.
+func (c *Connection) reconnectHint(closeCode int) string {
+	hints := c.ReconnectHints
+	if hints == nil {
+		hints = DefaultReconnectHints
+	}
+	if hint, ok := hints[closeCode]; ok {
+		return hint
+	}
+	return ReconnectBackoff
+}
+
+// syncErrorReconnectHint returns the hint to send before closing the
+// connection when a sync fails with the given error. Maintenance is expected
+// to last a while, so although the connection is closed as for a restart, the
+// client is told to back off rather than to reconnect straight away.
+func (c *Connection) syncErrorReconnectHint(err error) string {
+	if c.isMaintenanceError(err) {
+		return ReconnectBackoff
+	}
+	return c.reconnectHint(c.syncErrorCloseCode(err))
+}
+
+// closeWithHint sends the client a message telling it how to reconnect, and
+// then closes the connection with the given code and text.
+func (c *Connection) closeWithHint(closeCode int, text string, retryAfter time.Duration) {
+	c.closeWithReconnectHint(closeCode, c.reconnectHint(closeCode), text, retryAfter)
+}
+
+// closeWithReconnectHint is like closeWithHint, but with the given hint rather
+// than the one for the close code.
+func (c *Connection) closeWithReconnectHint(closeCode int, reconnect string, text string, retryAfter time.Duration) {
+	hint := map[string]interface{}{"reconnect": reconnect}
+	if retryAfter > 0 {
+		hint["retry_after_ms"] = int64(retryAfter / time.Millisecond)
+	}
+	msg, _ := json.Marshal(hint)
+	c.SendMessage(msg)
+	c.SendClose(closeCode, text)
+}
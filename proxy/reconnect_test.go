@@ -0,0 +1,173 @@
+package proxy
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestSyncErrorReconnectHints(t *testing.T) {
+	tests := []struct {
+		err          error
+		expectedCode int
+		expectedHint string
+	}{
+		{
+			&url.Error{Op: "Get", URL: "http://localhost/", Err: &net.OpError{Op: "dial", Err: errors.New("connection refused")}},
+			websocket.CloseInternalServerErr,
+			ReconnectBackoff,
+		},
+		{
+			&MatrixError{HTTPError{StatusCode: 401, ContentType: "application/json"}, MatrixErrorDetails{ErrCode: "M_UNKNOWN_TOKEN"}},
+			websocket.ClosePolicyViolation,
+			ReconnectNever,
+		},
+		{
+			&MatrixError{HTTPError{StatusCode: 403, ContentType: "application/json"}, MatrixErrorDetails{ErrCode: "M_MISSING_TOKEN"}},
+			websocket.ClosePolicyViolation,
+			ReconnectNever,
+		},
+		{
+			&HTTPError{StatusCode: 502, ContentType: "text/plain", Body: []byte("Bad Gateway")},
+			websocket.CloseInternalServerErr,
+			ReconnectBackoff,
+		},
+		{
+			&MatrixError{HTTPError{StatusCode: 500, ContentType: "application/json"}, MatrixErrorDetails{ErrCode: "M_UNKNOWN", Error: "Server is in maintenance mode"}},
+			websocket.CloseServiceRestart,
+			ReconnectBackoff,
+		},
+		{
+			&HTTPError{StatusCode: 503, ContentType: "text/html", Body: []byte("<h1>Down for Maintenance</h1>")},
+			websocket.CloseServiceRestart,
+			ReconnectBackoff,
+		},
+		{
+			&HTTPError{StatusCode: 502, ContentType: "text/html", Body: []byte("<h1>Down for Maintenance</h1>")},
+			websocket.CloseInternalServerErr,
+			ReconnectBackoff,
+		},
+		{
+			&MatrixError{HTTPError{StatusCode: 403, ContentType: "application/json"}, MatrixErrorDetails{ErrCode: "M_FORBIDDEN", Error: "Maintenance of this room is not allowed"}},
+			websocket.CloseInternalServerErr,
+			ReconnectBackoff,
+		},
+	}
+
+	c := &Connection{MaintenancePattern: regexp.MustCompile(DefaultMaintenancePattern)}
+	for _, tt := range tests {
+		code := c.syncErrorCloseCode(tt.err)
+		if code != tt.expectedCode {
+			t.Errorf("%v: expected close code %d, got %d", tt.err, tt.expectedCode, code)
+		}
+		if hint := c.syncErrorReconnectHint(tt.err); hint != tt.expectedHint {
+			t.Errorf("%v: expected hint %s, got %s", tt.err, tt.expectedHint, hint)
+		}
+	}
+
+	if hint := c.reconnectHint(websocket.CloseServiceRestart); hint != ReconnectNow {
+		t.Errorf("Expected hint %s for a restart, got %s", ReconnectNow, hint)
+	}
+}
+
+func TestParseReconnectHints(t *testing.T) {
+	hints, err := ParseReconnectHints("1011=never, 4000=now")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[int]string{
+		websocket.ClosePolicyViolation:   ReconnectNever,
+		websocket.CloseInternalServerErr: ReconnectNever,
+		websocket.CloseServiceRestart:    ReconnectNow,
+		websocket.CloseTryAgainLater:     ReconnectBackoff,
+		4000:                             ReconnectNow,
+	}
+	if !reflect.DeepEqual(hints, expected) {
+		t.Errorf("Expected %v, got %v", expected, hints)
+	}
+
+	for _, s := range []string{"1011", "abc=now", "1011=later"} {
+		if _, err := ParseReconnectHints(s); err == nil {
+			t.Errorf("Expected an error parsing %q", s)
+		}
+	}
+}
+
+func TestReconnectHintSentBeforeClose(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(401)
+		w.Write([]byte(`{"errcode": "M_UNKNOWN_TOKEN", "error": "Invalid access token"}`))
+	}))
+	defer upstream.Close()
+
+	ws, cleanup := makeWsConn(t, upstream, nil)
+	defer cleanup()
+
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, msg, err := ws.ReadMessage()
+	if err != nil {
+		t.Fatal("Error reading reconnect hint:", err)
+	}
+	if string(msg) != `{"reconnect":"never"}` {
+		t.Errorf("Unexpected message %s", msg)
+	}
+
+	_, _, err = ws.ReadMessage()
+	closeErr, ok := err.(*websocket.CloseError)
+	if !ok {
+		t.Fatalf("Expected a close error, got %v", err)
+	}
+	if closeErr.Code != websocket.ClosePolicyViolation {
+		t.Errorf("Expected close code %d, got %d", websocket.ClosePolicyViolation,
+			closeErr.Code)
+	}
+}
+
+func TestMaintenanceClose(t *testing.T) {
+	tests := []struct {
+		retryAfter string
+		hint       string
+	}{
+		{"", `{"reconnect":"backoff","retry_after_ms":60000}`},
+		{"5", `{"reconnect":"backoff","retry_after_ms":5000}`},
+	}
+
+	for _, tt := range tests {
+		upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if tt.retryAfter != "" {
+				w.Header().Set("Retry-After", tt.retryAfter)
+			}
+			w.WriteHeader(503)
+			w.Write([]byte(`{"errcode": "M_UNKNOWN", "error": "Synapse is undergoing planned work"}`))
+		}))
+
+		ws, cleanup := makeWsConn(t, upstream, func(c *Connection) {
+			c.MaintenancePattern = regexp.MustCompile("(?i)planned work")
+		})
+
+		ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, msg, err := ws.ReadMessage(); err != nil || string(msg) != tt.hint {
+			t.Fatalf("Expected reconnect hint %s, got %s (error %v)", tt.hint, msg, err)
+		}
+
+		_, _, err := ws.ReadMessage()
+		closeErr, ok := err.(*websocket.CloseError)
+		if !ok {
+			t.Fatalf("Expected a close error, got %v", err)
+		}
+		if closeErr.Code != websocket.CloseServiceRestart || closeErr.Text != maintenanceCloseText {
+			t.Errorf("Expected close %d %q, got %d %q", websocket.CloseServiceRestart,
+				maintenanceCloseText, closeErr.Code, closeErr.Text)
+		}
+		cleanup()
+		upstream.Close()
+	}
+}
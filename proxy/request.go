@@ -1,78 +1,600 @@
 package proxy
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
-	"log"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
 )
 
 type jsonRequest struct {
 	ID     *string
 	Method string
 	Params map[string]interface{}
-}
 
-type jsonError struct {
-	ErrCode string `json:"errcode"`
-	Error   string `json:"error"`
+	// the context for the upstream requests made by the handler, which is
+	// cancelled if the request times out or the connection stops
+	ctx context.Context
 }
 
 type jsonResponse struct {
 	// this is a pointer so that it can be set to 'nil' to give a null result
 	ID *string `json:"id"`
 
-	// these are pointers so that we can set them to be empty to omit them
+	// these are nilable so that we can set them to be empty to omit them
 	// from the output.
-	Result *map[string]interface{} `json:"result,omitempty"`
-	Error  *jsonError              `json:"error,omitempty"`
+	Result interface{}         `json:"result,omitempty"`
+	Error  *MatrixErrorDetails `json:"error,omitempty"`
+}
+
+// a handlerFunc processes a request, and returns either the result or an
+// error.
+type handlerFunc func(c *Connection, req *jsonRequest) (interface{}, error)
+
+// handlerMap maps from method name to the handler for that method.
+var handlerMap = map[string]handlerFunc{
+	"ping":                   handlePing,
+	"send":                   handleSend,
+	"edit":                   handleEdit,
+	"state":                  handleState,
+	"get_state_event":        handleGetStateEvent,
+	"get_state_events":       handleGetStateEvents,
+	"redact":                 handleRedact,
+	"capabilities":           handleCapabilities,
+	"bootstrap":              handleBootstrap,
+	"set_join_rules":         handleSetJoinRules,
+	"set_guest_access":       handleSetGuestAccess,
+	"set_history_visibility": handleSetHistoryVisibility,
+	"upgrade_room":           handleUpgradeRoom,
+	"knock":                  handleKnock,
+	"room_summary":           handleRoomSummary,
+	"pin_events":             handlePinEvents,
+	"unpin_events":           handleUnpinEvents,
+	"get_invites":            handleGetInvites,
+	"add_alias":              handleAddAlias,
+	"delete_alias":           handleDeleteAlias,
+	"refresh":                handleRefresh,
+	"set_filter":             handleSetFilter,
+	"ephemeral_only":         handleEphemeralOnly,
+	"subscribe_rooms":        handleSubscribeRooms,
+	"unsubscribe_rooms":      handleUnsubscribeRooms,
+	"mute_presence":          handleMutePresence,
+	"threads":                handleThreads,
+	"relations":              handleRelations,
+	"search":                 handleSearch,
+	"media_config":           handleMediaConfig,
+	"download":               handleDownload,
+	"report":                 handleReport,
+	"queue_receipt":          handleQueueReceipt,
+	"flush_receipts":         handleFlushReceipts,
+	"get_receipts":           handleGetReceipts,
+	"get_pushers":            handleGetPushers,
+	"set_pusher":             handleSetPusher,
+	"get_account_data":       handleGetAccountData,
+	"get_3pids":              handleGet3PIDs,
+	"auth_metadata":          handleAuthMetadata,
+	"delete_3pid":            handleDelete3PID,
+	"request_openid_token":   handleRequestOpenIDToken,
+	"set_access_token":       handleSetAccessToken,
+	"register_guest":         handleRegisterGuest,
+	"set_profile":            handleSetProfile,
+	"get_user_devices":       handleGetUserDevices,
+	"get_tags":               handleGetTags,
+	"set_tag":                handleSetTag,
+	"delete_tag":             handleDeleteTag,
+	"cs_api":                 handleCSAPI,
 }
 
 // handleRequest gets the correct response for a received message, and returns
 // the json encoding
-func handleRequest(request []byte) []byte {
+func (c *Connection) handleRequest(request []byte) []byte {
 	var resp *jsonResponse
 	var jr jsonRequest
 
-	if err := json.Unmarshal(request, &jr); err != nil {
-		log.Println("Invalid request:", err)
+	// encoding/json silently replaces invalid UTF-8, which would corrupt
+	// any event content, so reject it up front.
+	if !utf8.Valid(request) {
+		logInfo("Invalid request: not valid UTF-8")
+		resp = &jsonResponse{
+			Error: &MatrixErrorDetails{
+				ErrCode: "M_NOT_JSON",
+				Error:   "Request is not valid UTF-8",
+			},
+		}
+	} else if err := unmarshalRequest(request, &jr); err != nil {
+		logInfo("Invalid request:", err)
 		resp = &jsonResponse{
 			ID: jr.ID,
-			Error: &jsonError{
+			Error: &MatrixErrorDetails{
 				ErrCode: "M_NOT_JSON",
 				Error:   err.Error(),
 			},
 		}
+	} else if jr.ID != nil && !c.claimRequestID(*jr.ID) {
+		logInfo("Duplicate request id:", *jr.ID)
+		resp = &jsonResponse{
+			ID:    jr.ID,
+			Error: errDuplicateRequestID,
+		}
 	} else {
-		resp = handleRequestObject(&jr)
+		if jr.ID != nil {
+			defer c.releaseRequestID(*jr.ID)
+		}
+		resp = c.handleRequestObject(&jr)
 	}
 
 	v, err := json.Marshal(resp)
 	if err != nil {
-		log.Print("Error marshalling:", err)
+		logError("Error marshalling:", err)
 		return nil
 	}
 	return v
 }
 
-func handleRequestObject(req *jsonRequest) *jsonResponse {
-	switch req.Method {
-	case "ping":
-		return handlePing(req)
+// errDuplicateRequestID is returned for a request whose ID is the same as
+// that of a request which has not yet had a response.
+var errDuplicateRequestID = &MatrixErrorDetails{
+	ErrCode: "M_BAD_JSON",
+	Error:   "duplicate request id",
+}
+
+// claimRequestID records that a request with the given ID is being handled.
+// It returns false if there is already one.
+func (c *Connection) claimRequestID(id string) bool {
+	c.requestIDMutex.Lock()
+	defer c.requestIDMutex.Unlock()
+	if c.requestIDs[id] {
+		return false
+	}
+	if c.requestIDs == nil {
+		c.requestIDs = make(map[string]bool)
 	}
+	c.requestIDs[id] = true
+	return true
+}
 
-	// unknown method
-	log.Println("Unknown method:", req.Method)
-	return &jsonResponse{
-		ID: req.ID,
-		Error: &jsonError{
-			ErrCode: "M_BAD_JSON",
-			Error:   "Unknown method",
-		},
+// releaseRequestID records that the response to the request with the given ID
+// is ready, so that the ID may be used again.
+func (c *Connection) releaseRequestID(id string) {
+	c.requestIDMutex.Lock()
+	defer c.requestIDMutex.Unlock()
+	delete(c.requestIDs, id)
+}
+
+// unmarshalRequest is like json.Unmarshal, but decodes numbers in the request
+// parameters as json.Number rather than float64. Parameters such as event
+// content are passed on to the upstream server, and large integers would
+// otherwise lose precision.
+func unmarshalRequest(data []byte, v interface{}) error {
+	// json.Unmarshal checks the whole of the input, and gives more helpful
+	// errors than a Decoder.
+	if !json.Valid(data) {
+		return json.Unmarshal(data, v)
 	}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	return dec.Decode(v)
 }
 
-func handlePing(req *jsonRequest) *jsonResponse {
+func (c *Connection) handleRequestObject(req *jsonRequest) *jsonResponse {
+	handler, ok := handlerMap[req.Method]
+	if !ok {
+		logInfo("Unknown method:", req.Method)
+		return &jsonResponse{
+			ID: req.ID,
+			Error: &MatrixErrorDetails{
+				ErrCode: "M_BAD_JSON",
+				Error:   "Unknown method",
+			},
+		}
+	}
+
+	if c.client != nil && c.client.Versions != nil && !c.client.Versions.supportsMethod(req.Method) {
+		logInfo("Method not supported by upstream:", req.Method)
+		return &jsonResponse{
+			ID: req.ID,
+			Error: &MatrixErrorDetails{
+				ErrCode: "M_UNRECOGNIZED",
+				Error:   "The homeserver does not support " + req.Method,
+			},
+		}
+	}
+
+	timeout, err := c.requestTimeout(req)
+	if err != nil {
+		return &jsonResponse{
+			ID:    req.ID,
+			Error: errorToResponse(err),
+		}
+	}
+
+	req.ctx = c.requestContext()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		req.ctx, cancel = context.WithTimeout(req.ctx, timeout)
+		defer cancel()
+	}
+
+	var result interface{}
+	if key := coalesceKey(req); c.CoalesceReads && key != "" {
+		result, err = c.inflight.do(req.ctx, key, func() (interface{}, error) {
+			return c.callHandler(handler, req)
+		})
+	} else {
+		result, err = c.callHandler(handler, req)
+	}
+	if err != nil {
+		logInfo("Error handling", req.Method, "request:", err)
+		return &jsonResponse{
+			ID:    req.ID,
+			Error: errorToResponse(err),
+		}
+	}
 	return &jsonResponse{
 		ID:     req.ID,
-		Result: &map[string]interface{}{},
+		Result: result,
+	}
+}
+
+// requestTimeout returns the timeout given by the 'timeout_ms' parameter of
+// the request, reduced to MaxRequestTimeout if necessary, or zero if there is
+// none. The parameter is removed, so that handlers do not see it.
+func (c *Connection) requestTimeout(req *jsonRequest) (time.Duration, error) {
+	p := newParamReader(req)
+	ms := p.optionalNumber("timeout_ms")
+	if ms != nil && *ms <= 0 {
+		p.addInvalid("timeout_ms", "must be positive")
+	}
+	if err := p.err(); err != nil {
+		return 0, err
+	}
+	if ms == nil {
+		return 0, nil
+	}
+	delete(req.Params, "timeout_ms")
+
+	// clamp the number before converting it, since a huge one would
+	// overflow, and a tiny one would round to no timeout at all
+	timeout := time.Duration(math.MaxInt64)
+	if *ms < float64(math.MaxInt64/int64(time.Millisecond)) {
+		timeout = time.Duration(*ms * float64(time.Millisecond))
+	}
+	if timeout < 1 {
+		timeout = 1
+	}
+	if c.MaxRequestTimeout > 0 && timeout > c.MaxRequestTimeout {
+		timeout = c.MaxRequestTimeout
+	}
+	return timeout, nil
+}
+
+// requestContext returns the context for upstream requests other than syncs,
+// which is cancelled when the reader stops.
+func (c *Connection) requestContext() context.Context {
+	if c.requestCtx == nil {
+		return context.Background()
+	}
+	return c.requestCtx
+}
+
+// callHandler calls the given handler, turning any panic into an error so
+// that a bad request can't take down the whole server.
+func (c *Connection) callHandler(handler handlerFunc, req *jsonRequest) (result interface{}, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			logErrorf("Connection %d: panic handling %s request: %v\n%s",
+				c.id, req.Method, r, debug.Stack())
+			result = nil
+			err = errors.New("Internal error handling request")
+		}
+	}()
+	return handler(c, req)
+}
+
+// a requestError is returned by a handler when the request itself is invalid.
+// It is returned to the client without contacting the upstream server.
+type requestError struct {
+	errCode string
+	message string
+
+	// the names of the parameters which were at fault, if any
+	fields []string
+}
+
+func (e *requestError) Error() string {
+	return e.errCode + ": " + e.message
+}
+
+// errorToResponse converts an error returned by a handler into the error
+// details to be returned to the client.
+func errorToResponse(err error) *MatrixErrorDetails {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return &MatrixErrorDetails{
+			ErrCode: "M_TIMEOUT",
+			Error:   "Timed out waiting for a response from the homeserver",
+		}
+	}
+
+	// the url.Error wrapping it names the upstream server
+	var redirectErr redirectError
+	if errors.As(err, &redirectErr) {
+		return &MatrixErrorDetails{
+			ErrCode: "M_UNKNOWN",
+			Error:   redirectErr.Error(),
+		}
+	}
+
+	switch err.(type) {
+	case *requestError:
+		return &MatrixErrorDetails{
+			ErrCode: err.(*requestError).errCode,
+			Error:   err.(*requestError).message,
+			Fields:  err.(*requestError).fields,
+		}
+	case *MatrixError:
+		details := err.(*MatrixError).Details
+		details.StatusCode = err.(*MatrixError).StatusCode
+		return &details
+	case *HTTPError:
+		statusCode := err.(*HTTPError).StatusCode
+		return &MatrixErrorDetails{
+			ErrCode:    "M_UNKNOWN",
+			Error:      fmt.Sprintf("Unexpected HTTP %d response from the homeserver", statusCode),
+			StatusCode: statusCode,
+			Body:       truncateErrorBody(err.(*HTTPError).Body),
+		}
+	}
+	return &MatrixErrorDetails{
+		ErrCode: "M_UNKNOWN",
+		Error:   err.Error(),
 	}
 }
+
+// maxErrorBodyLength is the number of bytes of a non-Matrix error response
+// which are passed on to the client.
+const maxErrorBodyLength = 200
+
+// truncateErrorBody trims the body of an error response to
+// maxErrorBodyLength bytes, without splitting a UTF-8 sequence.
+func truncateErrorBody(body []byte) string {
+	if len(body) <= maxErrorBodyLength {
+		return string(body)
+	}
+	end := maxErrorBodyLength
+	for end > 0 && !utf8.RuneStart(body[end]) {
+		end--
+	}
+	return string(body[:end]) + "..."
+}
+
+func handlePing(c *Connection, req *jsonRequest) (interface{}, error) {
+	return map[string]interface{}{}, nil
+}
+
+// handleRefresh aborts the current long-poll sync, so that the client gets a
+// sync response straight away.
+func handleRefresh(c *Connection, req *jsonRequest) (interface{}, error) {
+	c.refreshSync()
+	return map[string]interface{}{}, nil
+}
+
+// a filterSetter is a SyncRequestor whose filter can be changed.
+type filterSetter interface {
+	Filter() string
+	SetFilter(filter string)
+}
+
+// handleSetFilter changes the filter used for subsequent syncs. The 'filter'
+// parameter is either a filter ID or a filter object. This replaces any room
+// subscriptions.
+func handleSetFilter(c *Connection, req *jsonRequest) (interface{}, error) {
+	var filter string
+	switch f := req.Params["filter"].(type) {
+	case string:
+		filter = f
+	case map[string]interface{}:
+		b, err := json.Marshal(f)
+		if err != nil {
+			return nil, err
+		}
+		filter = string(b)
+	}
+
+	p := newParamReader(req)
+	if !p.has("filter") {
+		p.addMissing("filter")
+	} else if filter == "" {
+		p.addInvalid("filter", "must be a filter ID or object")
+	}
+	if err := p.err(); err != nil {
+		return nil, err
+	}
+
+	fs, ok := c.syncer.(filterSetter)
+	if !ok {
+		return nil, &requestError{errCode: "M_UNRECOGNIZED", message: "Filters are not supported"}
+	}
+	c.clearRoomSubscriptions()
+	fs.SetFilter(filter)
+	return map[string]interface{}{}, nil
+}
+
+// handleSubscribeRooms restricts subsequent syncs to the given rooms, as well
+// as any already subscribed to. The rest of the filter is kept.
+func handleSubscribeRooms(c *Connection, req *jsonRequest) (interface{}, error) {
+	return updateRoomSubscriptions(c, req, true)
+}
+
+// handleUnsubscribeRooms removes rooms from those subscribed to with
+// subscribe_rooms. Once there are none left, the filter from before the first
+// subscription is restored.
+func handleUnsubscribeRooms(c *Connection, req *jsonRequest) (interface{}, error) {
+	return updateRoomSubscriptions(c, req, false)
+}
+
+func updateRoomSubscriptions(c *Connection, req *jsonRequest, subscribe bool) (interface{}, error) {
+	p := newParamReader(req)
+	roomIDs := p.roomIDList("room_ids")
+	if err := p.err(); err != nil {
+		return nil, err
+	}
+
+	fs, ok := c.syncer.(filterSetter)
+	if !ok {
+		return nil, &requestError{errCode: "M_UNRECOGNIZED", message: "Filters are not supported"}
+	}
+
+	c.subscriptionMutex.Lock()
+	defer c.subscriptionMutex.Unlock()
+
+	if len(c.subscribedRooms) == 0 {
+		if !subscribe {
+			return map[string]interface{}{"room_ids": []string{}}, nil
+		}
+		c.subscribedRooms = make(map[string]bool)
+		c.roomsBaseFilter = fs.Filter()
+		c.roomsBaseFilterDef = nil
+	}
+	for _, roomID := range roomIDs {
+		if subscribe {
+			c.subscribedRooms[roomID] = true
+		} else {
+			delete(c.subscribedRooms, roomID)
+		}
+	}
+
+	subscribed := make([]string, 0, len(c.subscribedRooms))
+	for roomID := range c.subscribedRooms {
+		subscribed = append(subscribed, roomID)
+	}
+	sort.Strings(subscribed)
+
+	if len(subscribed) == 0 {
+		fs.SetFilter(c.roomsBaseFilter)
+		return map[string]interface{}{"room_ids": subscribed}, nil
+	}
+
+	// the base filter may be the ID of an uploaded filter, in which case its
+	// definition is needed to add the rooms to it
+	if c.roomsBaseFilterDef == nil {
+		def := []byte(c.roomsBaseFilter)
+		if c.roomsBaseFilter == "" {
+			def = []byte("{}")
+		} else if !strings.HasPrefix(c.roomsBaseFilter, "{") {
+			var err error
+			if def, err = c.client.GetFilter(req.ctx, c.roomsBaseFilter); err != nil {
+				return nil, err
+			}
+		}
+		c.roomsBaseFilterDef = def
+	}
+
+	filter, err := roomsFilter(c.roomsBaseFilterDef, subscribed)
+	if err != nil {
+		return nil, err
+	}
+	fs.SetFilter(filter)
+	return map[string]interface{}{"room_ids": subscribed}, nil
+}
+
+// clearRoomSubscriptions forgets the rooms subscribed to with
+// 'subscribe_rooms', when the filter they were added to is replaced.
+func (c *Connection) clearRoomSubscriptions() {
+	c.subscriptionMutex.Lock()
+	defer c.subscriptionMutex.Unlock()
+	c.subscribedRooms = nil
+}
+
+// roomsFilter adds the given rooms to the JSON encoding of a sync filter, so
+// that only those of them which it already allows are included.
+func roomsFilter(def []byte, roomIDs []string) (string, error) {
+	var filter map[string]interface{}
+	d := json.NewDecoder(bytes.NewReader(def))
+	d.UseNumber()
+	if err := d.Decode(&filter); err != nil {
+		return "", err
+	}
+	if filter == nil {
+		filter = make(map[string]interface{})
+	}
+
+	room, _ := filter["room"].(map[string]interface{})
+	if room == nil {
+		room = make(map[string]interface{})
+		filter["room"] = room
+	}
+	if allowed, ok := room["rooms"].([]interface{}); ok {
+		var kept []string
+		for _, roomID := range roomIDs {
+			for _, a := range allowed {
+				if a == roomID {
+					kept = append(kept, roomID)
+					break
+				}
+			}
+		}
+		roomIDs = kept
+	}
+	if roomIDs == nil {
+		roomIDs = []string{}
+	}
+	room["rooms"] = roomIDs
+
+	b, err := json.Marshal(filter)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// ephemeralOnlyFilter is the sync filter used by 'ephemeral_only'. It
+// excludes everything except typing notifications, receipts and presence.
+const ephemeralOnlyFilter = `{"account_data":{"types":[]},"presence":{"types":["m.presence"]},` +
+	`"room":{"account_data":{"types":[]},"ephemeral":{"types":["m.typing","m.receipt"]},` +
+	`"state":{"types":[]},"timeline":{"types":[]}}}`
+
+// handleEphemeralOnly restricts subsequent syncs to ephemeral events and
+// presence, for clients which only show who is typing or online. This
+// replaces any other filter, including room subscriptions.
+func handleEphemeralOnly(c *Connection, req *jsonRequest) (interface{}, error) {
+	fs, ok := c.syncer.(filterSetter)
+	if !ok {
+		return nil, &requestError{errCode: "M_UNRECOGNIZED", message: "Filters are not supported"}
+	}
+	c.clearRoomSubscriptions()
+	fs.SetFilter(ephemeralOnlyFilter)
+	return map[string]interface{}{"filter": json.RawMessage(ephemeralOnlyFilter)}, nil
+}
+
+// a presenceSetter is a SyncRequestor whose 'set_presence' parameter can be
+// changed.
+type presenceSetter interface {
+	SetPresence(presence string)
+}
+
+// handleMutePresence marks the user as offline in subsequent syncs, and stops
+// sending presence to the client.
+func handleMutePresence(c *Connection, req *jsonRequest) (interface{}, error) {
+	ps, ok := c.syncer.(presenceSetter)
+	if !ok {
+		return nil, &requestError{errCode: "M_UNRECOGNIZED", message: "Presence is not supported"}
+	}
+	ps.SetPresence("offline")
+	atomic.StoreInt32(&c.presenceMuted, 1)
+	return map[string]interface{}{}, nil
+}
+
+func handleCapabilities(c *Connection, req *jsonRequest) (interface{}, error) {
+	return c.client.GetCapabilities(req.ctx)
+}
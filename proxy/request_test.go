@@ -1,15 +1,21 @@
 package proxy
 
 import (
+	"context"
 	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"regexp"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestBadMessage(t *testing.T) {
 	req := ""
-	resp := handleRequest([]byte(req))
+	resp := (&Connection{}).handleRequest([]byte(req))
 	respStr := string(resp)
 
 	// some initial checks that the json is as we expect
@@ -32,7 +38,7 @@ func TestBadMessage(t *testing.T) {
 
 func TestPing(t *testing.T) {
 	req := `{"id": "1234", "method": "ping"}`
-	resp := handleRequest([]byte(req))
+	resp := (&Connection{}).handleRequest([]byte(req))
 	respStr := string(resp)
 
 	if strings.Contains(respStr, "error") {
@@ -51,3 +57,394 @@ func TestPing(t *testing.T) {
 		}
 	}
 }
+
+// newTestConnection makes a Connection whose client talks to a test server
+// using the given handler. The caller should Close() the server.
+func newTestConnection(handler http.HandlerFunc) (*Connection, *httptest.Server) {
+	srv := httptest.NewServer(handler)
+	c := &Connection{
+		client: NewMatrixClient(srv.URL+"/", "token"),
+	}
+	return c, srv
+}
+
+func TestCapabilities(t *testing.T) {
+	caps := `{"m.change_password":{"enabled":false},"m.room_versions":{"default":"1","available":{"1":"stable"}}}`
+
+	c, srv := newTestConnection(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/_matrix/client/r0/capabilities" {
+			t.Error("Unexpected path:", r.URL.Path)
+		}
+		if r.Header.Get("Authorization") != "Bearer token" {
+			t.Error("Bad Authorization header:", r.Header.Get("Authorization"))
+		}
+		w.Write([]byte(`{"capabilities":` + caps + `}`))
+	})
+	defer srv.Close()
+
+	resp := c.handleRequest([]byte(`{"id": "1", "method": "capabilities"}`))
+	expected := `{"id":"1","result":` + caps + `}`
+	if string(resp) != expected {
+		t.Errorf("Expected %s, got %s", expected, resp)
+	}
+}
+
+func TestUpstreamTimeout(t *testing.T) {
+	done := make(chan struct{})
+	c, srv := newTestConnection(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+		}
+	})
+	defer srv.Close()
+	defer close(done)
+	c.client.RequestTimeout = 10 * time.Millisecond
+
+	resp := c.handleRequest([]byte(`{"id": "1", "method": "capabilities"}`))
+	expected := `{"id":"1","error":{"errcode":"M_TIMEOUT","error":"Timed out waiting for a response from the homeserver"}}`
+	if string(resp) != expected {
+		t.Errorf("Expected %s, got %s", expected, resp)
+	}
+}
+
+func TestClassTimeouts(t *testing.T) {
+	done := make(chan struct{})
+	c, srv := newTestConnection(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-done:
+		case <-time.After(100 * time.Millisecond):
+		}
+		if strings.HasSuffix(r.URL.Path, "/sync") {
+			w.Write([]byte(`{"next_batch": "s1"}`))
+		} else {
+			w.Write([]byte(`{"event_id": "$event"}`))
+		}
+	})
+	defer srv.Close()
+	defer close(done)
+	c.client.RequestTimeout = time.Second
+	c.client.ClassTimeouts = map[RequestClass]time.Duration{
+		RequestClassSync:  time.Second,
+		RequestClassWrite: 10 * time.Millisecond,
+	}
+
+	resp := c.handleRequest([]byte(`{"id": "1", "method": "send", "params": {"room_id": "!room:test", "event_type": "m.room.message", "content": {}}}`))
+	expected := `{"id":"1","error":{"errcode":"M_TIMEOUT","error":"Timed out waiting for a response from the homeserver"}}`
+	if string(resp) != expected {
+		t.Errorf("Expected %s, got %s", expected, resp)
+	}
+
+	if _, err := c.client.Sync(context.Background(), url.Values{}); err != nil {
+		t.Errorf("Expected sync to succeed, got %v", err)
+	}
+}
+
+func TestClientRequestTimeout(t *testing.T) {
+	done := make(chan struct{})
+	cancelled := make(chan struct{}, 10)
+	c, srv := newTestConnection(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("timeout_ms") != "" {
+			t.Error("timeout_ms was passed upstream")
+		}
+		select {
+		case <-done:
+		case <-r.Context().Done():
+			cancelled <- struct{}{}
+			return
+		case <-time.After(100 * time.Millisecond):
+		}
+		w.Write([]byte(`{"capabilities": {}}`))
+	})
+	defer srv.Close()
+	defer close(done)
+	c.MaxRequestTimeout = time.Second
+
+	tests := []struct {
+		timeoutMS string
+		expected  string
+	}{
+		{"10", `{"id":"1","error":{"errcode":"M_TIMEOUT","error":"Timed out waiting for a response from the homeserver"}}`},
+		{"5000", `{"id":"1","result":{}}`},
+		{"1e300", `{"id":"1","result":{}}`},
+		{"0", `{"id":"1","error":{"errcode":"M_INVALID_PARAM","error":"timeout_ms must be positive","fields":["timeout_ms"]}}`},
+		{`"soon"`, `{"id":"1","error":{"errcode":"M_INVALID_PARAM","error":"timeout_ms must be a number","fields":["timeout_ms"]}}`},
+	}
+	for _, tt := range tests {
+		resp := c.handleRequest([]byte(`{"id": "1", "method": "capabilities", "params": {"timeout_ms": ` + tt.timeoutMS + `}}`))
+		if string(resp) != tt.expected {
+			t.Errorf("timeout_ms %v: expected %s, got %s", tt.timeoutMS, tt.expected, resp)
+		}
+	}
+
+	// the upstream request is cancelled, rather than left running
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Error("Upstream request was not cancelled")
+	}
+
+	// the timeout is clamped to MaxRequestTimeout
+	c.MaxRequestTimeout = 10 * time.Millisecond
+	resp := c.handleRequest([]byte(`{"id": "1", "method": "capabilities", "params": {"timeout_ms": 5000}}`))
+	if !strings.Contains(string(resp), "M_TIMEOUT") {
+		t.Errorf("Expected a timeout, got %s", resp)
+	}
+}
+
+func TestParseClassTimeouts(t *testing.T) {
+	timeouts, err := ParseClassTimeouts("sync=90s, write=10s")
+	if err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+	if len(timeouts) != 2 || timeouts[RequestClassSync] != 90*time.Second || timeouts[RequestClassWrite] != 10*time.Second {
+		t.Errorf("Unexpected timeouts %v", timeouts)
+	}
+
+	for _, s := range []string{"sync", "delete=1s", "read=soon", "read=-1s"} {
+		if _, err := ParseClassTimeouts(s); err == nil {
+			t.Errorf("Expected an error for %q", s)
+		}
+	}
+}
+
+func TestHandlerPanic(t *testing.T) {
+	handlerMap["test_panic"] = func(c *Connection, req *jsonRequest) (interface{}, error) {
+		var m map[string]string
+		m["boom"] = "boom"
+		return nil, nil
+	}
+	defer delete(handlerMap, "test_panic")
+
+	c := &Connection{}
+	resp := c.handleRequest([]byte(`{"id": "1", "method": "test_panic"}`))
+	expected := `{"id":"1","error":{"errcode":"M_UNKNOWN","error":"Internal error handling request"}}`
+	if string(resp) != expected {
+		t.Errorf("Expected %s, got %s", expected, resp)
+	}
+
+	// check we're still alive
+	resp = c.handleRequest([]byte(`{"id": "2", "method": "ping"}`))
+	if string(resp) != `{"id":"2","result":{}}` {
+		t.Errorf("Unexpected response to ping: %s", resp)
+	}
+}
+
+func TestDuplicateRequestID(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	handlerMap["test_block"] = func(c *Connection, req *jsonRequest) (interface{}, error) {
+		started <- struct{}{}
+		<-release
+		return map[string]interface{}{}, nil
+	}
+	defer delete(handlerMap, "test_block")
+
+	c := &Connection{}
+	first := make(chan []byte)
+	go func() {
+		first <- c.handleRequest([]byte(`{"id": "1", "method": "test_block"}`))
+	}()
+	<-started
+
+	resp := c.handleRequest([]byte(`{"id": "1", "method": "ping"}`))
+	expected := `{"id":"1","error":{"errcode":"M_BAD_JSON","error":"duplicate request id"}}`
+	if string(resp) != expected {
+		t.Errorf("Expected %s, got %s", expected, resp)
+	}
+
+	// other ids are unaffected
+	resp = c.handleRequest([]byte(`{"id": "2", "method": "ping"}`))
+	if string(resp) != `{"id":"2","result":{}}` {
+		t.Errorf("Unexpected response to second id: %s", resp)
+	}
+
+	close(release)
+	if resp := <-first; string(resp) != `{"id":"1","result":{}}` {
+		t.Errorf("Unexpected response to first request: %s", resp)
+	}
+
+	// the id may be reused once the response has been sent
+	resp = c.handleRequest([]byte(`{"id": "1", "method": "ping"}`))
+	if string(resp) != `{"id":"1","result":{}}` {
+		t.Errorf("Unexpected response to reused id: %s", resp)
+	}
+}
+
+func TestUpstreamErrorStatusCode(t *testing.T) {
+	c, srv := newTestConnection(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(429)
+		w.Write([]byte(`{"errcode": "M_LIMIT_EXCEEDED", "error": "Too many requests", "retry_after_ms": 2000}`))
+	})
+	defer srv.Close()
+
+	resp := c.handleRequest([]byte(`{"id": "1", "method": "capabilities"}`))
+	expected := `{"id":"1","error":{"errcode":"M_LIMIT_EXCEEDED","error":"Too many requests","status_code":429}}`
+	if string(resp) != expected {
+		t.Errorf("Expected %s, got %s", expected, resp)
+	}
+}
+
+func TestLargeIntegersPreserved(t *testing.T) {
+	content := `{"big":12345678901234567890,"small":1.5,"ts":1700000000000123}`
+
+	c, srv := newTestConnection(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if string(body) != content {
+			t.Errorf("Expected body %s, got %s", content, body)
+		}
+		w.Write([]byte(`{"event_id": "$event", "big": 98765432109876543210}`))
+	})
+	defer srv.Close()
+	c.CSAPIPrefixes = []string{"r0/rooms/"}
+
+	resp := c.handleRequest([]byte(`{"id": "1", "method": "send", "params": {"room_id": "!room:test", "event_type": "m.room.message", "txn_id": "1", "content": ` + content + `}}`))
+	expected := `{"id":"1","result":{"event_id":"$event"}}`
+	if string(resp) != expected {
+		t.Errorf("Expected %s, got %s", expected, resp)
+	}
+
+	resp = c.handleRequest([]byte(`{"id": "2", "method": "cs_api", "params": {"method": "PUT", "endpoint": "r0/rooms/!room:test/send/m.room.message/2", "body": ` + content + `}}`))
+	expected = `{"id":"2","result":{"body":{"event_id":"$event","big":98765432109876543210},"status":200}}`
+	if string(resp) != expected {
+		t.Errorf("Expected %s, got %s", expected, resp)
+	}
+}
+
+// results from the upstream server are passed through as they are, rather
+// than being decoded and re-encoded, so large numbers in them are preserved
+func TestLargeIntegersInResults(t *testing.T) {
+	big := `{"n":98765432109876543210,"ts":1700000000000123,"f":1.50}`
+	c, srv := newTestConnection(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/capabilities"):
+			w.Write([]byte(`{"capabilities": {"m.example": ` + big + `}}`))
+		case strings.HasSuffix(r.URL.Path, "/state/m.room.topic/"):
+			w.Write([]byte(`{"event_id": "$topic", "content": ` + big + `}`))
+		case strings.HasSuffix(r.URL.Path, "/pushers"):
+			w.Write([]byte(`{"pushers": [` + big + `]}`))
+		default:
+			t.Error("Unexpected request:", r.URL.Path)
+		}
+	})
+	defer srv.Close()
+
+	tests := []struct {
+		request  string
+		expected string
+	}{
+		{
+			`{"method": "capabilities"}`,
+			`{"m.example":{"n":98765432109876543210,"ts":1700000000000123,"f":1.50}}`,
+		},
+		{
+			`{"method": "get_state_event", "params": {"room_id": "!room:test", "event_type": "m.room.topic"}}`,
+			`{"n":98765432109876543210,"ts":1700000000000123,"f":1.50}`,
+		},
+		{
+			`{"method": "get_pushers"}`,
+			`{"pushers":[{"n":98765432109876543210,"ts":1700000000000123,"f":1.50}]}`,
+		},
+	}
+	for _, tt := range tests {
+		request := `{"id": "1", ` + tt.request[1:]
+		resp := c.handleRequest([]byte(request))
+		if expected := `{"id":"1","result":` + tt.expected + `}`; string(resp) != expected {
+			t.Errorf("Expected %s, got %s", expected, resp)
+		}
+
+		rpcRequest := `{"jsonrpc": "2.0", "id": "1", ` + tt.request[1:]
+		resp = c.handleJSONRPCRequest([]byte(rpcRequest))
+		if expected := `{"jsonrpc":"2.0","id":"1","result":` + tt.expected + `}`; string(resp) != expected {
+			t.Errorf("Expected %s, got %s", expected, resp)
+		}
+	}
+}
+
+func TestTrailingDataRejected(t *testing.T) {
+	resp := (&Connection{}).handleRequest([]byte(`{"id": "1", "method": "ping"} {}`))
+	expected := `{"id":null,"error":{"errcode":"M_NOT_JSON","error":"invalid character '{' after top-level value"}}`
+	if string(resp) != expected {
+		t.Errorf("Expected %s, got %s", expected, resp)
+	}
+}
+
+func TestUpstreamHTTPError(t *testing.T) {
+	c, srv := newTestConnection(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(502)
+		w.Write([]byte("Bad Gateway"))
+	})
+	defer srv.Close()
+
+	resp := c.handleRequest([]byte(`{"id": "1", "method": "capabilities"}`))
+	expected := `{"id":"1","error":{"errcode":"M_UNKNOWN","error":"Unexpected HTTP 502 response from the homeserver","status_code":502,"body":"Bad Gateway"}}`
+	if string(resp) != expected {
+		t.Errorf("Expected %s, got %s", expected, resp)
+	}
+}
+
+func TestErrorToResponseTruncatesBody(t *testing.T) {
+	body := strings.Repeat("a", maxErrorBodyLength-1) + "é and more"
+	details := errorToResponse(&HTTPError{StatusCode: 504, ContentType: "text/plain", Body: []byte(body)})
+
+	if details.StatusCode != 504 || details.ErrCode != "M_UNKNOWN" {
+		t.Errorf("Unexpected details %+v", details)
+	}
+	expectedBody := strings.Repeat("a", maxErrorBodyLength-1) + "..."
+	if details.Body != expectedBody {
+		t.Errorf("Expected body %q, got %q", expectedBody, details.Body)
+	}
+}
+
+func TestStrictRoomIDs(t *testing.T) {
+	var paths []string
+	c, srv := newTestConnection(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+		w.Write([]byte(`{"event_id": "$event"}`))
+	})
+	defer srv.Close()
+
+	SetStrictRoomIDs(true)
+	defer SetStrictRoomIDs(false)
+
+	invalid := `{"errcode":"M_INVALID_PARAM","error":"room_id must be of the form !localpart:server","fields":["room_id"]}`
+	tests := []struct {
+		roomID   string
+		expected string
+	}{
+		{"!room:test", `{"event_id":"$event"}`},
+		{" !room:test.org:8448 ", `{"event_id":"$event"}`},
+		{"room:test", invalid},
+		{"!room", invalid},
+		{"!:test", invalid},
+		{"!room:", invalid},
+		{"#alias:test", invalid},
+		{"!ro om:test", invalid},
+	}
+	for _, tt := range tests {
+		paths = nil
+		roomID, _ := json.Marshal(tt.roomID)
+		resp := c.handleRequest([]byte(`{"id": "1", "method": "state", "params": {"room_id": ` + string(roomID) + `, "event_type": "m.room.topic", "content": {"topic": "hi"}}}`))
+		if !strings.Contains(string(resp), tt.expected) {
+			t.Errorf("%q: expected %s, got %s", tt.roomID, tt.expected, resp)
+		}
+		if tt.expected == invalid && len(paths) != 0 {
+			t.Errorf("%q: expected no upstream request, got %v", tt.roomID, paths)
+		}
+	}
+
+	// the whitespace is removed before the ID is sent upstream
+	c.handleRequest([]byte(`{"id": "1", "method": "state", "params": {"room_id": " !room:test ", "event_type": "m.room.topic", "content": {}}}`))
+	if len(paths) != 1 || paths[0] != "/_matrix/client/r0/rooms/!room:test/state/m.room.topic/" {
+		t.Errorf("Unexpected requests %v", paths)
+	}
+
+	// without strict checking, anything goes
+	SetStrictRoomIDs(false)
+	paths = nil
+	resp := c.handleRequest([]byte(`{"id": "1", "method": "state", "params": {"room_id": "room", "event_type": "m.room.topic", "content": {}}}`))
+	if !strings.Contains(string(resp), `"result"`) || len(paths) != 1 {
+		t.Errorf("Expected the request to be sent, got %s", resp)
+	}
+}
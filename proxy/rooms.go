@@ -0,0 +1,238 @@
+package proxy
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// the allowed values of 'join_rule' in m.room.join_rules
+var joinRules = []string{"public", "knock", "invite", "private"}
+
+// the allowed values of 'guest_access' in m.room.guest_access
+var guestAccessValues = []string{"can_join", "forbidden"}
+
+// the allowed values of 'history_visibility' in m.room.history_visibility
+var historyVisibilities = []string{"invited", "joined", "shared", "world_readable"}
+
+// handleSetJoinRules sets the m.room.join_rules state in a room.
+func handleSetJoinRules(c *Connection, req *jsonRequest) (interface{}, error) {
+	return sendEnumState(c, req, "m.room.join_rules", "join_rule", joinRules)
+}
+
+// handleSetGuestAccess sets the m.room.guest_access state in a room.
+func handleSetGuestAccess(c *Connection, req *jsonRequest) (interface{}, error) {
+	return sendEnumState(c, req, "m.room.guest_access", "guest_access", guestAccessValues)
+}
+
+// handleSetHistoryVisibility sets the m.room.history_visibility state in a
+// room.
+func handleSetHistoryVisibility(c *Connection, req *jsonRequest) (interface{}, error) {
+	return sendEnumState(c, req, "m.room.history_visibility", "history_visibility", historyVisibilities)
+}
+
+// sendEnumState handles requests which set a state event whose content is a
+// single enumerated key, which is taken from the parameter of the same name.
+func sendEnumState(c *Connection, req *jsonRequest, eventType string, key string, allowed []string) (interface{}, error) {
+	p := newParamReader(req)
+	roomID := p.roomID("room_id")
+	value := p.enum(key, allowed)
+	if err := p.err(); err != nil {
+		return nil, err
+	}
+	if err := c.checkRoomAllowed(roomID); err != nil {
+		return nil, err
+	}
+
+	eventID, err := c.client.SendState(req.ctx, roomID, eventType, "", map[string]string{key: value})
+	if err != nil {
+		return nil, err
+	}
+	return map[string]string{"event_id": eventID}, nil
+}
+
+// handleUpgradeRoom upgrades a room to a new room version.
+func handleUpgradeRoom(c *Connection, req *jsonRequest) (interface{}, error) {
+	p := newParamReader(req)
+	roomID := p.roomID("room_id")
+	newVersion := p.string("new_version")
+	if err := p.err(); err != nil {
+		return nil, err
+	}
+	if err := c.checkRoomAllowed(roomID); err != nil {
+		return nil, err
+	}
+
+	replacement, err := c.client.UpgradeRoom(req.ctx, roomID, newVersion)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]string{"replacement_room": replacement}, nil
+}
+
+// handleKnock asks to join a room, given by ID or alias.
+func handleKnock(c *Connection, req *jsonRequest) (interface{}, error) {
+	p := newParamReader(req)
+	room := p.string("room_id_or_alias")
+	reason := p.optionalString("reason")
+	serverNames := p.optionalStringList("server_name")
+	if room != "" && room[0] != '!' && room[0] != '#' {
+		p.addInvalid("room_id_or_alias", "must be a room ID or alias")
+	}
+	if err := p.err(); err != nil {
+		return nil, err
+	}
+	if err := c.checkRoomParamAllowed("room_id_or_alias", room); err != nil {
+		return nil, err
+	}
+
+	roomID, err := c.client.Knock(req.ctx, room, reason, serverNames)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]string{"room_id": roomID}, nil
+}
+
+// handleRoomSummary gets a summary of a room, which the user need not have
+// joined (MSC3266).
+func handleRoomSummary(c *Connection, req *jsonRequest) (interface{}, error) {
+	p := newParamReader(req)
+	room := p.string("room_id_or_alias")
+	via := p.optionalStringList("via")
+	if room != "" && room[0] != '!' && room[0] != '#' {
+		p.addInvalid("room_id_or_alias", "must be a room ID or alias")
+	}
+	if err := p.err(); err != nil {
+		return nil, err
+	}
+
+	return c.client.GetRoomSummary(req.ctx, room, via)
+}
+
+// handlePinEvents adds events to the pinned events of a room.
+func handlePinEvents(c *Connection, req *jsonRequest) (interface{}, error) {
+	return updatePinnedEvents(c, req, func(pinned []string, eventIDs []string) []string {
+		for _, id := range eventIDs {
+			if indexOf(pinned, id) < 0 {
+				pinned = append(pinned, id)
+			}
+		}
+		return pinned
+	})
+}
+
+// handleUnpinEvents removes events from the pinned events of a room.
+func handleUnpinEvents(c *Connection, req *jsonRequest) (interface{}, error) {
+	return updatePinnedEvents(c, req, func(pinned []string, eventIDs []string) []string {
+		res := []string{}
+		for _, id := range pinned {
+			if indexOf(eventIDs, id) < 0 {
+				res = append(res, id)
+			}
+		}
+		return res
+	})
+}
+
+// updatePinnedEvents reads the m.room.pinned_events state of the room given
+// by the 'room_id' parameter, applies update to it with the 'event_ids'
+// parameter, and writes it back.
+func updatePinnedEvents(c *Connection, req *jsonRequest, update func(pinned []string, eventIDs []string) []string) (interface{}, error) {
+	p := newParamReader(req)
+	roomID := p.roomID("room_id")
+	eventIDs := p.stringList("event_ids")
+	if err := p.err(); err != nil {
+		return nil, err
+	}
+	if err := c.checkRoomAllowed(roomID); err != nil {
+		return nil, err
+	}
+
+	pinned := []string{}
+	event, err := c.client.GetStateEvent(req.ctx, roomID, "m.room.pinned_events", "")
+	if err == nil {
+		var content struct {
+			Pinned []string `json:"pinned"`
+		}
+		// ignore malformed content, and replace it with our list
+		if json.Unmarshal(event.Content, &content) == nil && content.Pinned != nil {
+			pinned = content.Pinned
+		}
+	} else if mErr, ok := err.(*MatrixError); !ok || mErr.Details.ErrCode != "M_NOT_FOUND" {
+		return nil, err
+	}
+
+	pinned = update(pinned, eventIDs)
+	eventID, err := c.client.SendState(req.ctx, roomID, "m.room.pinned_events", "", map[string][]string{"pinned": pinned})
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{"event_id": eventID, "pinned": pinned}, nil
+}
+
+// indexOf returns the index of s in list, or -1 if it is not present.
+func indexOf(list []string, s string) int {
+	for i, item := range list {
+		if item == s {
+			return i
+		}
+	}
+	return -1
+}
+
+// handleAddAlias creates an alias for a room.
+func handleAddAlias(c *Connection, req *jsonRequest) (interface{}, error) {
+	p := newParamReader(req)
+	alias := p.string("alias")
+	roomID := p.roomID("room_id")
+	checkAlias(p, alias)
+	if err := p.err(); err != nil {
+		return nil, err
+	}
+	if err := c.checkRoomAllowed(roomID); err != nil {
+		return nil, err
+	}
+
+	if err := c.client.AddAlias(req.ctx, alias, roomID); err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{}, nil
+}
+
+// handleDeleteAlias removes a room alias.
+func handleDeleteAlias(c *Connection, req *jsonRequest) (interface{}, error) {
+	p := newParamReader(req)
+	alias := p.string("alias")
+	checkAlias(p, alias)
+	if err := p.err(); err != nil {
+		return nil, err
+	}
+	if err := c.checkRoomParamAllowed("alias", alias); err != nil {
+		return nil, err
+	}
+
+	if err := c.client.DeleteAlias(req.ctx, alias); err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{}, nil
+}
+
+// checkAlias records a problem with the 'alias' parameter if it is not of the
+// form '#localpart:server'.
+func checkAlias(p *paramReader, alias string) {
+	if alias == "" {
+		return
+	}
+	if alias[0] != '#' || strings.Index(alias, ":") < 2 {
+		p.addInvalid("alias", "must be of the form #localpart:server")
+	}
+}
+
+// handleGetInvites returns the rooms the user is invited to, in the format
+// of the 'rooms.invite' section of a sync response.
+func handleGetInvites(c *Connection, req *jsonRequest) (interface{}, error) {
+	invites, err := c.client.GetInvites(req.ctx)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{"invite": invites}, nil
+}
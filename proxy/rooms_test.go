@@ -0,0 +1,389 @@
+package proxy
+
+import (
+	"io/ioutil"
+	"net/http"
+	"testing"
+)
+
+func TestSetJoinRulesAndGuestAccess(t *testing.T) {
+	tests := []struct {
+		request      string
+		expectedPath string
+		expectedBody string
+	}{
+		{
+			`{"id": "1", "method": "set_join_rules", "params": {"room_id": "!room:test", "join_rule": "invite"}}`,
+			"/_matrix/client/r0/rooms/%21room:test/state/m.room.join_rules/",
+			`{"join_rule":"invite"}`,
+		},
+		{
+			`{"id": "1", "method": "set_guest_access", "params": {"room_id": "!room:test", "guest_access": "can_join"}}`,
+			"/_matrix/client/r0/rooms/%21room:test/state/m.room.guest_access/",
+			`{"guest_access":"can_join"}`,
+		},
+		{
+			`{"id": "1", "method": "set_history_visibility", "params": {"room_id": "!room:test", "history_visibility": "world_readable"}}`,
+			"/_matrix/client/r0/rooms/%21room:test/state/m.room.history_visibility/",
+			`{"history_visibility":"world_readable"}`,
+		},
+	}
+
+	for _, tt := range tests {
+		c, srv := newTestConnection(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != "PUT" {
+				t.Error("Unexpected method:", r.Method)
+			}
+			if r.URL.EscapedPath() != tt.expectedPath {
+				t.Errorf("Expected path %v, got %v", tt.expectedPath, r.URL.EscapedPath())
+			}
+			body, _ := ioutil.ReadAll(r.Body)
+			if string(body) != tt.expectedBody {
+				t.Errorf("Expected body %v, got %s", tt.expectedBody, body)
+			}
+			w.Write([]byte(`{"event_id": "$event"}`))
+		})
+
+		resp := c.handleRequest([]byte(tt.request))
+		if string(resp) != `{"id":"1","result":{"event_id":"$event"}}` {
+			t.Errorf("Unexpected response to %v: %s", tt.request, resp)
+		}
+		srv.Close()
+	}
+}
+
+func TestSetJoinRulesAndGuestAccessInvalid(t *testing.T) {
+	tests := []struct {
+		request          string
+		expectedResponse string
+	}{
+		{
+			`{"id": "1", "method": "set_join_rules", "params": {"room_id": "!room:test", "join_rule": "everyone"}}`,
+			`{"id":"1","error":{"errcode":"M_INVALID_PARAM","error":"join_rule must be one of: public, knock, invite, private","fields":["join_rule"]}}`,
+		},
+		{
+			`{"id": "1", "method": "set_join_rules", "params": {"room_id": "!room:test"}}`,
+			`{"id":"1","error":{"errcode":"M_MISSING_PARAM","error":"Missing parameter join_rule","fields":["join_rule"]}}`,
+		},
+		{
+			`{"id": "1", "method": "set_guest_access", "params": {"room_id": "!room:test", "guest_access": true}}`,
+			`{"id":"1","error":{"errcode":"M_INVALID_PARAM","error":"guest_access must be a string","fields":["guest_access"]}}`,
+		},
+		{
+			`{"id": "1", "method": "set_guest_access", "params": {"guest_access": "forbidden"}}`,
+			`{"id":"1","error":{"errcode":"M_MISSING_PARAM","error":"Missing parameter room_id","fields":["room_id"]}}`,
+		},
+		{
+			`{"id": "1", "method": "set_history_visibility", "params": {"room_id": "!room:test", "history_visibility": "public"}}`,
+			`{"id":"1","error":{"errcode":"M_INVALID_PARAM","error":"history_visibility must be one of: invited, joined, shared, world_readable","fields":["history_visibility"]}}`,
+		},
+	}
+
+	c, srv := newTestConnection(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("Unexpected upstream request:", r.URL)
+	})
+	defer srv.Close()
+
+	for _, tt := range tests {
+		resp := c.handleRequest([]byte(tt.request))
+		if string(resp) != tt.expectedResponse {
+			t.Errorf("Request %v: expected %v, got %s", tt.request, tt.expectedResponse, resp)
+		}
+	}
+}
+
+func TestUpgradeRoom(t *testing.T) {
+	c, srv := newTestConnection(func(w http.ResponseWriter, r *http.Request) {
+		expectedPath := "/_matrix/client/r0/rooms/%21room:test/upgrade"
+		if r.Method != "POST" || r.URL.EscapedPath() != expectedPath {
+			t.Error("Unexpected request:", r.Method, r.URL.EscapedPath())
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		if string(body) != `{"new_version":"6"}` {
+			t.Errorf("Unexpected body %s", body)
+		}
+		w.Write([]byte(`{"replacement_room": "!new:test"}`))
+	})
+	defer srv.Close()
+
+	resp := c.handleRequest([]byte(`{"id": "1", "method": "upgrade_room", "params": {"room_id": "!room:test", "new_version": "6"}}`))
+	expected := `{"id":"1","result":{"replacement_room":"!new:test"}}`
+	if string(resp) != expected {
+		t.Errorf("Expected %s, got %s", expected, resp)
+	}
+
+	resp = c.handleRequest([]byte(`{"id": "2", "method": "upgrade_room", "params": {"room_id": "!room:test"}}`))
+	expected = `{"id":"2","error":{"errcode":"M_MISSING_PARAM","error":"Missing parameter new_version","fields":["new_version"]}}`
+	if string(resp) != expected {
+		t.Errorf("Expected %s, got %s", expected, resp)
+	}
+}
+
+func TestMultipleInvalidParams(t *testing.T) {
+	c, srv := newTestConnection(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("Unexpected upstream request:", r.URL)
+	})
+	defer srv.Close()
+
+	resp := c.handleRequest([]byte(`{"id": "1", "method": "upgrade_room", "params": {}}`))
+	expected := `{"id":"1","error":{"errcode":"M_MISSING_PARAM","error":"Missing parameter room_id; Missing parameter new_version","fields":["room_id","new_version"]}}`
+	if string(resp) != expected {
+		t.Errorf("Expected %s, got %s", expected, resp)
+	}
+
+	resp = c.handleRequest([]byte(`{"id": "2", "method": "set_join_rules", "params": {"room_id": 1, "join_rule": "everyone"}}`))
+	expected = `{"id":"2","error":{"errcode":"M_INVALID_PARAM","error":"room_id must be a string; join_rule must be one of: public, knock, invite, private","fields":["room_id","join_rule"]}}`
+	if string(resp) != expected {
+		t.Errorf("Expected %s, got %s", expected, resp)
+	}
+}
+
+func TestKnock(t *testing.T) {
+	c, srv := newTestConnection(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" || r.URL.EscapedPath() != "/_matrix/client/r0/knock/%23room:test" {
+			t.Error("Unexpected request:", r.Method, r.URL.EscapedPath())
+		}
+		if names := r.URL.Query()["server_name"]; len(names) != 2 || names[0] != "a.test" || names[1] != "b.test" {
+			t.Error("Unexpected server_name:", names)
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		if string(body) != `{"reason":"let me in"}` {
+			t.Errorf("Unexpected body %s", body)
+		}
+		w.Write([]byte(`{"room_id": "!room:test"}`))
+	})
+	defer srv.Close()
+
+	resp := c.handleRequest([]byte(`{"id": "1", "method": "knock", "params": {"room_id_or_alias": "#room:test", "reason": "let me in", "server_name": ["a.test", "b.test"]}}`))
+	expected := `{"id":"1","result":{"room_id":"!room:test"}}`
+	if string(resp) != expected {
+		t.Errorf("Expected %s, got %s", expected, resp)
+	}
+
+	resp = c.handleRequest([]byte(`{"id": "2", "method": "knock", "params": {"room_id_or_alias": "room", "server_name": "a.test"}}`))
+	expected = `{"id":"2","error":{"errcode":"M_INVALID_PARAM","error":"server_name must be a list of strings; room_id_or_alias must be a room ID or alias","fields":["server_name","room_id_or_alias"]}}`
+	if string(resp) != expected {
+		t.Errorf("Expected %s, got %s", expected, resp)
+	}
+}
+
+func TestRoomSummary(t *testing.T) {
+	summary := `{"room_id":"!room:test","name":"Room","topic":"Things","num_joined_members":3}`
+
+	tests := []struct {
+		versions     *Versions
+		expectedPath string
+	}{
+		{nil, "/_matrix/client/unstable/im.nheko.summary/rooms/%23my%20room:test/summary"},
+		{&Versions{Versions: []string{"v1.15"}}, "/_matrix/client/v1/room_summary/%23my%20room:test"},
+	}
+
+	for _, tt := range tests {
+		c, srv := newTestConnection(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != "GET" || r.URL.EscapedPath() != tt.expectedPath {
+				t.Error("Unexpected request:", r.Method, r.URL.EscapedPath())
+			}
+			if via := r.URL.Query()["via"]; len(via) != 2 || via[0] != "a.test" || via[1] != "b.test" {
+				t.Error("Unexpected via:", via)
+			}
+			w.Write([]byte(summary))
+		})
+		c.client.Versions = tt.versions
+
+		resp := c.handleRequest([]byte(`{"id": "1", "method": "room_summary", "params": {"room_id_or_alias": "#my room:test", "via": ["a.test", "b.test"]}}`))
+		expected := `{"id":"1","result":` + summary + `}`
+		if string(resp) != expected {
+			t.Errorf("Expected %s, got %s", expected, resp)
+		}
+		srv.Close()
+	}
+}
+
+func TestRoomSummaryInvalid(t *testing.T) {
+	c, srv := newTestConnection(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("Unexpected request:", r.Method, r.URL.Path)
+	})
+	defer srv.Close()
+
+	resp := c.handleRequest([]byte(`{"id": "1", "method": "room_summary", "params": {"room_id_or_alias": "room:test", "via": "a.test"}}`))
+	expected := `{"id":"1","error":{"errcode":"M_INVALID_PARAM","error":"via must be a list of strings; room_id_or_alias must be a room ID or alias","fields":["via","room_id_or_alias"]}}`
+	if string(resp) != expected {
+		t.Errorf("Expected %s, got %s", expected, resp)
+	}
+}
+
+func TestAddAndDeleteAlias(t *testing.T) {
+	tests := []struct {
+		request        string
+		expectedMethod string
+		expectedBody   string
+	}{
+		{
+			`{"id": "1", "method": "add_alias", "params": {"alias": "#my room/x:test", "room_id": "!room:test"}}`,
+			"PUT",
+			`{"room_id":"!room:test"}`,
+		},
+		{
+			`{"id": "1", "method": "delete_alias", "params": {"alias": "#my room/x:test"}}`,
+			"DELETE",
+			``,
+		},
+	}
+
+	for _, tt := range tests {
+		c, srv := newTestConnection(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != tt.expectedMethod {
+				t.Error("Unexpected method:", r.Method)
+			}
+			expectedPath := "/_matrix/client/r0/directory/room/%23my%20room%2Fx:test"
+			if r.URL.EscapedPath() != expectedPath {
+				t.Errorf("Expected path %v, got %v", expectedPath, r.URL.EscapedPath())
+			}
+			body, _ := ioutil.ReadAll(r.Body)
+			if string(body) != tt.expectedBody {
+				t.Errorf("Expected body %v, got %s", tt.expectedBody, body)
+			}
+			w.Write([]byte(`{}`))
+		})
+
+		resp := c.handleRequest([]byte(tt.request))
+		if string(resp) != `{"id":"1","result":{}}` {
+			t.Errorf("Unexpected response: %s", resp)
+		}
+		srv.Close()
+	}
+}
+
+func TestAliasValidation(t *testing.T) {
+	c := &Connection{}
+	for _, alias := range []string{"room:test", "#room", "#:test"} {
+		resp := c.handleRequest([]byte(`{"id": "1", "method": "delete_alias", "params": {"alias": "` + alias + `"}}`))
+		expected := `{"id":"1","error":{"errcode":"M_INVALID_PARAM","error":"alias must be of the form #localpart:server","fields":["alias"]}}`
+		if string(resp) != expected {
+			t.Errorf("%s: expected %s, got %s", alias, expected, resp)
+		}
+	}
+}
+
+func TestDeleteAliasRestricted(t *testing.T) {
+	var requests int
+	c, srv := newTestConnection(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Write([]byte(`{}`))
+	})
+	defer srv.Close()
+	c.RoomAllowlist = RoomAllowlist{"@bot:test": {"!allowed:test"}}
+	c.UserID = "@bot:test"
+
+	// the alias may point at any room, so restricted users can't delete it
+	resp := c.handleRequest([]byte(`{"id": "1", "method": "delete_alias", "params": {"alias": "#room:test"}}`))
+	expected := `{"id":"1","error":{"errcode":"M_FORBIDDEN","error":"This connection may only send to rooms given by ID","fields":["alias"]}}`
+	if string(resp) != expected {
+		t.Errorf("Expected %s, got %s", expected, resp)
+	}
+	if requests != 0 {
+		t.Errorf("Expected no upstream requests, got %d", requests)
+	}
+}
+
+func TestGetInvites(t *testing.T) {
+	invites := `{"!room:test":{"invite_state":{"events":[{"type":"m.room.name","state_key":"","content":{"name":"Room"}}]}}}`
+
+	c, srv := newTestConnection(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/_matrix/client/r0/sync" {
+			t.Error("Unexpected path:", r.URL.Path)
+		}
+		if r.URL.Query().Get("timeout") != "0" || r.URL.Query().Get("since") != "" {
+			t.Error("Unexpected query:", r.URL.RawQuery)
+		}
+		if r.URL.Query().Get("filter") != inviteFilter {
+			t.Error("Unexpected filter:", r.URL.Query().Get("filter"))
+		}
+		w.Write([]byte(`{"next_batch": "s1", "rooms": {"join": {"!other:test": {}}, "invite": ` + invites + `}}`))
+	})
+	defer srv.Close()
+
+	resp := c.handleRequest([]byte(`{"id": "1", "method": "get_invites"}`))
+	expected := `{"id":"1","result":{"invite":` + invites + `}}`
+	if string(resp) != expected {
+		t.Errorf("Expected %s, got %s", expected, resp)
+	}
+}
+
+func TestPinEvents(t *testing.T) {
+	tests := []struct {
+		request      string
+		current      string
+		expectedBody string
+	}{
+		{
+			`{"id": "1", "method": "pin_events", "params": {"room_id": "!room:test", "event_ids": ["$b", "$c"]}}`,
+			`{"content": {"pinned": ["$a", "$b"]}, "event_id": "$pins", "type": "m.room.pinned_events"}`,
+			`{"pinned":["$a","$b","$c"]}`,
+		},
+		{
+			`{"id": "1", "method": "pin_events", "params": {"room_id": "!room:test", "event_ids": ["$a"]}}`,
+			"",
+			`{"pinned":["$a"]}`,
+		},
+		{
+			`{"id": "1", "method": "unpin_events", "params": {"room_id": "!room:test", "event_ids": ["$a", "$c"]}}`,
+			`{"pinned": ["$a", "$b"]}`,
+			`{"pinned":["$b"]}`,
+		},
+		{
+			`{"id": "1", "method": "unpin_events", "params": {"room_id": "!room:test", "event_ids": ["$a"]}}`,
+			"",
+			`{"pinned":[]}`,
+		},
+	}
+
+	for _, tt := range tests {
+		c, srv := newTestConnection(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.EscapedPath() != "/_matrix/client/r0/rooms/%21room:test/state/m.room.pinned_events/" {
+				t.Errorf("Unexpected path %v", r.URL.EscapedPath())
+			}
+			switch r.Method {
+			case "GET":
+				if tt.current == "" {
+					w.WriteHeader(404)
+					w.Write([]byte(`{"errcode": "M_NOT_FOUND", "error": "Event not found"}`))
+					return
+				}
+				w.Write([]byte(tt.current))
+			case "PUT":
+				body, _ := ioutil.ReadAll(r.Body)
+				if string(body) != tt.expectedBody {
+					t.Errorf("%v: expected body %v, got %s", tt.request, tt.expectedBody, body)
+				}
+				w.Write([]byte(`{"event_id": "$event"}`))
+			default:
+				t.Error("Unexpected method:", r.Method)
+			}
+		})
+
+		resp := c.handleRequest([]byte(tt.request))
+		expected := `{"id":"1","result":{"event_id":"$event",` + tt.expectedBody[1:] + `}`
+		if string(resp) != expected {
+			t.Errorf("Expected %s, got %s", expected, resp)
+		}
+		srv.Close()
+	}
+}
+
+func TestPinEventsError(t *testing.T) {
+	c, srv := newTestConnection(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			t.Error("Unexpected method:", r.Method)
+		}
+		w.WriteHeader(403)
+		w.Write([]byte(`{"errcode": "M_FORBIDDEN", "error": "You are not in this room"}`))
+	})
+	defer srv.Close()
+
+	resp := c.handleRequest([]byte(`{"id": "1", "method": "pin_events", "params": {"room_id": "!room:test", "event_ids": ["$a"]}}`))
+	expected := `{"id":"1","error":{"errcode":"M_FORBIDDEN","error":"You are not in this room","status_code":403}}`
+	if string(resp) != expected {
+		t.Errorf("Expected %s, got %s", expected, resp)
+	}
+}
@@ -0,0 +1,62 @@
+package proxy
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A serverTiming is a metric from a Server-Timing header.
+type serverTiming struct {
+	name        string
+	duration    time.Duration
+	description string
+}
+
+func (t serverTiming) String() string {
+	s := t.name + "=" + t.duration.String()
+	if t.description != "" {
+		s += fmt.Sprintf(" (%s)", t.description)
+	}
+	return s
+}
+
+// parseServerTiming parses the value of a Server-Timing header, such as:
+//
+//	db;dur=53, cache;desc="Cache Read";dur=23.2
+//
+// Malformed parameters are ignored.
+func parseServerTiming(header string) []serverTiming {
+	var timings []serverTiming
+
+	for _, metric := range strings.Split(header, ",") {
+		parts := strings.Split(metric, ";")
+		name := strings.TrimSpace(parts[0])
+		if name == "" {
+			continue
+		}
+
+		t := serverTiming{name: name}
+		for _, param := range parts[1:] {
+			kv := strings.SplitN(param, "=", 2)
+			if len(kv) != 2 {
+				continue
+			}
+			key := strings.ToLower(strings.TrimSpace(kv[0]))
+			value := strings.Trim(strings.TrimSpace(kv[1]), `"`)
+
+			switch key {
+			case "dur":
+				// durations are in milliseconds
+				if ms, err := strconv.ParseFloat(value, 64); err == nil {
+					t.duration = time.Duration(ms * float64(time.Millisecond))
+				}
+			case "desc":
+				t.description = value
+			}
+		}
+		timings = append(timings, t)
+	}
+	return timings
+}
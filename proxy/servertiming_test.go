@@ -0,0 +1,47 @@
+package proxy
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseServerTiming(t *testing.T) {
+	header := `db;dur=53, cache;desc="Cache Read";dur=23.2, miss, ;dur=1, bad;dur=x`
+	expected := []serverTiming{
+		{"db", 53 * time.Millisecond, ""},
+		{"cache", 23200 * time.Microsecond, "Cache Read"},
+		{"miss", 0, ""},
+		{"bad", 0, ""},
+	}
+
+	timings := parseServerTiming(header)
+	if !reflect.DeepEqual(timings, expected) {
+		t.Errorf("Expected %v, got %v", expected, timings)
+	}
+}
+
+func TestServerTimingLogged(t *testing.T) {
+	c, srv := newTestConnection(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Server-Timing", "db;dur=12.5, total;dur=40")
+		w.Write([]byte(`{"capabilities": {}}`))
+	})
+	defer srv.Close()
+	c.client.LogServerTiming = true
+
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	c.handleRequest([]byte(`{"id": "1", "method": "capabilities"}`))
+
+	expected := "Upstream Server-Timing for GET /_matrix/client/r0/capabilities: [db=12.5ms total=40ms]"
+	if !strings.Contains(buf.String(), expected) {
+		t.Errorf("Expected log to contain %q, got %q", expected, buf.String())
+	}
+}
@@ -0,0 +1,313 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"sync"
+	"sync/atomic"
+)
+
+// the number of frames which may be waiting for a subscriber to a shared
+// sync before it is dropped for falling behind
+const sharedSyncBuffer = 16
+
+// errSharedSyncBehind is returned to a subscriber to a shared sync which has
+// not kept up with the frames broadcast to it.
+var errSharedSyncBehind = errors.New("fell too far behind the shared sync")
+
+// errSharedSyncClosed is returned by a SharedSyncer once it has been closed.
+var errSharedSyncClosed = errors.New("shared sync closed")
+
+// A SyncHub lets connections which would make identical sync requests share
+// a single sync with the upstream server, whose responses are broadcast to
+// all of them. This is intended for deployments with many read-only clients
+// using the same account, such as wall displays.
+//
+// Each connection still makes its own initial sync, so that it gets the full
+// state, and carries on with its own syncs until it has reached the 'since'
+// of the shared sync; only after that are its syncs shared. That way it
+// neither misses events nor sees any twice.
+type SyncHub struct {
+	mutex   sync.Mutex
+	streams map[string]*syncStream
+}
+
+// NewSyncHub creates an empty SyncHub.
+func NewSyncHub() *SyncHub {
+	return &SyncHub{streams: make(map[string]*syncStream)}
+}
+
+// SharedSyncKey returns the key identifying the connections which can share a
+// sync: those with the same access token, presence and sync parameters. It
+// returns "" for syncs which continue from a 'since' token, which can't be
+// shared.
+func SharedSyncKey(client *MatrixClient, params url.Values) string {
+	if params.Get("since") != "" {
+		return ""
+	}
+	return client.accessToken() + " " + client.SetPresence + " " + params.Encode()
+}
+
+// sharedSyncKey returns the key for the syncs the given Syncer will make
+// next. Unlike SharedSyncKey, it ignores the 'since', which is checked when
+// joining a shared sync.
+func sharedSyncKey(s *Syncer) string {
+	params := copyValues(s.SyncParams)
+	params.Del("since")
+	return SharedSyncKey(s.Client, params)
+}
+
+// a syncStream is a sync shared by the subscribers with the same key.
+type syncStream struct {
+	hub    *SyncHub
+	key    string
+	syncer *Syncer
+
+	// stops the sync; called once there are no subscribers left
+	cancel context.CancelFunc
+
+	// guarded by hub.mutex: the 'since' of the request in progress, which a
+	// connection must have reached to subscribe, and the subscribers
+	since       string
+	subscribers map[*subscription]struct{}
+}
+
+// a subscription is a SharedSyncer's membership of a syncStream.
+type subscription struct {
+	stream *syncStream
+
+	frames chan []byte
+
+	// closed when the subscription is removed from the stream, with err set
+	// to the reason
+	done chan struct{}
+	err  error
+}
+
+// A SharedSyncer is a SyncRequestor which returns the responses of a sync
+// shared with other connections. Until it has caught up with the shared sync,
+// or once that has ended, it makes the connection's own syncs, continuing from
+// the last response it returned. It should be closed once the connection
+// stops.
+type SharedSyncer struct {
+	hub *SyncHub
+
+	// the connection's own syncer, which keeps track of its 'since'
+	own *Syncer
+
+	// set by ResetSync, from outside the sync pump
+	reset int32
+
+	// guarded by hub.mutex
+	sub    *subscription
+	closed bool
+}
+
+// NewSharedSyncer returns a SharedSyncer which continues from where the given
+// Syncer is, which is normally just after the connection's initial sync. The
+// SharedSyncer makes its subsequent requests with the Syncer where they can't
+// be shared.
+func (h *SyncHub) NewSharedSyncer(syncer *Syncer) *SharedSyncer {
+	return &SharedSyncer{hub: h, own: syncer}
+}
+
+// join subscribes to the shared sync for the SharedSyncer's key, if the
+// SharedSyncer has reached the shared sync's 'since', or starts a shared sync
+// if there is none. It returns nil if the SharedSyncer must carry on with its
+// own syncs. hub.mutex must be held.
+func (s *SharedSyncer) join() *subscription {
+	since := s.own.FetchedCursor()
+	if since == "" {
+		return nil
+	}
+
+	key := sharedSyncKey(s.own)
+	stream, ok := s.hub.streams[key]
+	if !ok {
+		stream = s.hub.start(key, s.own)
+	} else if stream.since != since {
+		return nil
+	}
+
+	sub := &subscription{
+		stream: stream,
+		frames: make(chan []byte, sharedSyncBuffer),
+		done:   make(chan struct{}),
+	}
+	stream.subscribers[sub] = struct{}{}
+	return sub
+}
+
+// start starts a shared sync with the given key, continuing from where the
+// given Syncer is. The shared sync has its own copy of the Syncer's client, so
+// that a change to the connection's client, such as a new access token,
+// doesn't affect the other subscribers. hub.mutex must be held.
+func (h *SyncHub) start(key string, from *Syncer) *syncStream {
+	ctx, cancel := context.WithCancel(context.Background())
+	stream := &syncStream{
+		hub: h,
+		key: key,
+		syncer: &Syncer{
+			Client:     from.Client.clone(),
+			SyncParams: copyValues(from.SyncParams),
+		},
+		cancel:      cancel,
+		since:       from.FetchedCursor(),
+		subscribers: make(map[*subscription]struct{}),
+	}
+	h.streams[key] = stream
+	go stream.run(ctx)
+	return stream
+}
+
+// remove removes a subscription from the stream, so that it gets err once it
+// has had any frames already queued for it, and stops the stream if it has no
+// other subscribers. hub.mutex must be held.
+func (s *syncStream) remove(sub *subscription, err error) {
+	if _, ok := s.subscribers[sub]; !ok {
+		return
+	}
+	delete(s.subscribers, sub)
+	sub.err = err
+	close(sub.done)
+
+	if len(s.subscribers) == 0 {
+		s.stop()
+	}
+}
+
+// stop stops the sync, and removes the stream from the hub, so that later
+// connections start a new one. hub.mutex must be held.
+func (s *syncStream) stop() {
+	s.cancel()
+	if s.hub.streams[s.key] == s {
+		delete(s.hub.streams, s.key)
+	}
+}
+
+// run makes the sync requests for the stream, and broadcasts the responses
+// to the subscribers, until there are none left or a request fails. On
+// failure, all of the subscribers get the error.
+func (s *syncStream) run(ctx context.Context) {
+	for {
+		body, err := s.syncer.MakeRequest(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+
+		s.hub.mutex.Lock()
+		if err != nil {
+			logWarn("Error in shared sync:", err)
+			for sub := range s.subscribers {
+				s.remove(sub, err)
+			}
+			s.hub.mutex.Unlock()
+			return
+		}
+		s.since = s.syncer.FetchedCursor()
+		for sub := range s.subscribers {
+			select {
+			case sub.frames <- body:
+			default:
+				logWarn("Dropping subscriber which fell behind the shared sync")
+				s.remove(sub, errSharedSyncBehind)
+			}
+		}
+		s.hub.mutex.Unlock()
+	}
+}
+
+// MakeRequest returns the next response from the shared sync, or, if the
+// connection can't share it yet, makes the connection's own sync request.
+//
+// If the shared sync ends, its error is returned, and later calls carry on
+// from the last response returned, joining or starting another shared sync
+// when they can.
+func (s *SharedSyncer) MakeRequest(ctx context.Context) ([]byte, error) {
+	if atomic.CompareAndSwapInt32(&s.reset, 1, 0) {
+		s.leave()
+		return s.own.MakeRequest(ctx)
+	}
+
+	sub, err := s.subscription()
+	if err != nil {
+		return nil, err
+	}
+	if sub == nil {
+		return s.own.MakeRequest(ctx)
+	}
+
+	select {
+	case body := <-sub.frames:
+		return s.frame(body)
+	case <-sub.done:
+		// no more frames will be queued, but return any which already were
+		select {
+		case body := <-sub.frames:
+			return s.frame(body)
+		default:
+		}
+		s.hub.mutex.Lock()
+		if s.sub == sub {
+			s.sub = nil
+		}
+		s.hub.mutex.Unlock()
+		return nil, sub.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// subscription returns the SharedSyncer's subscription to a shared sync,
+// joining or starting one if it can, or nil if it can't.
+func (s *SharedSyncer) subscription() (*subscription, error) {
+	s.hub.mutex.Lock()
+	defer s.hub.mutex.Unlock()
+	if s.closed {
+		return nil, errSharedSyncClosed
+	}
+	if s.sub == nil {
+		s.sub = s.join()
+	}
+	return s.sub, nil
+}
+
+// frame returns a response from the shared sync, after moving the
+// connection's own 'since' on past it, so that the connection's syncs carry
+// on from there if the shared sync ends.
+func (s *SharedSyncer) frame(body []byte) ([]byte, error) {
+	nextBatch, err := extractNextBatch(body)
+	if err != nil {
+		return nil, err
+	}
+	s.own.setSince(nextBatch)
+	return body, nil
+}
+
+// ResetSync makes the SharedSyncer leave the shared sync, and start again
+// with a full sync of its own on the next request, as for Syncer.ResetSync.
+// It joins a shared sync for its new key once it can.
+func (s *SharedSyncer) ResetSync() {
+	s.own.ResetSync()
+	atomic.StoreInt32(&s.reset, 1)
+}
+
+// leave unsubscribes from the shared sync, if the SharedSyncer is subscribed.
+func (s *SharedSyncer) leave() {
+	s.hub.mutex.Lock()
+	defer s.hub.mutex.Unlock()
+	if s.sub != nil {
+		s.sub.stream.remove(s.sub, errSharedSyncClosed)
+		s.sub = nil
+	}
+}
+
+// Close unsubscribes from the shared sync, which stops once it has no
+// subscribers left.
+func (s *SharedSyncer) Close() {
+	s.hub.mutex.Lock()
+	s.closed = true
+	s.hub.mutex.Unlock()
+	s.leave()
+}
@@ -0,0 +1,310 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+// a fake upstream server for shared sync tests. Its position advances when
+// the test says so; a sync from before the current position returns
+// straight away, and one from the current position waits for it to advance,
+// and fails if the test says so.
+type testSyncServer struct {
+	*httptest.Server
+
+	mutex    sync.Mutex
+	pos      int
+	next     chan struct{}
+	fail     bool
+	requests map[string]int
+	tokens   map[string]bool
+}
+
+func newTestSyncServer() *testSyncServer {
+	s := &testSyncServer{
+		next:     make(chan struct{}),
+		requests: make(map[string]int),
+		tokens:   make(map[string]bool),
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		since := r.URL.Query().Get("since")
+		n := -1
+		if since != "" {
+			fmt.Sscanf(since, "s%d", &n)
+		}
+
+		s.mutex.Lock()
+		s.requests[since]++
+		s.tokens[r.Header.Get("Authorization")] = true
+		next := s.next
+		wait := n >= s.pos
+		s.mutex.Unlock()
+
+		if wait {
+			select {
+			case <-next:
+			case <-r.Context().Done():
+				return
+			}
+		}
+
+		s.mutex.Lock()
+		pos, fail := s.pos, s.fail
+		s.mutex.Unlock()
+		if wait && fail {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		fmt.Fprintf(w, `{"next_batch": "s%d"}`, pos)
+	}))
+	return s
+}
+
+// advance moves the server on to the next position, failing the syncs which
+// were waiting for it if fail is set.
+func (s *testSyncServer) advance(fail bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.pos++
+	s.fail = fail
+	close(s.next)
+	s.next = make(chan struct{})
+}
+
+func (s *testSyncServer) requestCount(since string) int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.requests[since]
+}
+
+// waitForRequest waits for a sync from the given 'since' to have been made.
+func (s *testSyncServer) waitForRequest(t *testing.T, since string) {
+	deadline := time.Now().Add(2 * time.Second)
+	for s.requestCount(since) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for a sync from", since)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func (s *testSyncServer) sawAuthorization(header string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.tokens[header]
+}
+
+// newTestSharedSyncer returns a SharedSyncer continuing from the given 'since'
+// with its own client for the server.
+func newTestSharedSyncer(hub *SyncHub, srv *testSyncServer, since string) *SharedSyncer {
+	client := NewMatrixClient(srv.URL+"/", "token")
+	return hub.NewSharedSyncer(&Syncer{Client: client, SyncParams: url.Values{"since": {since}}})
+}
+
+// waitForSubscribers waits for the shared sync with the given key to have the
+// expected number of subscribers.
+func waitForSubscribers(t *testing.T, hub *SyncHub, key string, expected int) {
+	count := func() int {
+		hub.mutex.Lock()
+		defer hub.mutex.Unlock()
+		if stream := hub.streams[key]; stream != nil {
+			return len(stream.subscribers)
+		}
+		return 0
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for count() != expected {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected %d subscribers, got %d", expected, count())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// a syncResult is the result of a MakeRequest call made in the background
+type syncResult struct {
+	body string
+	err  error
+}
+
+func makeRequestAsync(s *SharedSyncer) chan syncResult {
+	res := make(chan syncResult, 1)
+	go func() {
+		body, err := s.MakeRequest(context.Background())
+		res <- syncResult{string(body), err}
+	}()
+	return res
+}
+
+func expectSync(t *testing.T, res chan syncResult, expected string) {
+	select {
+	case r := <-res:
+		if r.err != nil || r.body != expected {
+			t.Fatalf("Expected %s, got %s, %v", expected, r.body, r.err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Timed out waiting for", expected)
+	}
+}
+
+func TestSharedSync(t *testing.T) {
+	srv := newTestSyncServer()
+	defer srv.Close()
+	hub := NewSyncHub()
+
+	first := newTestSharedSyncer(hub, srv, "s0")
+	second := newTestSharedSyncer(hub, srv, "s0")
+	key := sharedSyncKey(first.own)
+
+	for i := 1; i <= 3; i++ {
+		res1, res2 := makeRequestAsync(first), makeRequestAsync(second)
+		waitForSubscribers(t, hub, key, 2)
+		srv.advance(false)
+		expected := fmt.Sprintf(`{"next_batch": "s%d"}`, i)
+		expectSync(t, res1, expected)
+		expectSync(t, res2, expected)
+	}
+	for _, since := range []string{"s0", "s1", "s2"} {
+		if n := srv.requestCount(since); n != 1 {
+			t.Errorf("Expected one sync from %s, got %d", since, n)
+		}
+	}
+
+	// a token switch on one connection doesn't change the shared sync's
+	first.own.Client.SetAccessToken("other")
+	res1, res2 := makeRequestAsync(first), makeRequestAsync(second)
+	srv.advance(false)
+	expectSync(t, res1, `{"next_batch": "s4"}`)
+	expectSync(t, res2, `{"next_batch": "s4"}`)
+	if srv.sawAuthorization("Bearer other") {
+		t.Error("Expected the shared sync to keep its own access token")
+	}
+
+	first.Close()
+	second.Close()
+	if _, err := first.MakeRequest(context.Background()); err != errSharedSyncClosed {
+		t.Errorf("Expected errSharedSyncClosed, got %v", err)
+	}
+	hub.mutex.Lock()
+	defer hub.mutex.Unlock()
+	if len(hub.streams) != 0 {
+		t.Error("Expected the shared sync to stop once it had no subscribers")
+	}
+}
+
+func TestSharedSyncCatchUp(t *testing.T) {
+	srv := newTestSyncServer()
+	defer srv.Close()
+	hub := NewSyncHub()
+
+	first := newTestSharedSyncer(hub, srv, "s0")
+	key := sharedSyncKey(first.own)
+	res := makeRequestAsync(first)
+	waitForSubscribers(t, hub, key, 1)
+	srv.advance(false)
+	expectSync(t, res, `{"next_batch": "s1"}`)
+
+	// a connection which is behind the shared sync catches up on its own,
+	// rather than getting responses it has already had
+	late := newTestSharedSyncer(hub, srv, "s0")
+	if body, err := late.MakeRequest(context.Background()); err != nil || string(body) != `{"next_batch": "s1"}` {
+		t.Fatalf("Expected to catch up to s1, got %s, %v", body, err)
+	}
+
+	res1, res2 := makeRequestAsync(first), makeRequestAsync(late)
+	waitForSubscribers(t, hub, key, 2)
+	srv.advance(false)
+	expectSync(t, res1, `{"next_batch": "s2"}`)
+	expectSync(t, res2, `{"next_batch": "s2"}`)
+	if n := srv.requestCount("s1"); n != 1 {
+		t.Errorf("Expected one sync from s1, got %d", n)
+	}
+
+	// after a reset, the connection starts again with a full sync of its own
+	late.ResetSync()
+	if body, err := late.MakeRequest(context.Background()); err != nil || string(body) != `{"next_batch": "s2"}` {
+		t.Fatalf("Expected a full sync, got %s, %v", body, err)
+	}
+	if n := srv.requestCount(""); n != 1 {
+		t.Errorf("Expected one sync without a since, got %d", n)
+	}
+	waitForSubscribers(t, hub, key, 1)
+
+	first.Close()
+	late.Close()
+}
+
+func TestSharedSyncError(t *testing.T) {
+	srv := newTestSyncServer()
+	defer srv.Close()
+	hub := NewSyncHub()
+
+	first := newTestSharedSyncer(hub, srv, "s0")
+	second := newTestSharedSyncer(hub, srv, "s0")
+	key := sharedSyncKey(first.own)
+
+	res1, res2 := makeRequestAsync(first), makeRequestAsync(second)
+	waitForSubscribers(t, hub, key, 2)
+	// the shared sync must be waiting for the failure
+	srv.waitForRequest(t, "s0")
+	srv.advance(true)
+	for _, res := range []chan syncResult{res1, res2} {
+		r := <-res
+		if httpErr, ok := r.err.(*HTTPError); !ok || httpErr.StatusCode != http.StatusBadGateway {
+			t.Errorf("Expected the upstream error, got %v", r.err)
+		}
+	}
+
+	// the next requests carry on from where the subscribers were, in
+	// another shared sync
+	res1, res2 = makeRequestAsync(first), makeRequestAsync(second)
+	expectSync(t, res1, `{"next_batch": "s1"}`)
+	expectSync(t, res2, `{"next_batch": "s1"}`)
+	res1, res2 = makeRequestAsync(first), makeRequestAsync(second)
+	waitForSubscribers(t, hub, key, 2)
+	srv.advance(false)
+	expectSync(t, res1, `{"next_batch": "s2"}`)
+	expectSync(t, res2, `{"next_batch": "s2"}`)
+
+	first.Close()
+	second.Close()
+}
+
+func TestSharedSyncBehind(t *testing.T) {
+	srv := newTestSyncServer()
+	defer srv.Close()
+	hub := NewSyncHub()
+
+	slow := newTestSharedSyncer(hub, srv, "s0")
+	fast := newTestSharedSyncer(hub, srv, "s0")
+	key := sharedSyncKey(slow.own)
+
+	// slow subscribes, but doesn't read any more
+	res := makeRequestAsync(slow)
+	for i := 1; i <= sharedSyncBuffer+2; i++ {
+		fastRes := makeRequestAsync(fast)
+		if i == 1 {
+			waitForSubscribers(t, hub, key, 2)
+		}
+		srv.advance(false)
+		expectSync(t, fastRes, fmt.Sprintf(`{"next_batch": "s%d"}`, i))
+	}
+
+	expectSync(t, res, `{"next_batch": "s1"}`)
+	for i := 2; i <= sharedSyncBuffer+1; i++ {
+		if _, err := slow.MakeRequest(context.Background()); err != nil {
+			t.Fatal("Unexpected error:", err)
+		}
+	}
+	if _, err := slow.MakeRequest(context.Background()); err != errSharedSyncBehind {
+		t.Errorf("Expected errSharedSyncBehind, got %v", err)
+	}
+	slow.Close()
+	fast.Close()
+}
@@ -0,0 +1,111 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// liveConnections holds the connections which have been started and not yet
+// stopped, for the status endpoint.
+var liveConnections = struct {
+	sync.Mutex
+	conns map[*Connection]struct{}
+}{conns: make(map[*Connection]struct{})}
+
+func registerConnection(c *Connection) {
+	liveConnections.Lock()
+	defer liveConnections.Unlock()
+	liveConnections.conns[c] = struct{}{}
+}
+
+func unregisterConnection(c *Connection) {
+	liveConnections.Lock()
+	defer liveConnections.Unlock()
+	delete(liveConnections.conns, c)
+}
+
+// listConnections returns the live connections, in order of ID.
+func listConnections() []*Connection {
+	liveConnections.Lock()
+	conns := make([]*Connection, 0, len(liveConnections.conns))
+	for c := range liveConnections.conns {
+		conns = append(conns, c)
+	}
+	liveConnections.Unlock()
+
+	sort.Slice(conns, func(i, j int) bool { return conns[i].id < conns[j].id })
+	return conns
+}
+
+// markEventsDelivered records that a sync response containing events was
+// passed to the client at the given time.
+func (c *Connection) markEventsDelivered(t time.Time) {
+	atomic.StoreInt64(&c.lastEventTime, t.UnixNano())
+}
+
+// Staleness returns how long it has been, at the given time, since the
+// connection last passed on a sync response containing events, or since it
+// was created if there has been none.
+//
+// The proxy cannot see how far behind the homeserver is, so this is only an
+// estimate of the connection's lag: a quiet account will look stale too.
+func (c *Connection) Staleness(now time.Time) time.Duration {
+	last := atomic.LoadInt64(&c.lastEventTime)
+	if last == 0 {
+		return 0
+	}
+	if d := now.Sub(time.Unix(0, last)); d > 0 {
+		return d
+	}
+	return 0
+}
+
+// maxStaleness returns the greatest staleness of the live connections.
+func maxStaleness(now time.Time) time.Duration {
+	var max time.Duration
+	for _, c := range listConnections() {
+		if s := c.Staleness(now); s > max {
+			max = s
+		}
+	}
+	return max
+}
+
+type connectionStatus struct {
+	ID               uint64  `json:"id"`
+	StalenessSeconds float64 `json:"staleness_seconds"`
+}
+
+// ServeStatus handles HTTP requests for the status of the live connections.
+func ServeStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	now := time.Now()
+	conns := listConnections()
+	statuses := make([]connectionStatus, len(conns))
+	for i, c := range conns {
+		statuses[i] = connectionStatus{c.id, c.Staleness(now).Seconds()}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	resp := map[string]interface{}{"connections": statuses}
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		logError("Error writing status:", err)
+	}
+}
+
+// writeStalenessMetric writes the gauge of the greatest connection staleness,
+// in the Prometheus text format.
+func writeStalenessMetric(w http.ResponseWriter, now time.Time) {
+	fmt.Fprintln(w, "# HELP websockets_proxy_max_sync_staleness_seconds Greatest time since any live connection was sent a sync response containing events.")
+	fmt.Fprintln(w, "# TYPE websockets_proxy_max_sync_staleness_seconds gauge")
+	fmt.Fprintf(w, "websockets_proxy_max_sync_staleness_seconds %g\n", maxStaleness(now).Seconds())
+}
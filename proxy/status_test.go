@@ -0,0 +1,70 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStaleness(t *testing.T) {
+	start := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	c := &Connection{}
+
+	if s := c.Staleness(start); s != 0 {
+		t.Errorf("Expected no staleness before any events, got %v", s)
+	}
+
+	// events at the start, then a series of empty syncs
+	c.markEventsDelivered(start)
+	if s := c.Staleness(start.Add(30 * time.Second)); s != 30*time.Second {
+		t.Errorf("Expected staleness 30s, got %v", s)
+	}
+
+	// more events reset the clock
+	c.markEventsDelivered(start.Add(40 * time.Second))
+	if s := c.Staleness(start.Add(45 * time.Second)); s != 5*time.Second {
+		t.Errorf("Expected staleness 5s, got %v", s)
+	}
+
+	// clocks going backwards don't give a negative staleness
+	if s := c.Staleness(start); s != 0 {
+		t.Errorf("Expected staleness 0, got %v", s)
+	}
+}
+
+func TestServeStatus(t *testing.T) {
+	c := &Connection{id: 1<<64 - 1}
+	c.markEventsDelivered(time.Now().Add(-time.Minute))
+	registerConnection(c)
+	defer unregisterConnection(c)
+
+	w := httptest.NewRecorder()
+	ServeStatus(w, httptest.NewRequest("GET", "/status", nil))
+
+	var resp struct {
+		Connections []connectionStatus `json:"connections"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("Invalid status %s: %v", w.Body.String(), err)
+	}
+	var found bool
+	for _, s := range resp.Connections {
+		if s.ID == c.id {
+			found = true
+			if s.StalenessSeconds < 60 || s.StalenessSeconds > 70 {
+				t.Errorf("Expected staleness of about 60s, got %v", s.StalenessSeconds)
+			}
+		}
+	}
+	if !found {
+		t.Errorf("Connection missing from status %s", w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	ServeMetrics(w, httptest.NewRequest("GET", "/metrics", nil))
+	if !strings.Contains(w.Body.String(), "# TYPE websockets_proxy_max_sync_staleness_seconds gauge\n") {
+		t.Errorf("Missing staleness gauge in %s", w.Body.String())
+	}
+}
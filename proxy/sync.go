@@ -1,63 +1,200 @@
 package proxy
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
-	"log"
-	"net/http"
 	"net/url"
+	"strings"
+	"sync"
 )
 
+// A SyncRequestor makes the sequence of sync requests for a connection.
+type SyncRequestor interface {
+	// MakeRequest makes the next sync request, and returns the body of the
+	// response. It should return promptly if ctx is cancelled.
+	MakeRequest(ctx context.Context) ([]byte, error)
+}
+
+// A Syncer is a SyncRequestor which calls /sync on the upstream server.
 type Syncer struct {
-	UpstreamURL string
+	// our client for the upstream connection
+	Client *MatrixClient
 
 	SyncParams url.Values
 
-	// our client for the upstream connection
-	client http.Client
+	// if set, used as the filter for syncs without a 'since', in place of
+	// any filter in SyncParams. This lets the initial sync use a cheaper
+	// filter than the client's.
+	InitialFilter string
+
+	// the 'next_batch' of the latest response which has been sent to the
+	// client, which is also saved in cursorStore, if set. Guarded by
+	// cursorMutex, since responses are sent by the connection's writer.
+	cursorMutex sync.Mutex
+	committed   string
+	cursorStore CursorStore
+	cursorKey   string
+
+	// a filter set by SetFilter and a presence set by SetPresence, to be
+	// applied to the next request; guarded by paramsMutex since they are
+	// set from outside the sync pump.
+	paramsMutex  sync.Mutex
+	nextFilter   *string
+	nextPresence *string
+	reset        bool
+
+	// whether the first response has been got, and whether it continued
+	// from an earlier sync rather than being a full sync
+	started bool
+	resumed bool
+}
+
+// Resumed returns true if the first response continued from an earlier sync,
+// because there was a 'since' token, or the InitialSyncCache replayed a
+// response for a 'resume' token.
+func (s *Syncer) Resumed() bool {
+	return s.resumed
+}
+
+// MarkResumed adds a 'resumed' member to the initial sync response for a
+// connection, so that the client can tell whether it is continuing from
+// where it left off or has been sent a full sync.
+func MarkResumed(body []byte, resumed bool) []byte {
+	return prependJSONMember(body, fmt.Sprintf(`"resumed":%t`, resumed))
+}
+
+// SetFilter changes the filter used by the Syncer, from the next request
+// onwards. The filter may be a filter ID or the JSON encoding of a filter; if
+// it is empty, the filter is removed.
+func (s *Syncer) SetFilter(filter string) {
+	s.paramsMutex.Lock()
+	defer s.paramsMutex.Unlock()
+	s.nextFilter = &filter
+}
+
+// Filter returns the filter used by the Syncer, including any change made by
+// SetFilter which has not yet been applied.
+func (s *Syncer) Filter() string {
+	s.paramsMutex.Lock()
+	defer s.paramsMutex.Unlock()
+	if s.nextFilter != nil {
+		return *s.nextFilter
+	}
+	return s.SyncParams.Get("filter")
 }
 
-// an error returned when the /sync endpoint returns a non-200.
-type SyncError struct {
-	StatusCode  int
-	ContentType string
-	Body        []byte
+// SetPresence changes the 'set_presence' parameter used by the Syncer, from
+// the next request onwards, overriding the client's SetPresence.
+func (s *Syncer) SetPresence(presence string) {
+	s.paramsMutex.Lock()
+	defer s.paramsMutex.Unlock()
+	s.nextPresence = &presence
 }
 
-func (s *SyncError) Error() string {
-	return string(s.Body)
+// ResetSync makes the Syncer start again with a full sync on the next
+// request, for when the connection has switched to a different user. The
+// cursor store, if any, is no longer used, since its key is for the old user.
+func (s *Syncer) ResetSync() {
+	s.paramsMutex.Lock()
+	defer s.paramsMutex.Unlock()
+	s.reset = true
+}
+
+// UseCursorStore sets up the Syncer to save its sync tokens in the given
+// store. If resume is set and no 'since' has been given, the token already in
+// the store, if any, is used; otherwise the sync starts afresh, as the client
+// asked.
+func (s *Syncer) UseCursorStore(store CursorStore, resume bool) error {
+	userID, deviceID, err := s.Client.WhoAmI(context.Background())
+	if err != nil {
+		return err
+	}
+	s.cursorStore = store
+	s.cursorKey = CursorKey(userID, deviceID)
+
+	if !resume || s.SyncParams.Get("since") != "" {
+		return nil
+	}
+
+	since, err := store.Load(s.cursorKey)
+	if err != nil {
+		return err
+	}
+	if since != "" {
+		logInfo("Resuming sync for", userID, "from stored token", since)
+		s.SyncParams.Set("since", since)
+	}
+	return nil
 }
 
 // MakeRequest sends the sync request, and returns the body of the response,
-// or an error.
+// or an error. If ctx was returned by withImmediateSync, the request is made
+// with a zero timeout, so that it returns immediately. If there is no 'since'
+// yet, InitialFilter is used if it is set.
 //
 // It keeps track of the 'next_batch' from the result, and uses it to se the
-// 'since' parameter for the next call.
+// 'since' parameter for the next call. It is not committed until the response
+// has been sent; see CommitCursor.
 //
 // Note that this method is not thread-safe; there should be only one concurrent
 // call per Syncer.
 //
-// If /sync returns a non-200 response, the error returned will be a SyncError.
-func (s *Syncer) MakeRequest() ([]byte, error) {
-	url := s.UpstreamURL + "?" + s.SyncParams.Encode()
-	log.Println("request", url)
-	resp, err := s.client.Get(url)
+// If /sync returns a non-200 response, the error returned will be a
+// MatrixError or an HTTPError.
+func (s *Syncer) MakeRequest(ctx context.Context) ([]byte, error) {
+	// a connection opened without an access token, for a client which is
+	// going to register as a guest, has nothing to sync until it does
+	if s.Client.accessToken() == "" {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
 
-	if err != nil {
-		log.Println("Error in sync", err)
-		return nil, err
+	s.paramsMutex.Lock()
+	if s.nextFilter != nil {
+		if *s.nextFilter == "" {
+			s.SyncParams.Del("filter")
+		} else {
+			s.SyncParams.Set("filter", *s.nextFilter)
+		}
+		s.nextFilter = nil
+	}
+	if s.nextPresence != nil {
+		s.SyncParams.Set("set_presence", *s.nextPresence)
+		s.nextPresence = nil
 	}
-	defer resp.Body.Close()
+	if s.reset {
+		s.SyncParams.Del("since")
+		s.cursorMutex.Lock()
+		s.cursorStore = nil
+		s.cursorMutex.Unlock()
+		s.reset = false
+	}
+	s.paramsMutex.Unlock()
 
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return nil, fmt.Errorf("error reading sync error response: %v", err)
+	if !s.started {
+		s.started = true
+		s.resumed = s.SyncParams.Get("since") != ""
 	}
 
-	log.Println("Sync response:", resp.StatusCode)
-	if resp.StatusCode != 200 {
-		return nil, &SyncError{resp.StatusCode, resp.Header.Get("Content-Type"), body}
+	params := s.SyncParams
+	immediate := isImmediateSync(ctx)
+	initial := s.InitialFilter != "" && params.Get("since") == ""
+	if immediate || initial {
+		params = copyValues(params)
+	}
+	if immediate {
+		params.Set("timeout", "0")
+	}
+	if initial {
+		params.Set("filter", s.InitialFilter)
+	}
+
+	body, err := s.Client.Sync(withoutUpstreamLimit(ctx), params)
+	if err != nil {
+		logWarn("Error in sync", err)
+		return nil, err
 	}
 
 	// we need the 'next_batch' token, so fish that out
@@ -65,15 +202,128 @@ func (s *Syncer) MakeRequest() ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
-	log.Println("Got next_batch:", next_batch)
+	logDebug("Got next_batch:", next_batch)
 
+	// SyncParams is read by Filter, from outside the sync pump
+	s.paramsMutex.Lock()
 	s.SyncParams.Set("since", next_batch)
+	s.paramsMutex.Unlock()
 	return body, nil
 }
 
+// FetchedCursor returns the 'next_batch' of the latest response, which is
+// the 'since' for the next request.
+func (s *Syncer) FetchedCursor() string {
+	return s.SyncParams.Get("since")
+}
+
+// setSince sets the 'since' for the next request, for when a response from
+// elsewhere, such as a shared sync, has been returned in place of the
+// Syncer's own.
+func (s *Syncer) setSince(since string) {
+	s.paramsMutex.Lock()
+	defer s.paramsMutex.Unlock()
+	s.SyncParams.Set("since", since)
+}
+
+// CommitCursor records that the response with the given 'next_batch' has
+// been sent to the client, and saves it in the cursor store, if there is
+// one.
+func (s *Syncer) CommitCursor(cursor string) {
+	s.cursorMutex.Lock()
+	defer s.cursorMutex.Unlock()
+	s.committed = cursor
+	if s.cursorStore != nil {
+		if err := s.cursorStore.Save(s.cursorKey, cursor); err != nil {
+			logError("Error saving sync token:", err)
+		}
+	}
+}
+
+// CommittedCursor returns the 'next_batch' of the latest response which has
+// been sent to the client.
+func (s *Syncer) CommittedCursor() string {
+	s.cursorMutex.Lock()
+	defer s.cursorMutex.Unlock()
+	return s.committed
+}
+
+type immediateSyncKey struct{}
+
+// withImmediateSync returns a context which tells MakeRequest not to wait for
+// new events.
+func withImmediateSync(ctx context.Context) context.Context {
+	return context.WithValue(ctx, immediateSyncKey{}, true)
+}
+
+func isImmediateSync(ctx context.Context) bool {
+	v, _ := ctx.Value(immediateSyncKey{}).(bool)
+	return v
+}
+
 // extractNextBatch fishes the 'next_batch' member out of the JSON response from
 // /sync.
+//
+// Sync responses can be large, and we forward them to the client unparsed, so
+// rather than decoding the whole response we check that it is valid and then
+// skip over the top-level members until we find next_batch. Anything unusual
+// is left to decodeNextBatch.
 func extractNextBatch(httpBody []byte) (string, error) {
+	if !json.Valid(httpBody) {
+		return decodeNextBatch(httpBody)
+	}
+
+	i := skipJSONWhitespace(httpBody, 0)
+	if httpBody[i] != '{' {
+		return decodeNextBatch(httpBody)
+	}
+	i++
+
+	// as with json.Unmarshal, if there is more than one next_batch, the last
+	// one wins.
+	var value []byte
+	for {
+		i = skipJSONWhitespace(httpBody, i)
+		if httpBody[i] == '}' {
+			break
+		}
+
+		keyEnd := skipJSONString(httpBody, i)
+		key := httpBody[i:keyEnd]
+		if bytes.IndexByte(key, '\\') >= 0 {
+			// an escaped key might still be next_batch
+			return decodeNextBatch(httpBody)
+		}
+
+		// skip the colon
+		i = skipJSONWhitespace(httpBody, keyEnd) + 1
+		i = skipJSONWhitespace(httpBody, i)
+		valueEnd := skipJSONValue(httpBody, i)
+		if string(key) == `"next_batch"` {
+			value = httpBody[i:valueEnd]
+		}
+
+		i = skipJSONWhitespace(httpBody, valueEnd)
+		if httpBody[i] == ',' {
+			i++
+		}
+	}
+
+	if value == nil {
+		return "", fmt.Errorf("/sync response missing next_batch")
+	}
+	if value[0] != '"' || bytes.IndexByte(value, '\\') >= 0 {
+		return decodeNextBatch(httpBody)
+	}
+	if len(value) == 2 {
+		return "", fmt.Errorf("/sync response missing next_batch")
+	}
+	return string(value[1 : len(value)-1]), nil
+}
+
+// decodeNextBatch extracts 'next_batch' from a sync response by decoding the
+// whole thing.
+func decodeNextBatch(httpBody []byte) (string, error) {
 	type syncResponse struct {
 		NextBatch string `json:"next_batch"`
 	}
@@ -88,3 +338,298 @@ func extractNextBatch(httpBody []byte) (string, error) {
 
 	return sr.NextBatch, nil
 }
+
+// The skipJSON functions take the index of the start of something in a valid
+// JSON document, and return the index just after it.
+
+func skipJSONWhitespace(data []byte, i int) int {
+	for i < len(data) && strings.IndexByte(jsonWhitespace, data[i]) >= 0 {
+		i++
+	}
+	return i
+}
+
+// skipJSONString skips a string, starting at the opening quote.
+func skipJSONString(data []byte, i int) int {
+	for i++; ; i++ {
+		switch data[i] {
+		case '\\':
+			i++
+		case '"':
+			return i + 1
+		}
+	}
+}
+
+func skipJSONValue(data []byte, i int) int {
+	switch data[i] {
+	case '"':
+		return skipJSONString(data, i)
+	case '{', '[':
+		depth := 0
+		for ; ; i++ {
+			switch data[i] {
+			case '"':
+				i = skipJSONString(data, i) - 1
+			case '{', '[':
+				depth++
+			case '}', ']':
+				depth--
+				if depth == 0 {
+					return i + 1
+				}
+			}
+		}
+	}
+
+	// a number, or true, false or null
+	for i < len(data) && strings.IndexByte(",}] \t\r\n", data[i]) < 0 {
+		i++
+	}
+	return i
+}
+
+// stripPresence removes the 'presence' section from a sync response. The
+// other members are copied as they are, rather than being decoded and
+// re-encoded, and the response is returned unchanged if it has no presence.
+func stripPresence(body []byte) []byte {
+	if !json.Valid(body) {
+		return body
+	}
+
+	var kept [][]byte
+	found := false
+	isObject := scanJSONObject(body, func(key, value, member []byte) {
+		if jsonKeyIs(key, "presence") {
+			found = true
+		} else {
+			kept = append(kept, member)
+		}
+	})
+	if !isObject || !found {
+		return body
+	}
+
+	res := make([]byte, 0, len(body))
+	res = append(res, '{')
+	res = append(res, bytes.Join(kept, []byte{','})...)
+	return append(res, '}')
+}
+
+// scanJSONObject calls fn with the key (including its quotes), the value, and
+// the whole of each member of a JSON object, which must be valid JSON. It
+// returns false if the document is not an object.
+func scanJSONObject(data []byte, fn func(key, value, member []byte)) bool {
+	i := skipJSONWhitespace(data, 0)
+	if i == len(data) || data[i] != '{' {
+		return false
+	}
+	i++
+
+	for {
+		i = skipJSONWhitespace(data, i)
+		if data[i] == '}' {
+			return true
+		}
+
+		keyEnd := skipJSONString(data, i)
+		// skip the colon
+		valueStart := skipJSONWhitespace(data, skipJSONWhitespace(data, keyEnd)+1)
+		valueEnd := skipJSONValue(data, valueStart)
+		fn(data[i:keyEnd], data[valueStart:valueEnd], data[i:valueEnd])
+
+		i = skipJSONWhitespace(data, valueEnd)
+		if data[i] == ',' {
+			i++
+		}
+	}
+}
+
+// jsonKeyIs returns true if the given JSON string, including its quotes, is
+// the given key.
+func jsonKeyIs(key []byte, name string) bool {
+	if bytes.IndexByte(key, '\\') < 0 {
+		return len(key) == len(name)+2 && string(key[1:len(key)-1]) == name
+	}
+	var s string
+	return json.Unmarshal(key, &s) == nil && s == name
+}
+
+// syncBookkeepingKeys are the top-level members of a sync response which are
+// present even when nothing has happened, and so are ignored by isEmptySync.
+var syncBookkeepingKeys = map[string]bool{
+	"next_batch":                                          true,
+	"device_one_time_keys_count":                          true,
+	"device_unused_fallback_key_types":                    true,
+	"org.matrix.msc2732.device_unused_fallback_key_types": true,
+}
+
+const jsonWhitespace = " \t\r\n"
+
+// insertEmptyMarker adds '_empty: true' to a sync response which is already
+// known to be empty.
+func insertEmptyMarker(body []byte) []byte {
+	return prependJSONMember(body, `"_empty":true`)
+}
+
+// prependJSONMember inserts a member, such as `"key":value`, at the start of
+// a JSON object, rather than re-encoding the whole thing. Anything other than
+// an object is returned unchanged.
+func prependJSONMember(body []byte, member string) []byte {
+	trimmed := bytes.TrimLeft(body, jsonWhitespace)
+	if len(trimmed) == 0 || trimmed[0] != '{' {
+		return body
+	}
+	rest := bytes.TrimLeft(trimmed[1:], jsonWhitespace)
+
+	res := make([]byte, 0, len(member)+len(rest)+2)
+	res = append(res, '{')
+	res = append(res, member...)
+	if len(rest) > 0 && rest[0] != '}' {
+		res = append(res, ',')
+	}
+	return append(res, rest...)
+}
+
+// isEmptySync returns true if the given sync response has nothing in it other
+// than bookkeeping: that is, every member is an empty object, empty array or
+// null, or an object made up of such members. It is checked for every sync
+// response, so it scans the response in place rather than decoding it, and
+// stops at the first thing which is not empty.
+func isEmptySync(body []byte) bool {
+	i := skipJSONWhitespace(body, 0)
+	if i == len(body) || body[i] != '{' {
+		return false
+	}
+	return scanJSONMembers(body, i, func(key []byte, start int) int {
+		if syncBookkeepingKeys[string(key[1:len(key)-1])] {
+			return skipCheckedJSONValue(body, start)
+		}
+		return skipEmptyJSON(body, start)
+	}) >= 0
+}
+
+// skipEmptyJSON returns the index just after the JSON value starting at or
+// after data[i], if it is an empty object, empty array or null, or an object
+// made up of such members. Otherwise, including if the JSON is malformed, it
+// returns -1.
+func skipEmptyJSON(data []byte, i int) int {
+	i = skipJSONWhitespace(data, i)
+	switch {
+	case bytes.HasPrefix(data[i:], []byte("null")):
+		return i + 4
+	case i == len(data):
+		return -1
+	case data[i] == '[':
+		i = skipJSONWhitespace(data, i+1)
+		if i < len(data) && data[i] == ']' {
+			return i + 1
+		}
+	case data[i] == '{':
+		return scanJSONMembers(data, i, func(key []byte, start int) int {
+			return skipEmptyJSON(data, start)
+		})
+	}
+	return -1
+}
+
+// skipCheckedJSONValue is like skipJSONValue, but for JSON which has not been
+// validated: it returns -1 if the value is malformed.
+func skipCheckedJSONValue(data []byte, i int) int {
+	i = skipJSONWhitespace(data, i)
+	if i == len(data) {
+		return -1
+	}
+	switch data[i] {
+	case '"':
+		return skipCheckedJSONString(data, i)
+	case '{':
+		return scanJSONMembers(data, i, func(key []byte, start int) int {
+			return skipCheckedJSONValue(data, start)
+		})
+	case '[':
+		i = skipJSONWhitespace(data, i+1)
+		if i < len(data) && data[i] == ']' {
+			return i + 1
+		}
+		for {
+			if i = skipCheckedJSONValue(data, i); i < 0 {
+				return -1
+			}
+			i = skipJSONWhitespace(data, i)
+			if i == len(data) {
+				return -1
+			}
+			switch data[i] {
+			case ',':
+				i++
+			case ']':
+				return i + 1
+			default:
+				return -1
+			}
+		}
+	}
+	end := skipJSONValue(data, i)
+	if end == i {
+		return -1
+	}
+	return end
+}
+
+// skipCheckedJSONString returns the index just after the JSON string starting
+// at data[i], or -1 if it is not terminated.
+func skipCheckedJSONString(data []byte, i int) int {
+	for i++; i < len(data); i++ {
+		switch data[i] {
+		case '\\':
+			i++
+		case '"':
+			return i + 1
+		}
+	}
+	return -1
+}
+
+// scanJSONMembers steps through the members of the JSON object starting at
+// data[i], which need not be valid JSON. For each member, value is called with
+// the key (including its quotes) and the index of the start of the value, and
+// returns the index just after the value, or -1 to stop. scanJSONMembers
+// returns the index just after the object, or -1 if value stopped or the
+// object is malformed.
+func scanJSONMembers(data []byte, i int, value func(key []byte, start int) int) int {
+	for i++; ; i++ {
+		i = skipJSONWhitespace(data, i)
+		if i == len(data) {
+			return -1
+		}
+		if data[i] == '}' {
+			return i + 1
+		}
+		if data[i] != '"' {
+			return -1
+		}
+		keyEnd := skipCheckedJSONString(data, i)
+		if keyEnd < 0 {
+			return -1
+		}
+		colon := skipJSONWhitespace(data, keyEnd)
+		if colon == len(data) || data[colon] != ':' {
+			return -1
+		}
+		if i = value(data[i:keyEnd], colon+1); i < 0 {
+			return -1
+		}
+
+		i = skipJSONWhitespace(data, i)
+		if i == len(data) {
+			return -1
+		}
+		if data[i] == '}' {
+			return i + 1
+		}
+		if data[i] != ',' {
+			return -1
+		}
+	}
+}
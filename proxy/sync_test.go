@@ -1,7 +1,18 @@
 package proxy
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
 )
 
 func TestExtractNextBatch(t *testing.T) {
@@ -36,6 +47,10 @@ func TestExtractNextBatchErrors(t *testing.T) {
 	}{
 		{"{}", "/sync response missing next_batch"},
 		{"{", "unexpected end of JSON input"},
+		{`{"next_batch": ""}`, "/sync response missing next_batch"},
+		{`{"next_batch": 1}`, "json: cannot unmarshal number into Go struct field syncResponse.next_batch of type string"},
+		{`{"next_batch": "s1"`, "unexpected end of JSON input"},
+		{`["next_batch"]`, "json: cannot unmarshal array into Go value of type proxy.syncResponse"},
 	}
 
 	for _, tt := range tests {
@@ -50,3 +65,603 @@ func TestExtractNextBatchErrors(t *testing.T) {
 		}
 	}
 }
+
+func TestExtractNextBatchUnusual(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{`{"rooms": {"next_batch": "inner"}, "next_batch": "s1"}`, "s1"},
+		{`{"a": ["}", "\"", {"b": [1, 2]}], "next_batch": "s1", "c": true}`, "s1"},
+		{`{"next_batch": "s1", "next_batch": "s2"}`, "s2"},
+		{`{"next\u005fbatch": "s1"}`, "s1"},
+		{`{"next_batch": "s\u00311"}`, "s11"},
+		{` {"count": 12.5e3 ,"next_batch":"s1"} `, "s1"},
+	}
+
+	for _, tt := range tests {
+		next_batch, err := extractNextBatch([]byte(tt.input))
+		if err != nil {
+			t.Errorf("Input %v: expected no error, got '%v'", tt.input, err)
+		}
+		if next_batch != tt.expected {
+			t.Errorf("Input %v: expected '%v', got '%v'", tt.input,
+				tt.expected, next_batch)
+		}
+	}
+}
+
+// makeLargeSync builds a sync response with a good number of rooms, each with
+// a timeline and some state.
+func makeLargeSync() []byte {
+	rooms := map[string]interface{}{}
+	for i := 0; i < 100; i++ {
+		var events []interface{}
+		for j := 0; j < 20; j++ {
+			events = append(events, map[string]interface{}{
+				"type":             "m.room.message",
+				"event_id":         fmt.Sprintf("$%d-%d:example.com", i, j),
+				"sender":           "@alice:example.com",
+				"origin_server_ts": 1700000000000 + j,
+				"content": map[string]interface{}{
+					"msgtype": "m.text",
+					"body":    "Hello, \"world\"! {not json} [nor this]",
+				},
+				"unsigned": map[string]interface{}{"age": 1234},
+			})
+		}
+		rooms[fmt.Sprintf("!room%d:example.com", i)] = map[string]interface{}{
+			"timeline": map[string]interface{}{
+				"events":     events,
+				"limited":    false,
+				"prev_batch": "p123",
+			},
+			"state":                map[string]interface{}{"events": events[:5]},
+			"unread_notifications": map[string]interface{}{"highlight_count": 0},
+		}
+	}
+	body, err := json.Marshal(map[string]interface{}{
+		"account_data": map[string]interface{}{"events": []interface{}{}},
+		"rooms":        map[string]interface{}{"join": rooms},
+		"next_batch":   "s361093_69_4_8353_1",
+	})
+	if err != nil {
+		panic(err)
+	}
+	return body
+}
+
+func BenchmarkExtractNextBatch(b *testing.B) {
+	body := makeLargeSync()
+	b.SetBytes(int64(len(body)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := extractNextBatch(body); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkDecodeNextBatch measures the full decode, for comparison.
+func BenchmarkDecodeNextBatch(b *testing.B) {
+	body := makeLargeSync()
+	b.SetBytes(int64(len(body)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := decodeNextBatch(body); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkIsEmptySync(b *testing.B) {
+	body := makeLargeSync()
+	b.SetBytes(int64(len(body)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if isEmptySync(body) {
+			b.Fatal("Expected a non-empty sync")
+		}
+	}
+}
+
+func TestSyncForwardsAcceptLanguage(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/_matrix/client/r0/sync" {
+			t.Error("Unexpected path:", r.URL.Path)
+		}
+		if lang := r.Header.Get("Accept-Language"); lang != "fr-CH, fr;q=0.9" {
+			t.Errorf("Expected Accept-Language 'fr-CH, fr;q=0.9', got '%v'", lang)
+		}
+		if cookie := r.Header.Get("Cookie"); cookie != "" {
+			t.Errorf("Unexpected Cookie header '%v'", cookie)
+		}
+		w.Write([]byte(`{"next_batch": "s1"}`))
+	}))
+	defer srv.Close()
+
+	client := NewMatrixClient(srv.URL+"/", "token")
+	client.SetForwardedHeaders(http.Header{
+		"Accept-Language": {"fr-CH, fr;q=0.9"},
+		"Cookie":          {"secret"},
+	})
+	syncer := &Syncer{Client: client, SyncParams: url.Values{}}
+
+	if _, err := syncer.MakeRequest(context.Background()); err != nil {
+		t.Fatalf("Expected no error, got '%v'", err)
+	}
+	if since := syncer.SyncParams.Get("since"); since != "s1" {
+		t.Errorf("Expected since 's1', got '%v'", since)
+	}
+}
+
+func TestSyncUpstream(t *testing.T) {
+	var mainPaths, replicaPaths []string
+	c, srv := newTestConnection(func(w http.ResponseWriter, r *http.Request) {
+		mainPaths = append(mainPaths, r.URL.Path)
+		w.Write([]byte(`{"event_id": "$event"}`))
+	})
+	defer srv.Close()
+	replica := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		replicaPaths = append(replicaPaths, r.URL.Path)
+		w.Write([]byte(`{"next_batch": "s1"}`))
+	}))
+	defer replica.Close()
+	c.client.SyncURL = replica.URL + "/"
+
+	syncer := &Syncer{Client: c.client, SyncParams: url.Values{}}
+	if _, err := syncer.MakeRequest(context.Background()); err != nil {
+		t.Fatalf("Expected no error, got '%v'", err)
+	}
+	resp := c.handleRequest([]byte(`{"id": "1", "method": "send", "params": {"room_id": "!room:test", "event_type": "m.room.message", "content": {"body": "hi"}}}`))
+	if string(resp) != `{"id":"1","result":{"event_id":"$event"}}` {
+		t.Errorf("Unexpected response %s", resp)
+	}
+
+	if !reflect.DeepEqual(replicaPaths, []string{"/_matrix/client/r0/sync"}) {
+		t.Errorf("Unexpected requests to the sync upstream: %v", replicaPaths)
+	}
+	if len(mainPaths) != 1 || !strings.HasPrefix(mainPaths[0], "/_matrix/client/r0/rooms/!room:test/send/") {
+		t.Errorf("Unexpected requests to the main upstream: %v", mainPaths)
+	}
+}
+
+func TestSyncSetPresence(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if p := r.URL.Query().Get("set_presence"); p != "offline" {
+			t.Errorf("Expected set_presence 'offline', got '%v'", p)
+		}
+		w.Write([]byte(`{"next_batch": "s1"}`))
+	}))
+	defer srv.Close()
+
+	client := NewMatrixClient(srv.URL+"/", "token")
+	client.SetPresence = "offline"
+	syncer := &Syncer{Client: client, SyncParams: url.Values{}}
+
+	if _, err := syncer.MakeRequest(context.Background()); err != nil {
+		t.Fatalf("Expected no error, got '%v'", err)
+	}
+}
+
+func TestSyncInitialFilter(t *testing.T) {
+	var filters []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		filters = append(filters, r.URL.Query().Get("filter"))
+		w.Write([]byte(`{"next_batch": "s1"}`))
+	}))
+	defer srv.Close()
+
+	syncer := &Syncer{
+		Client:        NewMatrixClient(srv.URL+"/", "token"),
+		SyncParams:    url.Values{"filter": {"client"}},
+		InitialFilter: `{"room":{"state":{"lazy_load_members":true},"timeline":{"limit":1}}}`,
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, err := syncer.MakeRequest(context.Background()); err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+	}
+
+	expected := []string{syncer.InitialFilter, "client"}
+	if !reflect.DeepEqual(filters, expected) {
+		t.Errorf("Expected filters %q, got %q", expected, filters)
+	}
+	if f := syncer.SyncParams.Get("filter"); f != "client" {
+		t.Errorf("Expected client filter to be kept, got %q", f)
+	}
+}
+
+func TestStripPresence(t *testing.T) {
+	tests := []struct {
+		body     string
+		expected string
+	}{
+		// the other members are kept in order, and not re-escaped
+		{
+			`{"next_batch": "s1", "presence": {"events": [{"type": "m.presence"}]}, "rooms": {"join": {"!a:test": {"body": "<b>&</b>"}}}}`,
+			`{"next_batch": "s1","rooms": {"join": {"!a:test": {"body": "<b>&</b>"}}}}`,
+		},
+		{`{"presence": {}, "next_batch": "s1"}`, `{"next_batch": "s1"}`},
+		{`{"next_batch": "s1", "presence": {}}`, `{"next_batch": "s1"}`},
+		{`{"presence": {}}`, `{}`},
+		{`{"pres\u0065nce": {}, "next_batch": "s1"}`, `{"next_batch": "s1"}`},
+		// responses without presence are returned unchanged
+		{`{"next_batch": "s1", "rooms": {"presence": 1}}`, `{"next_batch": "s1", "rooms": {"presence": 1}}`},
+		{`["presence"]`, `["presence"]`},
+		{`not json`, `not json`},
+	}
+	for _, tt := range tests {
+		if stripped := string(stripPresence([]byte(tt.body))); stripped != tt.expected {
+			t.Errorf("%s: expected %s, got %s", tt.body, tt.expected, stripped)
+		}
+	}
+}
+
+func TestIsValidPresence(t *testing.T) {
+	for _, p := range []string{"offline", "online", "unavailable"} {
+		if !IsValidPresence(p) {
+			t.Errorf("Expected '%v' to be valid", p)
+		}
+	}
+	for _, p := range []string{"", "away", "OFFLINE"} {
+		if IsValidPresence(p) {
+			t.Errorf("Expected '%v' to be invalid", p)
+		}
+	}
+}
+
+func TestEmptySyncMarker(t *testing.T) {
+	tests := []struct {
+		body     string
+		expected string
+	}{
+		{
+			`{"next_batch": "s1", "rooms": {"join": {}, "invite": {}}, "presence": {"events": []}, "device_one_time_keys_count": {"signed_curve25519": 50}}`,
+			`{"_empty":true,"next_batch": "s1", "rooms": {"join": {}, "invite": {}}, "presence": {"events": []}, "device_one_time_keys_count": {"signed_curve25519": 50}}`,
+		},
+		{
+			` { "next_batch": "s1"}`,
+			`{"_empty":true,"next_batch": "s1"}`,
+		},
+		{
+			`{}`,
+			`{"_empty":true}`,
+		},
+		{
+			`{"next_batch": "s2", "presence": {"events": [{"type": "m.presence"}]}}`,
+			`{"next_batch": "s2", "presence": {"events": [{"type": "m.presence"}]}}`,
+		},
+		{
+			`{"next_batch": "s2", "rooms": {"join": {"!room:test": {"timeline": {"events": [], "limited": false}}}}}`,
+			`{"next_batch": "s2", "rooms": {"join": {"!room:test": {"timeline": {"events": [], "limited": false}}}}}`,
+		},
+		{
+			`{"next_batch": "s\"3", "device_unused_fallback_key_types": ["signed_curve25519"], "account_data": null}`,
+			`{"_empty":true,"next_batch": "s\"3", "device_unused_fallback_key_types": ["signed_curve25519"], "account_data": null}`,
+		},
+		{`{"rooms": {"join": {}`, `{"rooms": {"join": {}`},
+		{`{"next_batch": "s1`, `{"next_batch": "s1`},
+		{`{"next_batch" "s1"}`, `{"next_batch" "s1"}`},
+		{`[]`, `[]`},
+	}
+
+	for _, tt := range tests {
+		marked := tt.body
+		if isEmptySync([]byte(tt.body)) {
+			marked = string(insertEmptyMarker([]byte(tt.body)))
+		}
+		if marked != tt.expected {
+			t.Errorf("Expected %s, got %s", tt.expected, marked)
+		}
+	}
+}
+
+func TestSetFilter(t *testing.T) {
+	filters := make(chan string, 100)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		filters <- r.URL.Query().Get("filter")
+		time.Sleep(10 * time.Millisecond)
+		w.Write([]byte(`{"next_batch": "s1"}`))
+	}))
+	defer upstream.Close()
+
+	ws, cleanup := makeWsConn(t, upstream, func(c *Connection) {
+		c.syncer.(*Syncer).SyncParams.Set("filter", "1")
+	})
+	defer cleanup()
+
+	if f := <-filters; f != "1" {
+		t.Errorf("Expected initial filter 1, got %q", f)
+	}
+
+	ws.WriteMessage(websocket.TextMessage, []byte(`{"id": "1", "method": "set_filter", "params": {"filter": {"room": {"timeline": {"limit": 5}}}}}`))
+
+	timeout := time.After(2 * time.Second)
+	for {
+		select {
+		case f := <-filters:
+			if f == `{"room":{"timeline":{"limit":5}}}` {
+				return
+			}
+			if f != "1" {
+				t.Fatalf("Unexpected filter %q", f)
+			}
+		case <-timeout:
+			t.Fatal("New filter was not used")
+		}
+	}
+}
+
+func TestEphemeralOnly(t *testing.T) {
+	filters := make(chan string, 100)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		filters <- r.URL.Query().Get("filter")
+		time.Sleep(10 * time.Millisecond)
+		w.Write([]byte(`{"next_batch": "s1"}`))
+	}))
+	defer upstream.Close()
+
+	ws, cleanup := makeWsConn(t, upstream, nil)
+	defer cleanup()
+
+	ws.WriteMessage(websocket.TextMessage, []byte(`{"id": "1", "method": "ephemeral_only"}`))
+
+	timeout := time.After(2 * time.Second)
+	for {
+		select {
+		case f := <-filters:
+			if f == "" {
+				continue
+			}
+			var filter struct {
+				Presence struct{ Types []string } `json:"presence"`
+				Room     struct {
+					Ephemeral struct{ Types []string } `json:"ephemeral"`
+					State     struct{ Types []string } `json:"state"`
+					Timeline  struct{ Types []string } `json:"timeline"`
+				} `json:"room"`
+			}
+			if err := json.Unmarshal([]byte(f), &filter); err != nil {
+				t.Fatalf("Invalid filter %q: %v", f, err)
+			}
+			if !reflect.DeepEqual(filter.Room.Ephemeral.Types, []string{"m.typing", "m.receipt"}) ||
+				!reflect.DeepEqual(filter.Presence.Types, []string{"m.presence"}) ||
+				filter.Room.State.Types == nil || len(filter.Room.State.Types) != 0 ||
+				filter.Room.Timeline.Types == nil || len(filter.Room.Timeline.Types) != 0 {
+				t.Errorf("Unexpected filter %s", f)
+			}
+			return
+		case <-timeout:
+			t.Fatal("Ephemeral-only filter was not used")
+		}
+	}
+}
+
+func TestSetFilterValidation(t *testing.T) {
+	c := &Connection{syncer: &Syncer{SyncParams: url.Values{}}}
+
+	resp := c.handleRequest([]byte(`{"id": "1", "method": "set_filter", "params": {"filter": 5}}`))
+	expected := `{"id":"1","error":{"errcode":"M_INVALID_PARAM","error":"filter must be a filter ID or object","fields":["filter"]}}`
+	if string(resp) != expected {
+		t.Errorf("Expected %s, got %s", expected, resp)
+	}
+
+	resp = c.handleRequest([]byte(`{"id": "2", "method": "set_filter", "params": {"filter": "abc"}}`))
+	if string(resp) != `{"id":"2","result":{}}` {
+		t.Errorf("Unexpected response %s", resp)
+	}
+	if f := *c.syncer.(*Syncer).nextFilter; f != "abc" {
+		t.Errorf("Expected next filter abc, got %s", f)
+	}
+
+	c.syncer = NewMockSyncer(nil, time.Second)
+	resp = c.handleRequest([]byte(`{"id": "3", "method": "set_filter", "params": {"filter": "abc"}}`))
+	expected = `{"id":"3","error":{"errcode":"M_UNRECOGNIZED","error":"Filters are not supported"}}`
+	if string(resp) != expected {
+		t.Errorf("Expected %s, got %s", expected, resp)
+	}
+}
+
+func TestMutePresence(t *testing.T) {
+	presences := make(chan string, 100)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		presences <- r.URL.Query().Get("set_presence")
+		time.Sleep(10 * time.Millisecond)
+		w.Write([]byte(`{"next_batch": "s1", "presence": {"events": [{"type": "m.presence"}]}}`))
+	}))
+	defer upstream.Close()
+
+	ws, cleanup := makeWsConn(t, upstream, nil)
+	defer cleanup()
+	ws.SetReadDeadline(time.Now().Add(2 * time.Second))
+
+	_, msg, err := ws.ReadMessage()
+	if err != nil {
+		t.Fatal("Error reading:", err)
+	}
+	if !strings.Contains(string(msg), `"presence"`) {
+		t.Errorf("Expected presence before muting, got %s", msg)
+	}
+	if p := <-presences; p != "" {
+		t.Errorf("Expected no set_presence before muting, got %q", p)
+	}
+
+	ws.WriteMessage(websocket.TextMessage, []byte(`{"id": "1", "method": "mute_presence"}`))
+
+	// there may be sync responses from before the request was handled;
+	// after the first stripped one, they should all be stripped.
+	muted := false
+	gotResponse := false
+	for i := 0; !gotResponse || i < 3; {
+		_, msg, err := ws.ReadMessage()
+		if err != nil {
+			t.Fatal("Error reading:", err)
+		}
+		switch {
+		case strings.HasPrefix(string(msg), `{"id"`):
+			if string(msg) != `{"id":"1","result":{}}` {
+				t.Errorf("Unexpected response %s", msg)
+			}
+			gotResponse = true
+		case strings.Contains(string(msg), `"presence"`):
+			if muted {
+				t.Errorf("Got presence after muting: %s", msg)
+			}
+		default:
+			if string(msg) != `{"next_batch": "s1"}` {
+				t.Errorf("Unexpected sync response %s", msg)
+			}
+			muted = true
+			i++
+		}
+	}
+
+	timeout := time.After(2 * time.Second)
+	for {
+		select {
+		case p := <-presences:
+			if p == "offline" {
+				return
+			}
+		case <-timeout:
+			t.Fatal("set_presence=offline was not sent upstream")
+		}
+	}
+}
+
+func TestSubscribeRooms(t *testing.T) {
+	filters := make(chan string, 100)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if f, ok := r.URL.Query()["filter"]; ok {
+			filters <- f[0]
+		} else {
+			filters <- "<none>"
+		}
+		time.Sleep(10 * time.Millisecond)
+		w.Write([]byte(`{"next_batch": "s1"}`))
+	}))
+	defer upstream.Close()
+
+	ws, cleanup := makeWsConn(t, upstream, nil)
+	defer cleanup()
+
+	// waitForFilter waits for a sync with the given filter, ignoring
+	// any which were already under way
+	waitForFilter := func(expected string, allowed string) {
+		timeout := time.After(2 * time.Second)
+		for {
+			select {
+			case f := <-filters:
+				if f == expected {
+					return
+				}
+				if f != allowed {
+					t.Fatalf("Unexpected filter %q", f)
+				}
+			case <-timeout:
+				t.Fatalf("Filter %q was not used", expected)
+			}
+		}
+	}
+	readResponse := func(expected string) {
+		ws.SetReadDeadline(time.Now().Add(2 * time.Second))
+		for {
+			_, msg, err := ws.ReadMessage()
+			if err != nil {
+				t.Fatal("Error reading:", err)
+			}
+			if strings.HasPrefix(string(msg), `{"id"`) {
+				if string(msg) != expected {
+					t.Errorf("Expected %s, got %s", expected, msg)
+				}
+				return
+			}
+		}
+	}
+
+	ws.WriteMessage(websocket.TextMessage, []byte(`{"id": "1", "method": "subscribe_rooms", "params": {"room_ids": ["!b:test", "!a:test"]}}`))
+	readResponse(`{"id":"1","result":{"room_ids":["!a:test","!b:test"]}}`)
+	twoRooms := `{"room":{"rooms":["!a:test","!b:test"]}}`
+	waitForFilter(twoRooms, "<none>")
+
+	ws.WriteMessage(websocket.TextMessage, []byte(`{"id": "2", "method": "unsubscribe_rooms", "params": {"room_ids": ["!a:test"]}}`))
+	readResponse(`{"id":"2","result":{"room_ids":["!b:test"]}}`)
+	waitForFilter(`{"room":{"rooms":["!b:test"]}}`, twoRooms)
+
+	ws.WriteMessage(websocket.TextMessage, []byte(`{"id": "3", "method": "unsubscribe_rooms", "params": {"room_ids": ["!b:test"]}}`))
+	readResponse(`{"id":"3","result":{"room_ids":[]}}`)
+	waitForFilter("<none>", `{"room":{"rooms":["!b:test"]}}`)
+}
+
+func TestSubscribeRoomsValidation(t *testing.T) {
+	c := &Connection{syncer: &Syncer{SyncParams: url.Values{}}}
+
+	tests := []struct {
+		request  string
+		expected string
+	}{
+		{
+			`{"id": "1", "method": "subscribe_rooms"}`,
+			`{"id":"1","error":{"errcode":"M_MISSING_PARAM","error":"Missing parameter room_ids","fields":["room_ids"]}}`,
+		},
+		{
+			`{"id": "1", "method": "subscribe_rooms", "params": {"room_ids": "!a:test"}}`,
+			`{"id":"1","error":{"errcode":"M_INVALID_PARAM","error":"room_ids must be a list of strings","fields":["room_ids"]}}`,
+		},
+		{
+			`{"id": "1", "method": "unsubscribe_rooms", "params": {"room_ids": ["#a:test"]}}`,
+			`{"id":"1","error":{"errcode":"M_INVALID_PARAM","error":"room_ids must be a list of room IDs of the form !localpart:server","fields":["room_ids"]}}`,
+		},
+	}
+
+	SetStrictRoomIDs(true)
+	defer SetStrictRoomIDs(false)
+	for _, tt := range tests {
+		resp := c.handleRequest([]byte(tt.request))
+		if string(resp) != tt.expected {
+			t.Errorf("Request %s: expected %s, got %s", tt.request, tt.expected, resp)
+		}
+	}
+}
+
+func TestSubscribeRoomsKeepsFilter(t *testing.T) {
+	c, srv := newTestConnection(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/_matrix/client/r0/account/whoami":
+			w.Write([]byte(`{"user_id": "@alice:test"}`))
+		case "/_matrix/client/r0/user/@alice:test/filter/f1":
+			w.Write([]byte(`{"room": {"rooms": ["!a:test", "!c:test"], "timeline": {"limit": 10}}, "presence": {"types": []}}`))
+		default:
+			t.Error("Unexpected path:", r.URL.Path)
+		}
+	})
+	defer srv.Close()
+
+	tests := []struct {
+		filter   string
+		expected string
+	}{
+		{"f1", `{"presence":{"types":[]},"room":{"rooms":["!a:test"],"timeline":{"limit":10}}}`},
+		{`{"room": {"timeline": {"limit": 1}}}`, `{"room":{"rooms":["!a:test","!b:test"],"timeline":{"limit":1}}}`},
+	}
+
+	for _, tt := range tests {
+		syncer := &Syncer{SyncParams: url.Values{"filter": {tt.filter}}}
+		c.syncer = syncer
+
+		resp := c.handleRequest([]byte(`{"id": "1", "method": "subscribe_rooms", "params": {"room_ids": ["!a:test", "!b:test"]}}`))
+		if expected := `{"id":"1","result":{"room_ids":["!a:test","!b:test"]}}`; string(resp) != expected {
+			t.Fatalf("Expected %s, got %s", expected, resp)
+		}
+		if f := syncer.Filter(); f != tt.expected {
+			t.Errorf("Expected filter %s, got %s", tt.expected, f)
+		}
+
+		c.handleRequest([]byte(`{"id": "2", "method": "unsubscribe_rooms", "params": {"room_ids": ["!a:test", "!b:test"]}}`))
+		if f := syncer.Filter(); f != tt.filter {
+			t.Errorf("Expected filter %s to be restored, got %s", tt.filter, f)
+		}
+	}
+}
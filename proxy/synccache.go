@@ -0,0 +1,140 @@
+package proxy
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// An InitialSyncCache holds the initial sync responses for recent
+// connections, so that a client which reconnects shortly after a disconnect
+// can have its initial sync replayed rather than making an expensive
+// full sync request to the upstream server.
+//
+// Responses are keyed on user ID and device ID. To resume, the client must
+// pass the 'next_batch' token from the cached response as the 'resume'
+// parameter.
+type InitialSyncCache struct {
+	// how long entries are kept after the connection closes
+	ttl time.Duration
+
+	mutex   sync.Mutex
+	entries map[initialSyncCacheKey]*initialSyncCacheEntry
+}
+
+type initialSyncCacheKey struct {
+	userID   string
+	deviceID string
+}
+
+type initialSyncCacheEntry struct {
+	body      []byte
+	nextBatch string
+
+	// zero while the connection which made the request is still open
+	expires time.Time
+}
+
+func (e *initialSyncCacheEntry) expired(now time.Time) bool {
+	return !e.expires.IsZero() && now.After(e.expires)
+}
+
+// NewInitialSyncCache creates an InitialSyncCache whose entries expire after
+// the given ttl.
+func NewInitialSyncCache(ttl time.Duration) *InitialSyncCache {
+	return &InitialSyncCache{
+		ttl:     ttl,
+		entries: make(map[initialSyncCacheKey]*initialSyncCacheEntry),
+	}
+}
+
+// InitialSync performs the initial sync for a new connection.
+//
+// If resume is non-empty and matches the 'next_batch' of a cached response
+// for the syncer's user and device, the cached response is returned and the
+// syncer is set up to continue with incremental syncs from that point.
+// Otherwise a request is made to the upstream server, and if it was a full
+// sync, the response is cached.
+func (sc *InitialSyncCache) InitialSync(syncer *Syncer, resume string) ([]byte, error) {
+	userID, deviceID, err := syncer.Client.WhoAmI(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	key := initialSyncCacheKey{userID, deviceID}
+
+	if resume != "" && syncer.SyncParams.Get("since") == "" {
+		if body := sc.get(key, resume); body != nil {
+			logInfo("Replaying cached initial sync for", userID)
+			syncer.SyncParams.Set("since", resume)
+			syncer.started, syncer.resumed = true, true
+			return body, nil
+		}
+	}
+
+	fullSync := syncer.SyncParams.Get("since") == ""
+	body, err := syncer.MakeRequest(context.Background())
+	if err != nil {
+		return nil, err
+	}
+
+	if fullSync {
+		sc.put(key, body, syncer.SyncParams.Get("since"))
+	}
+	return body, nil
+}
+
+// Touch starts the expiry timer on the cached response for the client's user
+// and device. It should be called when a connection closes, so that the
+// response is kept for the ttl after the disconnect.
+func (sc *InitialSyncCache) Touch(client *MatrixClient) {
+	userID, deviceID, err := client.WhoAmI(context.Background())
+	if err != nil {
+		return
+	}
+
+	sc.mutex.Lock()
+	defer sc.mutex.Unlock()
+	if e := sc.entries[initialSyncCacheKey{userID, deviceID}]; e != nil {
+		e.expires = time.Now().Add(sc.ttl)
+	}
+}
+
+func (sc *InitialSyncCache) get(key initialSyncCacheKey, resume string) []byte {
+	sc.mutex.Lock()
+	defer sc.mutex.Unlock()
+
+	e := sc.entries[key]
+	if e == nil {
+		return nil
+	}
+	if e.expired(time.Now()) {
+		delete(sc.entries, key)
+		return nil
+	}
+	if e.nextBatch != resume {
+		return nil
+	}
+
+	// the entry is in use again, so stop it expiring until the new
+	// connection closes.
+	e.expires = time.Time{}
+	return e.body
+}
+
+func (sc *InitialSyncCache) put(key initialSyncCacheKey, body []byte, nextBatch string) {
+	sc.mutex.Lock()
+	defer sc.mutex.Unlock()
+
+	// take the opportunity to clear out any expired entries
+	now := time.Now()
+	for k, e := range sc.entries {
+		if e.expired(now) {
+			delete(sc.entries, k)
+		}
+	}
+
+	sc.entries[key] = &initialSyncCacheEntry{
+		body:      body,
+		nextBatch: nextBatch,
+	}
+}
@@ -0,0 +1,113 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// newCacheTestServer returns a test server which implements /whoami and
+// /sync. The sync responses are numbered, and the 'since' of each sync
+// request is appended to *sinces.
+func newCacheTestServer(sinces *[]string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/_matrix/client/r0/account/whoami":
+			w.Write([]byte(`{"user_id": "@user:test", "device_id": "DEVICE"}`))
+		case "/_matrix/client/r0/sync":
+			*sinces = append(*sinces, r.URL.Query().Get("since"))
+			fmt.Fprintf(w, `{"next_batch": "s%d"}`, len(*sinces))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+}
+
+func newCacheTestSyncer(srv *httptest.Server) *Syncer {
+	return &Syncer{
+		Client:     NewMatrixClient(srv.URL+"/", "token"),
+		SyncParams: url.Values{},
+	}
+}
+
+func TestInitialSyncCacheHit(t *testing.T) {
+	var sinces []string
+	srv := newCacheTestServer(&sinces)
+	defer srv.Close()
+
+	cache := NewInitialSyncCache(time.Minute)
+	syncer := newCacheTestSyncer(srv)
+	if _, err := cache.InitialSync(syncer, ""); err != nil {
+		t.Fatalf("Expected no error, got '%v'", err)
+	}
+	cache.Touch(syncer.Client)
+
+	// reconnect, with the resume token
+	syncer = newCacheTestSyncer(srv)
+	body, err := cache.InitialSync(syncer, "s1")
+	if err != nil {
+		t.Fatalf("Expected no error, got '%v'", err)
+	}
+	if string(body) != `{"next_batch": "s1"}` {
+		t.Errorf("Expected cached sync body, got '%s'", body)
+	}
+	if !syncer.Resumed() {
+		t.Error("Expected a replayed sync to count as resumed")
+	}
+	if len(sinces) != 1 {
+		t.Errorf("Expected 1 upstream sync, got %d", len(sinces))
+	}
+
+	// the next sync should be incremental from the replayed response
+	if _, err := syncer.MakeRequest(context.Background()); err != nil {
+		t.Fatalf("Expected no error, got '%v'", err)
+	}
+	if sinces[len(sinces)-1] != "s1" {
+		t.Errorf("Expected incremental sync since 's1', got '%v'", sinces[len(sinces)-1])
+	}
+}
+
+func TestInitialSyncCacheMiss(t *testing.T) {
+	tests := []struct {
+		name   string
+		ttl    time.Duration
+		resume string
+	}{
+		{"no resume token", time.Minute, ""},
+		{"wrong resume token", time.Minute, "s0"},
+		{"expired", time.Nanosecond, "s1"},
+	}
+
+	for _, tt := range tests {
+		var sinces []string
+		srv := newCacheTestServer(&sinces)
+
+		cache := NewInitialSyncCache(tt.ttl)
+		syncer := newCacheTestSyncer(srv)
+		if _, err := cache.InitialSync(syncer, ""); err != nil {
+			t.Fatalf("%s: expected no error, got '%v'", tt.name, err)
+		}
+		cache.Touch(syncer.Client)
+		time.Sleep(time.Millisecond)
+
+		syncer = newCacheTestSyncer(srv)
+		body, err := cache.InitialSync(syncer, tt.resume)
+		if err != nil {
+			t.Fatalf("%s: expected no error, got '%v'", tt.name, err)
+		}
+		if string(body) != `{"next_batch": "s2"}` {
+			t.Errorf("%s: expected fresh sync body, got '%s'", tt.name, body)
+		}
+		if syncer.Resumed() {
+			t.Errorf("%s: expected a fresh sync not to count as resumed", tt.name)
+		}
+		if len(sinces) != 2 || sinces[1] != "" {
+			t.Errorf("%s: expected a second full sync, got %v", tt.name, sinces)
+		}
+		srv.Close()
+	}
+}
@@ -0,0 +1,47 @@
+package proxy
+
+// handleGetTags returns the tags the user has set on a room.
+func handleGetTags(c *Connection, req *jsonRequest) (interface{}, error) {
+	p := newParamReader(req)
+	roomID := p.roomID("room_id")
+	if err := p.err(); err != nil {
+		return nil, err
+	}
+
+	tags, err := c.client.GetTags(req.ctx, roomID)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{"tags": tags}, nil
+}
+
+// handleSetTag adds a tag to a room, with an optional 'order'.
+func handleSetTag(c *Connection, req *jsonRequest) (interface{}, error) {
+	p := newParamReader(req)
+	roomID := p.roomID("room_id")
+	tag := p.string("tag")
+	order := p.optionalNumber("order")
+	if err := p.err(); err != nil {
+		return nil, err
+	}
+
+	if err := c.client.SetTag(req.ctx, roomID, tag, order); err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{}, nil
+}
+
+// handleDeleteTag removes a tag from a room.
+func handleDeleteTag(c *Connection, req *jsonRequest) (interface{}, error) {
+	p := newParamReader(req)
+	roomID := p.roomID("room_id")
+	tag := p.string("tag")
+	if err := p.err(); err != nil {
+		return nil, err
+	}
+
+	if err := c.client.DeleteTag(req.ctx, roomID, tag); err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{}, nil
+}
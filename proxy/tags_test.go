@@ -0,0 +1,81 @@
+package proxy
+
+import (
+	"io/ioutil"
+	"net/http"
+	"testing"
+)
+
+// newWhoAmITestConnection returns a Connection whose upstream server implements
+// /whoami, and passes any other requests to the given handler.
+func newWhoAmITestConnection(handler http.HandlerFunc) (*Connection, func()) {
+	c, srv := newTestConnection(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/_matrix/client/r0/account/whoami" {
+			w.Write([]byte(`{"user_id": "@alice:example.org"}`))
+			return
+		}
+		handler(w, r)
+	})
+	return c, srv.Close
+}
+
+func TestGetTags(t *testing.T) {
+	tags := `{"m.favourite":{"order":0.5}}`
+
+	c, cleanup := newWhoAmITestConnection(func(w http.ResponseWriter, r *http.Request) {
+		path := "/_matrix/client/r0/user/@alice:example.org/rooms/%21room:example.org/tags"
+		if r.Method != "GET" || r.URL.EscapedPath() != path {
+			t.Error("Unexpected request:", r.Method, r.URL.EscapedPath())
+		}
+		w.Write([]byte(`{"tags":` + tags + `}`))
+	})
+	defer cleanup()
+
+	resp := c.handleRequest([]byte(`{"id": "1", "method": "get_tags", "params": {"room_id": "!room:example.org"}}`))
+	expected := `{"id":"1","result":{"tags":` + tags + `}}`
+	if string(resp) != expected {
+		t.Errorf("Expected %s, got %s", expected, resp)
+	}
+}
+
+func TestSetTag(t *testing.T) {
+	c, cleanup := newWhoAmITestConnection(func(w http.ResponseWriter, r *http.Request) {
+		path := "/_matrix/client/r0/user/@alice:example.org/rooms/%21room:example.org/tags/u.work%2Fhome"
+		if r.Method != "PUT" || r.URL.EscapedPath() != path {
+			t.Error("Unexpected request:", r.Method, r.URL.EscapedPath())
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		if string(body) != `{"order":0.25}` {
+			t.Errorf("Unexpected body %s", body)
+		}
+		w.Write([]byte(`{}`))
+	})
+	defer cleanup()
+
+	resp := c.handleRequest([]byte(`{"id": "1", "method": "set_tag", "params": {"room_id": "!room:example.org", "tag": "u.work/home", "order": 0.25}}`))
+	if string(resp) != `{"id":"1","result":{}}` {
+		t.Errorf("Unexpected response: %s", resp)
+	}
+
+	resp = c.handleRequest([]byte(`{"id": "2", "method": "set_tag", "params": {"room_id": "!room:example.org", "order": "first"}}`))
+	expected := `{"id":"2","error":{"errcode":"M_MISSING_PARAM","error":"Missing parameter tag; order must be a number","fields":["tag","order"]}}`
+	if string(resp) != expected {
+		t.Errorf("Expected %s, got %s", expected, resp)
+	}
+}
+
+func TestDeleteTag(t *testing.T) {
+	c, cleanup := newWhoAmITestConnection(func(w http.ResponseWriter, r *http.Request) {
+		path := "/_matrix/client/r0/user/@alice:example.org/rooms/%21room:example.org/tags/m.favourite"
+		if r.Method != "DELETE" || r.URL.EscapedPath() != path {
+			t.Error("Unexpected request:", r.Method, r.URL.EscapedPath())
+		}
+		w.Write([]byte(`{}`))
+	})
+	defer cleanup()
+
+	resp := c.handleRequest([]byte(`{"id": "1", "method": "delete_tag", "params": {"room_id": "!room:example.org", "tag": "m.favourite"}}`))
+	if string(resp) != `{"id":"1","result":{}}` {
+		t.Errorf("Unexpected response: %s", resp)
+	}
+}
@@ -0,0 +1,125 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// DefaultTenant is the metrics label for connections which did not give a
+// known tenant.
+const DefaultTenant = "other"
+
+// validTenant matches the tenant names which may be used as metrics labels
+// without escaping.
+var validTenant = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+// knownTenants holds the set of tenant names set by SetTenants, as a
+// map[string]bool.
+var knownTenants atomic.Value
+
+func init() {
+	knownTenants.Store(map[string]bool{})
+}
+
+// SetTenants sets the tenant names which connections may be labelled with in
+// metrics. Connections giving any other name are counted under DefaultTenant,
+// so that clients can't create arbitrarily many metrics. It should be called
+// before any connections are made.
+func SetTenants(names []string) error {
+	tenants := make(map[string]bool, len(names))
+	for _, name := range names {
+		if !validTenant.MatchString(name) {
+			return fmt.Errorf("invalid tenant name %q", name)
+		}
+		tenants[name] = true
+	}
+	knownTenants.Store(tenants)
+	return nil
+}
+
+// TenantLabel returns the metrics label for a connection which gave the
+// given tenant name: the name itself if it is known, or DefaultTenant
+// otherwise.
+func TenantLabel(name string) string {
+	if knownTenants.Load().(map[string]bool)[name] {
+		return name
+	}
+	return DefaultTenant
+}
+
+// tenant returns the metrics label for the connection.
+func (c *Connection) tenant() string {
+	if c.Tenant == "" {
+		return DefaultTenant
+	}
+	return c.Tenant
+}
+
+// messageCounts counts the messages sent to and received from clients, by
+// tenant.
+var messageCounts = struct {
+	sync.Mutex
+	sent     map[string]uint64
+	received map[string]uint64
+}{sent: make(map[string]uint64), received: make(map[string]uint64)}
+
+// countMessage adds a message sent to or received from the client to the
+// message counters.
+func (c *Connection) countMessage(received bool) {
+	messageCounts.Lock()
+	defer messageCounts.Unlock()
+	if received {
+		messageCounts.received[c.tenant()]++
+	} else {
+		messageCounts.sent[c.tenant()]++
+	}
+}
+
+// writeTenantMetrics writes the gauge of live connections and the message
+// counters, by tenant, in the Prometheus text format.
+func writeTenantMetrics(w http.ResponseWriter) {
+	conns := make(map[string]uint64)
+	for _, c := range listConnections() {
+		conns[c.tenant()]++
+	}
+
+	messageCounts.Lock()
+	sent := copyCounts(messageCounts.sent)
+	received := copyCounts(messageCounts.received)
+	messageCounts.Unlock()
+
+	fmt.Fprintln(w, "# HELP websockets_proxy_connections Live connections, by tenant.")
+	fmt.Fprintln(w, "# TYPE websockets_proxy_connections gauge")
+	writeTenantCounts(w, "websockets_proxy_connections", conns)
+	fmt.Fprintln(w, "# HELP websockets_proxy_messages_sent_total Messages sent to clients, by tenant.")
+	fmt.Fprintln(w, "# TYPE websockets_proxy_messages_sent_total counter")
+	writeTenantCounts(w, "websockets_proxy_messages_sent_total", sent)
+	fmt.Fprintln(w, "# HELP websockets_proxy_messages_received_total Messages received from clients, by tenant.")
+	fmt.Fprintln(w, "# TYPE websockets_proxy_messages_received_total counter")
+	writeTenantCounts(w, "websockets_proxy_messages_received_total", received)
+}
+
+func copyCounts(counts map[string]uint64) map[string]uint64 {
+	res := make(map[string]uint64, len(counts))
+	for k, v := range counts {
+		res[k] = v
+	}
+	return res
+}
+
+// writeTenantCounts writes the values of a metric labelled by tenant, in
+// order of tenant.
+func writeTenantCounts(w http.ResponseWriter, name string, counts map[string]uint64) {
+	tenants := make([]string, 0, len(counts))
+	for t := range counts {
+		tenants = append(tenants, t)
+	}
+	sort.Strings(tenants)
+	for _, t := range tenants {
+		fmt.Fprintf(w, "%s{tenant=\"%s\"} %d\n", name, t, counts[t])
+	}
+}
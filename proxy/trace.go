@@ -0,0 +1,85 @@
+package proxy
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"strings"
+)
+
+// The trace context of a MatrixClient follows the W3C Trace Context format:
+// each upstream request gets a 'traceparent' header with the client's trace
+// ID and a new span ID, so that the upstream requests for a connection can be
+// tied together, and to the request which opened the connection.
+
+const (
+	traceIDLength = 32
+	spanIDLength  = 16
+)
+
+// SetTraceParent sets the trace context for upstream requests from the
+// 'traceparent' header of the client's request. If the header is empty or
+// invalid, a new trace is started.
+func (c *MatrixClient) SetTraceParent(traceparent string) {
+	traceID, flags, ok := parseTraceParent(traceparent)
+	if !ok {
+		traceID, flags = randomHex(traceIDLength), "01"
+	}
+	c.traceID = traceID
+	c.traceFlags = flags
+}
+
+// TraceID returns the ID of the trace which the client's upstream requests
+// belong to, for logging; it is empty if SetTraceParent was never called.
+func (c *MatrixClient) TraceID() string {
+	return c.traceID
+}
+
+// traceParent returns the 'traceparent' header for a new upstream request, or
+// an empty string if there is no trace context.
+func (c *MatrixClient) traceParent() string {
+	if c.traceID == "" {
+		return ""
+	}
+	return "00-" + c.traceID + "-" + randomHex(spanIDLength) + "-" + c.traceFlags
+}
+
+// parseTraceParent extracts the trace ID and flags from a version 00
+// 'traceparent' header.
+func parseTraceParent(h string) (traceID string, flags string, ok bool) {
+	parts := strings.Split(strings.TrimSpace(h), "-")
+	if len(parts) != 4 || parts[0] != "00" {
+		return "", "", false
+	}
+	traceID, spanID, flags := parts[1], parts[2], parts[3]
+	if !isLowerHex(traceID, traceIDLength) || !isLowerHex(spanID, spanIDLength) ||
+		!isLowerHex(flags, 2) {
+		return "", "", false
+	}
+
+	// all-zero IDs are invalid
+	if strings.Trim(traceID, "0") == "" || strings.Trim(spanID, "0") == "" {
+		return "", "", false
+	}
+	return traceID, flags, true
+}
+
+func isLowerHex(s string, length int) bool {
+	if len(s) != length {
+		return false
+	}
+	for _, r := range s {
+		if !(r >= '0' && r <= '9' || r >= 'a' && r <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// randomHex returns a random string of the given number of hex digits.
+func randomHex(digits int) string {
+	b := make([]byte, digits/2)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,74 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestTraceParentForwarded(t *testing.T) {
+	var received []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = append(received, r.Header.Get("traceparent"))
+		w.Write([]byte(`{"capabilities": {}}`))
+	}))
+	defer srv.Close()
+
+	client := NewMatrixClient(srv.URL+"/", "token")
+	client.SetTraceParent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	client.GetCapabilities(context.Background())
+	client.GetCapabilities(context.Background())
+
+	if client.TraceID() != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("Unexpected trace ID %q", client.TraceID())
+	}
+	if len(received) != 2 {
+		t.Fatalf("Expected 2 requests, got %d", len(received))
+	}
+	for _, tp := range received {
+		traceID, flags, ok := parseTraceParent(tp)
+		if !ok || traceID != "4bf92f3577b34da6a3ce929d0e0e4736" || flags != "01" {
+			t.Errorf("Unexpected traceparent %q", tp)
+		}
+	}
+	if received[0] == received[1] {
+		t.Errorf("Expected a new span ID for each request, got %q twice", received[0])
+	}
+}
+
+func TestTraceParentGenerated(t *testing.T) {
+	var received string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r.Header.Get("traceparent")
+		w.Write([]byte(`{"capabilities": {}}`))
+	}))
+	defer srv.Close()
+
+	for _, incoming := range []string{"", "00-00000000000000000000000000000000-00f067aa0ba902b7-01", "garbage"} {
+		client := NewMatrixClient(srv.URL+"/", "token")
+		client.SetTraceParent(incoming)
+		client.GetCapabilities(context.Background())
+
+		traceID, _, ok := parseTraceParent(received)
+		if !ok || traceID != client.TraceID() {
+			t.Errorf("Incoming %q: unexpected traceparent %q for trace %q", incoming, received, client.TraceID())
+		}
+		if strings.Contains(received, "0000000000000000") {
+			t.Errorf("Incoming %q: invalid trace was used: %q", incoming, received)
+		}
+	}
+}
+
+func TestNoTraceParentByDefault(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := r.Header["Traceparent"]; ok {
+			t.Error("Unexpected traceparent:", r.Header.Get("traceparent"))
+		}
+		w.Write([]byte(`{"capabilities": {}}`))
+	}))
+	defer srv.Close()
+
+	NewMatrixClient(srv.URL+"/", "token").GetCapabilities(context.Background())
+}
@@ -0,0 +1,83 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+)
+
+// NewClientCertTransport returns an http.Transport which presents the client
+// certificate in the given PEM files to the upstream server, for homeservers
+// which require mutual TLS.
+func NewClientCertTransport(certFile, keyFile string) (*http.Transport, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.TLSClientConfig = &tls.Config{
+		Certificates: []tls.Certificate{cert},
+	}
+	return t, nil
+}
+
+// SetDialTimeout sets the time allowed for establishing TCP connections to
+// the upstream server, so that an unreachable server fails quickly rather
+// than after the operating system's timeout. Zero means no limit.
+func SetDialTimeout(t *http.Transport, timeout time.Duration) {
+	t.DialContext = newDialer(timeout).DialContext
+}
+
+func newDialer(timeout time.Duration) *net.Dialer {
+	return &net.Dialer{
+		Timeout:   timeout,
+		KeepAlive: 30 * time.Second,
+	}
+}
+
+// IsDialTimeout returns true if err is from a request to the upstream server
+// which timed out while connecting, as opposed to one which timed out waiting
+// for a response.
+func IsDialTimeout(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial" && opErr.Timeout()
+}
+
+// maxRedirects is the number of redirects from the upstream server which are
+// followed before giving up, as for http.Client's default policy.
+const maxRedirects = 10
+
+// checkRedirect is the redirect policy for requests to the upstream server.
+// Redirects to a different scheme or host are refused, so that a
+// misconfigured server can't cause access tokens to be sent elsewhere.
+func checkRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= maxRedirects {
+		return redirectError(fmt.Sprintf("Stopped after %d redirects from the homeserver", maxRedirects))
+	}
+	orig := via[0].URL
+	if req.URL.Scheme != orig.Scheme || req.URL.Host != orig.Host {
+		logWarnf("Refusing to follow redirect from %s://%s to %s://%s",
+			orig.Scheme, orig.Host, req.URL.Scheme, req.URL.Host)
+		return redirectError("Refused to follow a redirect from the homeserver to another server")
+	}
+	return nil
+}
+
+// a redirectError is returned when a redirect from the upstream server is not
+// followed. Its message is passed on to the client, so it does not say where
+// the redirect was from or to.
+type redirectError string
+
+func (e redirectError) Error() string {
+	return string(e)
+}
+
+// SetTransport sets the transport used for requests to the upstream server.
+// If it is never called, http.DefaultTransport is used.
+func (c *MatrixClient) SetTransport(t http.RoundTripper) {
+	c.httpClient.Transport = t
+}
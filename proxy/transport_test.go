@@ -0,0 +1,180 @@
+package proxy
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// writeClientCert generates a self-signed client certificate, writes it and
+// its key to PEM files in dir, and returns the certificate and the paths.
+func writeClientCert(t *testing.T, dir string) (*x509.Certificate, string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "proxy"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		IsCA:         true,
+
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile := filepath.Join(dir, "client.crt")
+	keyFile := filepath.Join(dir, "client.key")
+	ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	return cert, certFile, keyFile
+}
+
+func TestClientCertTransport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "transport_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cert, certFile, keyFile := writeClientCert(t, dir)
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"versions": ["r0.6.1"]}`))
+	}))
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(cert)
+	srv.TLS = &tls.Config{
+		ClientAuth: tls.RequireAndVerifyClientCert,
+		ClientCAs:  clientCAs,
+	}
+	srv.StartTLS()
+	defer srv.Close()
+
+	serverCAs := x509.NewCertPool()
+	serverCAs.AddCert(srv.Certificate())
+
+	transport, err := NewClientCertTransport(certFile, keyFile)
+	if err != nil {
+		t.Fatal("Error loading client certificate:", err)
+	}
+	transport.TLSClientConfig.RootCAs = serverCAs
+
+	client := NewMatrixClient(srv.URL+"/", "")
+	client.SetTransport(transport)
+	if _, err := client.GetVersions(context.Background()); err != nil {
+		t.Error("Request with client certificate failed:", err)
+	}
+
+	// without the certificate, the server should reject us
+	client = NewMatrixClient(srv.URL+"/", "")
+	client.SetTransport(&http.Transport{
+		TLSClientConfig: &tls.Config{RootCAs: serverCAs},
+	})
+	if _, err := client.GetVersions(context.Background()); err == nil {
+		t.Error("Request without client certificate succeeded")
+	}
+}
+
+func TestCrossOriginRedirectRefused(t *testing.T) {
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("Redirect was followed; Authorization:", r.Header.Get("Authorization"))
+	}))
+	defer other.Close()
+
+	c, srv := newTestConnection(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, other.URL+r.URL.Path, http.StatusFound)
+	})
+	defer srv.Close()
+
+	resp := string(c.handleRequest([]byte(`{"id": "1", "method": "capabilities"}`)))
+	expected := `{"id":"1","error":{"errcode":"M_UNKNOWN","error":"Refused to follow a redirect from the homeserver to another server"}}`
+	if resp != expected {
+		t.Errorf("Expected %s, got %s", expected, resp)
+	}
+}
+
+func TestSameOriginRedirectFollowed(t *testing.T) {
+	c, srv := newTestConnection(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/_matrix/client/r0/capabilities" {
+			http.Redirect(w, r, "/moved", http.StatusFound)
+			return
+		}
+		if r.Header.Get("Authorization") != "Bearer token" {
+			t.Error("Bad Authorization header:", r.Header.Get("Authorization"))
+		}
+		w.Write([]byte(`{"capabilities": {}}`))
+	})
+	defer srv.Close()
+
+	resp := c.handleRequest([]byte(`{"id": "1", "method": "capabilities"}`))
+	if string(resp) != `{"id":"1","result":{}}` {
+		t.Errorf("Unexpected response %s", resp)
+	}
+}
+
+func TestDialTimeout(t *testing.T) {
+	// a dialer which hangs until it is cancelled, as for an unreachable
+	// server, without depending on how the network treats a real address
+	dialer := newDialer(200 * time.Millisecond)
+	dialer.ControlContext = func(ctx context.Context, network, address string, c syscall.RawConn) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = dialer.DialContext
+
+	client := NewMatrixClient("http://127.0.0.1:1/", "token")
+	client.SetTransport(transport)
+
+	start := time.Now()
+	_, err := client.GetVersions(context.Background())
+	elapsed := time.Since(start)
+	if !IsDialTimeout(err) {
+		t.Fatal("Expected a dial timeout, got", err)
+	}
+	if elapsed > 2*time.Second {
+		t.Errorf("Expected failure within the dial timeout, took %v", elapsed)
+	}
+
+	// a timeout waiting for the response is not a dial timeout
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer srv.Close()
+	client = NewMatrixClient(srv.URL+"/", "token")
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, err = client.GetVersions(ctx)
+	if err == nil || IsDialTimeout(err) {
+		t.Error("Expected a timeout other than a dial timeout, got", err)
+	}
+}
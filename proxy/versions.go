@@ -0,0 +1,89 @@
+package proxy
+
+import (
+	"context"
+	"strconv"
+	"strings"
+)
+
+// Versions is the response from /_matrix/client/versions.
+type Versions struct {
+	Versions         []string        `json:"versions"`
+	UnstableFeatures map[string]bool `json:"unstable_features"`
+}
+
+// GetVersions returns the spec versions supported by the upstream server.
+func (c *MatrixClient) GetVersions(ctx context.Context) (*Versions, error) {
+	var resp Versions
+	if err := c.getJSON(ctx, "_matrix/client/versions", nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// APIPrefix returns the API prefix to use with the server: "v3" if it
+// supports v1.1 or later, or "r0" otherwise.
+func (v *Versions) APIPrefix() string {
+	if v.atLeast(1, 1) {
+		return "v3"
+	}
+	return "r0"
+}
+
+// atLeast returns true if the server supports spec version vMAJOR.MINOR or
+// later.
+func (v *Versions) atLeast(major, minor int) bool {
+	for _, s := range v.Versions {
+		maj, min, ok := parseSpecVersion(s)
+		if ok && (maj > major || (maj == major && min >= minor)) {
+			return true
+		}
+	}
+	return false
+}
+
+// methodFeatures maps from method name to a function which checks that the
+// upstream server supports the endpoints used by the method, for methods
+// which need a recent server.
+var methodFeatures = map[string]func(v *Versions) bool{
+	"relations": func(v *Versions) bool {
+		return v.atLeast(1, 3)
+	},
+	"threads": func(v *Versions) bool {
+		return v.atLeast(1, 4) || v.UnstableFeatures["org.matrix.msc3856"]
+	},
+	"auth_metadata": func(v *Versions) bool {
+		return v.atLeast(1, 15) || v.UnstableFeatures["org.matrix.msc2965"]
+	},
+	"room_summary": func(v *Versions) bool {
+		return v.atLeast(1, 15) || v.UnstableFeatures["im.nheko.summary"]
+	},
+}
+
+// supportsMethod returns true if the server supports the given method.
+func (v *Versions) supportsMethod(method string) bool {
+	check, ok := methodFeatures[method]
+	return !ok || check(v)
+}
+
+// parseSpecVersion parses a spec version of the form "vX.Y". Old-style
+// versions such as "r0.6.1" are not recognised.
+func parseSpecVersion(v string) (major int, minor int, ok bool) {
+	if !strings.HasPrefix(v, "v") {
+		return 0, 0, false
+	}
+	parts := strings.SplitN(v[1:], ".", 2)
+	if len(parts) != 2 {
+		return 0, 0, false
+	}
+
+	major, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, 0, false
+	}
+	minor, err = strconv.Atoi(parts[1])
+	if err != nil {
+		return 0, 0, false
+	}
+	return major, minor, true
+}
@@ -0,0 +1,99 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAPIPrefix(t *testing.T) {
+	tests := []struct {
+		versions       string
+		expectedPrefix string
+	}{
+		{`{"versions": ["r0.5.0", "r0.6.1"]}`, "r0"},
+		{`{"versions": ["r0.6.1", "v1.1"]}`, "v3"},
+		{`{"versions": ["r0.6.1", "v1.1", "v1.10"]}`, "v3"},
+		{`{"versions": ["v1.0"]}`, "r0"},
+		{`{"versions": ["v2.0"]}`, "v3"},
+		{`{"versions": ["v1.x", "bogus"]}`, "r0"},
+		{`{"versions": []}`, "r0"},
+	}
+
+	for _, tt := range tests {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/_matrix/client/versions" {
+				t.Error("Unexpected path:", r.URL.Path)
+			}
+			w.Write([]byte(tt.versions))
+		}))
+
+		versions, err := NewMatrixClient(srv.URL+"/", "").GetVersions(context.Background())
+		if err != nil {
+			t.Fatalf("%s: expected no error, got '%v'", tt.versions, err)
+		}
+		if prefix := versions.APIPrefix(); prefix != tt.expectedPrefix {
+			t.Errorf("%s: expected prefix %v, got %v", tt.versions,
+				tt.expectedPrefix, prefix)
+		}
+		srv.Close()
+	}
+}
+
+func TestAPIPrefixPaths(t *testing.T) {
+	c, srv := newTestConnection(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/_matrix/client/v3/capabilities" {
+			t.Error("Unexpected path:", r.URL.Path)
+		}
+		w.Write([]byte(`{"capabilities": {}}`))
+	})
+	defer srv.Close()
+	c.client.APIPrefix = "v3"
+
+	resp := c.handleRequest([]byte(`{"id": "1", "method": "capabilities"}`))
+	if string(resp) != `{"id":"1","result":{}}` {
+		t.Errorf("Unexpected response: %s", resp)
+	}
+}
+
+func TestUnsupportedMethodRejected(t *testing.T) {
+	c, srv := newTestConnection(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("Unexpected request:", r.Method, r.URL.Path)
+	})
+	defer srv.Close()
+	c.client.Versions = &Versions{Versions: []string{"r0.6.1", "v1.1"}}
+
+	resp := c.handleRequest([]byte(`{"id": "1", "method": "threads", "params": {"room_id": "!room:test"}}`))
+	expected := `{"id":"1","error":{"errcode":"M_UNRECOGNIZED","error":"The homeserver does not support threads"}}`
+	if string(resp) != expected {
+		t.Errorf("Expected %s, got %s", expected, resp)
+	}
+}
+
+func TestSupportsMethod(t *testing.T) {
+	tests := []struct {
+		versions Versions
+		method   string
+		expected bool
+	}{
+		{Versions{Versions: []string{"v1.1"}}, "threads", false},
+		{Versions{Versions: []string{"v1.4"}}, "threads", true},
+		{Versions{Versions: []string{"v1.1"}, UnstableFeatures: map[string]bool{"org.matrix.msc3856": true}}, "threads", true},
+		{Versions{Versions: []string{"v1.2"}}, "relations", false},
+		{Versions{Versions: []string{"v1.3"}}, "relations", true},
+		{Versions{Versions: []string{"v1.14"}}, "room_summary", false},
+		{Versions{Versions: []string{"v1.15"}}, "room_summary", true},
+		{Versions{Versions: []string{"v1.1"}, UnstableFeatures: map[string]bool{"im.nheko.summary": true}}, "room_summary", true},
+		{Versions{Versions: []string{"v1.14"}}, "auth_metadata", false},
+		{Versions{Versions: []string{"v1.15"}}, "auth_metadata", true},
+		{Versions{Versions: []string{"v1.1"}, UnstableFeatures: map[string]bool{"org.matrix.msc2965": true}}, "auth_metadata", true},
+		{Versions{Versions: []string{"r0.6.1"}}, "ping", true},
+	}
+
+	for _, tt := range tests {
+		if s := tt.versions.supportsMethod(tt.method); s != tt.expected {
+			t.Errorf("%v %s: expected %v, got %v", tt.versions, tt.method, tt.expected, s)
+		}
+	}
+}
@@ -26,7 +26,11 @@ function start() {
 
     var access_token = $("#token")[0].value;
     var since = $("#since")[0].value;
-    var url = "ws://"+window.location.host+"/stream" +
+    // the stream is relative to this page, which is under /test/, so that
+    // it works when everything is served under a -base-path
+    var stream = new URL("../stream", window.location.href);
+    stream.protocol = (window.location.protocol == "https:") ? "wss:" : "ws:";
+    var url = stream.href +
         "?access_token="+encodeURIComponent(access_token);
     if (since != "") {
         url += "&since="+encodeURIComponent(since);